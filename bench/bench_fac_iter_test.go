@@ -1,6 +1,7 @@
 package bench
 
 import (
+	"context"
 	"os"
 	"testing"
 
@@ -13,7 +14,7 @@ import (
 	"github.com/tetratelabs/wazero/wasm/wazeroir"
 )
 
-// TestFacIter ensures that the code in BenchmarkFacIter works as expected.
+// TestFacIter ensures that the code in BenchmarkFacIter and BenchmarkFacRec works as expected.
 func TestFacIter(t *testing.T) {
 	const in = 30
 	expValue := uint64(0x865df5dd54000000)
@@ -38,8 +39,16 @@ func TestFacIter(t *testing.T) {
 			require.Equal(t, expValue, res[0])
 		}
 	})
+	t.Run("rec", func(t *testing.T) {
+		for _, engine := range []wasm.Engine{wazeroir.NewEngine(), jit.NewEngine()} {
+			store := newStoreForFacIterBench(engine)
+			res, _, err := store.CallFunction("test", "fac-rec", in)
+			require.NoError(t, err)
+			require.Equal(t, expValue, res[0])
+		}
+	})
 	t.Run("wasmtime-go", func(t *testing.T) {
-		store, run := newWasmtimeForFacIterBench()
+		store, run := newWasmtimeForFacIterBench("fac-iter")
 		for i := 0; i < 10000; i++ {
 			res, err := run.Call(store, in)
 			if err != nil {
@@ -52,29 +61,56 @@ func TestFacIter(t *testing.T) {
 
 // Benchmarks on the interative factorial calculation.
 func BenchmarkFacIter(b *testing.B) {
+	runFacBenches(b, "fac-iter")
+}
+
+// Benchmarks on the recursive factorial calculation, which are dominated by the cost of function calls.
+func BenchmarkFacRec(b *testing.B) {
+	runFacBenches(b, "fac-rec")
+}
+
+func runFacBenches(b *testing.B, funcName string) {
 	const in = 30
 	b.Run("wazeroir", func(b *testing.B) {
 		store := newStoreForFacIterBench(wazeroir.NewEngine())
+		b.ReportAllocs()
 		b.ResetTimer()
 		for i := 0; i < b.N; i++ {
-			_, _, err := store.CallFunction("test", "fac-iter", in)
+			_, _, err := store.CallFunction("test", funcName, in)
 			if err != nil {
 				panic(err)
 			}
 		}
 	})
+	b.Run("wazeroir/results", func(b *testing.B) {
+		store := newStoreForFacIterBench(wazeroir.NewEngine())
+		f, err := store.ModuleInstances["test"].ExportedFunction(funcName)
+		if err != nil {
+			panic(err)
+		}
+		ctx, params, results := context.Background(), []uint64{in}, make([]uint64, 1)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := f.CallWithResults(ctx, results, params...); err != nil {
+				panic(err)
+			}
+		}
+	})
 	b.Run("jit", func(b *testing.B) {
 		store := newStoreForFacIterBench(jit.NewEngine())
+		b.ReportAllocs()
 		b.ResetTimer()
 		for i := 0; i < b.N; i++ {
-			_, _, err := store.CallFunction("test", "fac-iter", in)
+			_, _, err := store.CallFunction("test", funcName, in)
 			if err != nil {
 				panic(err)
 			}
 		}
 	})
 	b.Run("wasmtime-go", func(b *testing.B) {
-		store, run := newWasmtimeForFacIterBench()
+		store, run := newWasmtimeForFacIterBench(funcName)
+		b.ReportAllocs()
 		b.ResetTimer()
 		for i := 0; i < b.N; i++ {
 			_, err := run.Call(store, in)
@@ -102,7 +138,7 @@ func newStoreForFacIterBench(engine wasm.Engine) *wasm.Store {
 	return store
 }
 
-func newWasmtimeForFacIterBench() (*wasmtime.Store, *wasmtime.Func) {
+func newWasmtimeForFacIterBench(funcName string) (*wasmtime.Store, *wasmtime.Func) {
 	buf, err := os.ReadFile("testdata/fac.wasm")
 	if err != nil {
 		panic(err)
@@ -118,7 +154,7 @@ func newWasmtimeForFacIterBench() (*wasmtime.Store, *wasmtime.Func) {
 		panic(err)
 	}
 
-	run := instance.GetFunc(store, "fac-iter")
+	run := instance.GetFunc(store, funcName)
 	if run == nil {
 		panic("not a function")
 	}
@@ -0,0 +1,110 @@
+package bench
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/tetratelabs/wazero/wasm"
+	"github.com/tetratelabs/wazero/wasm/jit"
+	"github.com/tetratelabs/wazero/wasm/wazeroir"
+)
+
+// TestHostFunctionCall ensures that the code in BenchmarkHostFunctionCall works as expected.
+func TestHostFunctionCall(t *testing.T) {
+	const in = 1000
+	for _, engine := range []struct {
+		name      string
+		newEngine func() wasm.Engine
+	}{{"wazeroir", wazeroir.NewEngine}, {"jit", jit.NewEngine}} {
+		engine := engine
+		for _, raw := range []bool{false, true} {
+			store := newStoreForHostFunctionCallBench(engine.newEngine(), raw)
+			res, _, err := store.CallFunction("test", "call_host", in)
+			require.NoError(t, err, engine.name)
+			require.Equal(t, []uint64{in}, res, engine.name)
+		}
+	}
+}
+
+// Benchmarks on the host function calls made from Wasm with and without reflection.
+// Each op is a single call to the host function.
+func BenchmarkHostFunctionCall(b *testing.B) {
+	for _, engine := range []struct {
+		name      string
+		newEngine func() wasm.Engine
+	}{{"wazeroir", wazeroir.NewEngine}, {"jit", jit.NewEngine}} {
+		engine := engine
+		b.Run(engine.name+"/reflect", func(b *testing.B) {
+			store := newStoreForHostFunctionCallBench(engine.newEngine(), false)
+			runHostFunctionCallBench(b, store)
+		})
+		b.Run(engine.name+"/raw", func(b *testing.B) {
+			store := newStoreForHostFunctionCallBench(engine.newEngine(), true)
+			runHostFunctionCallBench(b, store)
+		})
+	}
+}
+
+func runHostFunctionCallBench(b *testing.B, store *wasm.Store) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	_, _, err := store.CallFunction("test", "call_host", uint64(b.N))
+	if err != nil {
+		panic(err)
+	}
+}
+
+// newStoreForHostFunctionCallBench returns the store where "call_host" in the "test" module takes the count n
+// and calls the host function "env.inc" n times. "env.inc" is defined with AddRawHostFunction if raw is true,
+// and AddHostFunction otherwise.
+func newStoreForHostFunctionCallBench(engine wasm.Engine, raw bool) *wasm.Store {
+	store := wasm.NewStore(engine)
+	i32, i64 := wasm.ValueTypeI32, wasm.ValueTypeI64
+	incType := &wasm.FunctionType{Params: []wasm.ValueType{i64}, Results: []wasm.ValueType{i64}}
+
+	var err error
+	if raw {
+		err = store.AddRawHostFunction("env", "inc", incType, func(_ *wasm.HostFunctionCallContext, stack []uint64) {
+			stack[0]++
+		})
+	} else {
+		err = store.AddHostFunction("env", "inc", reflect.ValueOf(func(_ *wasm.HostFunctionCallContext, x uint64) uint64 {
+			return x + 1
+		}))
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	mod := &wasm.Module{
+		TypeSection: []*wasm.FunctionType{incType, {Params: []wasm.ValueType{i32}, Results: []wasm.ValueType{i64}}},
+		ImportSection: []*wasm.Import{
+			{Kind: wasm.ImportKindFunc, Module: "env", Name: "inc", DescFunc: 0},
+		},
+		FunctionSection: []wasm.Index{1},
+		CodeSection: []*wasm.Code{
+			// (func (param $n i32) (result i64) (local $acc i64)
+			//   (block (loop
+			//     (br_if 1 (i32.eqz (local.get $n)))
+			//     (local.set $acc (call $inc (local.get $acc)))
+			//     (local.set $n (i32.sub (local.get $n) (i32.const 1)))
+			//     (br 0)))
+			//   (local.get $acc))
+			{NumLocals: 1, LocalTypes: []wasm.ValueType{i64}, Body: []byte{
+				wasm.OpcodeBlock, 0x40, wasm.OpcodeLoop, 0x40,
+				wasm.OpcodeLocalGet, 0x00, wasm.OpcodeI32Eqz, wasm.OpcodeBrIf, 0x01,
+				wasm.OpcodeLocalGet, 0x01, wasm.OpcodeCall, 0x00, wasm.OpcodeLocalSet, 0x01,
+				wasm.OpcodeLocalGet, 0x00, wasm.OpcodeI32Const, 0x01, wasm.OpcodeI32Sub, wasm.OpcodeLocalSet, 0x00,
+				wasm.OpcodeBr, 0x00, wasm.OpcodeEnd, wasm.OpcodeEnd,
+				wasm.OpcodeLocalGet, 0x01, wasm.OpcodeEnd,
+			}},
+		},
+		ExportSection: map[string]*wasm.Export{"call_host": {Name: "call_host", Kind: wasm.ExportKindFunc, Index: 1}},
+	}
+	if err = store.Instantiate(mod, "test"); err != nil {
+		panic(err)
+	}
+	return store
+}
@@ -68,6 +68,7 @@ func runBase64Benches(b *testing.B, store *wasm.Store) {
 		numPerExec := numPerExec
 		b.ResetTimer()
 		b.Run(fmt.Sprintf("base64_%d_per_exec", numPerExec), func(b *testing.B) {
+			b.ReportAllocs()
 			_, _, err := store.CallFunction("test", "base64", uint64(numPerExec))
 			if err != nil {
 				panic(err)
@@ -81,6 +82,7 @@ func runFibBenches(b *testing.B, store *wasm.Store) {
 		num := num
 		b.ResetTimer()
 		b.Run(fmt.Sprintf("fib_for_%d", num), func(b *testing.B) {
+			b.ReportAllocs()
 			for i := 0; i < b.N; i++ {
 				_, _, err := store.CallFunction("test", "fibonacci", uint64(num))
 				if err != nil {
@@ -96,6 +98,7 @@ func runStringsManipulationBenches(b *testing.B, store *wasm.Store) {
 		initialSize := initialSize
 		b.ResetTimer()
 		b.Run(fmt.Sprintf("string_manipulation_size_%d", initialSize), func(b *testing.B) {
+			b.ReportAllocs()
 			for i := 0; i < b.N; i++ {
 				_, _, err := store.CallFunction("test", "string_manipulation", uint64(initialSize))
 				if err != nil {
@@ -111,6 +114,7 @@ func runReverseArrayBenches(b *testing.B, store *wasm.Store) {
 		arraySize := arraySize
 		b.ResetTimer()
 		b.Run(fmt.Sprintf("reverse_array_size_%d", arraySize), func(b *testing.B) {
+			b.ReportAllocs()
 			for i := 0; i < b.N; i++ {
 				_, _, err := store.CallFunction("test", "reverse_array", uint64(arraySize))
 				if err != nil {
@@ -126,6 +130,7 @@ func runRandomMatMul(b *testing.B, store *wasm.Store) {
 		matrixSize := matrixSize
 		b.ResetTimer()
 		b.Run(fmt.Sprintf("random_mat_mul_size_%d", matrixSize), func(b *testing.B) {
+			b.ReportAllocs()
 			for i := 0; i < b.N; i++ {
 				_, _, err := store.CallFunction("test", "random_mat_mul", uint64(matrixSize))
 				if err != nil {
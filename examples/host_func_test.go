@@ -2,7 +2,6 @@ package examples
 
 import (
 	"crypto/rand"
-	"encoding/binary"
 	"os"
 	"reflect"
 	"testing"
@@ -37,11 +36,13 @@ func Test_hostFunc(t *testing.T) {
 		bufAddr := ret[0]
 
 		// Store the address info to the memory.
-		binary.LittleEndian.PutUint32(ctx.Memory.Buffer[retBufPtr:], uint32(bufAddr))
-		binary.LittleEndian.PutUint32(ctx.Memory.Buffer[retBufSize:], bufferSize)
+		require.True(t, ctx.Memory.WriteUint32Le(retBufPtr, uint32(bufAddr)))
+		require.True(t, ctx.Memory.WriteUint32Le(retBufSize, bufferSize))
 
 		// Now store the random values in the region.
-		n, err := rand.Read(ctx.Memory.Buffer[bufAddr : bufAddr+bufferSize])
+		buf, ok := ctx.Memory.Read(uint32(bufAddr), bufferSize)
+		require.True(t, ok)
+		n, err := rand.Read(buf)
 		require.NoError(t, err)
 		require.Equal(t, bufferSize, n)
 	}
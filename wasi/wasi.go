@@ -1,7 +1,6 @@
 package wasi
 
 import (
-	"encoding/binary"
 	"errors"
 	"io"
 	"io/fs"
@@ -159,7 +158,9 @@ func (w *WASIEnvirnment) fd_prestat_dir_name(ctx *wasm.HostFunctionCallContext,
 		return ENAMETOOLONG
 	}
 
-	copy(ctx.Memory.Buffer[pathPtr:], f.path)
+	if !ctx.Memory.Write(pathPtr, []byte(f.path)[:pathLen]) {
+		return EFAULT
+	}
 	return ESUCCESS
 }
 
@@ -167,7 +168,9 @@ func (w *WASIEnvirnment) fd_fdstat_get(ctx *wasm.HostFunctionCallContext, fd uin
 	if _, ok := w.opened[fd]; !ok {
 		return EBADF
 	}
-	binary.LittleEndian.PutUint64(ctx.Memory.Buffer[bufPtr+16:], R_FD_READ|R_FD_WRITE)
+	if !ctx.Memory.WriteUint64Le(bufPtr+16, R_FD_READ|R_FD_WRITE) {
+		return EFAULT
+	}
 	return ESUCCESS
 }
 
@@ -179,7 +182,11 @@ func (w *WASIEnvirnment) path_open(ctx *wasm.HostFunctionCallContext, fd, dirFla
 		return EINVAL
 	}
 
-	path := string(ctx.Memory.Buffer[pathPtr : pathPtr+pathLen])
+	b, ok := ctx.Memory.Read(pathPtr, pathLen)
+	if !ok {
+		return EFAULT
+	}
+	path := string(b)
 	f, err := dir.fileSys.OpenWASI(dirFlags, path, oFlags, fsRightsBase, fsRightsInheriting, fdFlags)
 	if err != nil {
 		switch {
@@ -196,7 +203,9 @@ func (w *WASIEnvirnment) path_open(ctx *wasm.HostFunctionCallContext, fd, dirFla
 		file: f,
 	}
 
-	binary.LittleEndian.PutUint32(ctx.Memory.Buffer[fdPtr:], newFD)
+	if !ctx.Memory.WriteUint32Le(fdPtr, newFD) {
+		return EFAULT
+	}
 	return ESUCCESS
 }
 
@@ -219,15 +228,19 @@ func (w *WASIEnvirnment) fd_write(ctx *wasm.HostFunctionCallContext, fd uint32,
 	var nwritten uint32
 	for i := uint32(0); i < iovsLen; i++ {
 		iovPtr := iovsPtr + i*8
-		offset := binary.LittleEndian.Uint32(ctx.Memory.Buffer[iovPtr:])
-		l := binary.LittleEndian.Uint32(ctx.Memory.Buffer[iovPtr+4:])
-		n, err := writer.Write(ctx.Memory.Buffer[offset : offset+l])
+		b, ok := readIOVec(ctx.Memory, iovPtr)
+		if !ok {
+			return EFAULT
+		}
+		n, err := writer.Write(b)
 		if err != nil {
 			panic(err)
 		}
 		nwritten += uint32(n)
 	}
-	binary.LittleEndian.PutUint32(ctx.Memory.Buffer[nwrittenPtr:], nwritten)
+	if !ctx.Memory.WriteUint32Le(nwrittenPtr, nwritten) {
+		return EFAULT
+	}
 	return ESUCCESS
 }
 
@@ -248,9 +261,11 @@ func (w *WASIEnvirnment) fd_read(ctx *wasm.HostFunctionCallContext, fd uint32, i
 	var nread uint32
 	for i := uint32(0); i < iovsLen; i++ {
 		iovPtr := iovsPtr + i*8
-		offset := binary.LittleEndian.Uint32(ctx.Memory.Buffer[iovPtr:])
-		l := binary.LittleEndian.Uint32(ctx.Memory.Buffer[iovPtr+4:])
-		n, err := reader.Read(ctx.Memory.Buffer[offset : offset+l])
+		b, ok := readIOVec(ctx.Memory, iovPtr)
+		if !ok {
+			return EFAULT
+		}
+		n, err := reader.Read(b)
 		nread += uint32(n)
 		if errors.Is(err, io.EOF) {
 			break
@@ -258,10 +273,25 @@ func (w *WASIEnvirnment) fd_read(ctx *wasm.HostFunctionCallContext, fd uint32, i
 			return EIO
 		}
 	}
-	binary.LittleEndian.PutUint32(ctx.Memory.Buffer[nreadPtr:], nread)
+	if !ctx.Memory.WriteUint32Le(nreadPtr, nread) {
+		return EFAULT
+	}
 	return ESUCCESS
 }
 
+// readIOVec returns the region of memory described by the iovec (a pair of offset and length) at iovPtr.
+func readIOVec(memory *wasm.MemoryInstance, iovPtr uint32) ([]byte, bool) {
+	offset, ok := memory.ReadUint32Le(iovPtr)
+	if !ok {
+		return nil, false
+	}
+	l, ok := memory.ReadUint32Le(iovPtr + 4)
+	if !ok {
+		return nil, false
+	}
+	return memory.Read(offset, l)
+}
+
 func (w *WASIEnvirnment) fd_close(ctx *wasm.HostFunctionCallContext, fd uint32) (err Errno) {
 	f, ok := w.opened[fd]
 	if !ok {
@@ -279,8 +309,9 @@ func (w *WASIEnvirnment) fd_close(ctx *wasm.HostFunctionCallContext, fd uint32)
 
 func args_sizes_get(ctx *wasm.HostFunctionCallContext, argcPtr uint32, argvPtr uint32) (err Errno) {
 	// not implemented yet
-	binary.LittleEndian.PutUint32(ctx.Memory.Buffer[argcPtr:], 0)
-	binary.LittleEndian.PutUint32(ctx.Memory.Buffer[argvPtr:], 0)
+	if !ctx.Memory.WriteUint32Le(argcPtr, 0) || !ctx.Memory.WriteUint32Le(argvPtr, 0) {
+		return EFAULT
+	}
 	return 0
 }
 
@@ -48,6 +48,7 @@ func TestDecodeModule(t *testing.T) {
 					{},
 					{Params: []wasm.ValueType{i32, i32}, Results: []wasm.ValueType{i32}},
 					{Params: []wasm.ValueType{i32, i32, i32, i32}, Results: []wasm.ValueType{i32}},
+					{Params: []wasm.ValueType{f32}, Results: []wasm.ValueType{i32, f32}},
 				},
 			},
 		},
@@ -96,6 +97,27 @@ func TestDecodeModule(t *testing.T) {
 	}
 }
 
+func TestDecodeModule_CodeBodyOffset(t *testing.T) {
+	binary := append(append(magic, version...),
+		SectionIDType, 0x04, // 4 bytes in this section
+		0x01, 0x60, 0x00, 0x00, // (type (func))
+		SectionIDFunction, 0x03, // 3 bytes in this section
+		0x02, 0x00, 0x00, // two functions of type 0
+		SectionIDCode, 0x08, // 8 bytes in this section
+		0x02,             // two code segments
+		0x02, 0x00, 0x0b, // no locals, (end)
+		0x03, 0x00, 0x01, 0x0b, // no locals, (nop) (end)
+	)
+	m, err := DecodeModule(binary)
+	require.NoError(t, err)
+	require.Len(t, m.CodeSection, 2)
+	for i, expected := range []uint64{24, 27} {
+		code := m.CodeSection[i]
+		require.Equal(t, expected, code.BodyOffset)
+		require.Equal(t, binary[code.BodyOffset:code.BodyOffset+uint64(len(code.Body))], code.Body)
+	}
+}
+
 func TestDecodeModule_Errors(t *testing.T) {
 	tests := []struct {
 		name        string
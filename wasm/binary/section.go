@@ -55,8 +55,6 @@ func decodeFunctionType(r io.Reader) (*wasm.FunctionType, error) {
 	s, _, err = leb128.DecodeUint32(r)
 	if err != nil {
 		return nil, fmt.Errorf("could not read result count: %w", err)
-	} else if s > 1 {
-		return nil, fmt.Errorf("multi value results not supported")
 	}
 
 	resultTypes, err := decodeValueTypes(r, s)
@@ -199,6 +197,8 @@ func decodeCodeSection(r *bytes.Reader) ([]*wasm.Code, error) {
 		if result[i], err = decodeCode(r); err != nil {
 			return nil, fmt.Errorf("read %d-th code segment: %v", i, err)
 		}
+		// The body is at the end of the code segment which is just read.
+		result[i].BodyOffset = uint64(r.Size()) - uint64(r.Len()) - uint64(len(result[i].Body))
 	}
 	return result, nil
 }
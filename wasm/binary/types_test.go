@@ -56,7 +56,7 @@ func TestEncodeFunctionType(t *testing.T) {
 			expected: []byte{0x60, 2, i32, i64, 0},
 		},
 		{
-			name:     "no param two results", // this is just for coverage as WebAssembly 1.0 (MVP) does not allow it!
+			name:     "no param two results", // multi-value
 			input:    &wasm.FunctionType{Results: []wasm.ValueType{i32, i64}},
 			expected: []byte{0x60, 0, 2, i32, i64},
 		},
@@ -3,5 +3,7 @@ package buildoptions
 // CallStackCeiling is the maximum WebAssembly call stack height. This allows wazero to raise
 // wasm.ErrCallStackOverflow instead of overflowing the Go runtime.
 //
-// The default value should suffice for most use cases. Those wishing to change this can via `go build -ldflags`.
+// This is the default of wasm.RuntimeConfig.MaxCallStackDepth, and the limit can be changed per store via
+// the config. The default value should suffice for most use cases. Those wishing to change the default can
+// via `go build -ldflags`.
 var CallStackCeiling = 2000
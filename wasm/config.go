@@ -0,0 +1,91 @@
+package wasm
+
+import (
+	"io"
+	"math"
+	"runtime"
+
+	"github.com/tetratelabs/wazero/wasm/buildoptions"
+)
+
+// RuntimeConfig holds the limits and options of the execution, and is given to NewStoreWithConfig and
+// the NewEngineWithConfig of each engine. This allows the stores in a process to have different limits,
+// for example per tenant.
+//
+// The zero value of each field means the default described on the field.
+type RuntimeConfig struct {
+	// MaxCallStackDepth is the maximum height of the call stack, and the calls exceeding it
+	// fail with ErrRuntimeCallStackOverflow. Used by engines.
+	// Defaults to buildoptions.CallStackCeiling.
+	MaxCallStackDepth uint32
+	// InitialOperandStackSize is the number of the uint64 slots of the operand stack allocated
+	// at the beginning of each call. Used by engines. Defaults to 1024.
+	InitialOperandStackSize uint32
+	// MaxOperandStackSize is the maximum number of the uint64 slots of the operand stack, and the calls
+	// exceeding it fail with ErrRuntimeCallStackOverflow. Used by engines. Defaults to no limit.
+	MaxOperandStackSize uint32
+	// MaxMemoryPages is the maximum number of pages of a memory instance regardless of the maximum
+	// declared by the module. Modules requiring more pages fail to be instantiated, and memory.grow
+	// beyond this fails. Used by stores. Defaults to 65536, the limit of 32-bit address space.
+	MaxMemoryPages uint32
+	// MaxTableElements is the maximum number of the elements of a table instance, and modules
+	// requiring more elements fail to be instantiated. Used by stores. Defaults to no limit.
+	MaxTableElements uint32
+	// MemoryGrowHook is set to the memory instances in the store. See MemoryInstance.SetGrowHook.
+	// Defaults to nil which allows all the growth within the limits.
+	MemoryGrowHook MemoryGrowHook
+	// CompilationWorkers is the number of the goroutines compiling the functions of a module concurrently
+	// in Store.CompileModule. Used by stores. Defaults to runtime.GOMAXPROCS(0).
+	CompilationWorkers uint32
+	// LazyCompilation defers the compilation of each function until its first call, which speeds up the
+	// instantiation of the modules whose functions are mostly unused. The functions are still validated
+	// when the module is compiled, and the same modules can run as without this, e.g. the JIT engine falls back
+	// to the interpreter on the first call of a function which it fails to compile. Used by engines.
+	LazyCompilation bool
+	// Optimize enables the optimization passes over wazeroir operations shared by engines, such as constant folding
+	// and dead code elimination. This slows down the compilation, and changes the fuel consumed by the calls as the
+	// fuel costs are calculated from the optimized operations. Used by engines.
+	Optimize bool
+	// Debug enables the diagnostic output of engines such as the Go stack traces on traps.
+	// This is the runtime counterpart of the debug_mode build tag, which also enables the verbose
+	// output of the compilers.
+	Debug bool
+	// DebugOutput is where the diagnostic output enabled by Debug is written, such as the operations before and after
+	// each optimization pass. The output of each function is written at once, so the output of the functions compiled
+	// concurrently doesn't interleave. Used by engines. Defaults to os.Stdout.
+	DebugOutput io.Writer
+}
+
+const (
+	defaultInitialOperandStackSize = 1024
+	// maxMemoryPages is the number of pages which covers 32-bit address space.
+	maxMemoryPages = uint32(math.MaxUint32/PageSize + 1)
+)
+
+// WithDefaults returns a copy of c where zero-valued fields are replaced with the defaults.
+// A nil c results in the default config.
+func (c *RuntimeConfig) WithDefaults() *RuntimeConfig {
+	ret := &RuntimeConfig{}
+	if c != nil {
+		*ret = *c
+	}
+	if ret.MaxCallStackDepth == 0 {
+		ret.MaxCallStackDepth = uint32(buildoptions.CallStackCeiling)
+	}
+	if ret.InitialOperandStackSize == 0 {
+		ret.InitialOperandStackSize = defaultInitialOperandStackSize
+	}
+	if ret.MaxOperandStackSize == 0 {
+		ret.MaxOperandStackSize = math.MaxUint32
+	}
+	if ret.MaxMemoryPages == 0 || ret.MaxMemoryPages > maxMemoryPages {
+		ret.MaxMemoryPages = maxMemoryPages
+	}
+	if ret.MaxTableElements == 0 {
+		ret.MaxTableElements = math.MaxUint32
+	}
+	if ret.CompilationWorkers == 0 {
+		ret.CompilationWorkers = uint32(runtime.GOMAXPROCS(0))
+	}
+	return ret
+}
@@ -0,0 +1,44 @@
+package wasm
+
+import (
+	"io"
+	"math"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/tetratelabs/wazero/wasm/buildoptions"
+)
+
+func TestRuntimeConfig_WithDefaults(t *testing.T) {
+	defaults := &RuntimeConfig{
+		MaxCallStackDepth:       uint32(buildoptions.CallStackCeiling),
+		InitialOperandStackSize: 1024,
+		MaxOperandStackSize:     math.MaxUint32,
+		MaxMemoryPages:          65536,
+		MaxTableElements:        math.MaxUint32,
+		CompilationWorkers:      uint32(runtime.GOMAXPROCS(0)),
+	}
+	var nilConfig *RuntimeConfig
+	require.Equal(t, defaults, nilConfig.WithDefaults())
+	require.Equal(t, defaults, (&RuntimeConfig{}).WithDefaults())
+	// The limit of memory can't exceed 32-bit address space.
+	require.Equal(t, defaults, (&RuntimeConfig{MaxMemoryPages: 65537}).WithDefaults())
+
+	config := &RuntimeConfig{
+		MaxCallStackDepth:       1,
+		InitialOperandStackSize: 2,
+		MaxOperandStackSize:     3,
+		MaxMemoryPages:          4,
+		MaxTableElements:        5,
+		CompilationWorkers:      6,
+		LazyCompilation:         true,
+		Optimize:                true,
+		Debug:                   true,
+		DebugOutput:             io.Discard,
+	}
+	actual := config.WithDefaults()
+	require.Equal(t, config, actual)
+	require.NotSame(t, config, actual)
+}
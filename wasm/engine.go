@@ -1,12 +1,68 @@
 package wasm
 
+import "context"
+
 const PageSize uint64 = 65536
 
 // Engine is the interface implemented by interpreters.
 type Engine interface {
 	// Call invokes a function instance f with given parameters.
 	// Returns the results from the function.
-	Call(f *FunctionInstance, params ...uint64) (results []uint64, err error)
-	// Compile compiles down the function instance.
-	Compile(f *FunctionInstance) error
+	//
+	// The execution is terminated with ErrRuntimeCallCanceled once ctx is done, and
+	// the engine stays usable for subsequent calls.
+	//
+	// If ctx carries Fuel (See WithFuel), the execution is metered and terminated with
+	// ErrRuntimeOutOfFuel once the fuel runs out. Fuel.Remaining is updated when the call returns.
+	Call(ctx context.Context, f *FunctionInstance, params ...uint64) (results []uint64, err error)
+	// Compile compiles down the function instance f into CompiledFunction.
+	//
+	// The result must not depend on any Store, as f might belong to a ModuleInstance which is only used
+	// for compilation (See Store.CompileModule), and the result is shared by all the instances of the module.
+	//
+	// Compile is called concurrently for the functions of a module (See RuntimeConfig.CompilationWorkers),
+	// so this must be safe for concurrent use.
+	Compile(f *FunctionInstance) (CompiledFunction, error)
+	// Bind makes the function instance f callable with the compiled code which is the result of Compile
+	// for the same function (possibly of another instance of the same module).
+	Bind(f *FunctionInstance, compiled CompiledFunction) error
+	// Release releases the resources bound to the function instance f by Bind, after which f must not be called.
+	// The compiled code is freed once no function instance is bound to it and it is released via ReleaseCompiled.
+	//
+	// An engine can be shared by stores whose function addresses collide, so this must not affect the other
+	// function instances even at the same address.
+	Release(f *FunctionInstance) error
+	// ReleaseCompiled releases the compiled code which is the result of Compile.
+	// The compiled code must not be passed to Bind after this is called.
+	ReleaseCompiled(compiled CompiledFunction) error
+}
+
+// ResultsCaller is optionally implemented by an Engine which can write the results of a call to the buffer given by
+// the caller instead of allocating them. See ExportedFunction.CallWithResults.
+type ResultsCaller interface {
+	// CallWithResults is the same as Engine.Call except that the results are written to results,
+	// whose length must equal the number of the results of f.
+	CallWithResults(ctx context.Context, f *FunctionInstance, results []uint64, params ...uint64) error
+}
+
+// CallState is the state of a call which is carried over when a function executed by an Engine calls the one executed
+// by another Engine, so that the whole call is subject to the same RuntimeConfig.MaxCallStackDepth and Fuel.
+// See StateCaller.
+type CallState struct {
+	// Fuel is the remaining fuel of the call, which is math.MaxUint64 if the call is not metered.
+	Fuel uint64
+	// CallStackDepth is the number of the call frames below the one of the called function.
+	CallStackDepth uint64
+}
+
+// StateCaller is optionally implemented by an Engine which can continue a call made by another Engine.
+// See ForeignCaller.
+type StateCaller interface {
+	// CallWithState is the same as ResultsCaller.CallWithResults except that the call starts with state instead of
+	// the Fuel of ctx and the empty call stack. state.Fuel is updated when the call returns, including when it fails.
+	CallWithState(ctx context.Context, state *CallState, f *FunctionInstance, results []uint64, params ...uint64) error
 }
+
+// CompiledFunction is the engine-specific representation of a compiled function.
+// This is nil for host functions if the engine doesn't need to compile them.
+type CompiledFunction interface{}
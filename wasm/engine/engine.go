@@ -0,0 +1,29 @@
+// Package engine provides the default wasm.Engine for the current platform.
+package engine
+
+import (
+	"runtime"
+
+	"github.com/tetratelabs/wazero/wasm"
+	"github.com/tetratelabs/wazero/wasm/jit"
+	"github.com/tetratelabs/wazero/wasm/wazeroir"
+)
+
+// NewEngine returns the JIT engine on the platforms where JIT is supported, and the interpreter elsewhere.
+// The functions which JIT fails to compile are executed by the interpreter.
+func NewEngine() wasm.Engine {
+	return NewEngineWithConfig(nil)
+}
+
+// NewEngineWithConfig is the same as NewEngine except that the calls are executed with the limits in config.
+func NewEngineWithConfig(config *wasm.RuntimeConfig) wasm.Engine {
+	if jitSupported() {
+		return jit.NewEngineWithConfig(config)
+	}
+	return wazeroir.NewEngineWithConfig(config)
+}
+
+// jitSupported returns true if JIT is implemented for the GOARCH.
+func jitSupported() bool {
+	return runtime.GOARCH == "amd64"
+}
@@ -0,0 +1,34 @@
+package engine
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/tetratelabs/wazero/wasm"
+	"github.com/tetratelabs/wazero/wasm/jit"
+	"github.com/tetratelabs/wazero/wasm/wazeroir"
+)
+
+func TestNewEngine(t *testing.T) {
+	expected := fmt.Sprintf("%T", wazeroir.NewEngine())
+	if jitSupported() {
+		expected = fmt.Sprintf("%T", jit.NewEngine())
+	}
+	require.Equal(t, expected, fmt.Sprintf("%T", NewEngine()))
+}
+
+func TestNewEngineWithConfig(t *testing.T) {
+	store := wasm.NewStore(NewEngineWithConfig(&wasm.RuntimeConfig{MaxCallStackDepth: 10}))
+	// (module (func $f (export "f") (call $f)))
+	mod := &wasm.Module{
+		TypeSection:     []*wasm.FunctionType{{}},
+		FunctionSection: []wasm.Index{0},
+		CodeSection:     []*wasm.Code{{Body: []byte{wasm.OpcodeCall, 0, wasm.OpcodeEnd}}},
+		ExportSection:   map[string]*wasm.Export{"f": {Name: "f", Kind: wasm.ExportKindFunc, Index: 0}},
+	}
+	require.NoError(t, store.Instantiate(mod, "test"))
+	_, _, err := store.CallFunction("test", "f")
+	require.ErrorIs(t, err, wasm.ErrRuntimeCallStackOverflow)
+}
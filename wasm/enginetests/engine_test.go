@@ -0,0 +1,1447 @@
+package enginetests
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/tetratelabs/wazero/wasm"
+	"github.com/tetratelabs/wazero/wasm/jit"
+	"github.com/tetratelabs/wazero/wasm/wazeroir"
+)
+
+// newEngineFunc creates the engine under test. A nil config means the default configuration.
+type newEngineFunc func(config *wasm.RuntimeConfig) wasm.Engine
+
+func TestJIT(t *testing.T) {
+	runTests(t, jit.NewEngineWithConfig)
+}
+
+func TestInterpreter(t *testing.T) {
+	runTests(t, wazeroir.NewEngineWithConfig)
+}
+
+// runTests runs the tests of the features which must behave the same in all the engines.
+// The assertions on the internals of an engine belong to the tests of each engine's package.
+func runTests(t *testing.T, newEngine newEngineFunc) {
+	for _, tc := range []struct {
+		name string
+		test func(t *testing.T, newEngine newEngineFunc)
+	}{
+		{name: "CallContext", test: testCallContext},
+		{name: "CallFuel", test: testCallFuel},
+		{name: "CallConcurrently", test: testCallConcurrently},
+		{name: "CompiledModule", test: testCompiledModule},
+		{name: "SharedEngine", test: testSharedEngine},
+		{name: "CloseModule", test: testCloseModule},
+		{name: "StoreClose", test: testStoreClose},
+		{name: "ExportedFunction", test: testExportedFunction},
+		{name: "ExportedGlobal", test: testExportedGlobal},
+		{name: "RuntimeConfig", test: testRuntimeConfig},
+		{name: "MemoryGrowHook", test: testMemoryGrowHook},
+		{name: "RawHostFunction", test: testRawHostFunction},
+		{name: "HostFunctionError", test: testHostFunctionError},
+		{name: "HostFunctionCallContext", test: testHostFunctionCallContext},
+		{name: "HostModuleBuilder", test: testHostModuleBuilder},
+		{name: "MultiValue", test: testMultiValue},
+		{name: "NestedCall", test: testNestedCall},
+		{name: "RuntimeError", test: testRuntimeError},
+		{name: "StubImportResolver", test: testStubImportResolver},
+		{name: "ExportedTable", test: testExportedTable},
+		{name: "LazyCompilation", test: testLazyCompilation},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tc.test(t, newEngine)
+		})
+	}
+}
+
+func testCallContext(t *testing.T, newEngine newEngineFunc) {
+	i32 := wasm.ValueTypeI32
+	mod := &wasm.Module{
+		TypeSection:     []*wasm.FunctionType{{}, {Results: []wasm.ValueType{i32}}},
+		FunctionSection: []wasm.Index{0, 1},
+		CodeSection: []*wasm.Code{
+			// (loop (br 0))
+			{Body: []byte{wasm.OpcodeLoop, 0x40, wasm.OpcodeBr, 0x00, wasm.OpcodeEnd, wasm.OpcodeEnd}},
+			// (i32.const 1)
+			{Body: []byte{wasm.OpcodeI32Const, 0x01, wasm.OpcodeEnd}},
+		},
+		ExportSection: map[string]*wasm.Export{
+			"infinite_loop": {Name: "infinite_loop", Kind: wasm.ExportKindFunc, Index: 0},
+			"one":           {Name: "one", Kind: wasm.ExportKindFunc, Index: 1},
+		},
+	}
+
+	store := wasm.NewStore(newEngine(nil))
+	require.NoError(t, store.Instantiate(mod, "test"))
+
+	t.Run("deadline exceeded", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, _, err := store.CallFunctionContext(ctx, "test", "infinite_loop")
+		require.True(t, errors.Is(err, wasm.ErrRuntimeCallCanceled), err)
+		require.Contains(t, err.Error(), context.DeadlineExceeded.Error())
+	})
+	t.Run("already canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, _, err := store.CallFunctionContext(ctx, "test", "one")
+		require.True(t, errors.Is(err, wasm.ErrRuntimeCallCanceled), err)
+		var runtimeErr *wasm.RuntimeError
+		require.ErrorAs(t, err, &runtimeErr)
+	})
+	t.Run("reusable after cancellation", func(t *testing.T) {
+		out, _, err := store.CallFunction("test", "one")
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), out[0])
+	})
+	t.Run("start function", func(t *testing.T) {
+		start := wasm.Index(0)
+		mod := &wasm.Module{
+			TypeSection:     []*wasm.FunctionType{{}},
+			FunctionSection: []wasm.Index{0},
+			// (loop (br 0))
+			CodeSection:  []*wasm.Code{{Body: []byte{wasm.OpcodeLoop, 0x40, wasm.OpcodeBr, 0x00, wasm.OpcodeEnd, wasm.OpcodeEnd}}},
+			StartSection: &start,
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		err := store.InstantiateContext(ctx, mod, "start")
+		require.True(t, errors.Is(err, wasm.ErrRuntimeCallCanceled), err)
+		var runtimeErr *wasm.RuntimeError
+		require.ErrorAs(t, err, &runtimeErr)
+	})
+}
+
+func testCallFuel(t *testing.T, newEngine newEngineFunc) {
+	i32 := wasm.ValueTypeI32
+	mod := &wasm.Module{
+		TypeSection:     []*wasm.FunctionType{{}, {Params: []wasm.ValueType{i32}}},
+		FunctionSection: []wasm.Index{0, 1, 0},
+		CodeSection: []*wasm.Code{
+			// (loop (br 0))
+			{Body: []byte{wasm.OpcodeLoop, 0x40, wasm.OpcodeBr, 0x00, wasm.OpcodeEnd, wasm.OpcodeEnd}},
+			// (loop (br_if 0 (local.tee 0 (i32.sub (local.get 0) (i32.const 1)))))
+			{Body: []byte{
+				wasm.OpcodeLoop, 0x40,
+				wasm.OpcodeLocalGet, 0x00, wasm.OpcodeI32Const, 0x01, wasm.OpcodeI32Sub, wasm.OpcodeLocalTee, 0x00,
+				wasm.OpcodeBrIf, 0x00,
+				wasm.OpcodeEnd, wasm.OpcodeEnd,
+			}},
+			// (block (br 0) (drop (i32.const 1))) (drop (i32.add (i32.const 2) (i32.const 3)))
+			{Body: []byte{
+				wasm.OpcodeBlock, 0x40, wasm.OpcodeBr, 0x00, wasm.OpcodeI32Const, 0x01, wasm.OpcodeDrop, wasm.OpcodeEnd,
+				wasm.OpcodeI32Const, 0x02, wasm.OpcodeI32Const, 0x03, wasm.OpcodeI32Add, wasm.OpcodeDrop,
+				wasm.OpcodeEnd,
+			}},
+		},
+		ExportSection: map[string]*wasm.Export{
+			"infinite_loop": {Name: "infinite_loop", Kind: wasm.ExportKindFunc, Index: 0},
+			"count_down":    {Name: "count_down", Kind: wasm.ExportKindFunc, Index: 1},
+			"dead_code":     {Name: "dead_code", Kind: wasm.ExportKindFunc, Index: 2},
+		},
+	}
+
+	store := wasm.NewStore(newEngine(nil))
+	require.NoError(t, store.Instantiate(mod, "test"))
+
+	t.Run("enough fuel", func(t *testing.T) {
+		// Note: the consumed fuel must be the same in all the engines.
+		for _, tc := range []struct {
+			n, consumed uint64
+		}{{n: 1, consumed: 10}, {n: 2, consumed: 17}, {n: 100, consumed: 703}} {
+			fuel := &wasm.Fuel{Remaining: 10000}
+			_, _, err := store.CallFunctionContext(wasm.WithFuel(context.Background(), fuel), "test", "count_down", tc.n)
+			require.NoError(t, err)
+			require.Equal(t, 10000-tc.consumed, fuel.Remaining)
+		}
+	})
+	t.Run("out of fuel", func(t *testing.T) {
+		fuel := &wasm.Fuel{Remaining: 100}
+		_, _, err := store.CallFunctionContext(wasm.WithFuel(context.Background(), fuel), "test", "count_down", 100)
+		require.True(t, errors.Is(err, wasm.ErrRuntimeOutOfFuel), err)
+		require.Equal(t, uint64(0), fuel.Remaining)
+	})
+	t.Run("infinite loop", func(t *testing.T) {
+		fuel := &wasm.Fuel{Remaining: 1 << 20}
+		_, _, err := store.CallFunctionContext(wasm.WithFuel(context.Background(), fuel), "test", "infinite_loop")
+		require.True(t, errors.Is(err, wasm.ErrRuntimeOutOfFuel), err)
+		require.Equal(t, uint64(0), fuel.Remaining)
+	})
+	t.Run("unmetered", func(t *testing.T) {
+		_, _, err := store.CallFunction("test", "count_down", 1<<20)
+		require.NoError(t, err)
+	})
+	t.Run("optimized", func(t *testing.T) {
+		// The fuel costs are calculated from the operations after the optimization passes, which fold constants and
+		// remove dead code including labels, so the same function consumes different fuel depending on Optimize.
+		optimized := wasm.NewStore(newEngine(&wasm.RuntimeConfig{Optimize: true}))
+		require.NoError(t, optimized.Instantiate(mod, "test"))
+		for _, tc := range []struct {
+			name                        string
+			params                      []uint64
+			consumed, optimizedConsumed uint64
+		}{
+			{name: "count_down", params: []uint64{1}, consumed: 10, optimizedConsumed: 10},
+			{name: "count_down", params: []uint64{100}, consumed: 703, optimizedConsumed: 703},
+			{name: "dead_code", consumed: 6, optimizedConsumed: 1},
+		} {
+			fuel := &wasm.Fuel{Remaining: 10000}
+			_, _, err := store.CallFunctionContext(wasm.WithFuel(context.Background(), fuel), "test", tc.name, tc.params...)
+			require.NoError(t, err)
+			require.Equal(t, 10000-tc.consumed, fuel.Remaining)
+
+			fuel = &wasm.Fuel{Remaining: 10000}
+			_, _, err = optimized.CallFunctionContext(wasm.WithFuel(context.Background(), fuel), "test", tc.name, tc.params...)
+			require.NoError(t, err)
+			require.Equal(t, 10000-tc.optimizedConsumed, fuel.Remaining)
+		}
+	})
+}
+
+func testCallConcurrently(t *testing.T, newEngine newEngineFunc) {
+	i64 := wasm.ValueTypeI64
+	mod := &wasm.Module{
+		TypeSection:     []*wasm.FunctionType{{Params: []wasm.ValueType{i64}, Results: []wasm.ValueType{i64}}},
+		FunctionSection: []wasm.Index{0},
+		CodeSection: []*wasm.Code{
+			// Sums up 1 to n: (loop (local.set 1 (i64.add (local.get 1) (local.get 0)))
+			//   (br_if 0 (i64.ne (local.tee 0 (i64.sub (local.get 0) (i64.const 1))) (i64.const 0))))
+			// (local.get 1)
+			{NumLocals: 1, LocalTypes: []wasm.ValueType{i64}, Body: []byte{
+				wasm.OpcodeLoop, 0x40,
+				wasm.OpcodeLocalGet, 0x01, wasm.OpcodeLocalGet, 0x00, wasm.OpcodeI64Add, wasm.OpcodeLocalSet, 0x01,
+				wasm.OpcodeLocalGet, 0x00, wasm.OpcodeI64Const, 0x01, wasm.OpcodeI64Sub, wasm.OpcodeLocalTee, 0x00,
+				wasm.OpcodeI64Const, 0x00, wasm.OpcodeI64Ne, wasm.OpcodeBrIf, 0x00,
+				wasm.OpcodeEnd,
+				wasm.OpcodeLocalGet, 0x01,
+				wasm.OpcodeEnd,
+			}},
+		},
+		ExportSection: map[string]*wasm.Export{"sum": {Name: "sum", Kind: wasm.ExportKindFunc, Index: 0}},
+	}
+
+	store := wasm.NewStore(newEngine(nil))
+	require.NoError(t, store.Instantiate(mod, "test"))
+
+	const goroutines = 50
+	var wg sync.WaitGroup
+	wg.Add(goroutines)
+	errs := make(chan error, goroutines)
+	for i := 0; i < goroutines; i++ {
+		n := uint64(1000 + i)
+		go func() {
+			defer wg.Done()
+			fuel := &wasm.Fuel{Remaining: 1 << 20}
+			out, _, err := store.CallFunctionContext(wasm.WithFuel(context.Background(), fuel), "test", "sum", n)
+			if err != nil {
+				errs <- err
+			} else if out[0] != n*(n+1)/2 {
+				errs <- fmt.Errorf("sum(%d): expected %d but got %d", n, n*(n+1)/2, out[0])
+			} else if consumed := 1<<20 - fuel.Remaining; consumed != 14*n+5 {
+				errs <- fmt.Errorf("sum(%d): expected %d fuel consumed but got %d", n, 14*n+5, consumed)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+}
+
+func testCompiledModule(t *testing.T, newEngine newEngineFunc) {
+	i32 := wasm.ValueTypeI32
+	mod := &wasm.Module{
+		TypeSection: []*wasm.FunctionType{{Params: []wasm.ValueType{i32}, Results: []wasm.ValueType{i32}}},
+		ImportSection: []*wasm.Import{
+			{Kind: wasm.ImportKindFunc, Module: "env", Name: "inc", DescFunc: 0},
+		},
+		FunctionSection: []wasm.Index{0, 0},
+		CodeSection: []*wasm.Code{
+			// (call 0 (local.get 0))
+			{Body: []byte{wasm.OpcodeLocalGet, 0x00, wasm.OpcodeCall, 0x00, wasm.OpcodeEnd}},
+			// (call_indirect (type 0) (local.get 0) (i32.const 0))
+			{Body: []byte{wasm.OpcodeLocalGet, 0x00, wasm.OpcodeI32Const, 0x00, wasm.OpcodeCallIndirect, 0x00, 0x00, wasm.OpcodeEnd}},
+		},
+		TableSection: []*wasm.TableType{{ElemType: 0x70, Limit: &wasm.LimitsType{Min: 1}}},
+		ElementSection: []*wasm.ElementSegment{
+			{OffsetExpr: &wasm.ConstantExpression{Opcode: wasm.OpcodeI32Const, Data: []byte{0x00}}, Init: []uint32{1}},
+		},
+		ExportSection: map[string]*wasm.Export{"call": {Name: "call", Kind: wasm.ExportKindFunc, Index: 2}},
+	}
+
+	store := wasm.NewStore(newEngine(nil))
+	// Add a host function of another type first so that the function addresses and type IDs differ
+	// from the ones in the compilation.
+	require.NoError(t, store.AddHostFunction("env", "nop", reflect.ValueOf(func(*wasm.HostFunctionCallContext) {})))
+	require.NoError(t, store.AddHostFunction("env", "inc", reflect.ValueOf(func(_ *wasm.HostFunctionCallContext, x uint32) uint32 {
+		return x + 1
+	})))
+	compiled, err := store.CompileModule(mod)
+	require.NoError(t, err)
+
+	for _, name := range []string{"a", "b"} {
+		require.NoError(t, store.InstantiateCompiled(compiled, name))
+		results, _, err := store.CallFunction(name, "call", 10)
+		require.NoError(t, err)
+		require.Equal(t, []uint64{11}, results)
+	}
+
+	t.Run("another engine", func(t *testing.T) {
+		for _, e := range []wasm.Engine{newEngine(nil), jit.NewEngine(), wazeroir.NewEngine()} {
+			err := wasm.NewStore(e).InstantiateCompiled(compiled, "a")
+			require.EqualError(t, err, "module is compiled by another engine")
+		}
+	})
+	t.Run("closed", func(t *testing.T) {
+		require.NoError(t, compiled.Close())
+		err := store.InstantiateCompiled(compiled, "c")
+		require.EqualError(t, err, "compiled module is closed")
+
+		// A closed module without functions is also rejected.
+		compiled, err := store.CompileModule(&wasm.Module{})
+		require.NoError(t, err)
+		require.NoError(t, compiled.Close())
+		err = store.InstantiateCompiled(compiled, "c")
+		require.EqualError(t, err, "compiled module is closed")
+	})
+}
+
+func testSharedEngine(t *testing.T, newEngine newEngineFunc) {
+	i32 := wasm.ValueTypeI32
+	mod := &wasm.Module{
+		TypeSection:     []*wasm.FunctionType{{Results: []wasm.ValueType{i32}}},
+		ImportSection:   []*wasm.Import{{Kind: wasm.ImportKindFunc, Module: "env", Name: "get", DescFunc: 0}},
+		FunctionSection: []wasm.Index{0, 0},
+		CodeSection: []*wasm.Code{
+			// (call 0)
+			{Body: []byte{wasm.OpcodeCall, 0x00, wasm.OpcodeEnd}},
+			// (call_indirect (type 0) (i32.const 0))
+			{Body: []byte{wasm.OpcodeI32Const, 0x00, wasm.OpcodeCallIndirect, 0x00, 0x00, wasm.OpcodeEnd}},
+		},
+		TableSection: []*wasm.TableType{{ElemType: 0x70, Limit: &wasm.LimitsType{Min: 1}}},
+		ElementSection: []*wasm.ElementSegment{
+			{OffsetExpr: &wasm.ConstantExpression{Opcode: wasm.OpcodeI32Const, Data: []byte{0x00}}, Init: []uint32{0}},
+		},
+		ExportSection: map[string]*wasm.Export{
+			"call":          {Name: "call", Kind: wasm.ExportKindFunc, Index: 1},
+			"call_indirect": {Name: "call_indirect", Kind: wasm.ExportKindFunc, Index: 2},
+		},
+	}
+
+	// The functions of the stores are at the same addresses, but return different values.
+	e := newEngine(nil)
+	stores := []*wasm.Store{wasm.NewStore(e), wasm.NewStore(e)}
+	for i, store := range stores {
+		v := uint32(i + 1)
+		require.NoError(t, store.AddHostFunction("env", "get", reflect.ValueOf(func(*wasm.HostFunctionCallContext) uint32 {
+			return v
+		})))
+	}
+	// A module compiled in a store can be instantiated in the other one sharing the engine.
+	compiled, err := stores[0].CompileModule(mod)
+	require.NoError(t, err)
+	for _, store := range stores {
+		require.NoError(t, store.InstantiateCompiled(compiled, "test"))
+	}
+	require.NoError(t, compiled.Close())
+	require.Equal(t, stores[0].Functions[1].Address, stores[1].Functions[1].Address)
+
+	requireResults := func(t *testing.T, store *wasm.Store, expected uint64) {
+		for _, name := range []string{"call", "call_indirect"} {
+			results, _, err := store.CallFunction("test", name)
+			require.NoError(t, err)
+			require.Equal(t, []uint64{expected}, results)
+		}
+	}
+	for i, store := range stores {
+		requireResults(t, store, uint64(i+1))
+	}
+
+	// Closing a module in a store doesn't release the functions of the other one at the same addresses.
+	require.NoError(t, stores[0].CloseModule("test"))
+	requireResults(t, stores[1], 2)
+
+	// The addresses released above are reused in the store, and still don't collide with the other one.
+	require.NoError(t, stores[0].Instantiate(mod, "test"))
+	require.Equal(t, stores[0].Functions[1].Address, stores[1].Functions[1].Address)
+	requireResults(t, stores[0], 1)
+	requireResults(t, stores[1], 2)
+
+	// Closing a store doesn't affect the other one.
+	require.NoError(t, stores[0].Close())
+	requireResults(t, stores[1], 2)
+	require.NoError(t, stores[1].Close())
+}
+
+func testCloseModule(t *testing.T, newEngine newEngineFunc) {
+	i32 := wasm.ValueTypeI32
+	sig := &wasm.FunctionType{Params: []wasm.ValueType{i32}, Results: []wasm.ValueType{i32}}
+	// (func (export "inc") (param i32) (result i32) (i32.add (local.get 0) (i32.const 1)))
+	mod := &wasm.Module{
+		TypeSection:     []*wasm.FunctionType{sig},
+		FunctionSection: []wasm.Index{0},
+		CodeSection: []*wasm.Code{
+			{Body: []byte{wasm.OpcodeLocalGet, 0x00, wasm.OpcodeI32Const, 0x01, wasm.OpcodeI32Add, wasm.OpcodeEnd}},
+		},
+		ExportSection: map[string]*wasm.Export{"inc": {Name: "inc", Kind: wasm.ExportKindFunc, Index: 0}},
+	}
+	// (func (export "inc") (import "a" "inc") (param i32) (result i32))
+	importing := &wasm.Module{
+		TypeSection:   []*wasm.FunctionType{sig},
+		ImportSection: []*wasm.Import{{Kind: wasm.ImportKindFunc, Module: "a", Name: "inc", DescFunc: 0}},
+		ExportSection: map[string]*wasm.Export{"inc": {Name: "inc", Kind: wasm.ExportKindFunc, Index: 0}},
+	}
+
+	store := wasm.NewStore(newEngine(nil))
+	compiled, err := store.CompileModule(mod)
+	require.NoError(t, err)
+	require.NoError(t, store.InstantiateCompiled(compiled, "a"))
+	require.NoError(t, store.InstantiateCompiled(compiled, "b"))
+	require.NoError(t, store.Instantiate(importing, "c"))
+	require.NoError(t, compiled.Close())
+	require.Len(t, store.Functions, 2)
+
+	// "a" is imported by "c".
+	err = store.CloseModule("a")
+	require.EqualError(t, err, "module 'a' is imported by 'c'")
+
+	// The code compiled once is still used by "a" after "b" is closed.
+	require.NoError(t, store.CloseModule("b"))
+	results, _, err := store.CallFunction("c", "inc", 1)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{2}, results)
+
+	_, _, err = store.CallFunction("b", "inc", 1)
+	require.EqualError(t, err, "module 'b' not instantiated")
+	err = store.CloseModule("b")
+	require.EqualError(t, err, "module 'b' not instantiated")
+
+	// Closing "c" makes "a" closable.
+	require.NoError(t, store.CloseModule("c"))
+	require.NoError(t, store.CloseModule("a"))
+	require.Empty(t, store.Functions)
+
+	// The closed CompiledModule can't be instantiated anymore.
+	err = store.InstantiateCompiled(compiled, "a")
+	require.EqualError(t, err, "compiled module is closed")
+}
+
+func testStoreClose(t *testing.T, newEngine newEngineFunc) {
+	store := wasm.NewStore(newEngine(nil))
+	require.NoError(t, store.AddHostFunction("env", "nop", reflect.ValueOf(func(*wasm.HostFunctionCallContext) {})))
+	require.NoError(t, store.AddGlobal("env", "g", 1, wasm.ValueTypeI32, false))
+	require.NoError(t, store.AddMemoryInstance("env", "mem", 1, nil))
+	require.NoError(t, store.AddTableInstance("env", "table", 1, nil))
+	mod := &wasm.Module{
+		TypeSection: []*wasm.FunctionType{{}},
+		ImportSection: []*wasm.Import{
+			{Kind: wasm.ImportKindFunc, Module: "env", Name: "nop", DescFunc: 0},
+			{Kind: wasm.ImportKindTable, Module: "env", Name: "table", DescTable: &wasm.TableType{ElemType: 0x70, Limit: &wasm.LimitsType{Min: 1}}},
+		},
+		FunctionSection: []wasm.Index{0},
+		CodeSection:     []*wasm.Code{{Body: []byte{wasm.OpcodeCall, 0x00, wasm.OpcodeEnd}}},
+		// Put the defined function into the imported table.
+		ElementSection: []*wasm.ElementSegment{
+			{OffsetExpr: &wasm.ConstantExpression{Opcode: wasm.OpcodeI32Const, Data: []byte{0x00}}, Init: []uint32{1}},
+		},
+	}
+	require.NoError(t, store.Instantiate(mod, "test"))
+	table := store.ModuleInstances["env"].Exports["table"].Table
+	require.Equal(t, store.Functions[1].Address, table.Table[0].FunctionAddress)
+
+	// Closing the module clears the element in the imported table.
+	require.NoError(t, store.CloseModule("test"))
+	require.Equal(t, wasm.UninitializedTableElelemtTypeID, table.Table[0].FunctionTypeID)
+	require.Len(t, store.Functions, 1)
+	require.Len(t, store.Tables, 1)
+
+	require.NoError(t, store.Close())
+	require.Empty(t, store.ModuleInstances)
+	require.Empty(t, store.Functions)
+	require.Empty(t, store.Globals)
+	require.Empty(t, store.Memories)
+	require.Empty(t, store.Tables)
+}
+
+func testExportedFunction(t *testing.T, newEngine newEngineFunc) {
+	f64 := wasm.ValueTypeF64
+	mod := &wasm.Module{
+		TypeSection:     []*wasm.FunctionType{{Params: []wasm.ValueType{f64, wasm.ValueTypeI32}, Results: []wasm.ValueType{f64}}},
+		FunctionSection: []wasm.Index{0},
+		CodeSection: []*wasm.Code{
+			// (f64.mul (local.get 0) (f64.convert_i32_s (local.get 1)))
+			{Body: []byte{wasm.OpcodeLocalGet, 0x00, wasm.OpcodeLocalGet, 0x01, wasm.OpcodeF64ConvertI32S, wasm.OpcodeF64Mul, wasm.OpcodeEnd}},
+		},
+		ExportSection: map[string]*wasm.Export{"mul": {Name: "mul", Kind: wasm.ExportKindFunc, Index: 0}},
+	}
+	store := wasm.NewStore(newEngine(nil))
+	require.NoError(t, store.Instantiate(mod, "test"))
+	require.NoError(t, store.AddGlobal("test", "global", 0, wasm.ValueTypeI32, false))
+	m := store.ModuleInstances["test"]
+
+	mul, err := m.ExportedFunction("mul")
+	require.NoError(t, err)
+	require.Equal(t, []wasm.ValueType{f64, wasm.ValueTypeI32}, mul.ParamTypes())
+	require.Equal(t, []wasm.ValueType{f64}, mul.ResultTypes())
+
+	results, err := mul.Call(context.Background(), wasm.EncodeF64(1.5), wasm.EncodeI32(-2))
+	require.NoError(t, err)
+	require.Equal(t, -3.0, wasm.DecodeF64(results[0]))
+	_, err = mul.Call(context.Background(), wasm.EncodeF64(1.5))
+	require.EqualError(t, err, "invalid number of parameters: expected 2 but got 1")
+
+	results = make([]uint64, 1)
+	require.NoError(t, mul.CallWithResults(context.Background(), results, wasm.EncodeF64(2.5), wasm.EncodeI32(2)))
+	require.Equal(t, 5.0, wasm.DecodeF64(results[0]))
+	err = mul.CallWithResults(context.Background(), nil, wasm.EncodeF64(2.5), wasm.EncodeI32(2))
+	require.EqualError(t, err, "invalid number of results: expected 1 but got 0")
+
+	values, err := mul.Invoke(context.Background(), 1.5, int32(-2))
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{-3.0}, values)
+	_, err = mul.Invoke(context.Background(), 1.5, int64(-2))
+	require.EqualError(t, err, "invalid parameter at index 1: int64 is not i32")
+	_, err = mul.Invoke(context.Background(), 1.5)
+	require.EqualError(t, err, "invalid number of parameters: expected 2 but got 1")
+
+	_, err = m.ExportedFunction("missing")
+	require.EqualError(t, err, "exported function 'missing' not found")
+	_, err = m.ExportedFunction("global")
+	require.EqualError(t, err, "'global' is not functype")
+}
+
+func testExportedGlobal(t *testing.T, newEngine newEngineFunc) {
+	i64 := wasm.ValueTypeI64
+	mod := &wasm.Module{
+		TypeSection: []*wasm.FunctionType{{Results: []wasm.ValueType{i64}}, {Params: []wasm.ValueType{i64}}},
+		GlobalSection: []*wasm.Global{{
+			Type: &wasm.GlobalType{ValType: i64, Mutable: true},
+			Init: &wasm.ConstantExpression{Opcode: wasm.OpcodeI64Const, Data: []byte{0x01}},
+		}},
+		FunctionSection: []wasm.Index{0, 1},
+		CodeSection: []*wasm.Code{
+			{Body: []byte{wasm.OpcodeGlobalGet, 0x00, wasm.OpcodeEnd}},
+			{Body: []byte{wasm.OpcodeLocalGet, 0x00, wasm.OpcodeGlobalSet, 0x00, wasm.OpcodeEnd}},
+		},
+		ExportSection: map[string]*wasm.Export{
+			"g":   {Name: "g", Kind: wasm.ExportKindGlobal, Index: 0},
+			"get": {Name: "get", Kind: wasm.ExportKindFunc, Index: 0},
+			"set": {Name: "set", Kind: wasm.ExportKindFunc, Index: 1},
+		},
+	}
+	store := wasm.NewStore(newEngine(nil))
+	require.NoError(t, store.Instantiate(mod, "test"))
+
+	g, err := store.ModuleInstances["test"].ExportedGlobal("g")
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), g.Get())
+
+	// The change by the host is visible to the guest.
+	require.NoError(t, g.Set(wasm.EncodeI64(-100)))
+	results, _, err := store.CallFunction("test", "get")
+	require.NoError(t, err)
+	require.Equal(t, int64(-100), wasm.DecodeI64(results[0]))
+
+	// The change by the guest is visible to the host.
+	_, _, err = store.CallFunction("test", "set", 12345)
+	require.NoError(t, err)
+	require.Equal(t, uint64(12345), g.Get())
+}
+
+func testRuntimeConfig(t *testing.T, newEngine newEngineFunc) {
+	i32 := wasm.ValueTypeI32
+	mod := &wasm.Module{
+		TypeSection:     []*wasm.FunctionType{{Params: []wasm.ValueType{i32}, Results: []wasm.ValueType{i32}}},
+		FunctionSection: []wasm.Index{0, 0},
+		CodeSection: []*wasm.Code{
+			// (if (result i32) (i32.eqz (local.get 0)) (then (i32.const 0))
+			//   (else (i32.add (call 0 (i32.sub (local.get 0) (i32.const 1))) (i32.const 1))))
+			{Body: []byte{
+				wasm.OpcodeLocalGet, 0x00, wasm.OpcodeI32Eqz,
+				wasm.OpcodeIf, 0x7f, wasm.OpcodeI32Const, 0x00,
+				wasm.OpcodeElse, wasm.OpcodeLocalGet, 0x00, wasm.OpcodeI32Const, 0x01, wasm.OpcodeI32Sub,
+				wasm.OpcodeCall, 0x00, wasm.OpcodeI32Const, 0x01, wasm.OpcodeI32Add,
+				wasm.OpcodeEnd, wasm.OpcodeEnd,
+			}},
+			// (memory.grow (local.get 0))
+			{Body: []byte{wasm.OpcodeLocalGet, 0x00, wasm.OpcodeMemoryGrow, 0x00, wasm.OpcodeEnd}},
+		},
+		MemorySection: []*wasm.MemoryType{{Min: 1}},
+		ExportSection: map[string]*wasm.Export{
+			"depth": {Name: "depth", Kind: wasm.ExportKindFunc, Index: 0},
+			"grow":  {Name: "grow", Kind: wasm.ExportKindFunc, Index: 1},
+		},
+	}
+
+	t.Run("call stack", func(t *testing.T) {
+		config := &wasm.RuntimeConfig{MaxCallStackDepth: 10}
+		store := wasm.NewStoreWithConfig(newEngine(config), config)
+		require.NoError(t, store.Instantiate(mod, "test"))
+		results, _, err := store.CallFunction("test", "depth", 5)
+		require.NoError(t, err)
+		require.Equal(t, []uint64{5}, results)
+		_, _, err = store.CallFunction("test", "depth", 20)
+		require.ErrorIs(t, err, wasm.ErrRuntimeCallStackOverflow)
+	})
+	t.Run("operand stack", func(t *testing.T) {
+		config := &wasm.RuntimeConfig{InitialOperandStackSize: 16, MaxOperandStackSize: 64}
+		store := wasm.NewStoreWithConfig(newEngine(config), config)
+		require.NoError(t, store.Instantiate(mod, "test"))
+		results, _, err := store.CallFunction("test", "depth", 5)
+		require.NoError(t, err)
+		require.Equal(t, []uint64{5}, results)
+		_, _, err = store.CallFunction("test", "depth", 100)
+		require.ErrorIs(t, err, wasm.ErrRuntimeCallStackOverflow)
+	})
+	t.Run("memory pages", func(t *testing.T) {
+		config := &wasm.RuntimeConfig{MaxMemoryPages: 3}
+		store := wasm.NewStoreWithConfig(newEngine(config), config)
+		require.NoError(t, store.Instantiate(mod, "test"))
+		results, _, err := store.CallFunction("test", "grow", 3)
+		require.NoError(t, err)
+		require.Equal(t, int32(-1), wasm.DecodeI32(results[0]))
+		results, _, err = store.CallFunction("test", "grow", 2)
+		require.NoError(t, err)
+		require.Equal(t, []uint64{1}, results)
+
+		config.MaxMemoryPages = 0 // The store copies the config.
+		results, _, err = store.CallFunction("test", "grow", 1)
+		require.NoError(t, err)
+		require.Equal(t, int32(-1), wasm.DecodeI32(results[0]))
+	})
+}
+
+func testMemoryGrowHook(t *testing.T, newEngine newEngineFunc) {
+	i32 := wasm.ValueTypeI32
+	mod := &wasm.Module{
+		TypeSection:     []*wasm.FunctionType{{Params: []wasm.ValueType{i32}, Results: []wasm.ValueType{i32}}},
+		FunctionSection: []wasm.Index{0},
+		CodeSection: []*wasm.Code{
+			// (memory.grow (local.get 0))
+			{Body: []byte{wasm.OpcodeLocalGet, 0x00, wasm.OpcodeMemoryGrow, 0x00, wasm.OpcodeEnd}},
+		},
+		MemorySection: []*wasm.MemoryType{{Min: 1}},
+		ExportSection: map[string]*wasm.Export{
+			"grow":   {Name: "grow", Kind: wasm.ExportKindFunc, Index: 0},
+			"memory": {Name: "memory", Kind: wasm.ExportKindMemory, Index: 0},
+		},
+	}
+
+	// The hook accounts for the pages allocated by all the memories in the store.
+	var budget uint32 = 4
+	config := &wasm.RuntimeConfig{MemoryGrowHook: func(_ *wasm.MemoryInstance, _, deltaPages uint32) bool {
+		if deltaPages > budget {
+			return false
+		}
+		budget -= deltaPages
+		return true
+	}}
+	store := wasm.NewStoreWithConfig(newEngine(config), config)
+	require.NoError(t, store.Instantiate(mod, "a"))
+	require.NoError(t, store.Instantiate(mod, "b"))
+
+	for _, c := range []struct {
+		name     string
+		delta    uint64
+		expected int32
+	}{{"a", 3, 1}, {"b", 2, -1}, {"b", 1, 1}, {"a", 1, -1}} {
+		results, _, err := store.CallFunction(c.name, "grow", c.delta)
+		require.NoError(t, err)
+		require.Equal(t, c.expected, wasm.DecodeI32(results[0]))
+	}
+	require.Equal(t, uint32(0), budget)
+
+	// The cap of each instance is respected by memory.grow.
+	memory := store.ModuleInstances["b"].Exports["memory"].Memory
+	require.NoError(t, memory.SetMaxPages(2))
+	memory.SetGrowHook(nil)
+	results, _, err := store.CallFunction("b", "grow", 1)
+	require.NoError(t, err)
+	require.Equal(t, int32(-1), wasm.DecodeI32(results[0]))
+	results, _, err = store.CallFunction("b", "grow", 0)
+	require.NoError(t, err)
+	require.Equal(t, int32(2), wasm.DecodeI32(results[0]))
+}
+
+func testRawHostFunction(t *testing.T, newEngine newEngineFunc) {
+	i32, i64 := wasm.ValueTypeI32, wasm.ValueTypeI64
+	store := wasm.NewStore(newEngine(nil))
+	// sub returns the difference of the params.
+	require.NoError(t, store.AddRawHostFunction("env", "sub",
+		&wasm.FunctionType{Params: []wasm.ValueType{i64, i64}, Results: []wasm.ValueType{i64}},
+		func(_ *wasm.HostFunctionCallContext, stack []uint64) {
+			require.Len(t, stack, 2)
+			stack[0] = stack[0] - stack[1]
+		}))
+	// load returns the i32 at the offset 0 in the memory of the caller, so the result outnumbers the params.
+	require.NoError(t, store.AddRawHostFunction("env", "load",
+		&wasm.FunctionType{Results: []wasm.ValueType{i32}},
+		func(ctx *wasm.HostFunctionCallContext, stack []uint64) {
+			require.Len(t, stack, 1)
+			v, ok := ctx.Memory.ReadUint32Le(0)
+			require.True(t, ok)
+			stack[0] = wasm.EncodeI32(int32(v))
+		}))
+
+	mod := &wasm.Module{
+		TypeSection: []*wasm.FunctionType{
+			{Params: []wasm.ValueType{i64, i64}, Results: []wasm.ValueType{i64}},
+			{Results: []wasm.ValueType{i32}},
+		},
+		ImportSection: []*wasm.Import{
+			{Kind: wasm.ImportKindFunc, Module: "env", Name: "sub", DescFunc: 0},
+			{Kind: wasm.ImportKindFunc, Module: "env", Name: "load", DescFunc: 1},
+		},
+		FunctionSection: []wasm.Index{0},
+		CodeSection: []*wasm.Code{
+			// (i64.add (i64.extend_i32_s (call $load)) (call $sub (local.get 0) (local.get 1)))
+			{Body: []byte{
+				wasm.OpcodeCall, 0x01, wasm.OpcodeI64ExtendI32S,
+				wasm.OpcodeLocalGet, 0x00, wasm.OpcodeLocalGet, 0x01, wasm.OpcodeCall, 0x00,
+				wasm.OpcodeI64Add, wasm.OpcodeEnd,
+			}},
+		},
+		MemorySection: []*wasm.MemoryType{{Min: 1}},
+		ExportSection: map[string]*wasm.Export{"run": {Name: "run", Kind: wasm.ExportKindFunc, Index: 2}},
+	}
+	require.NoError(t, store.Instantiate(mod, "test"))
+	require.True(t, store.ModuleInstances["test"].Memory.WriteUint32Le(0, 100))
+
+	results, _, err := store.CallFunction("test", "run", 50, 8)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{142}, results)
+
+	// Raw host functions can be called directly as well.
+	results, _, err = store.CallFunction("env", "sub", 50, 8)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{42}, results)
+}
+
+// hostError is returned by the host function in testHostFunctionError.
+type hostError struct{ code uint32 }
+
+func (e *hostError) Error() string { return fmt.Sprintf("host error %d", e.code) }
+
+func testHostFunctionError(t *testing.T, newEngine newEngineFunc) {
+	i32 := wasm.ValueTypeI32
+	errBadParam := errors.New("bad param")
+	store := wasm.NewStore(newEngine(nil))
+	// check returns the param as is if it isn't zero.
+	require.NoError(t, store.AddHostFunction("env", "check", reflect.ValueOf(func(_ *wasm.HostFunctionCallContext, x uint32) (uint32, error) {
+		if x == 0 {
+			return 0, fmt.Errorf("check: %w", errBadParam)
+		}
+		return x, nil
+	})))
+	// fail returns hostError with the given code if it is 100 or larger.
+	require.NoError(t, store.AddHostFunction("env", "fail", reflect.ValueOf(func(_ *wasm.HostFunctionCallContext, code uint32) error {
+		if code >= 100 {
+			return &hostError{code: code}
+		}
+		return nil
+	})))
+
+	// The error results are excluded from the signatures.
+	for name, expected := range map[string]*wasm.FunctionType{
+		"check": {Params: []wasm.ValueType{i32}, Results: []wasm.ValueType{i32}},
+		"fail":  {Params: []wasm.ValueType{i32}, Results: []wasm.ValueType{}},
+	} {
+		require.Equal(t, expected, store.ModuleInstances["env"].Exports[name].Function.FunctionType.Type)
+	}
+
+	mod := &wasm.Module{
+		TypeSection: []*wasm.FunctionType{
+			{Params: []wasm.ValueType{i32}, Results: []wasm.ValueType{i32}},
+			{Params: []wasm.ValueType{i32}},
+		},
+		ImportSection: []*wasm.Import{
+			{Kind: wasm.ImportKindFunc, Module: "env", Name: "check", DescFunc: 0},
+			{Kind: wasm.ImportKindFunc, Module: "env", Name: "fail", DescFunc: 1},
+		},
+		FunctionSection: []wasm.Index{0},
+		CodeSection: []*wasm.Code{
+			// (func (param i32) (result i32) (call $fail (local.get 0)) (call $check (local.get 0)))
+			{Body: []byte{
+				wasm.OpcodeLocalGet, 0x00, wasm.OpcodeCall, 0x01,
+				wasm.OpcodeLocalGet, 0x00, wasm.OpcodeCall, 0x00, wasm.OpcodeEnd,
+			}},
+		},
+		ExportSection: map[string]*wasm.Export{"run": {Name: "run", Kind: wasm.ExportKindFunc, Index: 2}},
+	}
+	require.NoError(t, store.Instantiate(mod, "test"))
+
+	t.Run("errors.Is", func(t *testing.T) {
+		_, _, err := store.CallFunction("test", "run", 0)
+		require.Error(t, err)
+		require.True(t, errors.Is(err, errBadParam))
+		require.Contains(t, err.Error(), "check: bad param")
+	})
+	t.Run("errors.As", func(t *testing.T) {
+		_, _, err := store.CallFunction("test", "run", 100)
+		var hostErr *hostError
+		require.True(t, errors.As(err, &hostErr))
+		require.Equal(t, uint32(100), hostErr.code)
+	})
+	t.Run("direct call", func(t *testing.T) {
+		_, _, err := store.CallFunction("env", "check", 0)
+		require.True(t, errors.Is(err, errBadParam))
+	})
+	t.Run("no error", func(t *testing.T) {
+		// Traps don't leave any state, so the subsequent calls succeed.
+		results, _, err := store.CallFunction("test", "run", 5)
+		require.NoError(t, err)
+		require.Equal(t, []uint64{5}, results)
+	})
+}
+
+func testHostFunctionCallContext(t *testing.T, newEngine newEngineFunc) {
+	i32 := wasm.ValueTypeI32
+	type key struct{}
+	ctx := context.WithValue(context.Background(), key{}, "context value")
+
+	store := wasm.NewStore(newEngine(nil))
+	var calls []*wasm.HostFunctionCallContext
+	// greet writes "hello" to the memory allocated by the caller's malloc, and returns the offset.
+	require.NoError(t, store.AddHostFunction("env", "greet", reflect.ValueOf(func(c *wasm.HostFunctionCallContext) (uint32, error) {
+		calls = append(calls, c)
+		results, err := c.CallFunction("malloc", 5)
+		if err != nil {
+			return 0, err
+		}
+		offset := uint32(results[0])
+		if !c.Memory.Write(offset, []byte("hello")) {
+			return 0, errors.New("out of range")
+		}
+		return offset, nil
+	})))
+	require.NoError(t, store.AddRawHostFunction("env", "record", &wasm.FunctionType{},
+		func(c *wasm.HostFunctionCallContext, _ []uint64) {
+			// The context of raw host functions is only valid during the call, so copy it.
+			copied := *c
+			calls = append(calls, &copied)
+		}))
+	env := store.ModuleInstances["env"]
+	env.UserValue = "user value"
+
+	mod := &wasm.Module{
+		TypeSection: []*wasm.FunctionType{
+			{Results: []wasm.ValueType{i32}},
+			{Params: []wasm.ValueType{i32}, Results: []wasm.ValueType{i32}},
+			{},
+		},
+		ImportSection: []*wasm.Import{
+			{Kind: wasm.ImportKindFunc, Module: "env", Name: "greet", DescFunc: 0},
+			{Kind: wasm.ImportKindFunc, Module: "env", Name: "record", DescFunc: 2},
+		},
+		FunctionSection: []wasm.Index{1, 0},
+		CodeSection: []*wasm.Code{
+			// (func $malloc (param i32) (result i32) (i32.add (local.get 0) (i32.const 10)))
+			{Body: []byte{wasm.OpcodeLocalGet, 0x00, wasm.OpcodeI32Const, 10, wasm.OpcodeI32Add, wasm.OpcodeEnd}},
+			// (func $run (result i32) (call $record) (call $greet))
+			{Body: []byte{wasm.OpcodeCall, 0x01, wasm.OpcodeCall, 0x00, wasm.OpcodeEnd}},
+		},
+		MemorySection: []*wasm.MemoryType{{Min: 1}},
+		ExportSection: map[string]*wasm.Export{
+			"malloc": {Name: "malloc", Kind: wasm.ExportKindFunc, Index: 2},
+			"run":    {Name: "run", Kind: wasm.ExportKindFunc, Index: 3},
+		},
+	}
+	require.NoError(t, store.Instantiate(mod, "test"))
+	test := store.ModuleInstances["test"]
+
+	results, _, err := store.CallFunctionContext(ctx, "test", "run")
+	require.NoError(t, err)
+	require.Equal(t, []uint64{15}, results)
+	hello, ok := test.Memory.Read(15, 5)
+	require.True(t, ok)
+	require.Equal(t, "hello", string(hello))
+
+	require.Len(t, calls, 2)
+	for _, c := range calls {
+		require.Equal(t, test, c.Module)
+		require.Equal(t, test.Memory, c.Memory)
+		require.Equal(t, "context value", c.Context.Value(key{}))
+		require.Equal(t, "user value", c.UserValue)
+	}
+
+	// When called directly, the caller is the module instance of the host function.
+	calls = nil
+	_, _, err = store.CallFunctionContext(ctx, "env", "record")
+	require.NoError(t, err)
+	require.Len(t, calls, 1)
+	require.Equal(t, env, calls[0].Module)
+	require.Nil(t, calls[0].Memory)
+	require.Equal(t, "context value", calls[0].Context.Value(key{}))
+	require.Equal(t, "user value", calls[0].UserValue)
+
+	// The error of CallFunction is returned as is.
+	_, _, err = store.CallFunction("env", "greet")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "exported function 'malloc' not found")
+}
+
+func testHostModuleBuilder(t *testing.T, newEngine newEngineFunc) {
+	i32 := wasm.ValueTypeI32
+	store := wasm.NewStore(newEngine(nil))
+	env, err := store.NewHostModuleBuilder("env").
+		Function("add", reflect.ValueOf(func(c *wasm.HostFunctionCallContext, x, y uint32) (uint32, error) {
+			if c.UserValue != "user value" {
+				return 0, errors.New("unexpected user value")
+			}
+			return x + y, nil
+		})).
+		RawFunction("double", &wasm.FunctionType{Params: []wasm.ValueType{i32}, Results: []wasm.ValueType{i32}},
+			func(_ *wasm.HostFunctionCallContext, stack []uint64) { stack[0] = stack[0] * 2 }).
+		Function("fail", reflect.ValueOf(func(*wasm.HostFunctionCallContext) error { return errors.New("failed") })).
+		Global("base", 100, i32, false).
+		Memory("memory", 1, nil).
+		Table("table", 2, nil).
+		UserValue("user value").
+		Instantiate()
+	require.NoError(t, err)
+	require.Equal(t, env, store.ModuleInstances["env"])
+	require.Len(t, env.Functions, 3)
+	require.Len(t, env.Globals, 1)
+	require.NotNil(t, env.Memory)
+	require.Len(t, env.Tables, 1)
+
+	mod := &wasm.Module{
+		TypeSection: []*wasm.FunctionType{
+			{Params: []wasm.ValueType{i32, i32}, Results: []wasm.ValueType{i32}},
+			{Params: []wasm.ValueType{i32}, Results: []wasm.ValueType{i32}},
+			{},
+		},
+		ImportSection: []*wasm.Import{
+			{Kind: wasm.ImportKindFunc, Module: "env", Name: "add", DescFunc: 0},
+			{Kind: wasm.ImportKindFunc, Module: "env", Name: "double", DescFunc: 1},
+			{Kind: wasm.ImportKindFunc, Module: "env", Name: "fail", DescFunc: 2},
+			{Kind: wasm.ImportKindGlobal, Module: "env", Name: "base", DescGlobal: &wasm.GlobalType{ValType: i32}},
+			{Kind: wasm.ImportKindMemory, Module: "env", Name: "memory", DescMem: &wasm.MemoryType{Min: 1}},
+			{Kind: wasm.ImportKindTable, Module: "env", Name: "table", DescTable: &wasm.TableType{ElemType: 0x70, Limit: &wasm.LimitsType{Min: 2}}},
+		},
+		FunctionSection: []wasm.Index{1, 2},
+		CodeSection: []*wasm.Code{
+			// (func $run (param i32) (result i32)
+			//   (i32.store (i32.const 0) (call $add (call $double (local.get 0)) (global.get $base)))
+			//   (i32.load (i32.const 0)))
+			{Body: []byte{
+				wasm.OpcodeI32Const, 0x00,
+				wasm.OpcodeLocalGet, 0x00, wasm.OpcodeCall, 0x01, wasm.OpcodeGlobalGet, 0x00, wasm.OpcodeCall, 0x00,
+				wasm.OpcodeI32Store, 0x02, 0x00,
+				wasm.OpcodeI32Const, 0x00, wasm.OpcodeI32Load, 0x02, 0x00, wasm.OpcodeEnd,
+			}},
+			// (func $fail (call $fail))
+			{Body: []byte{wasm.OpcodeCall, 0x02, wasm.OpcodeEnd}},
+		},
+		ExportSection: map[string]*wasm.Export{
+			"run":  {Name: "run", Kind: wasm.ExportKindFunc, Index: 3},
+			"fail": {Name: "fail", Kind: wasm.ExportKindFunc, Index: 4},
+		},
+	}
+	require.NoError(t, store.Instantiate(mod, "test"))
+
+	results, _, err := store.CallFunction("test", "run", 21)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{142}, results)
+	v, ok := env.Memory.ReadUint32Le(0)
+	require.True(t, ok)
+	require.Equal(t, uint32(142), v)
+
+	// The host functions are named after the module in the backtraces.
+	_, _, err = store.CallFunction("test", "fail")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "0: env.fail")
+
+	// The host module can be closed as a whole.
+	require.NoError(t, store.CloseModule("test"))
+	require.NoError(t, store.CloseModule("env"))
+	require.Empty(t, store.Functions)
+	require.Empty(t, store.Globals)
+	require.Empty(t, store.Memories)
+	require.Empty(t, store.Tables)
+}
+
+func testMultiValue(t *testing.T, newEngine newEngineFunc) {
+	i32 := wasm.ValueTypeI32
+	store := wasm.NewStore(newEngine(nil))
+	_, err := store.NewHostModuleBuilder("env").
+		Function("divmod", reflect.ValueOf(func(_ *wasm.HostFunctionCallContext, x, y uint32) (uint32, uint32) {
+			return x / y, x % y
+		})).
+		RawFunction("dup", &wasm.FunctionType{Params: []wasm.ValueType{i32}, Results: []wasm.ValueType{i32, i32}},
+			func(_ *wasm.HostFunctionCallContext, stack []uint64) { stack[1] = stack[0] }).
+		Instantiate()
+	require.NoError(t, err)
+
+	mod := &wasm.Module{
+		TypeSection: []*wasm.FunctionType{
+			{Results: []wasm.ValueType{i32, i32}},
+			{Params: []wasm.ValueType{i32, i32}, Results: []wasm.ValueType{i32, i32}},
+			{Params: []wasm.ValueType{i32}, Results: []wasm.ValueType{i32}},
+			{Params: []wasm.ValueType{i32, i32}, Results: []wasm.ValueType{i32}},
+			{Params: []wasm.ValueType{i32}, Results: []wasm.ValueType{i32, i32}},
+		},
+		ImportSection: []*wasm.Import{
+			{Kind: wasm.ImportKindFunc, Module: "env", Name: "divmod", DescFunc: 1},
+			{Kind: wasm.ImportKindFunc, Module: "env", Name: "dup", DescFunc: 4},
+		},
+		FunctionSection: []wasm.Index{0, 0, 2, 3, 3},
+		CodeSection: []*wasm.Code{
+			// (func $pair (result i32 i32) (i32.const 3) (i32.const 4))
+			{Body: []byte{wasm.OpcodeI32Const, 0x03, wasm.OpcodeI32Const, 0x04, wasm.OpcodeEnd}},
+			// (func $block (result i32 i32)
+			//   (call $pair)
+			//   (block (type 1) (param i32 i32) (result i32 i32) (i32.add) (i32.const 10) (br 0)))
+			{Body: []byte{
+				wasm.OpcodeCall, 0x02,
+				wasm.OpcodeBlock, 0x01, wasm.OpcodeI32Add, wasm.OpcodeI32Const, 0x0a, wasm.OpcodeBr, 0x00, wasm.OpcodeEnd,
+				wasm.OpcodeEnd,
+			}},
+			// (func $loop (param $n i32) (result i32)
+			//   (i32.const 0)
+			//   (loop (type 2) (param i32) (result i32)
+			//     (i32.add (local.get $n))
+			//     (br_if 0 (local.tee $n (i32.sub (local.get $n) (i32.const 1))))))
+			{Body: []byte{
+				wasm.OpcodeI32Const, 0x00,
+				wasm.OpcodeLoop, 0x02,
+				wasm.OpcodeLocalGet, 0x00, wasm.OpcodeI32Add,
+				wasm.OpcodeLocalGet, 0x00, wasm.OpcodeI32Const, 0x01, wasm.OpcodeI32Sub, wasm.OpcodeLocalTee, 0x00,
+				wasm.OpcodeBrIf, 0x00,
+				wasm.OpcodeEnd,
+				wasm.OpcodeEnd,
+			}},
+			// (func $if (param $x i32) (param $y i32) (result i32)
+			//   (local.get $x) (local.get $y)
+			//   (if (type 1) (param i32 i32) (result i32 i32) (local.get $x)
+			//     (then (i32.add) (i32.const 0))
+			//     (else (i32.sub) (i32.const 1)))
+			//   (i32.add))
+			{Body: []byte{
+				wasm.OpcodeLocalGet, 0x00, wasm.OpcodeLocalGet, 0x01, wasm.OpcodeLocalGet, 0x00,
+				wasm.OpcodeIf, 0x01, wasm.OpcodeI32Add, wasm.OpcodeI32Const, 0x00,
+				wasm.OpcodeElse, wasm.OpcodeI32Sub, wasm.OpcodeI32Const, 0x01, wasm.OpcodeEnd,
+				wasm.OpcodeI32Add,
+				wasm.OpcodeEnd,
+			}},
+			// (func $host (param $x i32) (param $y i32) (result i32)
+			//   (i32.mul (call $dup (i32.add (call $divmod (local.get $x) (local.get $y))))))
+			{Body: []byte{
+				wasm.OpcodeLocalGet, 0x00, wasm.OpcodeLocalGet, 0x01, wasm.OpcodeCall, 0x00,
+				wasm.OpcodeI32Add, wasm.OpcodeCall, 0x01, wasm.OpcodeI32Mul,
+				wasm.OpcodeEnd,
+			}},
+		},
+		ExportSection: map[string]*wasm.Export{
+			"pair":  {Name: "pair", Kind: wasm.ExportKindFunc, Index: 2},
+			"block": {Name: "block", Kind: wasm.ExportKindFunc, Index: 3},
+			"loop":  {Name: "loop", Kind: wasm.ExportKindFunc, Index: 4},
+			"if":    {Name: "if", Kind: wasm.ExportKindFunc, Index: 5},
+			"host":  {Name: "host", Kind: wasm.ExportKindFunc, Index: 6},
+		},
+	}
+	require.NoError(t, store.Instantiate(mod, "test"))
+
+	for _, tc := range []struct {
+		name     string
+		params   []uint64
+		expected []uint64
+	}{
+		{name: "pair", expected: []uint64{3, 4}},
+		{name: "block", expected: []uint64{7, 10}},
+		{name: "loop", params: []uint64{4}, expected: []uint64{10}},
+		{name: "if", params: []uint64{2, 3}, expected: []uint64{5}},
+		{name: "if", params: []uint64{0, 0}, expected: []uint64{1}},
+		{name: "host", params: []uint64{17, 5}, expected: []uint64{25}},
+	} {
+		results, _, err := store.CallFunction("test", tc.name, tc.params...)
+		require.NoError(t, err, tc.name)
+		require.Equal(t, tc.expected, results, tc.name)
+	}
+
+	// Multiple results of the exported functions are also visible to the host.
+	fn, err := store.ModuleInstances["test"].ExportedFunction("block")
+	require.NoError(t, err)
+	results, err := fn.Call(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []uint64{7, 10}, results)
+}
+
+func testNestedCall(t *testing.T, newEngine newEngineFunc) {
+	i32 := wasm.ValueTypeI32
+	// newModule returns the module which imports "host" from hostModule, and exports the function below:
+	//
+	// (func $run (param $n i32) (param $trapAt i32) (result i32)
+	//   (if (i32.eq (local.get $n) (local.get $trapAt)) (then (unreachable)))
+	//   (if (i32.eqz (local.get $n)) (then (return (i32.const 100))))
+	//   (i32.add (call $host (i32.sub (local.get $n) (i32.const 1)) (local.get $trapAt)) (i32.const 1)))
+	//
+	// where $host calls back $run with the same parameters and adds one to the result. Hence, this
+	// returns 100 + 2*$n unless a trap happens at the nesting level $trapAt.
+	newModule := func(hostModule string) *wasm.Module {
+		return &wasm.Module{
+			TypeSection:     []*wasm.FunctionType{{Params: []wasm.ValueType{i32, i32}, Results: []wasm.ValueType{i32}}},
+			ImportSection:   []*wasm.Import{{Kind: wasm.ImportKindFunc, Module: hostModule, Name: "host", DescFunc: 0}},
+			FunctionSection: []wasm.Index{0},
+			CodeSection: []*wasm.Code{{Body: []byte{
+				wasm.OpcodeLocalGet, 0x00, wasm.OpcodeLocalGet, 0x01, wasm.OpcodeI32Eq,
+				wasm.OpcodeIf, 0x40, wasm.OpcodeUnreachable, wasm.OpcodeEnd,
+				wasm.OpcodeLocalGet, 0x00, wasm.OpcodeI32Eqz,
+				wasm.OpcodeIf, 0x40, wasm.OpcodeI32Const, 0xe4, 0x00, wasm.OpcodeReturn, wasm.OpcodeEnd,
+				wasm.OpcodeLocalGet, 0x00, wasm.OpcodeI32Const, 0x01, wasm.OpcodeI32Sub, wasm.OpcodeLocalGet, 0x01,
+				wasm.OpcodeCall, 0x00,
+				wasm.OpcodeI32Const, 0x01, wasm.OpcodeI32Add,
+				wasm.OpcodeEnd,
+			}}},
+			ExportSection: map[string]*wasm.Export{"run": {Name: "run", Kind: wasm.ExportKindFunc, Index: 1}},
+			NameSection:   &wasm.NameSection{FunctionNames: wasm.NameMap{{Index: 1, Name: "run"}}},
+		}
+	}
+
+	// The small operand stack makes sure that the nested calls grow it.
+	store := wasm.NewStore(newEngine(&wasm.RuntimeConfig{InitialOperandStackSize: 4, MaxCallStackDepth: 100}))
+	// recoverTraps makes the host functions return 42 instead of the error of the nested call.
+	var recoverTraps bool
+	_, err := store.NewHostModuleBuilder("reflect").
+		Function("host", reflect.ValueOf(func(ctx *wasm.HostFunctionCallContext, n, trapAt uint32) (uint32, error) {
+			results, err := ctx.CallFunction("run", uint64(n), uint64(trapAt))
+			if err != nil {
+				if recoverTraps {
+					return 42, nil
+				}
+				return 0, fmt.Errorf("nested call: %w", err)
+			}
+			return uint32(results[0]) + 1, nil
+		})).Instantiate()
+	require.NoError(t, err)
+	_, err = store.NewHostModuleBuilder("raw").
+		RawFunction("host", store.ModuleInstances["reflect"].Functions[0].FunctionType.Type,
+			func(ctx *wasm.HostFunctionCallContext, stack []uint64) {
+				results, err := ctx.CallFunction("run", stack[0], stack[1])
+				if err != nil {
+					if recoverTraps {
+						stack[0] = 42
+						return
+					}
+					panic(err)
+				}
+				stack[0] = results[0] + 1
+			}).Instantiate()
+	require.NoError(t, err)
+
+	for _, hostModule := range []string{"reflect", "raw"} {
+		hostModule := hostModule
+		t.Run(hostModule, func(t *testing.T) {
+			moduleName := hostModule + "_test"
+			require.NoError(t, store.Instantiate(newModule(hostModule), moduleName))
+
+			const depth = 5
+			noTrap := uint64(math.MaxUint32)
+			results, _, err := store.CallFunction(moduleName, "run", depth, noTrap)
+			require.NoError(t, err)
+			require.Equal(t, []uint64{100 + 2*depth}, results)
+
+			for trapAt := uint64(0); trapAt <= depth; trapAt++ {
+				_, _, err := store.CallFunction(moduleName, "run", depth, trapAt)
+				require.ErrorIs(t, err, wasm.ErrRuntimeUnreachable)
+				// The backtrace covers the whole call stack from the trap only once.
+				msg := err.Error()
+				require.Equal(t, 1, strings.Count(msg, "wasm runtime error"), msg)
+				require.Equal(t, 1, strings.Count(msg, "wasm backtrace"), msg)
+				nested := int(depth - trapAt)
+				require.Equal(t, nested+1, strings.Count(msg, ": run"), msg)
+				require.Equal(t, nested, strings.Count(msg, ": "+hostModule+".host"), msg)
+				require.Contains(t, msg, fmt.Sprintf("\t%d: run", 2*nested))
+			}
+
+			// The host functions can continue after the trap of the nested call.
+			recoverTraps = true
+			results, _, err = store.CallFunction(moduleName, "run", depth, 1)
+			recoverTraps = false
+			require.NoError(t, err)
+			// 42 is returned for the trap at the nesting level 1, and each of the 7 calls above it adds one.
+			require.Equal(t, []uint64{49}, results)
+
+			// The nested calls are counted towards the limit of the call stack depth.
+			_, _, err = store.CallFunction(moduleName, "run", 1000, noTrap)
+			require.ErrorIs(t, err, wasm.ErrRuntimeCallStackOverflow)
+			require.Equal(t, 1, strings.Count(err.Error(), "wasm backtrace"))
+		})
+	}
+}
+
+func testRuntimeError(t *testing.T, newEngine newEngineFunc) {
+	i32 := wasm.ValueTypeI32
+	store := wasm.NewStore(newEngine(nil))
+	require.NoError(t, store.AddHostFunction("env", "nop", reflect.ValueOf(func(*wasm.HostFunctionCallContext) {})))
+	require.NoError(t, store.AddHostFunction("env", "fail", reflect.ValueOf(func(*wasm.HostFunctionCallContext) error {
+		return errors.New("host failure")
+	})))
+
+	m := &wasm.Module{
+		TypeSection:   []*wasm.FunctionType{{}, {Params: []wasm.ValueType{i32}, Results: []wasm.ValueType{i32}}},
+		ImportSection: []*wasm.Import{{Kind: wasm.ImportKindFunc, Module: "env", Name: "fail", DescFunc: 0}},
+		// The functions are "unreachable" (index 1), "div" (index 2), "call_unreachable" (index 3),
+		// "call_div" (index 4) and "call_fail" (index 5).
+		FunctionSection: []wasm.Index{0, 1, 0, 1, 0},
+		CodeSection: []*wasm.Code{
+			{Body: []byte{wasm.OpcodeI32Const, 0x01, wasm.OpcodeDrop, wasm.OpcodeUnreachable, wasm.OpcodeEnd}},
+			{Body: []byte{wasm.OpcodeLocalGet, 0x00, wasm.OpcodeI32Const, 0x00, wasm.OpcodeI32DivU, wasm.OpcodeEnd}},
+			{Body: []byte{wasm.OpcodeNop, wasm.OpcodeCall, 0x01, wasm.OpcodeEnd}},
+			{Body: []byte{wasm.OpcodeLocalGet, 0x00, wasm.OpcodeCall, 0x02, wasm.OpcodeEnd}},
+			{Body: []byte{wasm.OpcodeNop, wasm.OpcodeNop, wasm.OpcodeCall, 0x00, wasm.OpcodeEnd}},
+		},
+		ExportSection: map[string]*wasm.Export{
+			"call_unreachable": {Name: "call_unreachable", Kind: wasm.ExportKindFunc, Index: 3},
+			"call_div":         {Name: "call_div", Kind: wasm.ExportKindFunc, Index: 4},
+			"call_fail":        {Name: "call_fail", Kind: wasm.ExportKindFunc, Index: 5},
+		},
+		NameSection: &wasm.NameSection{FunctionNames: wasm.NameMap{
+			{Index: 1, Name: "unreachable"}, {Index: 2, Name: "div"}, {Index: 3, Name: "call_unreachable"},
+			{Index: 4, Name: "call_div"}, {Index: 5, Name: "call_fail"},
+		}},
+	}
+	require.NoError(t, store.Instantiate(m, "test"))
+
+	for _, tc := range []struct {
+		name          string
+		params        []uint64
+		expectedCause error
+		expected      []wasm.Frame
+	}{
+		{
+			name:          "call_unreachable",
+			expectedCause: wasm.ErrRuntimeUnreachable,
+			expected: []wasm.Frame{
+				{ModuleName: "test", FunctionIndex: 1, FunctionName: "unreachable", Offset: 3},
+				{ModuleName: "test", FunctionIndex: 3, FunctionName: "call_unreachable", Offset: 1},
+			},
+		},
+		{
+			name:          "call_div",
+			params:        []uint64{1},
+			expectedCause: wasm.ErrRuntimeIntegerDivideByZero,
+			expected: []wasm.Frame{
+				{ModuleName: "test", FunctionIndex: 2, FunctionName: "div", Offset: 4},
+				{ModuleName: "test", FunctionIndex: 4, FunctionName: "call_div", Offset: 2},
+			},
+		},
+		{
+			name: "call_fail",
+			expected: []wasm.Frame{
+				{ModuleName: "env", FunctionIndex: 1, FunctionName: "env.fail", IsHost: true},
+				{ModuleName: "test", FunctionIndex: 5, FunctionName: "call_fail", Offset: 2},
+			},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := store.CallFunction("test", tc.name, tc.params...)
+			var runtimeErr *wasm.RuntimeError
+			require.ErrorAs(t, err, &runtimeErr)
+			if tc.expectedCause != nil {
+				require.ErrorIs(t, err, tc.expectedCause)
+			} else {
+				require.EqualError(t, runtimeErr.Cause, "host failure")
+			}
+			require.Equal(t, tc.expected, runtimeErr.Frames)
+		})
+	}
+	t.Run("already canceled", func(t *testing.T) {
+		// The call is rejected before entering any function, so there's no frame.
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, _, err := store.CallFunctionContext(ctx, "test", "call_unreachable")
+		var runtimeErr *wasm.RuntimeError
+		require.ErrorAs(t, err, &runtimeErr)
+		require.ErrorIs(t, err, wasm.ErrRuntimeCallCanceled)
+		require.Empty(t, runtimeErr.Frames)
+	})
+}
+
+func testStubImportResolver(t *testing.T, newEngine newEngineFunc) {
+	m := &wasm.Module{
+		TypeSection:     []*wasm.FunctionType{{}},
+		ImportSection:   []*wasm.Import{{Kind: wasm.ImportKindFunc, Module: "env", Name: "missing", DescFunc: 0}},
+		FunctionSection: []wasm.Index{0},
+		CodeSection:     []*wasm.Code{{Body: []byte{wasm.OpcodeCall, 0x00, wasm.OpcodeEnd}}},
+		ExportSection:   map[string]*wasm.Export{"run": {Name: "run", Kind: wasm.ExportKindFunc, Index: 1}},
+	}
+	store := wasm.NewStore(newEngine(nil))
+	store.SetImportResolver(wasm.ChainImportResolvers(wasm.ModuleInstanceResolver, wasm.StubImportResolver))
+	require.NoError(t, store.Instantiate(m, "test"))
+
+	_, _, err := store.CallFunction("test", "run")
+	require.ErrorIs(t, err, wasm.ErrRuntimeUnresolvedImport)
+	var runtimeErr *wasm.RuntimeError
+	require.ErrorAs(t, err, &runtimeErr)
+	require.Equal(t, wasm.Frame{ModuleName: "test", FunctionName: "env.missing", IsHost: true}, runtimeErr.Frames[0])
+
+	// The stub is released together with the importing module instance.
+	require.Len(t, store.Functions, 2)
+	require.NoError(t, store.CloseModule("test"))
+	require.Len(t, store.Functions, 0)
+}
+
+func testExportedTable(t *testing.T, newEngine newEngineFunc) {
+	i32 := wasm.ValueTypeI32
+	resultI32 := &wasm.FunctionType{Results: []wasm.ValueType{i32}}
+	store := wasm.NewStore(newEngine(nil))
+	env, err := store.NewHostModuleBuilder("env").
+		Table("table", 1, nil).
+		Function("forty_two", reflect.ValueOf(func(*wasm.HostFunctionCallContext) uint32 { return 42 })).
+		// call_slot calls the function in the table exported by the caller.
+		Function("call_slot", reflect.ValueOf(func(ctx *wasm.HostFunctionCallContext, index uint32) (uint32, error) {
+			table, err := ctx.Module.ExportedTable("table")
+			if err != nil {
+				return 0, err
+			}
+			f, err := table.Lookup(index, resultI32)
+			if err != nil {
+				return 0, err
+			}
+			results, err := ctx.Call(f)
+			if err != nil {
+				return 0, err
+			}
+			return uint32(results[0]) + 1000, nil
+		})).
+		Instantiate()
+	require.NoError(t, err)
+
+	m := &wasm.Module{
+		TypeSection: []*wasm.FunctionType{resultI32, {Params: []wasm.ValueType{i32}, Results: []wasm.ValueType{i32}}},
+		ImportSection: []*wasm.Import{
+			{Kind: wasm.ImportKindTable, Module: "env", Name: "table", DescTable: &wasm.TableType{ElemType: 0x70, Limit: &wasm.LimitsType{Min: 1}}},
+			{Kind: wasm.ImportKindFunc, Module: "env", Name: "call_slot", DescFunc: 1},
+		},
+		FunctionSection: []wasm.Index{1, 0, 1},
+		CodeSection: []*wasm.Code{
+			// dispatch calls the function in the table with call_indirect.
+			{Body: []byte{wasm.OpcodeLocalGet, 0x00, wasm.OpcodeCallIndirect, 0x00, 0x00, wasm.OpcodeEnd}},
+			// seven returns 7.
+			{Body: []byte{wasm.OpcodeI32Const, 0x07, wasm.OpcodeEnd}},
+			// call_slot calls the imported call_slot.
+			{Body: []byte{wasm.OpcodeLocalGet, 0x00, wasm.OpcodeCall, 0x00, wasm.OpcodeEnd}},
+		},
+		ExportSection: map[string]*wasm.Export{
+			"dispatch":  {Name: "dispatch", Kind: wasm.ExportKindFunc, Index: 1},
+			"seven":     {Name: "seven", Kind: wasm.ExportKindFunc, Index: 2},
+			"call_slot": {Name: "call_slot", Kind: wasm.ExportKindFunc, Index: 3},
+			// The imported table is re-exported to the host function called by the guest.
+			"table": {Name: "table", Kind: wasm.ExportKindTable, Index: 0},
+		},
+	}
+	require.NoError(t, store.Instantiate(m, "test"))
+
+	table, err := env.ExportedTable("table")
+	require.NoError(t, err)
+	_, _, err = store.CallFunction("test", "dispatch", 0)
+	require.ErrorIs(t, err, wasm.ErrRuntimeInvalidTableAcces)
+
+	// The host function and the guest function set by the host are called by call_indirect.
+	require.NoError(t, table.Set(0, env.Exports["forty_two"].Function))
+	previous, err := table.Grow(2, store.ModuleInstances["test"].Exports["seven"].Function)
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), previous)
+	for index, expected := range []uint64{42, 7, 7} {
+		results, _, err := store.CallFunction("test", "dispatch", uint64(index))
+		require.NoError(t, err)
+		require.Equal(t, []uint64{expected}, results)
+
+		results, _, err = store.CallFunction("test", "call_slot", uint64(index))
+		require.NoError(t, err)
+		require.Equal(t, []uint64{expected + 1000}, results)
+
+		results, err = table.Call(context.Background(), uint32(index), resultI32)
+		require.NoError(t, err)
+		require.Equal(t, []uint64{expected}, results)
+	}
+
+	// The type is checked in the same way as call_indirect.
+	require.NoError(t, table.Set(1, store.ModuleInstances["test"].Exports["dispatch"].Function))
+	_, _, err = store.CallFunction("test", "dispatch", 1)
+	require.ErrorIs(t, err, wasm.ErrRuntimeIndirectCallTypeMismatch)
+	_, _, err = store.CallFunction("test", "call_slot", 1)
+	require.ErrorIs(t, err, wasm.ErrRuntimeIndirectCallTypeMismatch)
+	_, err = table.Call(context.Background(), 1, resultI32)
+	require.Equal(t, wasm.ErrRuntimeIndirectCallTypeMismatch, err)
+	_, err = table.Call(context.Background(), 3, resultI32)
+	require.Equal(t, wasm.ErrRuntimeInvalidTableAcces, err)
+}
+
+func testLazyCompilation(t *testing.T, newEngine newEngineFunc) {
+	i32 := wasm.ValueTypeI32
+	m := &wasm.Module{
+		TypeSection:     []*wasm.FunctionType{{Results: []wasm.ValueType{i32}}, {Params: []wasm.ValueType{i32}, Results: []wasm.ValueType{i32}}},
+		FunctionSection: []wasm.Index{0, 0, 1, 0},
+		CodeSection: []*wasm.Code{
+			// seven returns 7.
+			{Body: []byte{wasm.OpcodeI32Const, 0x07, wasm.OpcodeEnd}},
+			// (i32.add (call 0) (i32.const 1))
+			{Body: []byte{wasm.OpcodeCall, 0x00, wasm.OpcodeI32Const, 0x01, wasm.OpcodeI32Add, wasm.OpcodeEnd}},
+			// (call_indirect (type 0) (local.get 0))
+			{Body: []byte{wasm.OpcodeLocalGet, 0x00, wasm.OpcodeCallIndirect, 0x00, 0x00, wasm.OpcodeEnd}},
+			// (unreachable)
+			{Body: []byte{wasm.OpcodeUnreachable, wasm.OpcodeEnd}},
+		},
+		TableSection: []*wasm.TableType{{ElemType: 0x70, Limit: &wasm.LimitsType{Min: 2}}},
+		ElementSection: []*wasm.ElementSegment{
+			{OffsetExpr: &wasm.ConstantExpression{Opcode: wasm.OpcodeI32Const, Data: []byte{0x00}}, Init: []uint32{0, 1}},
+		},
+		ExportSection: map[string]*wasm.Export{
+			"call":     {Name: "call", Kind: wasm.ExportKindFunc, Index: 1},
+			"dispatch": {Name: "dispatch", Kind: wasm.ExportKindFunc, Index: 2},
+			"trap":     {Name: "trap", Kind: wasm.ExportKindFunc, Index: 3},
+		},
+	}
+
+	store := wasm.NewStore(newEngine(&wasm.RuntimeConfig{LazyCompilation: true}))
+	compiled, err := store.CompileModule(m)
+	require.NoError(t, err)
+
+	// The instances of the same compiled module share the code compiled on the first call in any of them.
+	for _, name := range []string{"a", "b"} {
+		require.NoError(t, store.InstantiateCompiled(compiled, name))
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		name := []string{"a", "b"}[i%2]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results, _, err := store.CallFunction(name, "call")
+			require.NoError(t, err)
+			require.Equal(t, []uint64{8}, results)
+		}()
+	}
+	wg.Wait()
+
+	for _, name := range []string{"a", "b"} {
+		for index, expected := range []uint64{7, 8} {
+			results, _, err := store.CallFunction(name, "dispatch", uint64(index))
+			require.NoError(t, err)
+			require.Equal(t, []uint64{expected}, results)
+		}
+
+		_, _, err = store.CallFunction(name, "trap")
+		require.ErrorIs(t, err, wasm.ErrRuntimeUnreachable)
+		var runtimeErr *wasm.RuntimeError
+		require.ErrorAs(t, err, &runtimeErr)
+		require.Equal(t, wasm.Index(3), runtimeErr.Frames[0].FunctionIndex)
+		require.NoError(t, store.CloseModule(name))
+	}
+	require.NoError(t, compiled.Close())
+}
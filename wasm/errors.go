@@ -1,6 +1,10 @@
 package wasm
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
 
 // All the erros are returned by Engine during the excecution of Wasm functions,
 // and they indicate that the Wasm virtual machine's state is unrecoverable.
@@ -28,4 +32,71 @@ var (
 	ErrRuntimeInvalidTableAcces = errors.New("invalid table access")
 	// ErrRuntimeIndirectCallTypeMismatch indicates that the type check failed during call_indirect.
 	ErrRuntimeIndirectCallTypeMismatch = errors.New("indirect call type mismatch")
+	// ErrRuntimeCallCanceled indicates that the context.Context given to the call was canceled or
+	// exceeded its deadline, and the engine terminated the execution.
+	ErrRuntimeCallCanceled = errors.New("call canceled")
+	// ErrRuntimeOutOfFuel indicates that the call consumed all the Fuel given via WithFuel,
+	// and the engine terminated the execution.
+	ErrRuntimeOutOfFuel = errors.New("out of fuel")
+	// ErrRuntimeUnresolvedImport indicates that the program called a function import which was not resolved
+	// and stubbed by StubImportResolver.
+	ErrRuntimeUnresolvedImport = errors.New("unresolved import")
 )
+
+// RuntimeError is the error returned by the calls into Wasm functions when the execution traps.
+type RuntimeError struct {
+	// Cause is the reason of the trap. This is one of the ErrRuntime* errors when the trap is caused
+	// by the engine, and otherwise the error (or the panic value) from the host function.
+	Cause error
+	// Frames is the backtrace of the call stack at the time of the trap, beginning with the innermost frame.
+	Frames []Frame
+}
+
+// Frame is a call frame in the backtrace of RuntimeError.
+type Frame struct {
+	// ModuleName is the name of the module instance which defines the function.
+	ModuleName string
+	// FunctionIndex is the index of the function in the function index space of the module instance.
+	FunctionIndex Index
+	// FunctionName is the name of the function. See FunctionInstance.Name.
+	FunctionName string
+	// IsHost is true if the function is a host function, and false if it is a Wasm function.
+	IsHost bool
+	// Offset is the byte offset in the module binary of the instruction being executed in this frame:
+	// the trapping one for the innermost frame, and the call for the others. This is zero for host functions.
+	//
+	// Note: this is relative to the function body (FunctionInstance.Body) if the module is not decoded from
+	// the binary, for example if it is decoded from the text format. See Code.BodyOffset.
+	Offset uint64
+}
+
+// NewFrame returns the Frame of the function f executing the instruction at the offset in f.Body.
+func NewFrame(f *FunctionInstance, offset uint64) Frame {
+	frame := Frame{FunctionIndex: f.Index, FunctionName: f.Name, IsHost: f.IsHostFunction()}
+	if !frame.IsHost {
+		frame.Offset = f.BodyOffset + offset
+	}
+	if m := f.ModuleInstance; m != nil {
+		frame.ModuleName = m.Name
+	}
+	return frame
+}
+
+// Error implements error.Error. The backtrace is formatted with the function names, one frame per line.
+func (e *RuntimeError) Error() string {
+	var b strings.Builder
+	b.WriteString("wasm runtime error: ")
+	b.WriteString(e.Cause.Error())
+	if len(e.Frames) > 0 {
+		b.WriteString("\nwasm backtrace:")
+		for i, frame := range e.Frames {
+			fmt.Fprintf(&b, "\n\t%d: %s", i, frame.FunctionName)
+		}
+	}
+	return b.String()
+}
+
+// Unwrap returns Cause, so errors.Is can be used to check the cause against ErrRuntime* errors.
+func (e *RuntimeError) Unwrap() error {
+	return e.Cause
+}
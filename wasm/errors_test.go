@@ -0,0 +1,32 @@
+package wasm
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRuntimeError_Error(t *testing.T) {
+	err := &RuntimeError{Cause: ErrRuntimeUnreachable}
+	require.EqualError(t, err, "wasm runtime error: unreachable")
+
+	err.Frames = []Frame{{FunctionName: "env.host", IsHost: true}, {FunctionName: "main", Offset: 3}}
+	require.EqualError(t, err, "wasm runtime error: unreachable\nwasm backtrace:\n\t0: env.host\n\t1: main")
+
+	// The cause can be checked through the wrapping errors.
+	require.ErrorIs(t, fmt.Errorf("call: %w", err), ErrRuntimeUnreachable)
+	require.False(t, errors.Is(err, ErrRuntimeOutOfFuel))
+}
+
+func TestNewFrame(t *testing.T) {
+	m := &ModuleInstance{Name: "test"}
+	host := &FunctionInstance{Name: "test.host", RawHostFunction: func(*HostFunctionCallContext, []uint64) {}, ModuleInstance: m}
+	f := &FunctionInstance{Name: "main", ModuleInstance: m, Index: 1, BodyOffset: 100}
+	m.Functions = []*FunctionInstance{host, f}
+
+	require.Equal(t, Frame{ModuleName: "test", FunctionIndex: 0, FunctionName: "test.host", IsHost: true}, NewFrame(host, 0))
+	// The offset is relative to the module binary.
+	require.Equal(t, Frame{ModuleName: "test", FunctionIndex: 1, FunctionName: "main", Offset: 105}, NewFrame(f, 5))
+}
@@ -0,0 +1,27 @@
+package wasm
+
+import "context"
+
+// Fuel is the budget for the deterministic metering of Wasm function execution.
+//
+// Engines charge one unit of fuel per wazeroir operation, and the cost of a basic block
+// is charged on entering it. Therefore, the same call with the same fuel consumes exactly
+// the same amount regardless of the engine and the host machine.
+type Fuel struct {
+	// Remaining is the amount of fuel left. Engines read this at the beginning of a call,
+	// and write back the remaining amount when the call returns, including when it fails.
+	Remaining uint64
+}
+
+type fuelKey struct{}
+
+// WithFuel returns a copy of ctx which makes the calls with it metered by fuel.
+func WithFuel(ctx context.Context, fuel *Fuel) context.Context {
+	return context.WithValue(ctx, fuelKey{}, fuel)
+}
+
+// FuelFromContext returns the Fuel given to WithFuel, or nil if ctx doesn't carry any.
+func FuelFromContext(ctx context.Context) *Fuel {
+	fuel, _ := ctx.Value(fuelKey{}).(*Fuel)
+	return fuel
+}
@@ -0,0 +1,100 @@
+package wasm
+
+import (
+	"context"
+	"fmt"
+)
+
+// ExportedFunction is a handle to a function exported by a ModuleInstance, returned by
+// ModuleInstance.ExportedFunction. Unlike Store.CallFunction, calls via the handle don't
+// look up the module and function by name.
+//
+// The handle can be called concurrently as is the case with Store.CallFunction, and must not
+// be called after the module instance is closed.
+type ExportedFunction struct {
+	function *FunctionInstance
+	engine   Engine
+}
+
+// ExportedFunction returns the handle to the function exported as name.
+func (m *ModuleInstance) ExportedFunction(name string) (*ExportedFunction, error) {
+	exp, ok := m.Exports[name]
+	if !ok {
+		return nil, fmt.Errorf("exported function '%s' not found", name)
+	}
+	if exp.Kind != ExportKindFunc {
+		return nil, fmt.Errorf("'%s' is not functype", name)
+	}
+	if m.engine == nil {
+		return nil, fmt.Errorf("module instance doesn't belong to any store")
+	}
+	return &ExportedFunction{function: exp.Function, engine: m.engine}, nil
+}
+
+// ParamTypes returns the types of the parameters of this function.
+func (f *ExportedFunction) ParamTypes() []ValueType {
+	return f.function.FunctionType.Type.Params
+}
+
+// ResultTypes returns the types of the results of this function.
+func (f *ExportedFunction) ResultTypes() []ValueType {
+	return f.function.FunctionType.Type.Results
+}
+
+// Call invokes this function with the parameters encoded as uint64 (See EncodeI32 etc.), and
+// returns the results in the same encoding. This returns an error if the number of params
+// doesn't match ParamTypes.
+func (f *ExportedFunction) Call(ctx context.Context, params ...uint64) ([]uint64, error) {
+	if len(params) != len(f.ParamTypes()) {
+		return nil, fmt.Errorf("invalid number of parameters: expected %d but got %d", len(f.ParamTypes()), len(params))
+	}
+	return f.engine.Call(ctx, f.function, params...)
+}
+
+// CallWithResults is the same as Call except that the results are written to results, whose length must
+// equal the length of ResultTypes. Reusing results across calls avoids allocating them on each call if
+// the engine supports it (See ResultsCaller).
+func (f *ExportedFunction) CallWithResults(ctx context.Context, results []uint64, params ...uint64) error {
+	if len(params) != len(f.ParamTypes()) {
+		return fmt.Errorf("invalid number of parameters: expected %d but got %d", len(f.ParamTypes()), len(params))
+	}
+	if len(results) != len(f.ResultTypes()) {
+		return fmt.Errorf("invalid number of results: expected %d but got %d", len(f.ResultTypes()), len(results))
+	}
+	if rc, ok := f.engine.(ResultsCaller); ok {
+		return rc.CallWithResults(ctx, f.function, results, params...)
+	}
+	ret, err := f.engine.Call(ctx, f.function, params...)
+	if err != nil {
+		return err
+	}
+	copy(results, ret)
+	return nil
+}
+
+// Invoke is the same as Call except that params and results are Go values, and the types of params
+// are checked against ParamTypes: int32 or uint32 for i32, int64 or uint64 for i64, float32 for f32
+// and float64 for f64. The results are int32, int64, float32 or float64 in the order of ResultTypes.
+func (f *ExportedFunction) Invoke(ctx context.Context, params ...interface{}) ([]interface{}, error) {
+	paramTypes := f.ParamTypes()
+	if len(params) != len(paramTypes) {
+		return nil, fmt.Errorf("invalid number of parameters: expected %d but got %d", len(paramTypes), len(params))
+	}
+	raw := make([]uint64, len(params))
+	for i, p := range params {
+		v, ok := encodeValue(paramTypes[i], p)
+		if !ok {
+			return nil, fmt.Errorf("invalid parameter at index %d: %T is not %s", i, p, valueTypeName(paramTypes[i]))
+		}
+		raw[i] = v
+	}
+	rawResults, err := f.engine.Call(ctx, f.function, raw...)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]interface{}, len(rawResults))
+	for i, t := range f.ResultTypes() {
+		results[i] = decodeValue(t, rawResults[i])
+	}
+	return results, nil
+}
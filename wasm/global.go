@@ -0,0 +1,59 @@
+package wasm
+
+import "fmt"
+
+// ExportedGlobal is a handle to a global exported by a ModuleInstance, returned by
+// ModuleInstance.ExportedGlobal.
+//
+// Get and Set access GlobalInstance.Val which is also read and written by engines at runtime,
+// so the changes made by either of the host and the guest are visible to the other.
+// Note that they are not synchronized with the concurrent calls accessing the same global.
+type ExportedGlobal struct {
+	global *GlobalInstance
+}
+
+// ExportedGlobal returns the handle to the global exported as name.
+func (m *ModuleInstance) ExportedGlobal(name string) (*ExportedGlobal, error) {
+	exp, ok := m.Exports[name]
+	if !ok {
+		return nil, fmt.Errorf("exported global '%s' not found", name)
+	}
+	if exp.Kind != ExportKindGlobal {
+		return nil, fmt.Errorf("'%s' is not global", name)
+	}
+	return &ExportedGlobal{global: exp.Global}, nil
+}
+
+// Type returns the type of the value of this global.
+func (g *ExportedGlobal) Type() ValueType {
+	return g.global.Type.ValType
+}
+
+// Mutable returns true if this global can be modified by Set.
+func (g *ExportedGlobal) Mutable() bool {
+	return g.global.Type.Mutable
+}
+
+// Get returns the current value of this global in the encoding of Type (See DecodeI32 etc.).
+func (g *ExportedGlobal) Get() uint64 {
+	return normalizeValue(g.Type(), g.global.Val)
+}
+
+// Set sets the value of this global to v encoded for Type (See EncodeI32 etc.).
+// This returns an error if this global is immutable.
+func (g *ExportedGlobal) Set(v uint64) error {
+	if !g.Mutable() {
+		return fmt.Errorf("global is immutable")
+	}
+	g.global.Val = normalizeValue(g.Type(), v)
+	return nil
+}
+
+// normalizeValue clears the upper 32 bits of v if t is a 32-bit type.
+func normalizeValue(t ValueType, v uint64) uint64 {
+	switch t {
+	case ValueTypeI32, ValueTypeF32:
+		return uint64(uint32(v))
+	}
+	return v
+}
@@ -0,0 +1,39 @@
+package wasm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestModuleInstance_ExportedGlobal(t *testing.T) {
+	m := &ModuleInstance{Exports: map[string]*ExportInstance{
+		"mutable":   {Kind: ExportKindGlobal, Global: &GlobalInstance{Type: &GlobalType{ValType: ValueTypeI32, Mutable: true}}},
+		"immutable": {Kind: ExportKindGlobal, Global: &GlobalInstance{Type: &GlobalType{ValType: ValueTypeF64}, Val: EncodeF64(1.5)}},
+		"memory":    {Kind: ExportKindMemory, Memory: &MemoryInstance{}},
+	}}
+
+	g, err := m.ExportedGlobal("mutable")
+	require.NoError(t, err)
+	require.Equal(t, ValueTypeI32, g.Type())
+	require.True(t, g.Mutable())
+	require.NoError(t, g.Set(EncodeI32(-1)))
+	require.Equal(t, int32(-1), DecodeI32(g.Get()))
+	// The upper 32 bits of i32 values are cleared.
+	require.NoError(t, g.Set(0xffff_ffff_0000_0001))
+	require.Equal(t, uint64(1), g.Get())
+	require.Equal(t, uint64(1), m.Exports["mutable"].Global.Val)
+
+	g, err = m.ExportedGlobal("immutable")
+	require.NoError(t, err)
+	require.Equal(t, ValueTypeF64, g.Type())
+	require.False(t, g.Mutable())
+	require.Equal(t, 1.5, DecodeF64(g.Get()))
+	require.EqualError(t, g.Set(EncodeF64(2.5)), "global is immutable")
+	require.Equal(t, 1.5, DecodeF64(g.Get()))
+
+	_, err = m.ExportedGlobal("memory")
+	require.EqualError(t, err, "'memory' is not global")
+	_, err = m.ExportedGlobal("missing")
+	require.EqualError(t, err, "exported global 'missing' not found")
+}
@@ -0,0 +1,237 @@
+package wasm
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// HostModuleBuilder defines a host module, and instantiates it in a Store with Instantiate.
+//
+// Unlike Store.AddHostFunction and the like which add the definitions to a module one by one, the definitions
+// are validated all together on Instantiate, and nothing is added to the store if any of them is invalid.
+type HostModuleBuilder struct {
+	store      *Store
+	moduleName string
+	// exportNames holds the names of all the definitions in the order of definition.
+	exportNames []string
+	functions   []*hostFunctionDefinition
+	globals     []*hostGlobalDefinition
+	memories    []*hostLimitedDefinition
+	tables      []*hostLimitedDefinition
+	userValue   interface{}
+}
+
+type hostFunctionDefinition struct {
+	name string
+	fn   reflect.Value
+	// raw is true if this is defined with RawFunction, and then rawFn and rawType are used instead of fn.
+	raw     bool
+	rawFn   RawHostFunction
+	rawType *FunctionType
+}
+
+type hostGlobalDefinition struct {
+	name      string
+	value     uint64
+	valueType ValueType
+	mutable   bool
+}
+
+// hostLimitedDefinition is the definition of a memory or table.
+type hostLimitedDefinition struct {
+	name string
+	min  uint32
+	max  *uint32
+}
+
+// NewHostModuleBuilder returns a HostModuleBuilder of the host module which will be instantiated as moduleName.
+func (s *Store) NewHostModuleBuilder(moduleName string) *HostModuleBuilder {
+	return &HostModuleBuilder{store: s, moduleName: moduleName}
+}
+
+// Function defines the host function fn exported as name. The requirements of fn are the same as
+// Store.AddHostFunction, and the function is named "moduleName.name" in the backtraces.
+func (b *HostModuleBuilder) Function(name string, fn reflect.Value) *HostModuleBuilder {
+	b.exportNames = append(b.exportNames, name)
+	b.functions = append(b.functions, &hostFunctionDefinition{name: name, fn: fn})
+	return b
+}
+
+// RawFunction defines the RawHostFunction fn of the signature sig exported as name.
+// See Store.AddRawHostFunction.
+func (b *HostModuleBuilder) RawFunction(name string, sig *FunctionType, fn RawHostFunction) *HostModuleBuilder {
+	b.exportNames = append(b.exportNames, name)
+	b.functions = append(b.functions, &hostFunctionDefinition{name: name, raw: true, rawFn: fn, rawType: sig})
+	return b
+}
+
+// Global defines the global exported as name. See Store.AddGlobal.
+func (b *HostModuleBuilder) Global(name string, value uint64, valueType ValueType, mutable bool) *HostModuleBuilder {
+	b.exportNames = append(b.exportNames, name)
+	b.globals = append(b.globals, &hostGlobalDefinition{name: name, value: value, valueType: valueType, mutable: mutable})
+	return b
+}
+
+// Memory defines the memory exported as name. At most one memory can be defined.
+func (b *HostModuleBuilder) Memory(name string, min uint32, max *uint32) *HostModuleBuilder {
+	b.exportNames = append(b.exportNames, name)
+	b.memories = append(b.memories, &hostLimitedDefinition{name: name, min: min, max: max})
+	return b
+}
+
+// Table defines the table exported as name. At most one table can be defined.
+func (b *HostModuleBuilder) Table(name string, min uint32, max *uint32) *HostModuleBuilder {
+	b.exportNames = append(b.exportNames, name)
+	b.tables = append(b.tables, &hostLimitedDefinition{name: name, min: min, max: max})
+	return b
+}
+
+// UserValue sets ModuleInstance.UserValue of the module instance.
+func (b *HostModuleBuilder) UserValue(v interface{}) *HostModuleBuilder {
+	b.userValue = v
+	return b
+}
+
+// Instantiate validates the definitions, and instantiates them as the module instance named moduleName
+// given to Store.NewHostModuleBuilder. This returns an error without modifying the store if a module
+// of the same name exists or any of the definitions is invalid.
+func (b *HostModuleBuilder) Instantiate() (*ModuleInstance, error) {
+	s := b.store
+	if _, ok := s.ModuleInstances[b.moduleName]; ok {
+		return nil, fmt.Errorf("module %s already exists", b.moduleName)
+	}
+	if err := b.validate(); err != nil {
+		return nil, err
+	}
+
+	m := &ModuleInstance{Name: b.moduleName, Exports: map[string]*ExportInstance{}, UserValue: b.userValue, engine: s.engine, store: s}
+	for _, def := range b.functions {
+		f := &FunctionInstance{Name: fmt.Sprintf("%s.%s", b.moduleName, def.name), ModuleInstance: m, Index: Index(len(m.Functions))}
+		if def.raw {
+			f.RawHostFunction = def.rawFn
+			f.FunctionType = s.getTypeInstance(def.rawType)
+		} else {
+			fn := def.fn
+			sig, _ := getHostFunctionType(fn.Type()) // Already validated.
+			f.HostFunction = &fn
+			f.FunctionType = s.getTypeInstance(sig)
+		}
+		m.Functions = append(m.Functions, f)
+		m.Exports[def.name] = &ExportInstance{Kind: ExportKindFunc, Function: f}
+	}
+	if err := b.bindFunctions(m.Functions); err != nil {
+		return nil, err
+	}
+
+	for _, def := range b.globals {
+		g := &GlobalInstance{Val: def.value, Type: &GlobalType{Mutable: def.mutable, ValType: def.valueType}}
+		m.Globals = append(m.Globals, g)
+		m.Exports[def.name] = &ExportInstance{Kind: ExportKindGlobal, Global: g}
+		s.Globals = append(s.Globals, g)
+	}
+	for _, def := range b.memories {
+		m.Memory = s.newHostMemoryInstance(def.min, def.max)
+		m.Exports[def.name] = &ExportInstance{Kind: ExportKindMemory, Memory: m.Memory}
+		s.Memories = append(s.Memories, m.Memory)
+	}
+	for _, def := range b.tables {
+		t := newTableInstance(def.min, def.max)
+		m.Tables = append(m.Tables, t)
+		m.Exports[def.name] = &ExportInstance{Kind: ExportKindTable, Table: t}
+		s.Tables = append(s.Tables, t)
+	}
+	s.ModuleInstances[b.moduleName] = m
+	return m, nil
+}
+
+// validate returns the first error in the definitions if any.
+func (b *HostModuleBuilder) validate() error {
+	names := map[string]struct{}{}
+	for _, name := range b.exportNames {
+		if _, ok := names[name]; ok {
+			return fmt.Errorf("name %s already exists in module %s", name, b.moduleName)
+		}
+		names[name] = struct{}{}
+	}
+
+	for _, def := range b.functions {
+		if def.raw {
+			if def.rawFn == nil {
+				return fmt.Errorf("function %s: host function is nil", def.name)
+			} else if def.rawType == nil {
+				return fmt.Errorf("function %s: signature is nil", def.name)
+			} else if err := validateRawHostFunctionType(def.rawType); err != nil {
+				return fmt.Errorf("function %s: %w", def.name, err)
+			}
+			continue
+		}
+		if def.fn.Kind() != reflect.Func {
+			return fmt.Errorf("function %s: %s is not a function", def.name, def.fn.Kind())
+		}
+		if _, err := getHostFunctionType(def.fn.Type()); err != nil {
+			return fmt.Errorf("function %s: invalid signature: %w", def.name, err)
+		}
+	}
+
+	for _, def := range b.globals {
+		switch def.valueType {
+		case ValueTypeI32, ValueTypeI64, ValueTypeF32, ValueTypeF64:
+		default:
+			return fmt.Errorf("global %s: invalid type: 0x%x", def.name, def.valueType)
+		}
+	}
+
+	config := b.store.config
+	if len(b.memories) > 1 {
+		return fmt.Errorf("multiple memories are not supported")
+	}
+	for _, def := range b.memories {
+		if def.max != nil && def.min > *def.max {
+			return fmt.Errorf("memory %s: min %d pages is greater than max %d pages", def.name, def.min, *def.max)
+		} else if def.min > config.MaxMemoryPages {
+			return fmt.Errorf("memory %s: min %d pages exceeds the limit %d pages", def.name, def.min, config.MaxMemoryPages)
+		}
+	}
+	if len(b.tables) > 1 {
+		return fmt.Errorf("multiple tables are not supported")
+	}
+	for _, def := range b.tables {
+		if def.max != nil && def.min > *def.max {
+			return fmt.Errorf("table %s: min %d elements is greater than max %d elements", def.name, def.min, *def.max)
+		} else if def.min > config.MaxTableElements {
+			return fmt.Errorf("table %s: min %d elements exceeds the limit %d elements", def.name, def.min, config.MaxTableElements)
+		}
+	}
+	return nil
+}
+
+// bindFunctions compiles and binds the host functions, and adds them to the store.
+// If any of them fails, the ones already added are removed from the store.
+func (b *HostModuleBuilder) bindFunctions(functions []*FunctionInstance) (err error) {
+	s := b.store
+	start := len(s.Functions)
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, f := range s.Functions[start:] {
+			_ = s.engine.Release(f)
+		}
+		s.Functions = s.Functions[:start]
+	}()
+
+	for _, f := range functions {
+		var compiled CompiledFunction
+		if compiled, err = s.engine.Compile(f); err != nil {
+			return fmt.Errorf("failed to compile %s: %v", f.Name, err)
+		}
+		// Bind requires the address of f, so the instance is added to the store first.
+		s.addFunctionInstance(f)
+		if err = s.engine.Bind(f, compiled); err != nil {
+			s.Functions = s.Functions[:f.Address]
+			_ = s.engine.ReleaseCompiled(compiled)
+			return fmt.Errorf("failed to bind %s: %v", f.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package wasm
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostModuleBuilder_Instantiate_Errors(t *testing.T) {
+	nop := reflect.ValueOf(func(*HostFunctionCallContext) {})
+	rawNop := func(*HostFunctionCallContext, []uint64) {}
+	one := uint32(1)
+	for _, c := range []struct {
+		name     string
+		build    func(b *HostModuleBuilder)
+		expected string
+	}{
+		{
+			name: "name clash",
+			build: func(b *HostModuleBuilder) {
+				b.Function("f", nop).Memory("memory", 1, nil).Global("f", 0, ValueTypeI32, false)
+			},
+			expected: "name f already exists in module env",
+		},
+		{
+			name:     "not a function",
+			build:    func(b *HostModuleBuilder) { b.Function("f", reflect.ValueOf(1)) },
+			expected: "function f: int is not a function",
+		},
+		{
+			name: "invalid signature",
+			build: func(b *HostModuleBuilder) {
+				b.Function("f", reflect.ValueOf(func(*HostFunctionCallContext, string) {}))
+			},
+			expected: "function f: invalid signature: invalid type: string",
+		},
+		{
+			name:     "nil raw function",
+			build:    func(b *HostModuleBuilder) { b.RawFunction("f", &FunctionType{}, nil) },
+			expected: "function f: host function is nil",
+		},
+		{
+			name:     "nil raw signature",
+			build:    func(b *HostModuleBuilder) { b.RawFunction("f", nil, rawNop) },
+			expected: "function f: signature is nil",
+		},
+		{
+			name:     "invalid raw signature",
+			build:    func(b *HostModuleBuilder) { b.RawFunction("f", &FunctionType{Params: []ValueType{0x10}}, rawNop) },
+			expected: "function f: invalid signature: invalid type: 0x10",
+		},
+		{
+			name:     "invalid global type",
+			build:    func(b *HostModuleBuilder) { b.Global("g", 0, 0x10, false) },
+			expected: "global g: invalid type: 0x10",
+		},
+		{
+			name:     "multiple memories",
+			build:    func(b *HostModuleBuilder) { b.Memory("m1", 1, nil).Memory("m2", 1, nil) },
+			expected: "multiple memories are not supported",
+		},
+		{
+			name:     "memory min over max",
+			build:    func(b *HostModuleBuilder) { b.Memory("memory", 2, &one) },
+			expected: "memory memory: min 2 pages is greater than max 1 pages",
+		},
+		{
+			name:     "memory over limit",
+			build:    func(b *HostModuleBuilder) { b.Memory("memory", 3, nil) },
+			expected: "memory memory: min 3 pages exceeds the limit 2 pages",
+		},
+		{
+			name:     "multiple tables",
+			build:    func(b *HostModuleBuilder) { b.Table("t1", 1, nil).Table("t2", 1, nil) },
+			expected: "multiple tables are not supported",
+		},
+		{
+			name:     "table min over max",
+			build:    func(b *HostModuleBuilder) { b.Table("table", 2, &one) },
+			expected: "table table: min 2 elements is greater than max 1 elements",
+		},
+		{
+			name:     "table over limit",
+			build:    func(b *HostModuleBuilder) { b.Table("table", 11, nil) },
+			expected: "table table: min 11 elements exceeds the limit 10 elements",
+		},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			s := NewStoreWithConfig(nil, &RuntimeConfig{MaxMemoryPages: 2, MaxTableElements: 10})
+			// The valid definitions are not added to the store either.
+			b := s.NewHostModuleBuilder("env").Global("valid", 1, ValueTypeI64, true)
+			c.build(b)
+			_, err := b.Instantiate()
+			require.EqualError(t, err, c.expected)
+			require.Empty(t, s.ModuleInstances)
+			require.Empty(t, s.Functions)
+			require.Empty(t, s.Globals)
+			require.Empty(t, s.Memories)
+			require.Empty(t, s.Tables)
+		})
+	}
+
+	t.Run("module exists", func(t *testing.T) {
+		s := NewStore(nil)
+		require.NoError(t, s.AddGlobal("env", "g", 0, ValueTypeI32, false))
+		_, err := s.NewHostModuleBuilder("env").Instantiate()
+		require.EqualError(t, err, "module env already exists")
+	})
+}
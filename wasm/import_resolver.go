@@ -0,0 +1,132 @@
+package wasm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ImportResolver resolves the imports of the modules instantiated in a Store. See Store.SetImportResolver.
+type ImportResolver interface {
+	// ResolveImport returns the instance to be bound to the import i of the module being instantiated in the store s,
+	// or nil if this cannot resolve i. The returned instance is checked against the kind and the type of i.
+	//
+	// The instance is either exported by a module instance in s, or a new one: new functions, globals, memories
+	// and tables are added to s, and they are released together with the importing module instance.
+	ResolveImport(s *Store, module *Module, i *Import) (*ExportInstance, error)
+}
+
+// ImportResolverFunc is a function implementing ImportResolver.
+type ImportResolverFunc func(s *Store, module *Module, i *Import) (*ExportInstance, error)
+
+// ResolveImport implements ImportResolver.ResolveImport.
+func (f ImportResolverFunc) ResolveImport(s *Store, module *Module, i *Import) (*ExportInstance, error) {
+	return f(s, module, i)
+}
+
+// ModuleInstanceResolver resolves the imports with the exports of the module instances in the store by the import's
+// module name. This is the default ImportResolver of Store.
+var ModuleInstanceResolver ImportResolver = ImportResolverFunc(resolveModuleInstanceExport)
+
+func resolveModuleInstanceExport(s *Store, _ *Module, i *Import) (*ExportInstance, error) {
+	if m, ok := s.ModuleInstances[i.Module]; ok {
+		return m.Exports[i.Name], nil
+	}
+	return nil, nil
+}
+
+// ModuleNameResolver returns the ImportResolver which resolves the imports from the module names in the keys of names
+// with the exports of the module instances in the store named as the corresponding values. The imports from the other
+// module names are left to the next resolvers. See Store.InstantiateCompiledWithImports.
+func ModuleNameResolver(names map[string]string) ImportResolver {
+	return ImportResolverFunc(func(s *Store, _ *Module, i *Import) (*ExportInstance, error) {
+		name, ok := names[i.Module]
+		if !ok {
+			return nil, nil
+		}
+		if m, ok := s.ModuleInstances[name]; ok {
+			return m.Exports[i.Name], nil
+		}
+		return nil, nil
+	})
+}
+
+// StubImportResolver resolves any import with a new stub instance: functions which trap with
+// ErrRuntimeUnresolvedImport when called, zero-valued globals, and memories and tables of the minimum size.
+// This is usually chained after other resolvers to instantiate modules whose imports are partially provided.
+var StubImportResolver ImportResolver = ImportResolverFunc(resolveStubImport)
+
+func resolveStubImport(s *Store, module *Module, i *Import) (*ExportInstance, error) {
+	switch i.Kind {
+	case ImportKindFunc:
+		if int(i.DescFunc) >= len(module.TypeSection) {
+			return nil, fmt.Errorf("unknown type for function import")
+		}
+		name := fmt.Sprintf("%s.%s", i.Module, i.Name)
+		f := &FunctionInstance{
+			Name:         name,
+			FunctionType: s.getTypeInstance(module.TypeSection[i.DescFunc]),
+			RawHostFunction: func(*HostFunctionCallContext, []uint64) {
+				panic(fmt.Errorf("%w: %s", ErrRuntimeUnresolvedImport, name))
+			},
+		}
+		return &ExportInstance{Kind: ExportKindFunc, Function: f}, nil
+	case ImportKindGlobal:
+		if i.DescGlobal == nil {
+			return nil, fmt.Errorf("global type is invalid")
+		}
+		g := &GlobalInstance{Type: &GlobalType{ValType: i.DescGlobal.ValType, Mutable: i.DescGlobal.Mutable}}
+		return &ExportInstance{Kind: ExportKindGlobal, Global: g}, nil
+	case ImportKindMemory:
+		if i.DescMem == nil {
+			return nil, fmt.Errorf("memory type is invalid")
+		}
+		return &ExportInstance{Kind: ExportKindMemory, Memory: s.newHostMemoryInstance(i.DescMem.Min, i.DescMem.Max)}, nil
+	case ImportKindTable:
+		if i.DescTable == nil {
+			return nil, fmt.Errorf("table type is invalid")
+		}
+		return &ExportInstance{Kind: ExportKindTable, Table: newTableInstance(i.DescTable.Limit.Min, i.DescTable.Limit.Max)}, nil
+	}
+	return nil, nil
+}
+
+// ChainImportResolvers returns the ImportResolver which returns the first instance resolved by resolvers in order.
+func ChainImportResolvers(resolvers ...ImportResolver) ImportResolver {
+	return ImportResolverFunc(func(s *Store, module *Module, i *Import) (*ExportInstance, error) {
+		for _, r := range resolvers {
+			if e, err := r.ResolveImport(s, module, i); err != nil || e != nil {
+				return e, err
+			}
+		}
+		return nil, nil
+	})
+}
+
+// UnresolvedImportsError is the error returned by the instantiation when any import is not resolved by the
+// ImportResolver. This holds all the unresolved imports of the module.
+type UnresolvedImportsError struct {
+	Imports []*Import
+}
+
+// Error implements error.Error.
+func (e *UnresolvedImportsError) Error() string {
+	names := make([]string, 0, len(e.Imports))
+	for _, i := range e.Imports {
+		names = append(names, fmt.Sprintf("%s.%s (%s)", i.Module, i.Name, importKindName(i.Kind)))
+	}
+	return "unresolved imports: " + strings.Join(names, ", ")
+}
+
+func importKindName(kind ImportKind) string {
+	switch kind {
+	case ImportKindFunc:
+		return "func"
+	case ImportKindTable:
+		return "table"
+	case ImportKindMemory:
+		return "memory"
+	case ImportKindGlobal:
+		return "global"
+	}
+	return fmt.Sprintf("%#x", kind)
+}
@@ -0,0 +1,138 @@
+package wasm
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore_Instantiate_UnresolvedImports(t *testing.T) {
+	max := uint32(1)
+	m := &Module{
+		TypeSection: []*FunctionType{{}},
+		ImportSection: []*Import{
+			{Kind: ImportKindFunc, Module: "env", Name: "f", DescFunc: 0},
+			{Kind: ImportKindGlobal, Module: "env", Name: "g", DescGlobal: &GlobalType{ValType: ValueTypeI32}},
+			{Kind: ImportKindMemory, Module: "other", Name: "mem", DescMem: &MemoryType{Min: 1, Max: &max}},
+		},
+	}
+	s := NewStore(nil)
+	require.NoError(t, s.AddGlobal("env", "g", 1, ValueTypeI32, false))
+
+	err := s.InstantiateCompiled(&CompiledModule{Module: m}, "test")
+	var unresolvedErr *UnresolvedImportsError
+	require.True(t, errors.As(err, &unresolvedErr))
+	require.Equal(t, []*Import{m.ImportSection[0], m.ImportSection[2]}, unresolvedErr.Imports)
+	require.EqualError(t, err, "resolve imports: unresolved imports: env.f (func), other.mem (memory)")
+}
+
+func TestStore_SetImportResolver(t *testing.T) {
+	m := &Module{
+		ImportSection: []*Import{
+			{Kind: ImportKindGlobal, Module: "renamed", Name: "g", DescGlobal: &GlobalType{ValType: ValueTypeI32}},
+			{Kind: ImportKindGlobal, Module: "env", Name: "missing", DescGlobal: &GlobalType{ValType: ValueTypeF64, Mutable: true}},
+			{Kind: ImportKindTable, Module: "env", Name: "table", DescTable: &TableType{ElemType: 0x70, Limit: &LimitsType{Min: 2}}},
+		},
+	}
+	s := NewStore(nil)
+	require.NoError(t, s.AddGlobal("env", "g", 1, ValueTypeI32, false))
+
+	rename := ImportResolverFunc(func(s *Store, module *Module, i *Import) (*ExportInstance, error) {
+		if i.Module != "renamed" {
+			return nil, nil
+		}
+		return s.ModuleInstances["env"].Exports[i.Name], nil
+	})
+	s.SetImportResolver(ChainImportResolvers(rename, ModuleInstanceResolver, StubImportResolver))
+	require.NoError(t, s.InstantiateCompiled(&CompiledModule{Module: m}, "test"))
+
+	instance := s.ModuleInstances["test"]
+	require.Equal(t, s.ModuleInstances["env"].Exports["g"].Global, instance.Globals[0])
+	require.Equal(t, []*ModuleInstance{s.ModuleInstances["env"]}, instance.dependencies)
+	// The stubs are added to the store, and owned by the importing module instance.
+	require.Equal(t, &GlobalType{ValType: ValueTypeF64, Mutable: true}, instance.Globals[1].Type)
+	require.Zero(t, instance.Globals[1].Val)
+	require.Len(t, instance.Tables[0].Table, 2)
+	require.Len(t, s.Globals, 2)
+	require.Len(t, s.Tables, 1)
+	require.NoError(t, s.CloseModule("test"))
+	require.Len(t, s.Globals, 1)
+	require.Len(t, s.Tables, 0)
+
+	// nil restores the default resolver.
+	s.SetImportResolver(nil)
+	err := s.InstantiateCompiled(&CompiledModule{Module: m}, "test")
+	require.EqualError(t, err, "resolve imports: unresolved imports: renamed.g (global), env.missing (global), env.table (table)")
+}
+
+func TestStubImportResolver_Func(t *testing.T) {
+	m := &Module{
+		TypeSection:   []*FunctionType{{Params: []ValueType{ValueTypeI32}}},
+		ImportSection: []*Import{{Kind: ImportKindFunc, Module: "env", Name: "f", DescFunc: 0}},
+	}
+	s := NewStore(nil)
+	e, err := StubImportResolver.ResolveImport(s, m, m.ImportSection[0])
+	require.NoError(t, err)
+	require.Equal(t, ExportKindFunc, e.Kind)
+	require.Equal(t, "env.f", e.Function.Name)
+	require.Equal(t, m.TypeSection[0], e.Function.FunctionType.Type)
+
+	defer func() {
+		err := recover().(error)
+		require.ErrorIs(t, err, ErrRuntimeUnresolvedImport)
+		require.EqualError(t, err, "unresolved import: env.f")
+	}()
+	e.Function.RawHostFunction(nil, []uint64{0})
+}
+
+func TestStore_InstantiateCompiledWithImports(t *testing.T) {
+	m := &Module{
+		ImportSection: []*Import{
+			{Kind: ImportKindGlobal, Module: "env", Name: "g", DescGlobal: &GlobalType{ValType: ValueTypeI32}},
+			{Kind: ImportKindGlobal, Module: "common", Name: "g", DescGlobal: &GlobalType{ValType: ValueTypeI32}},
+		},
+	}
+	s := NewStore(nil)
+	require.NoError(t, s.AddGlobal("tenant1", "g", 1, ValueTypeI32, false))
+	require.NoError(t, s.AddGlobal("tenant2", "g", 2, ValueTypeI32, false))
+	require.NoError(t, s.AddGlobal("common", "g", 3, ValueTypeI32, false))
+
+	// The same module is instantiated with different imports, and the others are resolved by the store's resolver.
+	compiled := &CompiledModule{Module: m}
+	for _, tenant := range []string{"tenant1", "tenant2"} {
+		err := s.InstantiateCompiledWithImports(context.Background(), compiled, tenant+"_main", ModuleNameResolver(map[string]string{"env": tenant}))
+		require.NoError(t, err)
+	}
+	require.Equal(t, uint64(1), s.ModuleInstances["tenant1_main"].Globals[0].Val)
+	require.Equal(t, uint64(2), s.ModuleInstances["tenant2_main"].Globals[0].Val)
+	require.Equal(t, s.ModuleInstances["tenant1_main"].Globals[1], s.ModuleInstances["tenant2_main"].Globals[1])
+
+	// The overrides are not applied to the other instantiations.
+	err := s.InstantiateCompiled(compiled, "main")
+	require.EqualError(t, err, "resolve imports: unresolved imports: env.g (global)")
+}
+
+func TestStore_AliasModule(t *testing.T) {
+	s := NewStore(nil)
+	require.NoError(t, s.AddGlobal("env", "g", 1, ValueTypeI32, false))
+	require.NoError(t, s.AliasModule("env", "alias"))
+	require.Equal(t, s.ModuleInstances["env"], s.ModuleInstances["alias"])
+
+	require.EqualError(t, s.AliasModule("env", "alias"), "module 'alias' already exists")
+	require.EqualError(t, s.AliasModule("unknown", "other"), "module 'unknown' not instantiated")
+
+	// The module instance is imported with the alias.
+	m := &Module{ImportSection: []*Import{
+		{Kind: ImportKindGlobal, Module: "alias", Name: "g", DescGlobal: &GlobalType{ValType: ValueTypeI32}},
+	}}
+	require.NoError(t, s.InstantiateCompiled(&CompiledModule{Module: m}, "main"))
+	require.Equal(t, s.ModuleInstances["env"].Exports["g"].Global, s.ModuleInstances["main"].Globals[0])
+	require.EqualError(t, s.CloseModule("alias"), "module 'alias' is imported by 'main'")
+
+	// Closing the module instance removes all of its names.
+	require.NoError(t, s.CloseModule("main"))
+	require.NoError(t, s.CloseModule("alias"))
+	require.Empty(t, s.ModuleInstances)
+}
@@ -9,12 +9,17 @@ type compiler interface {
 	String() string
 	// emitPreamble is called before compiling any wazeroir operation.
 	// This is used, for example, to initilize the reserved registers, etc.
-	emitPreamble()
+	emitPreamble() error
 	// Generates the byte slice of native codes.
 	// maxStackPointer is the max stack pointer that the target function would reach.
 	generate() (code []byte, staticData compiledFunctionStaticData, maxStackPointer uint64, err error)
+	// setSourceOffset is called before compiling each wazeroir operation with the offset of the Wasm instruction
+	// from which the operation is compiled. See wazeroir.CompilationResult.SourceOffsets.
+	setSourceOffset(offset uint64)
+	// sourceOffsetMap returns the mapping from the native code to the Wasm instructions, and is valid after generate.
+	sourceOffsetMap() sourceOffsetMap
 	// Return true if the compiler decided to skip the entire label.
-	compileLabel(o *wazeroir.OperationLabel) (skipThisLabel bool)
+	compileLabel(o *wazeroir.OperationLabel) (skipThisLabel bool, err error)
 	// Followings are resinposible for compiling each wazeroir operation.
 	compileUnreachable() error
 	compileSwap(o *wazeroir.OperationSwap) error
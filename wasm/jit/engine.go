@@ -1,13 +1,17 @@
 package jit
 
 import (
+	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"math"
 	"reflect"
 	"runtime"
 	"runtime/debug"
-	"strings"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"unsafe"
 
 	"github.com/tetratelabs/wazero/wasm"
@@ -15,7 +19,27 @@ import (
 	"github.com/tetratelabs/wazero/wasm/wazeroir"
 )
 
+// engine is the JIT implementation of wasm.Engine, and holds the compiled functions which are shared by all the calls.
 type engine struct {
+	// mux protects compiledFunctions so that calls can be made while other functions are compiled.
+	mux sync.RWMutex
+	// Store the compiled functions. These are keyed by the function instances rather than their addresses,
+	// since the addresses are only unique within a store while an engine can be shared by stores.
+	compiledFunctions map[*wasm.FunctionInstance]*compiledFunction
+	// config holds the limits of the calls. See wasm.RuntimeConfig.
+	config *wasm.RuntimeConfig
+	// fallback is the interpreter which executes the functions failed to be compiled by JIT.
+	// All the functions are bound to this as well so that the interpreted functions can call
+	// the JITed ones. See crossEngineCall.
+	fallback wasm.Engine
+	// callEngines pools the callEngines so that their stacks are reused across the calls.
+	callEngines sync.Pool
+	// compileWasmFunction compiles the Wasm functions with JIT, and is replaced in tests to emulate the failures.
+	compileWasmFunction func(f *wasm.FunctionInstance, config *wasm.RuntimeConfig) (*compiledCode, error)
+}
+
+// callEngine holds the execution context of a Call, so that functions can be called concurrently.
+type callEngine struct {
 	// These fields are used and manipulated by JITed code.
 
 	// The actual Go-allocated stack.
@@ -52,203 +76,484 @@ type engine struct {
 	tableSliceAddress uintptr
 	// tableSliceLen stores the length of the unique table used by the currently executed function.
 	tableSliceLen uint64
+	// callCanceledCheckCountdown is decremented by JITed code at function entries and loop headers.
+	// When it reaches zero, JITed code calls builtinFunctionAddressCheckCallCanceled which checks
+	// whether the context.Context given to Call is done. This also gives the Go runtime a chance
+	// to preempt the goroutine executing long-running loops.
+	callCanceledCheckCountdown uint64
+	// fuel is the remaining fuel of this call, and JITed code subtracts the fuel cost
+	// of each basic block from this on entering the block. See wasm.Fuel for detail.
+	fuel uint64
+	// functionsSliceAddress is the address of the first element of ModuleInstance.Functions of the
+	// currently executed function. JITed code reads the callee's address from this on function calls
+	// since the compiled code is shared by module instances in different stores.
+	functionsSliceAddress uintptr
+	// typesSliceAddress is the address of the first element of ModuleInstance.Types of the currently
+	// executed function. JITed code reads the type ID from this on call_indirect.
+	typesSliceAddress uintptr
+
+	// The following fields are only used by Go code.
+
 	// Function call frames in linked list
 	callFrameStack *callFrame
 	// callFrameNum tracks the current number of call frames.
 	// Note: this is not len(callFrameStack) because the stack is implemented as a linked list.
 	callFrameNum uint64
-
-	// The following fields are only used during compilation.
-
-	// Store the compiled functions.
-	compiledFunctions map[wasm.FunctionAddress]*compiledFunction
+	// ctx is the context.Context given to this call.
+	ctx context.Context
+	// engine is the engine from which this is created, and used to look up the callee functions.
+	engine *engine
+	// hostCallContext is passed to raw host functions, and reused across the calls to avoid allocations.
+	hostCallContext wasm.HostFunctionCallContext
+	// freeHostCallFrames holds the call frames of host functions which have returned, and are reused
+	// for the subsequent host function calls to avoid allocations.
+	freeHostCallFrames []*callFrame
 }
 
-// Native code manipulates the engine's fields with these constants.
+// Native code manipulates the callEngine's fields with these constants.
 const (
-	engineStackSliceOffset          = 0
-	enginestackPointerOffset        = 24
-	enginestackBasePointerOffset    = 32
-	engineJITCallStatusCodeOffset   = 40
-	engineFunctionCallAddressOffset = 48
-	engineContinuationAddressOffset = 56
-	engineglobalSliceAddressOffset  = 64
-	engineMemorySliceAddressOffset  = 72
-	engineMemorySliceLenOffset      = 80
-	engineTableSliceAddressOffset   = 88
-	engineTableSliceLenOffset       = 96
+	callEngineStackSliceOffset                 = 0
+	callEnginestackPointerOffset               = 24
+	callEnginestackBasePointerOffset           = 32
+	callEngineJITCallStatusCodeOffset          = 40
+	callEngineFunctionCallAddressOffset        = 48
+	callEngineContinuationAddressOffset        = 56
+	callEngineglobalSliceAddressOffset         = 64
+	callEngineMemorySliceAddressOffset         = 72
+	callEngineMemorySliceLenOffset             = 80
+	callEngineTableSliceAddressOffset          = 88
+	callEngineTableSliceLenOffset              = 96
+	callEngineCallCanceledCheckCountdownOffset = 104
+	callEngineFuelOffset                       = 112
+	callEngineFunctionsSliceAddressOffset      = 120
+	callEngineTypesSliceAddressOffset          = 128
 )
 
-func (e *engine) Call(f *wasm.FunctionInstance, params ...uint64) (results []uint64, err error) {
-	// We ensure that this Call method never panics as
-	// this Call method is indirectly invoked by embedders via store.CallFunction,
+// Call implements wasm.Engine Call.
+//
+// Each call is made with its own callEngine, so calls can be made concurrently from multiple goroutines.
+// The callEngines are pooled, so that the calls don't allocate their stacks.
+func (e *engine) Call(ctx context.Context, f *wasm.FunctionInstance, params ...uint64) (results []uint64, err error) {
+	compiled, ok := e.getCompiledFunction(f)
+	if !ok {
+		err = fmt.Errorf("function not compiled")
+		return
+	}
+	if compiled.interpreted != nil {
+		results, err = e.fallback.Call(ctx, f, params...)
+	} else {
+		results = make([]uint64, compiled.resultCount)
+		ce := e.getCallEngine()
+		err = ce.call(ctx, compiled, results, params)
+		e.putCallEngine(ce)
+	}
+	if err != nil {
+		results, err = nil, joinBacktrace(err)
+	}
+	return
+}
+
+// CallWithState implements wasm.StateCaller.
+func (e *engine) CallWithState(ctx context.Context, state *wasm.CallState, f *wasm.FunctionInstance, results []uint64, params ...uint64) error {
+	if len(results) != len(f.FunctionType.Type.Results) {
+		return fmt.Errorf("invalid number of results: expected %d but got %d", len(f.FunctionType.Type.Results), len(results))
+	}
+	compiled, ok := e.getCompiledFunction(f)
+	if !ok {
+		return fmt.Errorf("function not compiled")
+	}
+	if compiled.interpreted != nil {
+		return e.fallback.(wasm.StateCaller).CallWithState(ctx, state, f, results, params...)
+	}
+	ce := e.getCallEngine()
+	err := ce.callWithState(ctx, state, compiled, results, params)
+	e.putCallEngine(ce)
+	return err
+}
+
+// call calls compiled with params, and writes the results to results.
+func (ce *callEngine) call(ctx context.Context, compiled *compiledFunction, results, params []uint64) error {
+	state := wasm.CallState{Fuel: math.MaxUint64}
+	if fuel := wasm.FuelFromContext(ctx); fuel != nil {
+		state.Fuel = fuel.Remaining
+		defer func() { fuel.Remaining = state.Fuel }()
+	}
+	return ce.callWithState(ctx, &state, compiled, results, params)
+}
+
+// callWithState is the same as call except that the call starts with state, which is updated with the remaining fuel
+// when this returns. See wasm.StateCaller.
+func (ce *callEngine) callWithState(ctx context.Context, state *wasm.CallState, compiled *compiledFunction, results, params []uint64) (err error) {
+	// We ensure that this call method never panics as
+	// this call method is indirectly invoked by embedders via store.CallFunction,
 	// and we have to make sure that all the runtime errors, including the one happening inside
 	// host functions, will be captured as errors, not panics.
+	if ctx.Err() != nil {
+		err = &wasm.RuntimeError{Cause: callCanceledError(ctx)}
+		return
+	}
+	ce.ctx, ce.fuel, ce.callFrameNum = ctx, state.Fuel, state.CallStackDepth
+	defer func() { state.Fuel = ce.fuel }()
 
-	// shouldRecover is true when a panic at the origin of callstack should be recovered
-	//
-	// If this is the recursive call into Wasm (e.callFrameStack != nil), we do not recover, and delegate the
-	// recovery to the first engine.Call.
-	//
-	// For example, given the call stack:
-	//	 "original host function" --(engine.Call)--> Wasm func A --> Host func --(engine.Call)--> Wasm function B,
-	// if the top Wasm function panics, we go back to the "original host function".
-	shouldRecover := e.callFrameStack == nil
 	defer func() {
-		if shouldRecover {
-			if v := recover(); v != nil {
-				if buildoptions.IsDebugMode {
-					debug.PrintStack()
-				}
-				top := e.callFrameStack
-				var frames []string
-				var counter int
-				for top != nil {
-					frames = append(frames, fmt.Sprintf("\t%d: %s", counter, top.getFunctionName()))
-					top = top.caller
-					counter++
-					// TODO: include DWARF symbols. See #58
-				}
-				runtimeErr, ok := v.(error)
-				if ok {
-					err = fmt.Errorf("wasm runtime error: %w", runtimeErr)
-				} else {
-					err = fmt.Errorf("wasm runtime error: %v", v)
-				}
-
-				if len(frames) > 0 {
-					err = fmt.Errorf("%w\nwasm backtrace:\n%s", err, strings.Join(frames, "\n"))
-				}
-				// Reset the state so this engine can be reused
-				e.callFrameStack = nil
-				e.stackBasePointer = 0
-				e.stackPointer = 0
-				e.callFrameNum = 0
-			}
+		if v := recover(); v != nil {
+			err = ce.runtimeError(v)
 		}
 	}()
 
 	for _, param := range params {
-		e.push(param)
+		ce.push(param)
+	}
+
+	if compiled.isHostFunction() {
+		ce.execAnyHostFunction(compiled, compiled.source.ModuleInstance)
+	} else {
+		ce.execFunction(compiled)
+	}
+
+	// Note the top value is the tail of the results,
+	// so we assign them in reverse order.
+	for i := range results {
+		results[len(results)-1-i] = ce.pop()
 	}
+	return
+}
 
-	compiled, ok := e.compiledFunctions[f.Address]
+// CallForeign implements wasm.ForeignCaller.
+func (ce *callEngine) CallForeign(engine wasm.StateCaller, f *wasm.FunctionInstance, results, params []uint64) error {
+	// The top frame is the one of the host function calling f, which is replaced with the frame of f in engine.
+	state := wasm.CallState{Fuel: ce.fuel, CallStackDepth: ce.callFrameNum - 1}
+	err := engine.CallWithState(ce.ctx, &state, f, results, params...)
+	ce.fuel = state.Fuel
+	return err
+}
+
+// CallNested implements wasm.NestedCaller by calling f on top of the call frame of the host function being executed.
+func (ce *callEngine) CallNested(f *wasm.FunctionInstance, params []uint64) (results []uint64, err error) {
+	compiled, ok := ce.engine.getCompiledFunction(f)
 	if !ok {
 		err = fmt.Errorf("function not compiled")
 		return
 	}
 
+	// The call frames and the stack are restored after the call, including the case of a trap
+	// so that the host function can continue.
+	top, frameNum, hostCallContext := ce.callFrameStack, ce.callFrameNum, ce.hostCallContext
+	stackBasePointer, stackPointer := ce.stackBasePointer, ce.stackPointer
+	defer func() {
+		if v := recover(); v != nil {
+			err = &nestedCallError{ce: ce, err: ce.runtimeError(v)}
+		}
+		ce.callFrameStack, ce.callFrameNum, ce.hostCallContext = top, frameNum, hostCallContext
+		ce.stackBasePointer, ce.stackPointer = stackBasePointer, stackPointer
+	}()
+
+	ce.maybeGrowStack(stackPointer + uint64(len(params)))
+	for _, param := range params {
+		ce.push(param)
+	}
+
 	if compiled.isHostFunction() {
-		e.execHostFunction(compiled.source.HostFunction, &wasm.HostFunctionCallContext{Memory: f.ModuleInstance.Memory})
+		callee := ce.newHostCallFrame(compiled)
+		ce.callFramePush(callee)
+		ce.execAnyHostFunction(compiled, compiled.source.ModuleInstance)
+		ce.callFramePop()
+		ce.freeHostCallFrames = append(ce.freeHostCallFrames, callee)
 	} else {
-		e.execFunction(compiled)
+		ce.execFunction(compiled)
 	}
 
-	// Note the top value is the tail of the results,
-	// so we assign them in reverse order.
-	results = make([]uint64, len(f.FunctionType.Type.Results))
-	for i := range results {
-		results[len(results)-1-i] = e.pop()
-	}
+	// The results are placed where the params were pushed.
+	start := stackBasePointer + stackPointer
+	results = make([]uint64, compiled.resultCount)
+	copy(results, ce.stack[start:start+compiled.resultCount])
 	return
 }
 
-func (e *engine) Compile(f *wasm.FunctionInstance) error {
+// nestedCallError is the error of a trap in CallNested. This includes the backtrace of all the call frames of the
+// call engine, so the outer calls propagate this as is when the host function traps with this error.
+type nestedCallError struct {
+	ce  *callEngine
+	err error
+}
+
+func (e *nestedCallError) Error() string {
+	return e.err.Error()
+}
+
+func (e *nestedCallError) Unwrap() error {
+	return e.err
+}
+
+// runtimeError returns the *wasm.RuntimeError of the trap v with the backtrace of the current call frames.
+func (ce *callEngine) runtimeError(v interface{}) error {
+	if buildoptions.IsDebugMode || ce.engine.config.Debug {
+		debug.PrintStack()
+	}
+
+	cause, ok := v.(error)
+	if ok {
+		var nested *nestedCallError
+		if errors.As(cause, &nested) && nested.ce == ce {
+			// The error already includes the backtrace from the call frame of the trap.
+			return cause
+		}
+	} else {
+		cause = fmt.Errorf("%v", v)
+	}
+
+	var frames []wasm.Frame
+	for top := ce.callFrameStack; top != nil; top = top.caller {
+		frames = append(frames, wasm.NewFrame(top.compiledFunction.source, top.wasmOffset()))
+	}
+	return &wasm.RuntimeError{Cause: cause, Frames: frames}
+}
+
+// Compile implements wasm.Engine Compile.
+//
+// Functions which JIT fails to compile, for example any function on the platforms where JIT is not supported,
+// are compiled by the fallback interpreter instead, and the result is *interpretedCode. With lazy compilation,
+// this happens on the first call instead. See compiledFunction.ensureCompiled.
+func (e *engine) Compile(f *wasm.FunctionInstance) (wasm.CompiledFunction, error) {
 	if f.IsHostFunction() {
-		e.compiledFunctions[f.Address] = &compiledFunction{
-			source:      f,
-			paramCount:  uint64(len(f.FunctionType.Type.Params)),
-			resultCount: uint64(len(f.FunctionType.Type.Results)),
+		// Host functions are called directly by Go code, so there's nothing to compile.
+		return nil, nil
+	}
+	if e.config.LazyCompilation {
+		// The code is compiled on the first call. See compiledFunction.ensureCompiled.
+		return &compiledCode{refCount: 1, lazy: &lazyCompilation{engine: e}}, nil
+	}
+	code, err := e.compileWasmFunction(f, e.config)
+	if err != nil {
+		err = fmt.Errorf("failed to compile Wasm function: %w", err)
+		if interpreted, fallbackErr := e.fallback.Compile(f); fallbackErr == nil {
+			return &interpretedCode{compiled: interpreted}, nil
+		}
+		return nil, err
+	}
+	return code, nil
+}
+
+// Bind implements wasm.Engine Bind.
+//
+// The function f is bound to the fallback interpreter as well, so that it can be called by the interpreted functions.
+func (e *engine) Bind(f *wasm.FunctionInstance, compiled wasm.CompiledFunction) error {
+	cf := &compiledFunction{
+		source:      f,
+		paramCount:  uint64(len(f.FunctionType.Type.Params)),
+		resultCount: uint64(len(f.FunctionType.Type.Results)),
+	}
+	if interpreted, ok := compiled.(*interpretedCode); ok {
+		if err := e.fallback.Bind(f, interpreted.compiled); err != nil {
+			return err
 		}
+		// JITed functions call this as if it is a host function.
+		cf.interpreted = crossEngineCall(e.fallback.(wasm.StateCaller), f)
 	} else {
-		cf, err := e.compileWasmFunction(f)
-		if err != nil {
-			return fmt.Errorf("failed to compile Wasm function: %w", err)
+		if !f.IsHostFunction() {
+			code, ok := compiled.(*compiledCode)
+			if !ok || code == nil {
+				return fmt.Errorf("%T is not compiled by JIT engine", compiled)
+			}
+			if !code.acquire() {
+				return fmt.Errorf("compiled code is already released")
+			}
+			cf.compiledCode = code
 		}
-		e.compiledFunctions[f.Address] = cf
+		if err := e.bindFallback(f); err != nil {
+			if cf.compiledCode != nil {
+				_ = cf.compiledCode.release()
+			}
+			return err
+		}
+	}
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	e.compiledFunctions[f] = cf
+	return nil
+}
+
+// bindFallback binds the function f executed by JIT to the fallback interpreter. Host functions are bound as is,
+// and the JITed functions are bound as the host functions which call them via crossEngineCall. Either way, the
+// binding is keyed by f so that the interpreter resolves the callees in the same way as this engine.
+func (e *engine) bindFallback(f *wasm.FunctionInstance) error {
+	target := f
+	if !f.IsHostFunction() {
+		proxy := *f
+		proxy.HostFunction, proxy.RawHostFunction = nil, crossEngineCall(e, f)
+		target = &proxy
+	}
+	compiled, err := e.fallback.Compile(target)
+	if err != nil {
+		return err
+	}
+	return e.fallback.Bind(f, compiled)
+}
+
+// Release implements wasm.Engine Release.
+func (e *engine) Release(f *wasm.FunctionInstance) error {
+	e.mux.Lock()
+	cf, ok := e.compiledFunctions[f]
+	delete(e.compiledFunctions, f)
+	e.mux.Unlock()
+	if !ok {
+		return fmt.Errorf("function at address %d is not bound", f.Address)
+	}
+	if err := e.fallback.Release(f); err != nil {
+		return err
+	}
+	if cf.compiledCode != nil {
+		return cf.compiledCode.release()
 	}
 	return nil
 }
 
+// ReleaseCompiled implements wasm.Engine ReleaseCompiled.
+func (e *engine) ReleaseCompiled(compiled wasm.CompiledFunction) error {
+	if compiled == nil {
+		return nil
+	}
+	if interpreted, ok := compiled.(*interpretedCode); ok {
+		return e.fallback.ReleaseCompiled(interpreted.compiled)
+	}
+	code, ok := compiled.(*compiledCode)
+	if !ok {
+		return fmt.Errorf("%T is not compiled by JIT engine", compiled)
+	} else if code == nil {
+		return nil
+	}
+	return code.release()
+}
+
+func (e *engine) getCompiledFunction(f *wasm.FunctionInstance) (cf *compiledFunction, ok bool) {
+	e.mux.RLock()
+	defer e.mux.RUnlock()
+	cf, ok = e.compiledFunctions[f]
+	return
+}
+
 func NewEngine() wasm.Engine {
 	return newEngine()
 }
 
-const initialStackSize = 1024
+// NewEngineWithConfig is the same as NewEngine except that the calls are executed with the limits in config.
+func NewEngineWithConfig(config *wasm.RuntimeConfig) wasm.Engine {
+	return newEngineWithConfig(config)
+}
 
 func newEngine() *engine {
+	return newEngineWithConfig(nil)
+}
+
+func newEngineWithConfig(config *wasm.RuntimeConfig) *engine {
 	e := &engine{
-		stack:             make([]uint64, initialStackSize),
-		compiledFunctions: make(map[wasm.FunctionAddress]*compiledFunction),
+		compiledFunctions:   make(map[*wasm.FunctionInstance]*compiledFunction),
+		config:              config.WithDefaults(),
+		compileWasmFunction: compileWasmFunction,
 	}
+	e.fallback = wazeroir.NewEngineWithConfig(e.config)
+	e.callEngines.New = func() interface{} { return e.newCallEngine() }
 	return e
 }
 
-func (e *engine) pop() (ret uint64) {
-	ret = e.stack[e.stackBasePointer+e.stackPointer-1]
-	e.stackPointer--
-	return
+func (e *engine) newCallEngine() *callEngine {
+	return &callEngine{
+		stack:                      make([]uint64, e.config.InitialOperandStackSize),
+		callCanceledCheckCountdown: callCanceledCheckInterval,
+		engine:                     e,
+	}
 }
 
-func (e *engine) push(v uint64) {
-	e.stack[e.stackBasePointer+e.stackPointer] = v
-	e.stackPointer++
+// getCallEngine returns a callEngine from the pool, which is ready for a new Call.
+func (e *engine) getCallEngine() *callEngine {
+	ce := e.callEngines.Get().(*callEngine)
+	ce.stackPointer, ce.stackBasePointer, ce.callFrameStack = 0, 0, nil
+	ce.callCanceledCheckCountdown = callCanceledCheckInterval
+	return ce
 }
 
-var callStackCeiling = uint64(buildoptions.CallStackCeiling)
+// putCallEngine returns ce to the pool after clearing the references to the finished call.
+func (e *engine) putCallEngine(ce *callEngine) {
+	ce.ctx, ce.hostCallContext, ce.callFrameStack = nil, wasm.HostFunctionCallContext{}, nil
+	e.callEngines.Put(ce)
+}
+
+func (ce *callEngine) pop() (ret uint64) {
+	ret = ce.stack[ce.stackBasePointer+ce.stackPointer-1]
+	ce.stackPointer--
+	return
+}
+
+func (ce *callEngine) push(v uint64) {
+	ce.stack[ce.stackBasePointer+ce.stackPointer] = v
+	ce.stackPointer++
+}
 
-func (e *engine) callFramePush(callee *callFrame) {
-	e.callFrameNum++
-	if callStackCeiling < e.callFrameNum {
+func (ce *callEngine) callFramePush(callee *callFrame) {
+	ce.callFrameNum++
+	if uint64(ce.engine.config.MaxCallStackDepth) < ce.callFrameNum {
 		panic(wasm.ErrRuntimeCallStackOverflow)
 	}
 
 	// Push the new frame to the top of stack.
-	callee.caller = e.callFrameStack
-	e.callFrameStack = callee
+	callee.caller = ce.callFrameStack
+	ce.callFrameStack = callee
 
-	e.callFrameStack.stackBasePointer = e.stackBasePointer + e.stackPointer - callee.compiledFunction.paramCount
-	e.stackBasePointer = callee.stackBasePointer
-	e.stackPointer = callee.compiledFunction.paramCount
-	e.initModuleInstance(callee.compiledFunction.source.ModuleInstance)
+	ce.callFrameStack.stackBasePointer = ce.stackBasePointer + ce.stackPointer - callee.compiledFunction.paramCount
+	ce.stackBasePointer = callee.stackBasePointer
+	ce.stackPointer = callee.compiledFunction.paramCount
+	ce.initModuleInstance(callee.compiledFunction.source.ModuleInstance)
 }
 
-func (e *engine) callFramePop() {
+func (ce *callEngine) callFramePop() {
 	// Pop the old callframe from the top of stack.
-	e.callFrameNum--
-	caller := e.callFrameStack.caller
-	e.callFrameStack = caller
+	ce.callFrameNum--
+	caller := ce.callFrameStack.caller
+	ce.callFrameStack = caller
 
 	// If the caller is not nil, we have to go back into the caller's frame.
 	if caller != nil {
-		e.stackBasePointer = caller.stackBasePointer
-		e.stackPointer = caller.continuationStackPointer
-		e.initModuleInstance(caller.compiledFunction.source.ModuleInstance)
+		ce.stackBasePointer = caller.stackBasePointer
+		ce.stackPointer = caller.continuationStackPointer
+		ce.initModuleInstance(caller.compiledFunction.source.ModuleInstance)
 	}
 }
 
 // initModuleInstance initializes the engine's state based on the given module instance.
-func (e *engine) initModuleInstance(m *wasm.ModuleInstance) {
+func (ce *callEngine) initModuleInstance(m *wasm.ModuleInstance) {
 	if len(m.Globals) > 0 {
-		e.globalSliceAddress = uintptr(unsafe.Pointer(&m.Globals[0]))
+		ce.globalSliceAddress = uintptr(unsafe.Pointer(&m.Globals[0]))
 	}
 	if tables := m.Tables; len(tables) > 0 {
 		// WebAssembly 1.0 (MVP) has at most 1 table
 		// See https://www.w3.org/TR/wasm-core-1/#tables%E2%91%A0
 		table := tables[0]
 		if len(table.Table) > 0 {
-			e.tableSliceAddress = uintptr(unsafe.Pointer(&table.Table[0]))
+			ce.tableSliceAddress = uintptr(unsafe.Pointer(&table.Table[0]))
 		}
-		e.tableSliceLen = uint64(len(table.Table))
+		ce.tableSliceLen = uint64(len(table.Table))
+	}
+	if len(m.Functions) > 0 {
+		ce.functionsSliceAddress = uintptr(unsafe.Pointer(&m.Functions[0]))
+	}
+	if len(m.Types) > 0 {
+		ce.typesSliceAddress = uintptr(unsafe.Pointer(&m.Types[0]))
 	}
 	if m.Memory != nil {
-		e.memorySliceLen = uint64(len(m.Memory.Buffer))
+		ce.memorySliceLen = uint64(len(m.Memory.Buffer))
 		if len(m.Memory.Buffer) > 0 {
-			e.memorySliceAddress = uintptr(unsafe.Pointer(&m.Memory.Buffer[0]))
+			ce.memorySliceAddress = uintptr(unsafe.Pointer(&m.Memory.Buffer[0]))
 		}
 	}
 }
 
+func callCanceledError(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("%w: %v", wasm.ErrRuntimeCallCanceled, err)
+	}
+	return wasm.ErrRuntimeCallCanceled
+}
+
 // jitCallStatusCode represents the result of `jitcall`.
 // This is set by the jitted native code.
 type jitCallStatusCode uint32
@@ -273,6 +578,8 @@ const (
 	jitCallStatusCodeTypeMismatchOnIndirectCall
 	jitCallStatusIntegerOverflow
 	jitCallStatusIntegerDivisionByZero
+	// jitCallStatusCodeOutOfFuel means the remaining fuel was less than the cost of the basic block to be entered.
+	jitCallStatusCodeOutOfFuel
 )
 
 func (s jitCallStatusCode) String() (ret string) {
@@ -304,6 +611,16 @@ func (c *callFrame) String() string {
 	)
 }
 
+// wasmOffset returns the offset of the Wasm instruction being executed in this frame. The continuation address
+// points to the next instruction of the exit from the native code on calls and traps, so we look up the one before it.
+func (c *callFrame) wasmOffset() uint64 {
+	code := c.compiledFunction.compiledCode
+	if code == nil || c.continuationAddress <= code.codeInitialAddress {
+		return 0
+	}
+	return code.sourceOffsetMap.wasmOffset(uint64(c.continuationAddress-code.codeInitialAddress) - 1)
+}
+
 func (c *callFrame) getFunctionName() string {
 	return c.compiledFunction.source.Name
 }
@@ -312,6 +629,29 @@ type compiledFunction struct {
 	// The source function instance from which this is compiled.
 	source                  *wasm.FunctionInstance
 	paramCount, resultCount uint64
+	// compiledCode is shared by all the instances of the same function in any store.
+	// This is nil for host functions and the interpreted functions.
+	*compiledCode
+	// interpreted is non-nil if this function is executed by the fallback interpreter, in which case
+	// this is called in the same way as the raw host functions.
+	interpreted wasm.RawHostFunction
+	// lazyFallback is the state of the binding to the fallback interpreter, which is made on the first call
+	// if the lazy compilation by JIT fails. See ensureCompiled.
+	lazyFallback struct {
+		once sync.Once
+		// interpreted is the same as compiledFunction.interpreted, but is only accessed after once.
+		interpreted wasm.RawHostFunction
+		err         error
+	}
+}
+
+// compiledCode is the store-independent native code of a Wasm function, and is the
+// result of engine.Compile.
+type compiledCode struct {
+	// refCount is the number of the references to this compiled code: one held by the result of
+	// engine.Compile until engine.ReleaseCompiled, and one per function instance bound to this code.
+	// codeSegment is unmapped once this reaches zero.
+	refCount int64
 	// codeSegment is holding the compiled native code as a byte slice.
 	codeSegment []byte
 	// Pre-calculated pointer pointing to the initial byte of .codeSegment slice.
@@ -322,6 +662,85 @@ type compiledFunction struct {
 	// The max of the stack pointer this function can reach. Lazily applied via maybeGrowStack.
 	maxStackPointer uint64
 	staticData      compiledFunctionStaticData
+	// sourceOffsetMap is used to find the Wasm instructions of the call frames in the backtrace of traps.
+	sourceOffsetMap sourceOffsetMap
+	// lazy is non-nil if the compilation is deferred until the first call, in which case the fields above
+	// are set by compiledFunction.ensureCompiled. See wasm.RuntimeConfig.LazyCompilation.
+	lazy *lazyCompilation
+}
+
+// lazyCompilation is the state of the compilation deferred until the first call of the function.
+type lazyCompilation struct {
+	once sync.Once
+	// engine is the engine which compiles the code.
+	engine *engine
+	// interpreted is the result of the compilation by the fallback interpreter if JIT fails to compile the code.
+	interpreted wasm.CompiledFunction
+	// err is the error of the compilation, which traps all the calls.
+	err error
+}
+
+// ensureCompiled compiles the code of f on the first call if the compilation is deferred, and panics
+// if the compilation fails.
+//
+// As with engine.Compile, the code which JIT fails to compile is compiled by the fallback interpreter instead.
+// In that case, f is bound to the interpreted code, and this returns the function which calls it in the same way
+// as compiledFunction.interpreted.
+func (f *compiledFunction) ensureCompiled() (interpreted wasm.RawHostFunction) {
+	lazy := f.lazy
+	if lazy == nil {
+		return nil
+	}
+	lazy.once.Do(func() {
+		// The compiled code doesn't depend on the instance, so the code compiled from any of the instances
+		// sharing this code can be used by all of them.
+		code, err := lazy.engine.compileWasmFunction(f.source, lazy.engine.config)
+		if err != nil {
+			var fallbackErr error
+			if lazy.interpreted, fallbackErr = lazy.engine.fallback.Compile(f.source); fallbackErr != nil {
+				lazy.err = fmt.Errorf("failed to compile Wasm function: %w", err)
+			}
+			return
+		}
+		c := f.compiledCode
+		c.codeSegment, c.codeInitialAddress = code.codeSegment, code.codeInitialAddress
+		c.maxStackPointer, c.staticData, c.sourceOffsetMap = code.maxStackPointer, code.staticData, code.sourceOffsetMap
+	})
+	if lazy.err != nil {
+		panic(lazy.err)
+	} else if lazy.interpreted == nil {
+		return nil
+	}
+
+	fallback := &f.lazyFallback
+	fallback.once.Do(func() {
+		// f is bound to the fallback interpreter as the function calling back to JIT (See engine.bindFallback),
+		// so this replaces it before any call to the interpreted code is made.
+		if fallback.err = lazy.engine.fallback.Bind(f.source, lazy.interpreted); fallback.err == nil {
+			fallback.interpreted = crossEngineCall(lazy.engine.fallback.(wasm.StateCaller), f.source)
+		}
+	})
+	if fallback.err != nil {
+		panic(fallback.err)
+	}
+	return fallback.interpreted
+}
+
+// sourceOffsetMap maps the offsets in the native code to the offsets of the original Wasm instructions
+// in the function body.
+type sourceOffsetMap struct {
+	// nativeOffsets is sorted in ascending order, and the native code of the Wasm instruction at
+	// wasmOffsets[i] begins at nativeOffsets[i].
+	nativeOffsets, wasmOffsets []uint64
+}
+
+// wasmOffset returns the offset of the Wasm instruction whose native code contains nativeOffset.
+func (m *sourceOffsetMap) wasmOffset(nativeOffset uint64) uint64 {
+	i := sort.Search(len(m.nativeOffsets), func(i int) bool { return m.nativeOffsets[i] > nativeOffset })
+	if i == 0 {
+		return 0
+	}
+	return m.wasmOffsets[i-1]
 }
 
 // staticData holds the read-only data (i.e. out side of codeSegment which is marked as executable) per function.
@@ -330,8 +749,40 @@ type compiledFunction struct {
 // correspond to different jump tables for different br_table instructions.
 type compiledFunctionStaticData = [][]byte
 
+// acquire increments the reference count of this code, and returns false if this is already released.
+func (c *compiledCode) acquire() bool {
+	for {
+		n := atomic.LoadInt64(&c.refCount)
+		if n <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&c.refCount, n, n+1) {
+			return true
+		}
+	}
+}
+
+// release decrements the reference count of this code, and unmaps codeSegment if no reference remains.
+func (c *compiledCode) release() error {
+	if atomic.AddInt64(&c.refCount, -1) != 0 {
+		return nil
+	} else if c.codeSegment == nil {
+		// The lazy compilation has never happened, or has fallen back to the interpreter.
+		if c.lazy != nil && c.lazy.interpreted != nil {
+			return c.lazy.engine.fallback.ReleaseCompiled(c.lazy.interpreted)
+		}
+		return nil
+	}
+	if err := munmapCodeSegment(c.codeSegment); err != nil {
+		return fmt.Errorf("failed to unmap code segment: %w", err)
+	}
+	c.codeSegment, c.codeInitialAddress = nil, 0
+	return nil
+}
+
+// isHostFunction returns true if f is called by Go code, which is the case for the interpreted functions as well.
 func (f *compiledFunction) isHostFunction() bool {
-	return f.source.HostFunction != nil
+	return f.interpreted != nil || f.source.IsHostFunction()
 }
 
 const (
@@ -339,26 +790,114 @@ const (
 	builtinFunctionAddressMemorySize
 	// builtinFunctionAddressBreakPoint is internal (only for wazero developers). Disabled by default.
 	builtinFunctionAddressBreakPoint
+	builtinFunctionAddressCheckCallCanceled
 )
 
+// callCanceledCheckInterval is the number of function entries and loop iterations
+// between checks of whether the context.Context given to Call is done.
+const callCanceledCheckInterval = 1 << 16
+
 // Grow the stack size according to maxStackPointer argument
 // which is the max stack pointer from the base pointer
 // for the next function frame execution.
-func (e *engine) maybeGrowStack(maxStackPointer uint64) {
-	currentLen := uint64(len(e.stack))
-	remained := currentLen - e.stackBasePointer
+func (ce *callEngine) maybeGrowStack(maxStackPointer uint64) {
+	currentLen := uint64(len(ce.stack))
+	remained := currentLen - ce.stackBasePointer
 	if maxStackPointer > remained {
+		required := ce.stackBasePointer + maxStackPointer
+		limit := uint64(ce.engine.config.MaxOperandStackSize)
+		if required > limit {
+			panic(wasm.ErrRuntimeCallStackOverflow)
+		}
 		// This case we need to grow the stack as the empty slots
 		// are not able to store all the stack items.
-		// So we grow the stack with the new len = currentLen*2+maxStackPointer.
-		newStack := make([]uint64, currentLen*2+(maxStackPointer))
-		top := e.stackBasePointer + e.stackPointer
-		copy(newStack[:top], e.stack[:top])
-		e.stack = newStack
+		// So we grow the stack with the new len = currentLen*2+maxStackPointer up to the limit.
+		newLen := currentLen*2 + maxStackPointer
+		if newLen > limit {
+			newLen = limit
+		}
+		newStack := make([]uint64, newLen)
+		top := ce.stackBasePointer + ce.stackPointer
+		copy(newStack[:top], ce.stack[:top])
+		ce.stack = newStack
 	}
 	// TODO: maybe better think about how to shrink the stack as well.
 }
 
+// newHostCallFrame returns the call frame for the host function f, reusing the one in freeHostCallFrames if exists.
+func (ce *callEngine) newHostCallFrame(f *compiledFunction) (frame *callFrame) {
+	if l := len(ce.freeHostCallFrames); l > 0 {
+		frame = ce.freeHostCallFrames[l-1]
+		ce.freeHostCallFrames = ce.freeHostCallFrames[:l-1]
+		*frame = callFrame{compiledFunction: f}
+	} else {
+		frame = &callFrame{compiledFunction: f}
+	}
+	return
+}
+
+// execAnyHostFunction executes the host function f with the parameters on the top of the stack
+// where caller is the module instance of the caller, or that of f if called directly.
+func (ce *callEngine) execAnyHostFunction(f *compiledFunction, caller *wasm.ModuleInstance) {
+	hostCallContext := wasm.HostFunctionCallContext{
+		Memory:       caller.Memory,
+		Module:       caller,
+		Context:      ce.ctx,
+		UserValue:    f.source.ModuleInstance.UserValue,
+		NestedCaller: ce,
+	}
+	if f.interpreted != nil {
+		ce.execRawHostFunction(f, f.interpreted, hostCallContext)
+	} else if f.source.RawHostFunction != nil {
+		ce.execRawHostFunction(f, f.source.RawHostFunction, hostCallContext)
+	} else {
+		// Copy the context so that hostCallContext doesn't escape in the case of raw host functions.
+		ctx := hostCallContext
+		ce.execHostFunction(f.source.HostFunction, &ctx)
+	}
+}
+
+// execInterpretedFunction executes f with interpreted, which is returned by compiledFunction.ensureCompiled when
+// the lazy compilation falls back to the interpreter, in the same way as the interpreted functions.
+func (ce *callEngine) execInterpretedFunction(f *compiledFunction, interpreted wasm.RawHostFunction, caller *wasm.ModuleInstance) {
+	callee := ce.newHostCallFrame(f)
+	ce.callFramePush(callee)
+	ce.execRawHostFunction(f, interpreted, wasm.HostFunctionCallContext{
+		Memory:       caller.Memory,
+		Module:       caller,
+		Context:      ce.ctx,
+		NestedCaller: ce,
+	})
+	ce.callFramePop()
+	ce.freeHostCallFrames = append(ce.freeHostCallFrames, callee)
+}
+
+// execRawHostFunction executes the raw host function fn of f directly on the stack without reflection
+// nor allocations. The parameters on the top of the stack are replaced with the results.
+func (ce *callEngine) execRawHostFunction(f *compiledFunction, fn wasm.RawHostFunction, hostCallContext wasm.HostFunctionCallContext) {
+	size := f.paramCount
+	if f.resultCount > size {
+		size = f.resultCount
+	}
+	bottom := ce.stackPointer - f.paramCount
+	ce.maybeGrowStack(bottom + size)
+
+	// The context is restored after the call in case that this is a nested host function call.
+	saved := ce.hostCallContext
+	ce.hostCallContext = hostCallContext
+	start := ce.stackBasePointer + bottom
+	stack := ce.stack[start : start+size]
+	// The slots are reserved so that the calls made by the host function via HostFunctionCallContext.Call
+	// are placed above them.
+	ce.stackPointer = bottom + size
+	fn(&ce.hostCallContext, stack)
+	// Such calls might have grown the stack, so the values are copied back in case stack is the old one.
+	copy(ce.stack[start:start+size], stack)
+	ce.hostCallContext = saved
+
+	ce.stackPointer = bottom + f.resultCount
+}
+
 // execHostFunction executes the given host function represented as *reflect.Value.
 //
 // The arguments to the function are popped from the stack stack following the convension of
@@ -368,9 +907,10 @@ func (e *engine) maybeGrowStack(maxStackPointer uint64) {
 // as uint32 and float32 respectively.
 //
 // After the execution, the result of host function is pushed onto the stack.
+// If the host function returns a non-nil error as the last result, this panics with the error.
 //
 // ctx parameter is passed to the host function as a first argument.
-func (e *engine) execHostFunction(f *reflect.Value, ctx *wasm.HostFunctionCallContext) {
+func (ce *callEngine) execHostFunction(f *reflect.Value, ctx *wasm.HostFunctionCallContext) {
 	tp := f.Type()
 	in := make([]reflect.Value, tp.NumIn())
 
@@ -378,7 +918,7 @@ func (e *engine) execHostFunction(f *reflect.Value, ctx *wasm.HostFunctionCallCo
 	// stack machine convension.
 	for i := len(in) - 1; i >= 1; i-- {
 		val := reflect.New(tp.In(i)).Elem()
-		raw := e.pop()
+		raw := ce.pop()
 		kind := tp.In(i).Kind()
 		switch kind {
 		case reflect.Float64, reflect.Float32:
@@ -400,82 +940,99 @@ func (e *engine) execHostFunction(f *reflect.Value, ctx *wasm.HostFunctionCallCo
 	for _, ret := range f.Call(in) {
 		switch ret.Kind() {
 		case reflect.Float64, reflect.Float32:
-			e.push(math.Float64bits(ret.Float()))
+			ce.push(math.Float64bits(ret.Float()))
 		case reflect.Uint32, reflect.Uint64:
-			e.push(ret.Uint())
+			ce.push(ret.Uint())
 		case reflect.Int32, reflect.Int64:
-			e.push(uint64(ret.Int()))
+			ce.push(uint64(ret.Int()))
+		case reflect.Interface:
+			// This is the trailing error result, and a non-nil error traps.
+			if !ret.IsNil() {
+				panic(ret.Interface().(error))
+			}
 		default:
 			panic("invalid return type")
 		}
 	}
 }
 
-func (e *engine) execFunction(f *compiledFunction) {
-	previousTopFrame := e.callFrameStack
+func (ce *callEngine) execFunction(f *compiledFunction) {
+	previousTopFrame := ce.callFrameStack
+	if interpreted := f.ensureCompiled(); interpreted != nil {
+		ce.execInterpretedFunction(f, interpreted, f.source.ModuleInstance)
+		return
+	}
 
 	// Push a new call frame for the target function.
-	e.callFramePush(&callFrame{continuationAddress: f.codeInitialAddress, compiledFunction: f})
+	ce.callFramePush(&callFrame{continuationAddress: f.codeInitialAddress, compiledFunction: f})
 
 	// If the Go-allocated stack is running out, we grow it before calling into JITed code.
-	e.maybeGrowStack(f.maxStackPointer)
+	ce.maybeGrowStack(f.maxStackPointer)
 
 	// We continuously execute functions until we reach the previous top frame which is either
 	// nil if this is the initial call into Wasm, or the host function frame if this is the
 	// recursive function call.
-	for e.callFrameStack != previousTopFrame {
-		currentFrame := e.callFrameStack
+	for ce.callFrameStack != previousTopFrame {
+		currentFrame := ce.callFrameStack
 		if buildoptions.IsDebugMode {
 			fmt.Printf("callframe=%s (at %d), stackBasePointer: %d, stackPointer: %d\n",
-				currentFrame.String(), e.callFrameNum, e.stackBasePointer, e.stackPointer)
+				currentFrame.String(), ce.callFrameNum, ce.stackBasePointer, ce.stackPointer)
 		}
 
 		// Call into the jitted code.
 		jitcall(
 			currentFrame.continuationAddress,
-			uintptr(unsafe.Pointer(e)),
-			e.memorySliceAddress,
+			uintptr(unsafe.Pointer(ce)),
+			ce.memorySliceAddress,
 		)
 
+		// JITed code sets continuationAddressOffset on function calls and traps, and we calculate the continuation
+		// address so we can resume this caller function frame, or find the trapping instruction in runtimeError.
+		currentFrame.continuationAddress = currentFrame.compiledFunction.codeInitialAddress + ce.continuationAddressOffset
+
 		// Check the status code from JIT code.
-		switch e.jitCallStatusCode {
+		switch ce.jitCallStatusCode {
 		case jitCallStatusCodeReturned:
 			// Meaning that the current frame exits
 			// so restore the caller's frame.
-			e.callFramePop()
+			ce.callFramePop()
 		case jitCallStatusCodeCallFunction:
 			// We consolidate host function calls with normal wasm function calls.
 			// This reduced the cost of checking isHost in the assembly as well as
 			// the cost of doing fully native function calls between wasm functions we will do later.
-			nextFunc := e.compiledFunctions[e.functionCallAddress]
-			// Calculate the continuation address so we can resume this caller function frame.
-			currentFrame.continuationAddress = currentFrame.compiledFunction.codeInitialAddress + e.continuationAddressOffset
-			currentFrame.continuationStackPointer = e.stackPointer + nextFunc.resultCount - nextFunc.paramCount
+			// The address is resolved in the store of the caller, since the engine might be shared by stores.
+			caller := currentFrame.compiledFunction.source.ModuleInstance
+			nextFunc, _ := ce.engine.getCompiledFunction(caller.FunctionByAddress(ce.functionCallAddress))
+			currentFrame.continuationStackPointer = ce.stackPointer + nextFunc.resultCount - nextFunc.paramCount
 
-			callee := &callFrame{compiledFunction: nextFunc}
 			if nextFunc.isHostFunction() {
-				e.callFramePush(callee)
-				e.execHostFunction(nextFunc.source.HostFunction, &wasm.HostFunctionCallContext{Memory: currentFrame.compiledFunction.source.ModuleInstance.Memory})
-				e.callFramePop()
+				callee := ce.newHostCallFrame(nextFunc)
+				ce.callFramePush(callee)
+				ce.execAnyHostFunction(nextFunc, currentFrame.compiledFunction.source.ModuleInstance)
+				ce.callFramePop()
+				ce.freeHostCallFrames = append(ce.freeHostCallFrames, callee)
+			} else if interpreted := nextFunc.ensureCompiled(); interpreted != nil {
+				ce.execInterpretedFunction(nextFunc, interpreted, currentFrame.compiledFunction.source.ModuleInstance)
 			} else {
-				callee.continuationAddress = nextFunc.codeInitialAddress
-				e.callFramePush(callee)
+				callee := &callFrame{continuationAddress: nextFunc.codeInitialAddress, compiledFunction: nextFunc}
+				ce.callFramePush(callee)
 				// If the Go-allocated stack is running out, we grow it before calling into JITed code.
-				e.maybeGrowStack(nextFunc.maxStackPointer)
+				ce.maybeGrowStack(nextFunc.maxStackPointer)
 			}
 		case jitCallStatusCodeCallBuiltInFunction:
-			switch e.functionCallAddress {
+			switch ce.functionCallAddress {
 			case builtinFunctionAddressMemoryGrow:
-				e.builtinFunctionMemoryGrow(currentFrame.compiledFunction.source.ModuleInstance.Memory)
+				ce.builtinFunctionMemoryGrow(currentFrame.compiledFunction.source.ModuleInstance.Memory)
 			case builtinFunctionAddressMemorySize:
-				e.builtinFunctionMemorySize(currentFrame.compiledFunction.source.ModuleInstance.Memory)
+				ce.builtinFunctionMemorySize(currentFrame.compiledFunction.source.ModuleInstance.Memory)
+			case builtinFunctionAddressCheckCallCanceled:
+				ce.builtinFunctionCheckCallCanceled()
 			}
 			if buildoptions.IsDebugMode {
-				if e.functionCallAddress == builtinFunctionAddressBreakPoint {
+				if ce.functionCallAddress == builtinFunctionAddressBreakPoint {
 					runtime.Breakpoint()
 				}
 			}
-			currentFrame.continuationAddress = currentFrame.compiledFunction.codeInitialAddress + e.continuationAddressOffset
 		case jitCallStatusIntegerOverflow:
 			panic(wasm.ErrRuntimeIntegerOverflow)
 		case jitCallStatusIntegerDivisionByZero:
@@ -490,33 +1047,38 @@ func (e *engine) execFunction(f *compiledFunction) {
 			panic(wasm.ErrRuntimeInvalidTableAcces)
 		case jitCallStatusCodeTypeMismatchOnIndirectCall:
 			panic(wasm.ErrRuntimeIndirectCallTypeMismatch)
+		case jitCallStatusCodeOutOfFuel:
+			ce.fuel = 0
+			panic(wasm.ErrRuntimeOutOfFuel)
 		}
 	}
 }
 
-func (e *engine) builtinFunctionMemoryGrow(mem *wasm.MemoryInstance) {
-	newPages := e.pop()
-	max := uint64(math.MaxUint32)
-	if mem.Max != nil {
-		max = uint64(*mem.Max) * wasm.PageSize
-	}
+func (ce *callEngine) builtinFunctionMemoryGrow(mem *wasm.MemoryInstance) {
+	newPages := ce.pop()
 	// If exceeds the max of memory size, we push -1 according to the spec.
-	if uint64(newPages*wasm.PageSize+uint64(len(mem.Buffer))) > max {
+	if previousPages, ok := mem.Grow(uint32(newPages)); !ok {
 		v := int32(-1)
-		e.push(uint64(v))
+		ce.push(uint64(v))
 	} else {
-		e.builtinFunctionMemorySize(mem) // Grow returns the prior memory size on change.
-		mem.Buffer = append(mem.Buffer, make([]byte, newPages*wasm.PageSize)...)
-		e.memorySliceLen = uint64(len(mem.Buffer))
+		ce.push(uint64(previousPages)) // Grow returns the prior memory size on change.
+		ce.memorySliceLen = uint64(len(mem.Buffer))
 	}
 }
 
-func (e *engine) builtinFunctionMemorySize(mem *wasm.MemoryInstance) {
-	e.push(uint64(len(mem.Buffer)) / wasm.PageSize)
+func (ce *callEngine) builtinFunctionMemorySize(mem *wasm.MemoryInstance) {
+	ce.push(uint64(len(mem.Buffer)) / wasm.PageSize)
+}
+
+func (ce *callEngine) builtinFunctionCheckCallCanceled() {
+	ce.callCanceledCheckCountdown = callCanceledCheckInterval
+	if ce.ctx != nil && ce.ctx.Err() != nil {
+		panic(callCanceledError(ce.ctx))
+	}
 }
 
-func (e *engine) compileWasmFunction(f *wasm.FunctionInstance) (*compiledFunction, error) {
-	ir, err := wazeroir.Compile(f)
+func compileWasmFunction(f *wasm.FunctionInstance, config *wasm.RuntimeConfig) (*compiledCode, error) {
+	ir, err := wazeroir.CompileWithConfig(f, config)
 	if err != nil {
 		return nil, fmt.Errorf("failed to lower to wazeroir: %w", err)
 	}
@@ -525,20 +1087,24 @@ func (e *engine) compileWasmFunction(f *wasm.FunctionInstance) (*compiledFunctio
 		fmt.Printf("compilation target wazeroir:\n%s\n", wazeroir.Format(ir.Operations))
 	}
 
-	compiler, err := newCompiler(e, f, ir)
+	compiler, err := newCompiler(f, ir)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize assembly builder: %w", err)
 	}
 
-	compiler.emitPreamble()
+	if err := compiler.emitPreamble(); err != nil {
+		return nil, fmt.Errorf("failed to emit preamble: %w", err)
+	}
 
 	var skip bool
-	for _, op := range ir.Operations {
+	for i, op := range ir.Operations {
 		// Compiler determines whether or not skip the entire label.
 		// For example, if the label doesn't have any caller,
 		// we don't need to generate native code at all as we never reach the region.
 		if op.Kind() == wazeroir.OperationKindLabel {
-			skip = compiler.compileLabel(op.(*wazeroir.OperationLabel))
+			if skip, err = compiler.compileLabel(op.(*wazeroir.OperationLabel)); err != nil {
+				return nil, fmt.Errorf("failed to compile label: %w", err)
+			}
 		}
 		if skip {
 			continue
@@ -547,6 +1113,7 @@ func (e *engine) compileWasmFunction(f *wasm.FunctionInstance) (*compiledFunctio
 		if buildoptions.IsDebugMode {
 			fmt.Printf("compiling op=%s: %s\n", op.Kind(), compiler)
 		}
+		compiler.setSourceOffset(ir.SourceOffsets[i])
 		var err error
 		switch o := op.(type) {
 		case *wazeroir.OperationUnreachable:
@@ -700,14 +1267,12 @@ func (e *engine) compileWasmFunction(f *wasm.FunctionInstance) (*compiledFunctio
 		fmt.Printf("compiled code in hex: %s\n", hex.EncodeToString(code))
 	}
 
-	cf := &compiledFunction{
-		source:             f,
+	return &compiledCode{
+		refCount:           1,
 		codeSegment:        code,
 		codeInitialAddress: uintptr(unsafe.Pointer(&code[0])),
-		paramCount:         uint64(len(f.FunctionType.Type.Params)),
-		resultCount:        uint64(len(f.FunctionType.Type.Results)),
 		maxStackPointer:    maxStackPointer,
 		staticData:         staticData,
-	}
-	return cf, nil
+		sourceOffsetMap:    compiler.sourceOffsetMap(),
+	}, nil
 }
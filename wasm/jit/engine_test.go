@@ -1,6 +1,10 @@
 package jit
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"os"
 	"reflect"
 	"sync"
@@ -16,17 +20,21 @@ import (
 
 // Ensures that the offset consts do not drift when we manipulate the engine struct.
 func TestEngine_veifyOffsetValue(t *testing.T) {
-	require.Equal(t, int(unsafe.Offsetof((&engine{}).stack)), engineStackSliceOffset)
-	require.Equal(t, int(unsafe.Offsetof((&engine{}).stackPointer)), enginestackPointerOffset)
-	require.Equal(t, int(unsafe.Offsetof((&engine{}).stackBasePointer)), enginestackBasePointerOffset)
-	require.Equal(t, int(unsafe.Offsetof((&engine{}).jitCallStatusCode)), engineJITCallStatusCodeOffset)
-	require.Equal(t, int(unsafe.Offsetof((&engine{}).functionCallAddress)), engineFunctionCallAddressOffset)
-	require.Equal(t, int(unsafe.Offsetof((&engine{}).continuationAddressOffset)), engineContinuationAddressOffset)
-	require.Equal(t, int(unsafe.Offsetof((&engine{}).globalSliceAddress)), engineglobalSliceAddressOffset)
-	require.Equal(t, int(unsafe.Offsetof((&engine{}).memorySliceAddress)), engineMemorySliceAddressOffset)
-	require.Equal(t, int(unsafe.Offsetof((&engine{}).memorySliceLen)), engineMemorySliceLenOffset)
-	require.Equal(t, int(unsafe.Offsetof((&engine{}).tableSliceAddress)), engineTableSliceAddressOffset)
-	require.Equal(t, int(unsafe.Offsetof((&engine{}).tableSliceLen)), engineTableSliceLenOffset)
+	require.Equal(t, int(unsafe.Offsetof((&callEngine{}).stack)), callEngineStackSliceOffset)
+	require.Equal(t, int(unsafe.Offsetof((&callEngine{}).stackPointer)), callEnginestackPointerOffset)
+	require.Equal(t, int(unsafe.Offsetof((&callEngine{}).stackBasePointer)), callEnginestackBasePointerOffset)
+	require.Equal(t, int(unsafe.Offsetof((&callEngine{}).jitCallStatusCode)), callEngineJITCallStatusCodeOffset)
+	require.Equal(t, int(unsafe.Offsetof((&callEngine{}).functionCallAddress)), callEngineFunctionCallAddressOffset)
+	require.Equal(t, int(unsafe.Offsetof((&callEngine{}).continuationAddressOffset)), callEngineContinuationAddressOffset)
+	require.Equal(t, int(unsafe.Offsetof((&callEngine{}).globalSliceAddress)), callEngineglobalSliceAddressOffset)
+	require.Equal(t, int(unsafe.Offsetof((&callEngine{}).memorySliceAddress)), callEngineMemorySliceAddressOffset)
+	require.Equal(t, int(unsafe.Offsetof((&callEngine{}).memorySliceLen)), callEngineMemorySliceLenOffset)
+	require.Equal(t, int(unsafe.Offsetof((&callEngine{}).tableSliceAddress)), callEngineTableSliceAddressOffset)
+	require.Equal(t, int(unsafe.Offsetof((&callEngine{}).tableSliceLen)), callEngineTableSliceLenOffset)
+	require.Equal(t, int(unsafe.Offsetof((&callEngine{}).callCanceledCheckCountdown)), callEngineCallCanceledCheckCountdownOffset)
+	require.Equal(t, int(unsafe.Offsetof((&callEngine{}).fuel)), callEngineFuelOffset)
+	require.Equal(t, int(unsafe.Offsetof((&callEngine{}).functionsSliceAddress)), callEngineFunctionsSliceAddressOffset)
+	require.Equal(t, int(unsafe.Offsetof((&callEngine{}).typesSliceAddress)), callEngineTypesSliceAddressOffset)
 }
 
 func Test_Simple(t *testing.T) {
@@ -47,7 +55,7 @@ func Test_Simple(t *testing.T) {
 	require.NoError(t, store.AddHostFunction("", "hello", reflect.ValueOf(hostFunction)))
 
 	memoryInstance := &wasm.MemoryInstance{Buffer: make([]byte, len(msg))}
-	engine.compiledFunctions[0].source.ModuleInstance.Memory = memoryInstance
+	engine.compiledFunctions[store.Functions[0]].source.ModuleInstance.Memory = memoryInstance
 
 	moduleName := "simple"
 	require.NoError(t, store.Instantiate(mod, moduleName))
@@ -72,8 +80,7 @@ func TestEngine_fibonacci(t *testing.T) {
 		go func() {
 			defer wg.Done()
 			store := wasm.NewStore(NewEngine())
-			require.NoError(t, err)
-			err = store.Instantiate(mod, "test")
+			err := store.Instantiate(mod, "test")
 			require.NoError(t, err)
 			out, _, err := store.CallFunction("test", "fib", 20)
 			require.NoError(t, err)
@@ -122,8 +129,10 @@ func TestEngine_unreachable(t *testing.T) {
 	const moduleName = "test"
 
 	callUnreachable := func(ctx *wasm.HostFunctionCallContext) {
+		// The nested call is made with its own stack, so the error is returned to the host function.
 		_, _, err := store.CallFunction(moduleName, "unreachable_func")
-		require.NoError(t, err)
+		require.Error(t, err)
+		panic(err)
 	}
 	err = store.AddHostFunction("host", "cause_unreachable", reflect.ValueOf(callUnreachable))
 	require.NoError(t, err)
@@ -132,14 +141,15 @@ func TestEngine_unreachable(t *testing.T) {
 	require.NoError(t, err)
 
 	_, _, err = store.CallFunction(moduleName, "main")
-	exp := `wasm runtime error: unreachable
+	exp := `wasm runtime error: wasm runtime error: unreachable
 wasm backtrace:
 	0: unreachable_func
-	1: host.cause_unreachable
-	2: two
-	3: one
-	4: main`
-	require.Error(t, err)
+wasm backtrace:
+	0: host.cause_unreachable
+	1: two
+	2: one
+	3: main`
+	require.ErrorIs(t, err, wasm.ErrRuntimeUnreachable)
 	require.Equal(t, exp, err.Error())
 }
 
@@ -197,7 +207,7 @@ func TestEngine_RecursiveEntry(t *testing.T) {
 
 func TestEngine_maybeGrowStack(t *testing.T) {
 	t.Run("grow", func(t *testing.T) {
-		eng := &engine{stack: make([]uint64, 10)}
+		eng := &callEngine{stack: make([]uint64, 10), engine: newEngine()}
 		eng.stackBasePointer = 5
 		eng.push(10)
 		require.Equal(t, uint64(1), eng.stackPointer)
@@ -213,7 +223,7 @@ func TestEngine_maybeGrowStack(t *testing.T) {
 		require.Equal(t, uint64(10), eng.stack[eng.stackBasePointer+eng.stackPointer-1])
 	})
 	t.Run("noop", func(t *testing.T) {
-		eng := &engine{stack: make([]uint64, 10)}
+		eng := &callEngine{stack: make([]uint64, 10), engine: newEngine()}
 		eng.stackBasePointer = 1
 		eng.push(10)
 		require.Equal(t, uint64(1), eng.stackPointer)
@@ -226,4 +236,230 @@ func TestEngine_maybeGrowStack(t *testing.T) {
 		require.Equal(t, uint64(1), eng.stackPointer)
 		require.Equal(t, uint64(10), eng.stack[eng.stackBasePointer+eng.stackPointer-1])
 	})
+	t.Run("limit", func(t *testing.T) {
+		eng := &callEngine{stack: make([]uint64, 10), engine: newEngineWithConfig(&wasm.RuntimeConfig{MaxOperandStackSize: 101})}
+		eng.stackBasePointer = 5
+		eng.maybeGrowStack(96)
+		// The stack grows only up to the limit instead of 10*2+96.
+		require.Len(t, eng.stack, 101)
+		require.PanicsWithValue(t, wasm.ErrRuntimeCallStackOverflow, func() { eng.maybeGrowStack(97) })
+	})
+}
+
+func TestEngine_CloseModule(t *testing.T) {
+	i32 := wasm.ValueTypeI32
+	sig := &wasm.FunctionType{Params: []wasm.ValueType{i32}, Results: []wasm.ValueType{i32}}
+	// (func (export "inc") (param i32) (result i32) (i32.add (local.get 0) (i32.const 1)))
+	mod := &wasm.Module{
+		TypeSection:     []*wasm.FunctionType{sig},
+		FunctionSection: []wasm.Index{0},
+		CodeSection: []*wasm.Code{
+			{Body: []byte{wasm.OpcodeLocalGet, 0x00, wasm.OpcodeI32Const, 0x01, wasm.OpcodeI32Add, wasm.OpcodeEnd}},
+		},
+		ExportSection: map[string]*wasm.Export{"inc": {Name: "inc", Kind: wasm.ExportKindFunc, Index: 0}},
+	}
+	// (func (export "inc") (import "a" "inc") (param i32) (result i32))
+	importing := &wasm.Module{
+		TypeSection:   []*wasm.FunctionType{sig},
+		ImportSection: []*wasm.Import{{Kind: wasm.ImportKindFunc, Module: "a", Name: "inc", DescFunc: 0}},
+		ExportSection: map[string]*wasm.Export{"inc": {Name: "inc", Kind: wasm.ExportKindFunc, Index: 0}},
+	}
+
+	e := newEngine()
+	store := wasm.NewStore(e)
+	compiled, err := store.CompileModule(mod)
+	require.NoError(t, err)
+	require.NoError(t, store.InstantiateCompiled(compiled, "a"))
+	require.NoError(t, store.InstantiateCompiled(compiled, "b"))
+	require.NoError(t, store.Instantiate(importing, "c"))
+	require.NoError(t, compiled.Close())
+	require.Len(t, e.compiledFunctions, 2)
+
+	code := e.compiledFunctions[store.Functions[0]].compiledCode
+	require.Equal(t, int64(2), code.refCount)
+
+	// The compiled code is still used by "a" after "b" is closed.
+	require.NoError(t, store.CloseModule("b"))
+	require.Equal(t, int64(1), code.refCount)
+	require.NotNil(t, code.codeSegment)
+
+	// Closing "c" makes "a" closable, and then the native code is unmapped.
+	require.NoError(t, store.CloseModule("c"))
+	require.NoError(t, store.CloseModule("a"))
+	require.Equal(t, int64(0), code.refCount)
+	require.Nil(t, code.codeSegment)
+	require.Empty(t, e.compiledFunctions)
+
+	require.NoError(t, store.Close())
+	require.Empty(t, e.compiledFunctions)
+}
+
+func TestEngine_LazyCompilation_CompiledCode(t *testing.T) {
+	i32 := wasm.ValueTypeI32
+	mod := &wasm.Module{
+		TypeSection:     []*wasm.FunctionType{{Results: []wasm.ValueType{i32}}},
+		FunctionSection: []wasm.Index{0},
+		CodeSection:     []*wasm.Code{{Body: []byte{wasm.OpcodeI32Const, 0x01, wasm.OpcodeEnd}}},
+		ExportSection:   map[string]*wasm.Export{"one": {Name: "one", Kind: wasm.ExportKindFunc, Index: 0}},
+	}
+
+	e := newEngineWithConfig(&wasm.RuntimeConfig{LazyCompilation: true})
+	store := wasm.NewStore(e)
+	require.NoError(t, store.Instantiate(mod, "test"))
+	cf, ok := e.getCompiledFunction(store.ModuleInstances["test"].Exports["one"].Function)
+	require.True(t, ok)
+
+	// Not compiled until the first call.
+	require.Nil(t, cf.codeSegment)
+
+	results, _, err := store.CallFunction("test", "one")
+	require.NoError(t, err)
+	require.Equal(t, []uint64{1}, results)
+	require.NotNil(t, cf.codeSegment)
+	require.Equal(t, uintptr(unsafe.Pointer(&cf.codeSegment[0])), cf.codeInitialAddress)
+
+	// The code is unmapped on the release.
+	require.NoError(t, store.CloseModule("test"))
+	require.Nil(t, cf.codeSegment)
+
+	// The code never compiled is also released.
+	require.NoError(t, store.Instantiate(mod, "test"))
+	require.NoError(t, store.CloseModule("test"))
+}
+
+func TestEngine_Fallback(t *testing.T) {
+	i32 := wasm.ValueTypeI32
+	// (if (i32.eqz (local.get 0)) (then (return (i32.const 100)))) (i32.add (call_indirect (type 0) (i32.sub (local.get 0) (i32.const 1)) (i32.const 0)) (i32.const 1))
+	jitBody := []byte{
+		wasm.OpcodeLocalGet, 0x00, wasm.OpcodeI32Eqz, wasm.OpcodeIf, 0x40, wasm.OpcodeI32Const, 0xe4, 0x00, wasm.OpcodeReturn, wasm.OpcodeEnd,
+		wasm.OpcodeLocalGet, 0x00, wasm.OpcodeI32Const, 0x01, wasm.OpcodeI32Sub, wasm.OpcodeI32Const, 0x00, wasm.OpcodeCallIndirect, 0x00, 0x00,
+		wasm.OpcodeI32Const, 0x01, wasm.OpcodeI32Add, wasm.OpcodeEnd,
+	}
+	// (if (i32.eqz (local.get 0)) (then (unreachable))) (i32.add (call 0 (i32.sub (local.get 0) (i32.const 1))) (i32.const 1))
+	interpretedBody := []byte{
+		wasm.OpcodeLocalGet, 0x00, wasm.OpcodeI32Eqz, wasm.OpcodeIf, 0x40, wasm.OpcodeUnreachable, wasm.OpcodeEnd,
+		wasm.OpcodeLocalGet, 0x00, wasm.OpcodeI32Const, 0x01, wasm.OpcodeI32Sub, wasm.OpcodeCall, 0x00,
+		wasm.OpcodeI32Const, 0x01, wasm.OpcodeI32Add, wasm.OpcodeEnd,
+	}
+	m := &wasm.Module{
+		TypeSection:     []*wasm.FunctionType{{Params: []wasm.ValueType{i32}, Results: []wasm.ValueType{i32}}},
+		FunctionSection: []wasm.Index{0, 0},
+		CodeSection:     []*wasm.Code{{Body: jitBody}, {Body: interpretedBody}},
+		TableSection:    []*wasm.TableType{{ElemType: 0x70, Limit: &wasm.LimitsType{Min: 1}}},
+		ElementSection: []*wasm.ElementSegment{
+			{OffsetExpr: &wasm.ConstantExpression{Opcode: wasm.OpcodeI32Const, Data: []byte{0x00}}, Init: []uint32{1}},
+		},
+		ExportSection: map[string]*wasm.Export{
+			"jit":         {Name: "jit", Kind: wasm.ExportKindFunc, Index: 0},
+			"interpreted": {Name: "interpreted", Kind: wasm.ExportKindFunc, Index: 1},
+		},
+	}
+
+	const maxCallStackDepth = 10
+	for _, lazy := range []bool{false, true} {
+		lazy := lazy
+		t.Run(fmt.Sprintf("lazy=%v", lazy), func(t *testing.T) {
+			e := newEngineWithConfig(&wasm.RuntimeConfig{MaxCallStackDepth: maxCallStackDepth, LazyCompilation: lazy})
+			// Emulates the failure of JIT on interpretedBody.
+			e.compileWasmFunction = func(f *wasm.FunctionInstance, config *wasm.RuntimeConfig) (*compiledCode, error) {
+				if bytes.Equal(f.Body, interpretedBody) {
+					return nil, errors.New("unsupported")
+				}
+				return compileWasmFunction(f, config)
+			}
+			store := wasm.NewStore(e)
+			require.NoError(t, store.Instantiate(m, "test"))
+			jitFunc := store.ModuleInstances["test"].Exports["jit"].Function
+			interpretedFunc := store.ModuleInstances["test"].Exports["interpreted"].Function
+			cf, ok := e.getCompiledFunction(jitFunc)
+			require.True(t, ok)
+			require.NotNil(t, cf.compiledCode)
+			cf, ok = e.getCompiledFunction(interpretedFunc)
+			require.True(t, ok)
+			if lazy {
+				// Falls back to the interpreter on the first call.
+				require.Nil(t, cf.interpreted)
+				require.NotNil(t, cf.lazy)
+			} else {
+				require.NotNil(t, cf.interpreted)
+			}
+
+			for _, tc := range []struct {
+				name   string
+				param  uint64
+				frames []wasm.Index
+			}{
+				{name: "jit", param: 4},
+				{name: "jit", param: 3, frames: []wasm.Index{1, 0, 1, 0}},
+				{name: "interpreted", param: 3},
+				{name: "interpreted", param: 4, frames: []wasm.Index{1, 0, 1, 0, 1}},
+			} {
+				tc := tc
+				t.Run(fmt.Sprintf("%s(%d)", tc.name, tc.param), func(t *testing.T) {
+					results, _, err := store.CallFunction("test", tc.name, tc.param)
+					if tc.frames == nil {
+						require.NoError(t, err)
+						require.Equal(t, []uint64{100 + tc.param}, results)
+						return
+					}
+					require.ErrorIs(t, err, wasm.ErrRuntimeUnreachable)
+					var runtimeErr *wasm.RuntimeError
+					require.ErrorAs(t, err, &runtimeErr)
+					var frames []wasm.Index
+					for _, frame := range runtimeErr.Frames {
+						require.False(t, frame.IsHost)
+						frames = append(frames, frame.FunctionIndex)
+					}
+					require.Equal(t, tc.frames, frames)
+				})
+			}
+
+			if lazy {
+				require.NotNil(t, cf.lazy.interpreted)
+				require.Nil(t, cf.codeSegment)
+			}
+
+			t.Run("call stack depth", func(t *testing.T) {
+				// The frames of both engines count towards the same limit.
+				for _, tc := range []struct {
+					name  string
+					param uint64
+				}{{name: "jit", param: maxCallStackDepth - 2}, {name: "interpreted", param: maxCallStackDepth - 1}} {
+					results, _, err := store.CallFunction("test", tc.name, tc.param)
+					require.NoError(t, err)
+					require.Equal(t, []uint64{100 + tc.param}, results)
+					_, _, err = store.CallFunction("test", tc.name, tc.param+2)
+					require.ErrorIs(t, err, wasm.ErrRuntimeCallStackOverflow)
+				}
+			})
+
+			t.Run("fuel", func(t *testing.T) {
+				// The fuel consumed by the interpreted functions is metered as if they are JITed.
+				jitStore := wasm.NewStore(newEngineWithConfig(&wasm.RuntimeConfig{MaxCallStackDepth: maxCallStackDepth}))
+				require.NoError(t, jitStore.Instantiate(m, "test"))
+				expected := &wasm.Fuel{Remaining: 10000}
+				_, _, err := jitStore.CallFunctionContext(wasm.WithFuel(context.Background(), expected), "test", "jit", 8)
+				require.NoError(t, err)
+				consumed := 10000 - expected.Remaining
+
+				fuel := &wasm.Fuel{Remaining: 10000}
+				_, _, err = store.CallFunctionContext(wasm.WithFuel(context.Background(), fuel), "test", "jit", 8)
+				require.NoError(t, err)
+				require.Equal(t, expected.Remaining, fuel.Remaining)
+
+				fuel = &wasm.Fuel{Remaining: consumed - 1}
+				_, _, err = store.CallFunctionContext(wasm.WithFuel(context.Background(), fuel), "test", "jit", 8)
+				require.ErrorIs(t, err, wasm.ErrRuntimeOutOfFuel)
+				require.Equal(t, uint64(0), fuel.Remaining)
+			})
+
+			require.NoError(t, store.CloseModule("test"))
+			for _, f := range []*wasm.FunctionInstance{jitFunc, interpretedFunc} {
+				_, ok := e.getCompiledFunction(f)
+				require.False(t, ok)
+				_, err := e.fallback.Call(context.Background(), f)
+				require.EqualError(t, err, "function not compiled")
+			}
+		})
+	}
 }
@@ -0,0 +1,70 @@
+package jit
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/tetratelabs/wazero/wasm"
+)
+
+// interpretedCode is the result of engine.Compile for the functions which JIT fails to compile,
+// and holds the result of the compilation by the fallback interpreter.
+type interpretedCode struct {
+	compiled wasm.CompiledFunction
+}
+
+// crossEngineCall returns the wasm.RawHostFunction which calls the function f with the engine, so that
+// the functions executed by one of JIT and the fallback interpreter can call the ones executed by the other.
+// The call continues the one of the caller via wasm.ForeignCaller, so the whole call shares the fuel and
+// the limit of the call stack depth.
+func crossEngineCall(engine wasm.StateCaller, f *wasm.FunctionInstance) wasm.RawHostFunction {
+	paramCount, resultCount := len(f.FunctionType.Type.Params), len(f.FunctionType.Type.Results)
+	return func(ctx *wasm.HostFunctionCallContext, stack []uint64) {
+		caller, ok := ctx.NestedCaller.(wasm.ForeignCaller)
+		if !ok {
+			panic(fmt.Errorf("%T can't call functions with another engine", ctx.NestedCaller))
+		}
+		if err := caller.CallForeign(engine, f, stack[:resultCount], stack[:paramCount]); err != nil {
+			panic(&engineBoundaryError{err: err})
+		}
+	}
+}
+
+// engineBoundaryError is the error of the call made by crossEngineCall. This is the cause of the trap in
+// the calling engine, and joinBacktrace merges the backtraces of both.
+type engineBoundaryError struct {
+	err error
+}
+
+func (e *engineBoundaryError) Error() string {
+	return e.err.Error()
+}
+
+func (e *engineBoundaryError) Unwrap() error {
+	return e.err
+}
+
+// joinBacktrace returns the wasm.RuntimeError of err whose backtrace includes the frames of the calls across
+// the engines. The top frame of the caller is the one of the callee called as a host function, so this is
+// replaced with the frames of the callee.
+func joinBacktrace(err error) error {
+	var outer *wasm.RuntimeError
+	if !errors.As(err, &outer) {
+		return err
+	}
+	boundary, ok := outer.Cause.(*engineBoundaryError)
+	if !ok {
+		return err
+	}
+	joined := joinBacktrace(boundary.err)
+	var inner *wasm.RuntimeError
+	if !errors.As(joined, &inner) {
+		return &wasm.RuntimeError{Cause: joined, Frames: outer.Frames}
+	}
+	frames := make([]wasm.Frame, 0, len(inner.Frames)+len(outer.Frames))
+	frames = append(frames, inner.Frames...)
+	if len(outer.Frames) > 0 {
+		frames = append(frames, outer.Frames[1:]...)
+	}
+	return &wasm.RuntimeError{Cause: inner.Cause, Frames: frames}
+}
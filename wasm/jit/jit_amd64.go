@@ -74,6 +74,12 @@ func init() {
 	float64ForMaximumSigned32bitIntPlusOneAddress = uintptr(unsafe.Pointer(&float64ForMaximumSigned32bitIntPlusOne))
 	float32ForMaximumSigned64bitIntPlusOneAddress = uintptr(unsafe.Pointer(&float32ForMaximumSigned64bitIntPlusOne))
 	float64ForMaximumSigned64bitIntPlusOneAddress = uintptr(unsafe.Pointer(&float64ForMaximumSigned64bitIntPlusOne))
+
+	// The assembler lazily initializes its global instruction tables on the first builder, which races when
+	// functions are compiled concurrently. So we create one here to initialize them before any compilation.
+	if _, err := asm.NewBuilder("amd64", 1); err != nil {
+		panic(err)
+	}
 }
 
 // jitcall is implemented in jit_amd64.s as a Go Assembler function.
@@ -83,7 +89,7 @@ func init() {
 // memory is the pointer to the first byte of memoryInstance.Buffer slice to be used by the target function.
 func jitcall(codeSegment, engine, memory uintptr)
 
-func newCompiler(eng *engine, f *wasm.FunctionInstance, ir *wazeroir.CompilationResult) (compiler, error) {
+func newCompiler(f *wasm.FunctionInstance, ir *wazeroir.CompilationResult) (compiler, error) {
 	// We can choose arbitrary number instead of 1024 which indicates the cache size in the compiler.
 	// TODO: optimize the number.
 	b, err := asm.NewBuilder("amd64", 1024)
@@ -95,10 +101,16 @@ func newCompiler(eng *engine, f *wasm.FunctionInstance, ir *wazeroir.Compilation
 	for key, callers := range ir.LabelCallers {
 		labels[key] = &labelInfo{callers: callers}
 	}
+	for key, cost := range ir.LabelFuelCosts {
+		if l, ok := labels[key]; ok {
+			l.fuelCost = cost
+		}
+	}
 	return &amd64Compiler{
-		eng: eng, f: f, builder: b, locationStack: newValueLocationStack(),
-		labels:       labels,
-		currentLabel: ".entrypoint",
+		f: f, builder: b, locationStack: newValueLocationStack(),
+		labels:        labels,
+		currentLabel:  ".entrypoint",
+		entryFuelCost: ir.EntryFuelCost,
 	}, nil
 }
 
@@ -108,7 +120,6 @@ func (c *amd64Compiler) String() string {
 
 type amd64Compiler struct {
 	builder *asm.Builder
-	eng     *engine
 	f       *wasm.FunctionInstance
 	// setJmpOrigins sets jmp kind instructions where you want to set the next coming
 	// instruction as the destination of the jmp instruction.
@@ -126,6 +137,20 @@ type amd64Compiler struct {
 	// onGenerateCallbacks holds the callbacks which are called AFTER generating native code.
 	onGenerateCallbacks []func(code []byte) error
 	staticData          compiledFunctionStaticData
+	// entryFuelCost is the fuel consumed on entering this function.
+	entryFuelCost uint64
+	// currentSourceOffset is the offset of the Wasm instruction from which the current operation is compiled,
+	// and sourceOffsetChanged is true until the first instruction of the operation is added.
+	currentSourceOffset uint64
+	sourceOffsetChanged bool
+	// sourceOffsetInstructions holds the first instruction compiled from each Wasm instruction whose offset
+	// is the corresponding element of sourceOffsets. These are resolved into sourceOffsetMap in generate.
+	sourceOffsetInstructions []*obj.Prog
+	sourceOffsets            []uint64
+	// trapSites holds the instructions storing trapSiteOffsetPlaceholder to callEngine.continuationAddressOffset
+	// before exiting on traps, and the placeholders are replaced with the actual offsets in generate.
+	trapSites []*obj.Prog
+	offsetMap sourceOffsetMap
 }
 
 // replaceLocationStack sets the given valueLocationStack to .locationStack field,
@@ -151,6 +176,8 @@ type labelInfo struct {
 	initialStack *valueLocationStack
 	// labelBeginningCallbacks holds callbacks should to be called with initialInstruction
 	labelBeginningCallbacks []func(*obj.Prog)
+	// fuelCost is the fuel consumed on entering this label.
+	fuelCost uint64
 }
 
 func (c *amd64Compiler) label(labelKey string) *labelInfo {
@@ -162,12 +189,76 @@ func (c *amd64Compiler) label(labelKey string) *labelInfo {
 	return c.labels[labelKey]
 }
 
-func (c *amd64Compiler) emitPreamble() {
+func (c *amd64Compiler) emitPreamble() error {
 	// We assume all function parameters are already pushed onto the stack by
 	// the caller.
 	c.pushFunctionParams()
 	// Initialize the reserved registers first of all.
 	c.initializeReservedRegisters()
+	if err := c.emitFuelConsumption(c.entryFuelCost); err != nil {
+		return err
+	}
+	// Function entries are one of the places where we check the cancellation of calls.
+	return c.emitCallCanceledCheck()
+}
+
+// emitFuelConsumption adds instructions to subtract cost from engine.fuel, and exit
+// with jitCallStatusCodeOutOfFuel if the remaining fuel is less than cost.
+func (c *amd64Compiler) emitFuelConsumption(cost uint64) error {
+	if cost == 0 {
+		return nil
+	} else if cost > math.MaxInt32 {
+		return fmt.Errorf("fuel cost %d of a basic block exceeds the limit", cost)
+	}
+
+	sub := c.newProg()
+	sub.As = x86.ASUBQ
+	sub.From.Type = obj.TYPE_CONST
+	sub.From.Offset = int64(cost)
+	sub.To.Type = obj.TYPE_MEM
+	sub.To.Reg = reservedRegisterForEngine
+	sub.To.Offset = callEngineFuelOffset
+	c.addInstruction(sub)
+
+	// If the subtraction doesn't borrow, the fuel was enough.
+	jmpIfEnough := c.newProg()
+	jmpIfEnough.As = x86.AJCC
+	jmpIfEnough.To.Type = obj.TYPE_BRANCH
+	c.addInstruction(jmpIfEnough)
+
+	// Otherwise, we exit with jitCallStatusCodeOutOfFuel.
+	c.setJITStatus(jitCallStatusCodeOutOfFuel)
+	c.returnFunction()
+
+	c.addSetJmpOrigins(jmpIfEnough)
+	return nil
+}
+
+// emitCallCanceledCheck adds instructions to decrement engine.callCanceledCheckCountdown, and call
+// builtinFunctionAddressCheckCallCanceled when it reaches zero.
+//
+// Note: this must be called only when all the values are on the stack, i.e. at the function entry
+// or at the beginning of labels with multiple callers.
+func (c *amd64Compiler) emitCallCanceledCheck() error {
+	dec := c.newProg()
+	dec.As = x86.ADECQ
+	dec.To.Type = obj.TYPE_MEM
+	dec.To.Reg = reservedRegisterForEngine
+	dec.To.Offset = callEngineCallCanceledCheckCountdownOffset
+	c.addInstruction(dec)
+
+	jmpIfNotZero := c.newProg()
+	jmpIfNotZero.As = x86.AJNE
+	jmpIfNotZero.To.Type = obj.TYPE_BRANCH
+	c.addInstruction(jmpIfNotZero)
+
+	if err := c.compileFunctionCallFromAddress(jitCallStatusCodeCallBuiltInFunction, builtinFunctionAddressCheckCallCanceled); err != nil {
+		return err
+	}
+
+	// Otherwise, continue the execution from the next instruction.
+	c.addSetJmpOrigins(jmpIfNotZero)
+	return nil
 }
 
 func (c *amd64Compiler) generate() (code []byte, staticData compiledFunctionStaticData, maxStackPointer uint64, err error) {
@@ -214,6 +305,31 @@ func (c *amd64Compiler) generate() (code []byte, staticData compiledFunctionStat
 		binary.LittleEndian.PutUint64(code[start:start+operandSizeBytes], uint64(afterReturnInst.Pc))
 	}
 
+	// Similarly, the trap sites store the offset of the next instruction as continuationAddressOffset,
+	// so that the trapping instruction can be found in the same way as the call sites.
+	// The placeholder is the 32-bit immediate at the end of the MOVQ instruction.
+	for _, inst := range c.trapSites {
+		next := inst.Link
+		if next == nil {
+			err = fmt.Errorf("invalid trap site at %v", inst)
+			return
+		}
+		end := next.Pc
+		if binary.LittleEndian.Uint32(code[end-4:end]) != trapSiteOffsetPlaceholder {
+			err = fmt.Errorf("placeholder not found for trap site at %v", inst)
+			return
+		}
+		binary.LittleEndian.PutUint32(code[end-4:end], uint32(end))
+	}
+
+	c.offsetMap = sourceOffsetMap{
+		nativeOffsets: make([]uint64, len(c.sourceOffsetInstructions)),
+		wasmOffsets:   c.sourceOffsets,
+	}
+	for i, inst := range c.sourceOffsetInstructions {
+		c.offsetMap.nativeOffsets[i] = uint64(inst.Pc)
+	}
+
 	// c.maxStackPointer tracks the maximum stack pointer across all valueLocationStack
 	// used for all labels (via replaceLocationStack), excluding the current one.
 	// Hense, we check here if the final block's max one exceeds the current c.maxStackPointer.
@@ -238,8 +354,24 @@ func (c *amd64Compiler) pushFunctionParams() {
 	}
 }
 
+func (c *amd64Compiler) setSourceOffset(offset uint64) {
+	c.currentSourceOffset = offset
+	c.sourceOffsetChanged = true
+}
+
+func (c *amd64Compiler) sourceOffsetMap() sourceOffsetMap {
+	return c.offsetMap
+}
+
 func (c *amd64Compiler) addInstruction(prog *obj.Prog) {
 	c.builder.AddInstruction(prog)
+	if c.sourceOffsetChanged {
+		c.sourceOffsetChanged = false
+		if l := len(c.sourceOffsets); l == 0 || c.sourceOffsets[l-1] != c.currentSourceOffset {
+			c.sourceOffsetInstructions = append(c.sourceOffsetInstructions, prog)
+			c.sourceOffsets = append(c.sourceOffsets, c.currentSourceOffset)
+		}
+	}
 	for _, origin := range c.setJmpOrigins {
 		origin.To.SetTarget(prog)
 	}
@@ -372,7 +504,7 @@ func (c *amd64Compiler) compileGlobalGet(o *wazeroir.OperationGlobalGet) error {
 	moveGlobalSlicePointer.To.Reg = intReg
 	moveGlobalSlicePointer.From.Type = obj.TYPE_MEM
 	moveGlobalSlicePointer.From.Reg = reservedRegisterForEngine
-	moveGlobalSlicePointer.From.Offset = engineglobalSliceAddressOffset
+	moveGlobalSlicePointer.From.Offset = callEngineglobalSliceAddressOffset
 	c.addInstruction(moveGlobalSlicePointer)
 
 	// Then, get the memory location of the target global instance's pointer.
@@ -445,7 +577,7 @@ func (c *amd64Compiler) compileGlobalSet(o *wazeroir.OperationGlobalSet) error {
 	moveGlobalSlicePointer.To.Reg = intReg
 	moveGlobalSlicePointer.From.Type = obj.TYPE_MEM
 	moveGlobalSlicePointer.From.Reg = reservedRegisterForEngine
-	moveGlobalSlicePointer.From.Offset = engineglobalSliceAddressOffset
+	moveGlobalSlicePointer.From.Offset = callEngineglobalSliceAddressOffset
 	c.addInstruction(moveGlobalSlicePointer)
 
 	// Then, get the memory location of the target global instance's pointer.
@@ -915,7 +1047,7 @@ func (c *amd64Compiler) assignJumpTarget(labelKey string, jmpInstruction *obj.Pr
 // knowing the following instructions.
 // Returns true if the label doesn't have any caller, and it is ok to skip the
 // entire operations in the given label.
-func (c *amd64Compiler) compileLabel(o *wazeroir.OperationLabel) (skipLabel bool) {
+func (c *amd64Compiler) compileLabel(o *wazeroir.OperationLabel) (skipLabel bool, err error) {
 	if buildoptions.IsDebugMode {
 		if c.currentLabel != "" {
 			fmt.Printf("[label %s ends]\n\n", c.currentLabel)
@@ -961,6 +1093,19 @@ func (c *amd64Compiler) compileLabel(o *wazeroir.OperationLabel) (skipLabel bool
 	// Clear for debuggin purpose. See the comment in "len(labelInfo.labelBeginningCallbacks) > 0" block above.
 	labelInfo.labelBeginningCallbacks = nil
 
+	if err = c.emitFuelConsumption(labelInfo.fuelCost); err != nil {
+		return
+	}
+
+	// Loop headers are the only labels which have backward branches, and they have more than one caller
+	// (the loop entry and the backward branches) unlike headers of if and br_if. Check the cancellation
+	// on each iteration.
+	if o.Label.Kind == wazeroir.LabelKindHeader && labelInfo.callers > 1 {
+		if err = c.emitCallCanceledCheck(); err != nil {
+			return
+		}
+	}
+
 	if buildoptions.IsDebugMode {
 		fmt.Printf("[label %s (num callers=%d)]\n%s\n", labelKey, labelInfo.callers, c.locationStack)
 	}
@@ -975,10 +1120,49 @@ func (c *amd64Compiler) compileCall(o *wazeroir.OperationCall) error {
 		return err
 	}
 
-	target := c.f.ModuleInstance.Functions[o.FunctionIndex]
-	if err := c.compileFunctionCallFromAddress(jitCallStatusCodeCallFunction, target.Address); err != nil {
+	// The address of the target is specific to a store, so we read it from the function instance at runtime.
+	addressReg, err := c.allocateRegister(generalPurposeRegisterTypeInt)
+	if err != nil {
+		return err
+	}
+	c.locationStack.markRegisterUsed(addressReg)
+
+	// First, move the pointer to the function instance slice into the allocated register.
+	moveFunctionSlicePointer := c.newProg()
+	moveFunctionSlicePointer.As = x86.AMOVQ
+	moveFunctionSlicePointer.To.Type = obj.TYPE_REG
+	moveFunctionSlicePointer.To.Reg = addressReg
+	moveFunctionSlicePointer.From.Type = obj.TYPE_MEM
+	moveFunctionSlicePointer.From.Reg = reservedRegisterForEngine
+	moveFunctionSlicePointer.From.Offset = callEngineFunctionsSliceAddressOffset
+	c.addInstruction(moveFunctionSlicePointer)
+
+	// Then, move the pointer to the target function instance into the register.
+	getFunctionInstancePointer := c.newProg()
+	getFunctionInstancePointer.As = x86.AMOVQ
+	getFunctionInstancePointer.To.Type = obj.TYPE_REG
+	getFunctionInstancePointer.To.Reg = addressReg
+	getFunctionInstancePointer.From.Type = obj.TYPE_MEM
+	getFunctionInstancePointer.From.Reg = addressReg
+	getFunctionInstancePointer.From.Offset = 8 * int64(o.FunctionIndex)
+	c.addInstruction(getFunctionInstancePointer)
+
+	// Finally, read the address of the target function instance.
+	getFunctionAddress := c.newProg()
+	getFunctionAddress.As = x86.AMOVQ
+	getFunctionAddress.To.Type = obj.TYPE_REG
+	getFunctionAddress.To.Reg = addressReg
+	getFunctionAddress.From.Type = obj.TYPE_MEM
+	getFunctionAddress.From.Reg = addressReg
+	getFunctionAddress.From.Offset = functionInstanceAddressOffset
+	c.addInstruction(getFunctionAddress)
+
+	if err := c.compileFunctionCallFromRegister(addressReg); err != nil {
 		return err
 	}
+	c.locationStack.markRegisterUnused(addressReg)
+
+	target := c.f.ModuleInstance.Functions[o.FunctionIndex]
 
 	// We consumed the function parameters from the stack after call.
 	for i := 0; i < len(target.FunctionType.Type.Params); i++ {
@@ -1001,6 +1185,8 @@ func (c *amd64Compiler) compileCall(o *wazeroir.OperationCall) error {
 const (
 	tableElementFunctionAddressOffest = 0
 	tableElementTypeIDOffest          = 8
+	typeInstanceTypeIDOffset          = 8
+	functionInstanceAddressOffset     = 72
 )
 
 // compileCallIndirect adds instructions to perform call_indirect operation.
@@ -1028,7 +1214,7 @@ func (c *amd64Compiler) compileCallIndirect(o *wazeroir.OperationCallIndirect) e
 	cmpLength.To.Reg = offset.register
 	cmpLength.From.Type = obj.TYPE_MEM
 	cmpLength.From.Reg = reservedRegisterForEngine
-	cmpLength.From.Offset = engineTableSliceLenOffset
+	cmpLength.From.Offset = callEngineTableSliceLenOffset
 	c.addInstruction(cmpLength)
 
 	notLengthExceedJump := c.newProg()
@@ -1060,7 +1246,7 @@ func (c *amd64Compiler) compileCallIndirect(o *wazeroir.OperationCallIndirect) e
 	movTableSliceAddress.To.Reg = offset.register
 	movTableSliceAddress.From.Type = obj.TYPE_MEM
 	movTableSliceAddress.From.Reg = reservedRegisterForEngine
-	movTableSliceAddress.From.Offset = engineTableSliceAddressOffset
+	movTableSliceAddress.From.Offset = callEngineTableSliceAddressOffset
 	c.addInstruction(movTableSliceAddress)
 
 	// At this point offset.register holds the address of wasm.TableElement at wasm.TableInstance[offset]
@@ -1085,15 +1271,48 @@ func (c *amd64Compiler) compileCallIndirect(o *wazeroir.OperationCallIndirect) e
 	c.setJITStatus(jitCallStatusCodeInvalidTableAccess)
 	c.returnFunction()
 
+	// The type ID is specific to a store, so we read it from the type instance of the current module at runtime.
 	targetFunctionType := c.f.ModuleInstance.Types[o.TypeIndex]
+	typeIDReg, err := c.allocateRegister(generalPurposeRegisterTypeInt)
+	if err != nil {
+		return err
+	}
+
+	moveTypeSlicePointer := c.newProg()
+	jumpIfInitialized.To.SetTarget(moveTypeSlicePointer)
+	moveTypeSlicePointer.As = x86.AMOVQ
+	moveTypeSlicePointer.To.Type = obj.TYPE_REG
+	moveTypeSlicePointer.To.Reg = typeIDReg
+	moveTypeSlicePointer.From.Type = obj.TYPE_MEM
+	moveTypeSlicePointer.From.Reg = reservedRegisterForEngine
+	moveTypeSlicePointer.From.Offset = callEngineTypesSliceAddressOffset
+	c.addInstruction(moveTypeSlicePointer)
+
+	getTypeInstancePointer := c.newProg()
+	getTypeInstancePointer.As = x86.AMOVQ
+	getTypeInstancePointer.To.Type = obj.TYPE_REG
+	getTypeInstancePointer.To.Reg = typeIDReg
+	getTypeInstancePointer.From.Type = obj.TYPE_MEM
+	getTypeInstancePointer.From.Reg = typeIDReg
+	getTypeInstancePointer.From.Offset = 8 * int64(o.TypeIndex)
+	c.addInstruction(getTypeInstancePointer)
+
+	getTypeID := c.newProg()
+	getTypeID.As = x86.AMOVQ
+	getTypeID.To.Type = obj.TYPE_REG
+	getTypeID.To.Reg = typeIDReg
+	getTypeID.From.Type = obj.TYPE_MEM
+	getTypeID.From.Reg = typeIDReg
+	getTypeID.From.Offset = typeInstanceTypeIDOffset
+	c.addInstruction(getTypeID)
+
 	checkIfTypeMatch := c.newProg()
-	jumpIfInitialized.To.SetTarget(checkIfTypeMatch)
 	checkIfTypeMatch.As = x86.ACMPQ
 	checkIfTypeMatch.From.Type = obj.TYPE_MEM
 	checkIfTypeMatch.From.Reg = offset.register
 	checkIfTypeMatch.From.Offset = tableElementTypeIDOffest
-	checkIfTypeMatch.To.Type = obj.TYPE_CONST
-	checkIfTypeMatch.To.Offset = int64(targetFunctionType.TypeID)
+	checkIfTypeMatch.To.Type = obj.TYPE_REG
+	checkIfTypeMatch.To.Reg = typeIDReg
 	c.addInstruction(checkIfTypeMatch)
 
 	// Jump if the type matches.
@@ -4225,7 +4444,7 @@ func (c *amd64Compiler) setupMemoryOffset(offsetArg uint32, targetSizeInByte int
 	cmp.To.Reg = tmpReg
 	cmp.From.Type = obj.TYPE_MEM
 	cmp.From.Reg = reservedRegisterForEngine
-	cmp.From.Offset = engineMemorySliceLenOffset
+	cmp.From.Offset = callEngineMemorySliceLenOffset
 	c.addInstruction(cmp)
 
 	// Jump if the value is within the memory length.
@@ -4599,10 +4818,28 @@ func (c *amd64Compiler) setJITStatus(status jitCallStatusCode) {
 	prog.From.Offset = int64(status)
 	prog.To.Type = obj.TYPE_MEM
 	prog.To.Reg = reservedRegisterForEngine
-	prog.To.Offset = engineJITCallStatusCodeOffset
+	prog.To.Offset = callEngineJITCallStatusCodeOffset
 	c.addInstruction(prog)
+
+	if status > jitCallStatusCodeCallBuiltInFunction {
+		// This is a trap, so we store the offset of the trap site to continuationAddressOffset.
+		// The placeholder is replaced with the actual offset in generate.
+		prog = c.newProg()
+		prog.As = x86.AMOVQ
+		prog.From.Type = obj.TYPE_CONST
+		prog.From.Offset = trapSiteOffsetPlaceholder
+		prog.To.Type = obj.TYPE_MEM
+		prog.To.Reg = reservedRegisterForEngine
+		prog.To.Offset = callEngineContinuationAddressOffset
+		c.addInstruction(prog)
+		c.trapSites = append(c.trapSites, prog)
+	}
 }
 
+// trapSiteOffsetPlaceholder is the placeholder of the trap site offset which is large enough
+// to be encoded as a 32-bit immediate.
+const trapSiteOffsetPlaceholder = 1 << 30
+
 // compileFunctionCallFromAddress adds instructions to call a function whose address equals the addr parameter.
 // jitStatus is set before making call, and it should either jitCallStatusCodeCallBuiltInFunction or
 // jitCallStatusCodeCallFunction.
@@ -4615,7 +4852,7 @@ func (c *amd64Compiler) compileFunctionCallFromAddress(jitStatus jitCallStatusCo
 	prog.From.Offset = int64(addr)
 	prog.To.Type = obj.TYPE_MEM
 	prog.To.Reg = reservedRegisterForEngine
-	prog.To.Offset = engineFunctionCallAddressOffset
+	prog.To.Offset = callEngineFunctionCallAddressOffset
 	c.addInstruction(prog)
 
 	// Release all the registers as our calling convention requires the callee-save.
@@ -4640,7 +4877,7 @@ func (c *amd64Compiler) compileFunctionCallFromRegister(functionCallAddressRegis
 	setFunctionAddressFromReg.From.Reg = functionCallAddressRegister
 	setFunctionAddressFromReg.To.Type = obj.TYPE_MEM
 	setFunctionAddressFromReg.To.Reg = reservedRegisterForEngine
-	setFunctionAddressFromReg.To.Offset = engineFunctionCallAddressOffset
+	setFunctionAddressFromReg.To.Offset = callEngineFunctionCallAddressOffset
 	c.addInstruction(setFunctionAddressFromReg)
 
 	// Release all the registers as our calling convention requires the callee-save.
@@ -4697,7 +4934,7 @@ func (c *amd64Compiler) setContinuationOffsetAtNextInstructionAndReturn() {
 	prog.From.Reg = tmpReg
 	prog.To.Type = obj.TYPE_MEM
 	prog.To.Reg = reservedRegisterForEngine
-	prog.To.Offset = engineContinuationAddressOffset
+	prog.To.Offset = callEngineContinuationAddressOffset
 	c.addInstruction(prog)
 
 	// Then return temporarily -- giving control to normal Go code.
@@ -4711,7 +4948,7 @@ func (c *amd64Compiler) setFunctionCallIndexFromRegister(reg int16) {
 	prog.From.Reg = reg
 	prog.To.Type = obj.TYPE_MEM
 	prog.To.Reg = reservedRegisterForEngine
-	prog.To.Offset = engineFunctionCallAddressOffset
+	prog.To.Offset = callEngineFunctionCallAddressOffset
 	c.addInstruction(prog)
 }
 
@@ -4747,7 +4984,7 @@ func (c *amd64Compiler) returnFunction() {
 	prog.From.Offset = int64(c.locationStack.sp)
 	prog.To.Type = obj.TYPE_MEM
 	prog.To.Reg = reservedRegisterForEngine
-	prog.To.Offset = enginestackPointerOffset
+	prog.To.Offset = callEnginestackPointerOffset
 	c.addInstruction(prog)
 
 	// Return.
@@ -4758,16 +4995,16 @@ func (c *amd64Compiler) returnFunction() {
 
 // initializeReservedRegisters must be called at the very beginning and all the
 // after-call continuations of JITed functions.
-// This caches the actual stack base pointer (engine.stackBasePointer*8+[engine.engineStackSliceOffset])
+// This caches the actual stack base pointer (engine.stackBasePointer*8+[engine.callEngineStackSliceOffset])
 // to cachedStackBasePointerReg
 func (c *amd64Compiler) initializeReservedRegisters() {
 	// At first, make cachedStackBasePointerReg point to the beginning of the slice backing array.
-	// movq [engineInstanceReg+engineStackSliceOffset] cachedStackBasePointerReg
+	// movq [engineInstanceReg+callEngineStackSliceOffset] cachedStackBasePointerReg
 	prog := c.newProg()
 	prog.As = x86.AMOVQ
 	prog.From.Type = obj.TYPE_MEM
 	prog.From.Reg = reservedRegisterForEngine
-	prog.From.Offset = engineStackSliceOffset
+	prog.From.Offset = callEngineStackSliceOffset
 	prog.To.Type = obj.TYPE_REG
 	prog.To.Reg = reservedRegisterForStackBasePointer
 	c.addInstruction(prog)
@@ -4778,12 +5015,12 @@ func (c *amd64Compiler) initializeReservedRegisters() {
 
 	// Next we move the base pointer (engine.stackBasePointer) to
 	// a temporary register.
-	// movq [engineInstanceReg+engineCurrentstackBasePointerOffset] reg
+	// movq [engineInstanceReg+callEngineCurrentstackBasePointerOffset] reg
 	prog = c.newProg()
 	prog.As = x86.AMOVQ
 	prog.From.Type = obj.TYPE_MEM
 	prog.From.Reg = reservedRegisterForEngine
-	prog.From.Offset = enginestackBasePointerOffset
+	prog.From.Offset = callEnginestackBasePointerOffset
 	prog.To.Type = obj.TYPE_REG
 	prog.To.Reg = reg
 	c.addInstruction(prog)
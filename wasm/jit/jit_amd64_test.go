@@ -24,10 +24,11 @@ import (
 // TODO: have some utility functions to reduce loc here: https://github.com/tetratelabs/wazero/issues/100
 
 type jitEnv struct {
-	eng     *engine
+	ce      *callEngine
 	mem     *wasm.MemoryInstance
 	globals []*wasm.GlobalInstance
 	table   *wasm.TableInstance
+	module  *wasm.ModuleInstance
 }
 
 func (j *jitEnv) stackTopAsByte() byte {
@@ -66,27 +67,27 @@ func (j *jitEnv) memory() []byte {
 }
 
 func (j *jitEnv) stack() []uint64 {
-	return j.eng.stack
+	return j.ce.stack
 }
 
 func (j *jitEnv) jitStatus() jitCallStatusCode {
-	return j.eng.jitCallStatusCode
+	return j.ce.jitCallStatusCode
 }
 
 func (j *jitEnv) functionCallAddress() wasm.FunctionAddress {
-	return j.eng.functionCallAddress
+	return j.ce.functionCallAddress
 }
 
 func (j *jitEnv) continuationAddressOffset() uintptr {
-	return j.eng.continuationAddressOffset
+	return j.ce.continuationAddressOffset
 }
 
 func (j *jitEnv) stackPointer() uint64 {
-	return j.eng.stackPointer
+	return j.ce.stackPointer
 }
 
 func (j *jitEnv) setStackPointer(sp uint64) {
-	j.eng.stackPointer = sp
+	j.ce.stackPointer = sp
 }
 
 func (j *jitEnv) addGlobals(g ...*wasm.GlobalInstance) {
@@ -97,29 +98,41 @@ func (j *jitEnv) getGlobal(index uint32) uint64 {
 	return j.globals[index].Val
 }
 
+func (j *jitEnv) setModuleInstance(m *wasm.ModuleInstance) {
+	j.module = m
+}
+
 func (j *jitEnv) setTable(table []wasm.TableElement) {
 	j.table.Table = table
 }
 
 func (j *jitEnv) exec(code []byte) {
-	j.eng.memorySliceLen = uint64(len(j.mem.Buffer))
+	j.ce.memorySliceLen = uint64(len(j.mem.Buffer))
 	if len(j.globals) > 0 {
-		j.eng.globalSliceAddress = uintptr(unsafe.Pointer(&j.globals[0]))
+		j.ce.globalSliceAddress = uintptr(unsafe.Pointer(&j.globals[0]))
 	}
 	if l := len(j.table.Table); l > 0 {
-		j.eng.tableSliceAddress = uintptr(unsafe.Pointer(&j.table.Table[0]))
-		j.eng.tableSliceLen = uint64(l)
+		j.ce.tableSliceAddress = uintptr(unsafe.Pointer(&j.table.Table[0]))
+		j.ce.tableSliceLen = uint64(l)
+	}
+	if j.module != nil {
+		if len(j.module.Functions) > 0 {
+			j.ce.functionsSliceAddress = uintptr(unsafe.Pointer(&j.module.Functions[0]))
+		}
+		if len(j.module.Types) > 0 {
+			j.ce.typesSliceAddress = uintptr(unsafe.Pointer(&j.module.Types[0]))
+		}
 	}
 	jitcall(
 		uintptr(unsafe.Pointer(&code[0])),
-		uintptr(unsafe.Pointer(j.eng)),
+		uintptr(unsafe.Pointer(j.ce)),
 		uintptr(unsafe.Pointer(&j.mem.Buffer[0])),
 	)
 }
 
 func newJITEnvironment() *jitEnv {
 	return &jitEnv{
-		eng:   newEngine(),
+		ce:    newEngine().newCallEngine(),
 		mem:   &wasm.MemoryInstance{Buffer: make([]byte, 1024)},
 		table: &wasm.TableInstance{},
 	}
@@ -128,7 +141,7 @@ func newJITEnvironment() *jitEnv {
 func requireNewCompiler(t *testing.T) *amd64Compiler {
 	b, err := asm.NewBuilder("amd64", 128)
 	require.NoError(t, err)
-	return &amd64Compiler{eng: nil, builder: b,
+	return &amd64Compiler{builder: b,
 		locationStack: newValueLocationStack(),
 		labels:        map[string]*labelInfo{},
 	}
@@ -200,9 +213,10 @@ func TestAmd64Compiler_compileBrTable(t *testing.T) {
 		for returnValue := uint32(0); returnValue < 10; returnValue++ {
 			label := &wazeroir.Label{Kind: wazeroir.LabelKindHeader, FrameID: returnValue}
 			c.label(label.String()).callers = 1
-			_ = c.compileLabel(&wazeroir.OperationLabel{Label: label})
+			_, err := c.compileLabel(&wazeroir.OperationLabel{Label: label})
+			require.NoError(t, err)
 			_ = c.compileConstI32(&wazeroir.OperationConstI32{Value: label.FrameID})
-			err := c.releaseAllRegistersToStack()
+			err = c.releaseAllRegistersToStack()
 			require.NoError(t, err)
 			c.returnFunction()
 		}
@@ -548,14 +562,16 @@ func TestAmd64Compiler_compileLabel(t *testing.T) {
 	}
 
 	// If callers > 0, the label must not be skipped.
-	skip := compiler.compileLabel(&wazeroir.OperationLabel{Label: label})
+	skip, err := compiler.compileLabel(&wazeroir.OperationLabel{Label: label})
+	require.NoError(t, err)
 	require.False(t, skip)
 	require.NotNil(t, compiler.labels[labelKey].initialInstruction)
 	require.True(t, called)
 
 	// Otherwise, skip.
 	compiler.labels[labelKey].initialStack = nil
-	skip = compiler.compileLabel(&wazeroir.OperationLabel{Label: label})
+	skip, err = compiler.compileLabel(&wazeroir.OperationLabel{Label: label})
+	require.NoError(t, err)
 	require.True(t, skip)
 }
 
@@ -4644,13 +4660,16 @@ func TestAmd64Compiler_compile_min_max_copysign(t *testing.T) {
 }
 
 func TestAmd64Compiler_compileCall(t *testing.T) {
+	// Ensure that the offset of wasm.FunctionInstance doesn't drift.
+	require.Equal(t, int(unsafe.Offsetof((&wasm.FunctionInstance{}).Address)), functionInstanceAddressOffset)
+
 	const functionAddress wasm.FunctionAddress = 5 // arbitrary value for testing
 	env := newJITEnvironment()
 	compiler := requireNewCompiler(t)
 	compiler.f = &wasm.FunctionInstance{ModuleInstance: &wasm.ModuleInstance{}}
 
 	// Setup.
-	compiler.eng = env.eng
+	env.setModuleInstance(compiler.f.ModuleInstance)
 	wasmFuncInstance := &wasm.FunctionInstance{FunctionType: &wasm.TypeInstance{Type: &wasm.FunctionType{}}, Address: functionAddress}
 	compiler.f.ModuleInstance.Functions = []*wasm.FunctionInstance{wasmFuncInstance}
 
@@ -5733,6 +5752,7 @@ func TestAmd64Compiler_compileCallIndirect(t *testing.T) {
 	// Ensure that the offset of wasm.TableInstance doesn't drift.
 	require.Equal(t, int(unsafe.Offsetof((&wasm.TableElement{}).FunctionAddress)), tableElementFunctionAddressOffest)
 	require.Equal(t, int(unsafe.Offsetof((&wasm.TableElement{}).FunctionTypeID)), tableElementTypeIDOffest)
+	require.Equal(t, int(unsafe.Offsetof((&wasm.TypeInstance{}).TypeID)), typeInstanceTypeIDOffset)
 
 	t.Run("out of bounds", func(t *testing.T) {
 		env := newJITEnvironment()
@@ -5757,6 +5777,7 @@ func TestAmd64Compiler_compileCallIndirect(t *testing.T) {
 		require.NoError(t, err)
 
 		// Run code.
+		env.setModuleInstance(compiler.f.ModuleInstance)
 		env.exec(code)
 
 		require.Equal(t, jitCallStatusCodeInvalidTableAccess, env.jitStatus())
@@ -5790,6 +5811,7 @@ func TestAmd64Compiler_compileCallIndirect(t *testing.T) {
 		require.NoError(t, err)
 
 		// Run code.
+		env.setModuleInstance(compiler.f.ModuleInstance)
 		env.exec(code)
 
 		require.Equal(t, jitCallStatusCodeInvalidTableAccess, env.jitStatus())
@@ -5822,6 +5844,7 @@ func TestAmd64Compiler_compileCallIndirect(t *testing.T) {
 		require.NoError(t, err)
 
 		// Run code.
+		env.setModuleInstance(compiler.f.ModuleInstance)
 		env.exec(code)
 
 		require.Equal(t, jitCallStatusCodeTypeMismatchOnIndirectCall, env.jitStatus())
@@ -5874,6 +5897,7 @@ func TestAmd64Compiler_compileCallIndirect(t *testing.T) {
 				require.NoError(t, err)
 
 				// Run code.
+				env.setModuleInstance(compiler.f.ModuleInstance)
 				env.exec(code)
 
 				require.Equal(t, jitCallStatusCodeCallFunction, env.jitStatus())
@@ -4,6 +4,9 @@
 package jit
 
 import (
+	"fmt"
+	"runtime"
+
 	"github.com/tetratelabs/wazero/wasm"
 	"github.com/tetratelabs/wazero/wasm/wazeroir"
 )
@@ -12,6 +15,8 @@ func jitcall(codeSegment, engine, memory uintptr) {
 	panic("unsupported GOARCH")
 }
 
-func newCompiler(eng *engine, f *wasm.FunctionInstance, ir *wazeroir.CompilationResult) (compiler, error) {
-	panic("unsupported GOARCH")
+// newCompiler returns an error as JIT is not supported on this GOARCH, so that all the functions
+// are executed by the fallback interpreter. See engine.Compile.
+func newCompiler(f *wasm.FunctionInstance, ir *wazeroir.CompilationResult) (compiler, error) {
+	return nil, fmt.Errorf("unsupported GOARCH %s", runtime.GOARCH)
 }
@@ -209,10 +209,11 @@ func (s *valueLocationStack) push(loc *valueLocation) {
 	} else {
 		s.stack[s.sp] = loc
 	}
+	s.sp++
+	// maxStackPointer is the height of the stack, hence updated after the increment.
 	if s.sp > s.maxStackPointer {
 		s.maxStackPointer = s.sp
 	}
-	s.sp++
 }
 
 func (s *valueLocationStack) pop() (loc *valueLocation) {
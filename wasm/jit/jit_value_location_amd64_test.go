@@ -58,14 +58,14 @@ func TestValueLocationStack_basic(t *testing.T) {
 		actual, exp := s.stack[i], cloned.stack[i]
 		require.NotEqual(t, uintptr(unsafe.Pointer(exp)), uintptr(unsafe.Pointer(actual)))
 	}
-	// Check the max stack pointer.
+	// Check the max stack pointer, which is the max height of the stack: 2 values are already pushed.
 	for i := 0; i < 1000; i++ {
 		s.pushValueOnStack()
 	}
 	for i := 0; i < 1000; i++ {
 		s.pop()
 	}
-	require.Equal(t, uint64(1001), s.maxStackPointer)
+	require.Equal(t, uint64(1002), s.maxStackPointer)
 }
 
 func TestValueLocationStack_takeFreeRegister(t *testing.T) {
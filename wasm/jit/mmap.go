@@ -17,3 +17,8 @@ func mmapCodeSegment(code []byte) ([]byte, error) {
 	copy(mmapFunc, code)
 	return mmapFunc, nil
 }
+
+// munmapCodeSegment unmaps the region returned by mmapCodeSegment.
+func munmapCodeSegment(code []byte) error {
+	return syscall.Munmap(code)
+}
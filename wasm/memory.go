@@ -0,0 +1,177 @@
+package wasm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// MemoryGrowHook is called when memory is about to grow by deltaPages from currentPages within the limits.
+// Returning false denies the growth, and then memory.grow results in -1.
+//
+// This allows embedders to account for the allocation, for example to enforce a budget shared
+// by multiple memory instances. Note that this is called during the execution of Wasm functions.
+type MemoryGrowHook func(memory *MemoryInstance, currentPages, deltaPages uint32) bool
+
+// The following methods provide the bounds-checked access to the linear memory for host functions.
+// Each of them returns false instead of panicking when the accessed range exceeds the memory,
+// so that host functions can validate the pointers given by guests.
+//
+// Note: ReadUint8 and WriteUint8 are not named ReadByte and WriteByte since those names
+// have the well-known signatures of io.ByteReader and io.ByteWriter.
+
+// Size returns the size of the memory in bytes.
+//
+// Note: this is uint64 since the memory of 65536 pages, the maximum, is 4GiB which doesn't fit in uint32.
+func (m *MemoryInstance) Size() uint64 {
+	return uint64(len(m.Buffer))
+}
+
+// hasSize returns true if the range [offset, offset+byteCount) is within the memory.
+func (m *MemoryInstance) hasSize(offset uint32, byteCount uint64) bool {
+	return uint64(offset)+byteCount <= uint64(len(m.Buffer))
+}
+
+// ReadUint8 reads a byte at offset.
+func (m *MemoryInstance) ReadUint8(offset uint32) (byte, bool) {
+	if !m.hasSize(offset, 1) {
+		return 0, false
+	}
+	return m.Buffer[offset], true
+}
+
+// ReadUint32Le reads a uint32 in little-endian encoding at offset.
+func (m *MemoryInstance) ReadUint32Le(offset uint32) (uint32, bool) {
+	if !m.hasSize(offset, 4) {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(m.Buffer[offset:]), true
+}
+
+// ReadUint64Le reads a uint64 in little-endian encoding at offset.
+func (m *MemoryInstance) ReadUint64Le(offset uint32) (uint64, bool) {
+	if !m.hasSize(offset, 8) {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint64(m.Buffer[offset:]), true
+}
+
+// ReadFloat32Le reads a float32 in IEEE 754 little-endian encoding at offset.
+func (m *MemoryInstance) ReadFloat32Le(offset uint32) (float32, bool) {
+	v, ok := m.ReadUint32Le(offset)
+	if !ok {
+		return 0, false
+	}
+	return math.Float32frombits(v), true
+}
+
+// ReadFloat64Le reads a float64 in IEEE 754 little-endian encoding at offset.
+func (m *MemoryInstance) ReadFloat64Le(offset uint32) (float64, bool) {
+	v, ok := m.ReadUint64Le(offset)
+	if !ok {
+		return 0, false
+	}
+	return math.Float64frombits(v), true
+}
+
+// Read returns the byteCount bytes at offset.
+//
+// Note: the returned slice is a view of the memory, not a copy. Therefore, writes to it are visible
+// to the guest, and it must not be used after the memory grows since Grow reallocates the buffer.
+func (m *MemoryInstance) Read(offset, byteCount uint32) ([]byte, bool) {
+	if !m.hasSize(offset, uint64(byteCount)) {
+		return nil, false
+	}
+	// offset+byteCount isn't computed in uint32 since it overflows at the end of 4GiB memory.
+	return m.Buffer[offset:][:byteCount:byteCount], true
+}
+
+// WriteUint8 writes the byte v at offset.
+func (m *MemoryInstance) WriteUint8(offset uint32, v byte) bool {
+	if !m.hasSize(offset, 1) {
+		return false
+	}
+	m.Buffer[offset] = v
+	return true
+}
+
+// WriteUint32Le writes v in little-endian encoding at offset.
+func (m *MemoryInstance) WriteUint32Le(offset, v uint32) bool {
+	if !m.hasSize(offset, 4) {
+		return false
+	}
+	binary.LittleEndian.PutUint32(m.Buffer[offset:], v)
+	return true
+}
+
+// WriteUint64Le writes v in little-endian encoding at offset.
+func (m *MemoryInstance) WriteUint64Le(offset uint32, v uint64) bool {
+	if !m.hasSize(offset, 8) {
+		return false
+	}
+	binary.LittleEndian.PutUint64(m.Buffer[offset:], v)
+	return true
+}
+
+// WriteFloat32Le writes v in IEEE 754 little-endian encoding at offset.
+func (m *MemoryInstance) WriteFloat32Le(offset uint32, v float32) bool {
+	return m.WriteUint32Le(offset, math.Float32bits(v))
+}
+
+// WriteFloat64Le writes v in IEEE 754 little-endian encoding at offset.
+func (m *MemoryInstance) WriteFloat64Le(offset uint32, v float64) bool {
+	return m.WriteUint64Le(offset, math.Float64bits(v))
+}
+
+// Write copies v to the memory at offset. Nothing is written if v doesn't fit in the memory.
+func (m *MemoryInstance) Write(offset uint32, v []byte) bool {
+	if !m.hasSize(offset, uint64(len(v))) {
+		return false
+	}
+	copy(m.Buffer[offset:], v)
+	return true
+}
+
+// Grow grows the memory by deltaPages pages, and returns the previous size in pages.
+// This returns false and leaves the memory unchanged if the new size exceeds the maximum or
+// the limit (See SetMaxPages), or the hook denies the growth (See SetGrowHook).
+// This implements memory.grow, see https://www.w3.org/TR/wasm-core-1/#grow-mem
+func (m *MemoryInstance) Grow(deltaPages uint32) (previousPages uint32, ok bool) {
+	// Without the maximum, the size is limited by the 32-bit address space, which is 65536 pages.
+	max := uint64(math.MaxUint32) + 1
+	if m.Max != nil {
+		max = uint64(*m.Max) * PageSize
+	}
+	if m.maxPages != nil && uint64(*m.maxPages)*PageSize < max {
+		max = uint64(*m.maxPages) * PageSize
+	}
+	if uint64(deltaPages)*PageSize+uint64(len(m.Buffer)) > max {
+		return 0, false
+	}
+	previousPages = uint32(uint64(len(m.Buffer)) / PageSize)
+	if m.growHook != nil && !m.growHook(m, previousPages, deltaPages) {
+		return 0, false
+	}
+	m.Buffer = append(m.Buffer, make([]byte, uint64(deltaPages)*PageSize)...)
+	return previousPages, true
+}
+
+// SetMaxPages limits the number of pages of this memory in addition to Max, so that memory.grow beyond the
+// limit results in -1. The limit can only be lowered, and this returns an error if pages exceeds the current
+// limit including RuntimeConfig.MaxMemoryPages of the store, or is smaller than the current size.
+func (m *MemoryInstance) SetMaxPages(pages uint32) error {
+	if m.maxPages != nil && pages > *m.maxPages {
+		return fmt.Errorf("max pages %d exceeds the current limit %d", pages, *m.maxPages)
+	}
+	if uint64(pages)*PageSize < uint64(len(m.Buffer)) {
+		return fmt.Errorf("max pages %d is smaller than the current size %d", pages, uint64(len(m.Buffer))/PageSize)
+	}
+	m.maxPages = &pages
+	return nil
+}
+
+// SetGrowHook sets the hook called on each growth of this memory, overriding RuntimeConfig.MemoryGrowHook
+// of the store. A nil hook removes the current one.
+func (m *MemoryInstance) SetGrowHook(hook MemoryGrowHook) {
+	m.growHook = hook
+}
@@ -0,0 +1,194 @@
+package wasm
+
+import (
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryInstance_Size(t *testing.T) {
+	m := &MemoryInstance{Buffer: make([]byte, PageSize)}
+	require.Equal(t, PageSize, m.Size())
+	require.Equal(t, uint64(0), (&MemoryInstance{}).Size())
+}
+
+func TestMemoryInstance_MaxSize(t *testing.T) {
+	if strconv.IntSize < 64 {
+		t.Skip("4GiB memory requires 64-bit address space")
+	}
+	// The memory of 65536 pages, the maximum, is allocated but only the last bytes are touched.
+	m := &MemoryInstance{Buffer: make([]byte, 65536*PageSize)}
+	require.Equal(t, uint64(math.MaxUint32)+1, m.Size())
+
+	require.True(t, m.WriteUint64Le(math.MaxUint32-7, math.MaxUint64))
+	v64, ok := m.ReadUint64Le(math.MaxUint32 - 7)
+	require.True(t, ok)
+	require.Equal(t, uint64(math.MaxUint64), v64)
+	_, ok = m.ReadUint64Le(math.MaxUint32 - 6)
+	require.False(t, ok)
+
+	require.True(t, m.WriteUint8(math.MaxUint32, 1))
+	v8, ok := m.ReadUint8(math.MaxUint32)
+	require.True(t, ok)
+	require.Equal(t, byte(1), v8)
+
+	// The range ending at the end of the memory doesn't overflow.
+	b, ok := m.Read(math.MaxUint32-3, 4)
+	require.True(t, ok)
+	require.Equal(t, []byte{0xff, 0xff, 0xff, 1}, b)
+	_, ok = m.Read(math.MaxUint32-3, 5)
+	require.False(t, ok)
+	require.True(t, m.Write(math.MaxUint32-1, []byte{2, 3}))
+	require.False(t, m.Write(math.MaxUint32-1, []byte{2, 3, 4}))
+}
+
+func TestMemoryInstance_ReadWrite(t *testing.T) {
+	m := &MemoryInstance{Buffer: make([]byte, 16)}
+
+	require.True(t, m.WriteUint8(15, 0xff))
+	v8, ok := m.ReadUint8(15)
+	require.True(t, ok)
+	require.Equal(t, byte(0xff), v8)
+	require.False(t, m.WriteUint8(16, 0xff))
+	_, ok = m.ReadUint8(16)
+	require.False(t, ok)
+
+	require.True(t, m.WriteUint32Le(12, 0x01020304))
+	require.Equal(t, []byte{0x04, 0x03, 0x02, 0x01}, m.Buffer[12:])
+	v32, ok := m.ReadUint32Le(12)
+	require.True(t, ok)
+	require.Equal(t, uint32(0x01020304), v32)
+	require.False(t, m.WriteUint32Le(13, 0))
+	_, ok = m.ReadUint32Le(13)
+	require.False(t, ok)
+
+	require.True(t, m.WriteUint64Le(8, math.MaxUint64-1))
+	v64, ok := m.ReadUint64Le(8)
+	require.True(t, ok)
+	require.Equal(t, uint64(math.MaxUint64-1), v64)
+	require.False(t, m.WriteUint64Le(9, 0))
+	_, ok = m.ReadUint64Le(9)
+	require.False(t, ok)
+	// The offset must not wrap around.
+	_, ok = m.ReadUint64Le(math.MaxUint32)
+	require.False(t, ok)
+
+	require.True(t, m.WriteFloat32Le(0, 1.5))
+	f32, ok := m.ReadFloat32Le(0)
+	require.True(t, ok)
+	require.Equal(t, float32(1.5), f32)
+	require.False(t, m.WriteFloat32Le(13, 1.5))
+	_, ok = m.ReadFloat32Le(13)
+	require.False(t, ok)
+
+	require.True(t, m.WriteFloat64Le(8, -1.5))
+	f64, ok := m.ReadFloat64Le(8)
+	require.True(t, ok)
+	require.Equal(t, -1.5, f64)
+	require.False(t, m.WriteFloat64Le(9, 1.5))
+	_, ok = m.ReadFloat64Le(9)
+	require.False(t, ok)
+
+	require.True(t, m.Write(4, []byte("wazero")))
+	b, ok := m.Read(4, 6)
+	require.True(t, ok)
+	require.Equal(t, []byte("wazero"), b)
+	// The returned slice is a view of the memory.
+	b[0] = 'W'
+	require.Equal(t, byte('W'), m.Buffer[4])
+	require.False(t, m.Write(12, []byte("wazero")))
+	require.Equal(t, byte(0x00), m.Buffer[12]) // Nothing is written.
+	_, ok = m.Read(12, 6)
+	require.False(t, ok)
+	_, ok = m.Read(math.MaxUint32, math.MaxUint32)
+	require.False(t, ok)
+	b, ok = m.Read(16, 0)
+	require.True(t, ok)
+	require.Empty(t, b)
+}
+
+func TestMemoryInstance_Grow(t *testing.T) {
+	max := uint32(2)
+	m := &MemoryInstance{Buffer: make([]byte, PageSize), Min: 1, Max: &max}
+
+	previous, ok := m.Grow(1)
+	require.True(t, ok)
+	require.Equal(t, uint32(1), previous)
+	require.Equal(t, 2*PageSize, m.Size())
+
+	_, ok = m.Grow(1)
+	require.False(t, ok)
+	require.Equal(t, 2*PageSize, m.Size())
+
+	previous, ok = m.Grow(0)
+	require.True(t, ok)
+	require.Equal(t, uint32(2), previous)
+
+	// Without the maximum, the size is limited by the 32-bit address space, which is 65536 pages.
+	// The growth is denied by the hook to check the limit without allocating 4GiB.
+	var hooked bool
+	m = &MemoryInstance{}
+	m.SetGrowHook(func(_ *MemoryInstance, _, _ uint32) bool {
+		hooked = true
+		return false
+	})
+	_, ok = m.Grow(65537)
+	require.False(t, ok)
+	require.False(t, hooked)
+	_, ok = m.Grow(65536)
+	require.False(t, ok)
+	require.True(t, hooked)
+}
+
+func TestMemoryInstance_SetMaxPages(t *testing.T) {
+	m := &MemoryInstance{Buffer: make([]byte, PageSize)}
+	require.EqualError(t, m.SetMaxPages(0), "max pages 0 is smaller than the current size 1")
+	require.NoError(t, m.SetMaxPages(3))
+	require.EqualError(t, m.SetMaxPages(4), "max pages 4 exceeds the current limit 3")
+
+	_, ok := m.Grow(3)
+	require.False(t, ok)
+	previous, ok := m.Grow(2)
+	require.True(t, ok)
+	require.Equal(t, uint32(1), previous)
+	_, ok = m.Grow(1)
+	require.False(t, ok)
+
+	// The lower of Max and the limit is applied.
+	max := uint32(1)
+	m = &MemoryInstance{Max: &max}
+	require.NoError(t, m.SetMaxPages(2))
+	_, ok = m.Grow(2)
+	require.False(t, ok)
+}
+
+func TestMemoryInstance_SetGrowHook(t *testing.T) {
+	var calls [][2]uint32
+	var deny bool
+	m := &MemoryInstance{}
+	m.SetGrowHook(func(memory *MemoryInstance, currentPages, deltaPages uint32) bool {
+		require.Equal(t, m, memory)
+		calls = append(calls, [2]uint32{currentPages, deltaPages})
+		return !deny
+	})
+
+	_, ok := m.Grow(1)
+	require.True(t, ok)
+	deny = true
+	_, ok = m.Grow(1)
+	require.False(t, ok)
+	require.Equal(t, PageSize, m.Size())
+	require.Equal(t, [][2]uint32{{0, 1}, {1, 1}}, calls)
+
+	// The hook isn't called if the growth exceeds the limits.
+	require.NoError(t, m.SetMaxPages(1))
+	_, ok = m.Grow(1)
+	require.False(t, ok)
+	require.Len(t, calls, 2)
+
+	m.SetGrowHook(nil)
+	_, ok = m.Grow(0)
+	require.True(t, ok)
+}
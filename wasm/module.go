@@ -257,6 +257,9 @@ type Code struct {
 	NumLocals  uint32
 	LocalTypes []ValueType
 	Body       []byte
+	// BodyOffset is the byte offset of Body in the binary which this is decoded from, so that
+	// the offsets in Body can be reported relative to the module. Zero if not decoded from the binary.
+	BodyOffset uint64
 }
 
 type DataSegment struct {
@@ -220,6 +220,18 @@ func TestInterpreter(t *testing.T) {
 	runTest(t, wazeroir.NewEngine)
 }
 
+func TestJIT_Optimize(t *testing.T) {
+	runTest(t, func() wasm.Engine {
+		return jit.NewEngineWithConfig(&wasm.RuntimeConfig{Optimize: true})
+	})
+}
+
+func TestInterpreter_Optimize(t *testing.T) {
+	runTest(t, func() wasm.Engine {
+		return wazeroir.NewEngineWithConfig(&wasm.RuntimeConfig{Optimize: true})
+	})
+}
+
 func runTest(t *testing.T, newEngine func() wasm.Engine) {
 	const caseDir = "./cases"
 	files, err := os.ReadDir(caseDir)
@@ -265,7 +277,7 @@ func runTest(t *testing.T, newEngine func() wasm.Engine) {
 						if c.Name != "" {
 							name = c.Name
 						}
-						store.ModuleInstances[c.As] = store.ModuleInstances[name]
+						require.NoError(t, store.AliasModule(name, c.As), msg)
 					case "assert_return", "action":
 						moduleName := lastInstanceName
 						if c.Action.Module != "" {
@@ -350,6 +362,10 @@ func runTest(t *testing.T, newEngine func() wasm.Engine) {
 							// We don't support direct loading of wast yet.
 							t.Skip()
 						}
+						if c.Text == "invalid result arity" {
+							// The multi-value proposal is supported, so these are valid modules.
+							t.Skip()
+						}
 						buf, err := os.ReadFile(filepath.Join(caseDir, c.Filename))
 						require.NoError(t, err, msg)
 						mod, err := binary.DecodeModule(buf)
@@ -2,11 +2,14 @@ package wasm
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"math"
 	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/tetratelabs/wazero/wasm/ieee754"
 	"github.com/tetratelabs/wazero/wasm/leb128"
@@ -22,6 +25,10 @@ type (
 	// Note that store is not thread (concurrency) safe, meaning that using single Store
 	// via multiple goroutines might result in race conditions. In that case, the invocation
 	// and access to any methods and field of Store must be guarded by mutex.
+	// The exception is CallFunction and CallFunctionContext: each call is executed with its own
+	// stack, so they can be invoked concurrently unless other methods are invoked at the same time.
+	// Note that such calls still share the instances such as MemoryInstance and GlobalInstance,
+	// so the Wasm functions accessing them concurrently (e.g. memory.grow) race with each other.
 	//
 	// See https://www.w3.org/TR/wasm-core-1/#store%E2%91%A0
 	Store struct {
@@ -29,6 +36,10 @@ type (
 
 		// engine is a global context for a Store which is in reponsible for compilation and execution of Wasm modules.
 		engine Engine
+		// config holds the limits applied to the instances in this store. See RuntimeConfig.
+		config *RuntimeConfig
+		// importResolver resolves the imports of the modules instantiated in this store. See SetImportResolver.
+		importResolver ImportResolver
 		// ModuleInstances holds the instantiated Wasm modules keyed on names given at Instantiate.
 		ModuleInstances map[string]*ModuleInstance
 		// TypeIDs maps each FunctionType.String() to a unique FunctionTypeID. This is used at runtime to
@@ -61,12 +72,40 @@ type (
 	//
 	// See https://www.w3.org/TR/wasm-core-1/#syntax-moduleinst
 	ModuleInstance struct {
+		// Name is the name with which this module instance is instantiated in the Store.
+		Name      string
 		Exports   map[string]*ExportInstance
 		Functions []*FunctionInstance
 		Globals   []*GlobalInstance
 		Memory    *MemoryInstance
 		Tables    []*TableInstance
 		Types     []*TypeInstance
+
+		// UserValue is an arbitrary value set by the embedder, and is given to the host functions
+		// in this module instance as HostFunctionCallContext.UserValue.
+		UserValue interface{}
+
+		// dependencies holds the module instances from which this module instance imports,
+		// and is used to check that no live instance imports a module instance being closed.
+		dependencies []*ModuleInstance
+		// engine is the Engine of the store to which this module instance belongs.
+		engine Engine
+		// store is the Store to which this module instance belongs.
+		store *Store
+	}
+
+	// CompiledModule is a Module which is validated and whose functions are compiled by an Engine.
+	// This is the result of Store.CompileModule, and can be instantiated many times without recompiling.
+	CompiledModule struct {
+		// Module is the source of this CompiledModule.
+		Module *Module
+		// functions holds the results of Engine.Compile for the functions defined in Module
+		// in the order of Module.FunctionSection.
+		functions []CompiledFunction
+		// engine is the Engine which compiled the functions.
+		engine Engine
+		// closed is true once Close is called.
+		closed bool
 	}
 
 	// ExportInstance represents an exported instance in a Store.
@@ -104,11 +143,18 @@ type (
 		Address FunctionAddress
 		// Name is for debugging purpose, and is used to argument the stack traces.
 		//
-		// When HostFunction is not nil, this returns dot-delimited parameters given to
-		// Store.AddHostFunction. Ex. something.realistic
+		// For host functions, this returns dot-delimited parameters given to
+		// Store.AddHostFunction or Store.AddRawHostFunction. Ex. something.realistic
 		//
 		// Otherwise, this is the corresponding value in NameSection.FunctionNames or "unknown" if unavailable.
 		Name string
+		// RawHostFunction holds the host function added by Store.AddRawHostFunction.
+		// If this is not nil, the fields specific to non-host functions are ignored as well as HostFunction.
+		RawHostFunction RawHostFunction
+		// Index is the index of this function in the function index space of ModuleInstance.
+		Index Index
+		// BodyOffset is the byte offset of Body in the binary of the module. See Code.BodyOffset.
+		BodyOffset uint64
 	}
 
 	// TypeInstance is a store-specific representation of FunctionType where the function type
@@ -165,6 +211,12 @@ type (
 		Buffer []byte
 		Min    uint32
 		Max    *uint32
+
+		// maxPages is the limit imposed by the embedder in addition to Max, or nil if there's no such limit.
+		// See RuntimeConfig.MaxMemoryPages and SetMaxPages.
+		maxPages *uint32
+		// growHook is called on memory growth if set. See SetGrowHook.
+		growHook MemoryGrowHook
 	}
 
 	// FunctionAddress is funcaddr (https://www.w3.org/TR/wasm-core-1/#syntax-funcaddr),
@@ -178,34 +230,197 @@ type (
 )
 
 func (f *FunctionInstance) IsHostFunction() bool {
-	return f.HostFunction != nil
+	return f.HostFunction != nil || f.RawHostFunction != nil
 }
 
 func NewStore(engine Engine) *Store {
-	return &Store{ModuleInstances: map[string]*ModuleInstance{}, TypeIDs: map[string]FunctionTypeID{}, engine: engine}
+	return NewStoreWithConfig(engine, nil)
+}
+
+// NewStoreWithConfig is the same as NewStore except that the limits in config are applied to the instances in the store.
+// Note that the limits on the execution such as RuntimeConfig.MaxCallStackDepth are applied by the engine, so config
+// should also be given to engine.
+func NewStoreWithConfig(engine Engine, config *RuntimeConfig) *Store {
+	return &Store{
+		ModuleInstances: map[string]*ModuleInstance{},
+		TypeIDs:         map[string]FunctionTypeID{},
+		engine:          engine,
+		config:          config.WithDefaults(),
+		importResolver:  ModuleInstanceResolver,
+	}
+}
+
+// SetImportResolver sets the ImportResolver consulted for each import of the modules instantiated after this call.
+// nil restores the default ModuleInstanceResolver.
+func (s *Store) SetImportResolver(r ImportResolver) {
+	if r == nil {
+		r = ModuleInstanceResolver
+	}
+	s.importResolver = r
 }
 
+// Instantiate instantiates the module under the given name, and executes its start function if exists.
 func (s *Store) Instantiate(module *Module, name string) error {
-	instance := &ModuleInstance{}
+	return s.InstantiateContext(context.Background(), module, name)
+}
+
+// InstantiateContext is the same as Instantiate except the start function is executed with the given ctx,
+// which allows callers to cancel or set a deadline on the execution.
+func (s *Store) InstantiateContext(ctx context.Context, module *Module, name string) error {
+	compiled, err := s.CompileModule(module)
+	if err != nil {
+		return err
+	}
+	err = s.InstantiateCompiledContext(ctx, compiled, name)
+	// The compiled code is held by the instance if succeeded, so the CompiledModule is no longer needed.
+	if closeErr := compiled.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// CompileModule validates the module and compiles its functions with the engine of this store.
+//
+// The returned CompiledModule can be instantiated many times via InstantiateCompiled, in this store or other ones
+// using the same Engine, without recompiling the functions.
+func (s *Store) CompileModule(module *Module) (*CompiledModule, error) {
+	template, err := newCompilationTemplate(module)
+	if err != nil {
+		return nil, fmt.Errorf("functions: %w", err)
+	}
+
+	ret := &CompiledModule{Module: module, engine: s.engine}
+	importedFunctionCount := len(template.Functions) - len(module.FunctionSection)
+	functions := template.Functions[importedFunctionCount:]
+	compiled, errs := make([]CompiledFunction, len(functions)), make([]error, len(functions))
+	s.compileFunctions(functions, compiled, errs)
+	// The error of the first function is reported regardless of the order of the compilation.
+	for i, err := range errs {
+		if err != nil {
+			for j, c := range compiled {
+				if errs[j] == nil {
+					ret.functions = append(ret.functions, c)
+				}
+			}
+			_ = ret.Close()
+			return nil, fmt.Errorf("compilation failed at index %d/%d: %v", i, len(module.FunctionSection)-1, err)
+		}
+	}
+	ret.functions = compiled
+	return ret, nil
+}
+
+// compileFunctions compiles functions with the engine on RuntimeConfig.CompilationWorkers goroutines, and sets
+// the results to compiled and errs at the same indexes as functions.
+func (s *Store) compileFunctions(functions []*FunctionInstance, compiled []CompiledFunction, errs []error) {
+	compile := func(i int) {
+		defer func() {
+			// Panics can't be recovered by the caller on the worker goroutines.
+			if r := recover(); r != nil {
+				errs[i] = fmt.Errorf("panic during compilation: %v", r)
+			}
+		}()
+		compiled[i], errs[i] = s.engine.Compile(functions[i])
+	}
+
+	workers := int(s.config.CompilationWorkers)
+	if workers > len(functions) {
+		workers = len(functions)
+	}
+	if workers <= 1 {
+		for i := range functions {
+			compile(i)
+		}
+		return
+	}
+
+	var next int64
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1) - 1)
+				if i >= len(functions) {
+					return
+				}
+				compile(i)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Close releases the compiled code held by this CompiledModule. The instances of this module remain usable
+// until they are closed, but this CompiledModule cannot be instantiated anymore.
+//
+// All the functions are released even if some of them fail, and the failures are reported together.
+func (c *CompiledModule) Close() error {
+	c.closed = true
+	functions := c.functions
+	c.functions = nil
+	var failures []string
+	for i, f := range functions {
+		if err := c.engine.ReleaseCompiled(f); err != nil {
+			failures = append(failures, fmt.Sprintf("index %d/%d: %v", i, len(functions)-1, err))
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("releasing compiled functions failed at %s", strings.Join(failures, ", "))
+	}
+	return nil
+}
+
+// InstantiateCompiled instantiates the compiled module under the given name, and executes its start function if exists.
+func (s *Store) InstantiateCompiled(compiled *CompiledModule, name string) error {
+	return s.InstantiateCompiledContext(context.Background(), compiled, name)
+}
+
+// InstantiateCompiledContext is the same as InstantiateCompiled except the start function is executed with the given ctx,
+// which allows callers to cancel or set a deadline on the execution.
+func (s *Store) InstantiateCompiledContext(ctx context.Context, compiled *CompiledModule, name string) error {
+	return s.InstantiateCompiledWithImports(ctx, compiled, name, nil)
+}
+
+// InstantiateCompiledWithImports is the same as InstantiateCompiledContext except that imports, if not nil, is consulted
+// before the ImportResolver of this store for the imports of this instantiation. This allows instantiating the same
+// CompiledModule many times with different import providers, for example with ModuleNameResolver.
+func (s *Store) InstantiateCompiledWithImports(ctx context.Context, compiled *CompiledModule, name string, imports ImportResolver) error {
+	if compiled.closed {
+		return fmt.Errorf("compiled module is closed")
+	} else if compiled.engine != s.engine {
+		return fmt.Errorf("module is compiled by another engine")
+	}
+	module := compiled.Module
+
+	instance := &ModuleInstance{Name: name, engine: s.engine, store: s}
 	for _, t := range module.TypeSection {
 		instance.Types = append(instance.Types, s.getTypeInstance(t))
 	}
 
 	s.ModuleInstances[name] = instance
-	// Resolve the imports before doing the actual instantiation (mutating store).
-	if err := s.resolveImports(module, instance); err != nil {
-		return fmt.Errorf("resolve imports: %w", err)
-	}
-	// Instantiation.
-	// Note that some of them mutate the store, so
+	// Note that some of the following steps mutate the store, so
 	// in the case of errors, we must rollback the state of store.
 	var rollbackFuncs []func()
 	defer func() {
-		for _, f := range rollbackFuncs {
-			f()
+		// Rollback in the reverse order as the later steps depend on the state made by the earlier ones.
+		for i := len(rollbackFuncs) - 1; i >= 0; i-- {
+			rollbackFuncs[i]()
 		}
 	}()
-	rs, err := s.buildGlobalInstances(module, instance)
+	// Resolve the imports before doing the actual instantiation.
+	resolver := s.importResolver
+	if imports != nil {
+		resolver = ChainImportResolvers(imports, resolver)
+	}
+	rs, err := s.resolveImports(resolver, module, instance)
+	rollbackFuncs = append(rollbackFuncs, rs...)
+	if err != nil {
+		return fmt.Errorf("resolve imports: %w", err)
+	}
+	// Instantiation.
+	rs, err = s.buildGlobalInstances(module, instance)
 	rollbackFuncs = append(rollbackFuncs, rs...)
 	if err != nil {
 		return fmt.Errorf("globals: %w", err)
@@ -231,10 +446,15 @@ func (s *Store) Instantiate(module *Module, name string) error {
 		return fmt.Errorf("exports: %w", err)
 	}
 
-	for i, f := range instance.Functions {
-		if err := s.engine.Compile(f); err != nil {
-			return fmt.Errorf("compilation failed at index %d/%d: %v", i, len(module.FunctionSection)-1, err)
+	importedFunctionCount := len(instance.Functions) - len(module.FunctionSection)
+	for i, f := range instance.Functions[importedFunctionCount:] {
+		if err := s.engine.Bind(f, compiled.functions[i]); err != nil {
+			return fmt.Errorf("binding compiled function failed at index %d/%d: %v", i, len(module.FunctionSection)-1, err)
 		}
+		f := f
+		rollbackFuncs = append(rollbackFuncs, func() {
+			_ = s.engine.Release(f)
+		})
 	}
 
 	// Check the start function is valid.
@@ -255,14 +475,21 @@ func (s *Store) Instantiate(module *Module, name string) error {
 	// Execute the start function.
 	if startIndex := module.StartSection; startIndex != nil {
 		f := instance.Functions[*startIndex]
-		if _, err := s.engine.Call(f); err != nil {
-			return fmt.Errorf("calling start function failed: %v", err)
+		if _, err := s.engine.Call(ctx, f); err != nil {
+			return fmt.Errorf("calling start function failed: %w", err)
 		}
 	}
 	return nil
 }
 
+// CallFunction invokes the function exported as funcName in the module instantiated as moduleName.
 func (s *Store) CallFunction(moduleName, funcName string, params ...uint64) (results []uint64, resultTypes []ValueType, err error) {
+	return s.CallFunctionContext(context.Background(), moduleName, funcName, params...)
+}
+
+// CallFunctionContext is the same as CallFunction except the execution is terminated with ErrRuntimeCallCanceled
+// once ctx is done. For example, this can be used to bound the execution time of a guest stuck in an infinite loop.
+func (s *Store) CallFunctionContext(ctx context.Context, moduleName, funcName string, params ...uint64) (results []uint64, resultTypes []ValueType, err error) {
 	m, ok := s.ModuleInstances[moduleName]
 	if !ok {
 		return nil, nil, fmt.Errorf("module '%s' not instantiated", moduleName)
@@ -282,62 +509,320 @@ func (s *Store) CallFunction(moduleName, funcName string, params ...uint64) (res
 		return nil, nil, fmt.Errorf("invalid number of parameters")
 	}
 
-	ret, err := s.engine.Call(f, params...)
+	ret, err := s.engine.Call(ctx, f, params...)
 	return ret, f.FunctionType.Type.Results, err
 }
 
-func (s *Store) addFunctionInstance(f *FunctionInstance) {
-	f.Address = FunctionAddress(len(s.Functions))
-	s.Functions = append(s.Functions, f)
+// FunctionByAddress returns the function instance at the address addr in the store to which this module instance
+// belongs, or nil if there's no such function. Function addresses, such as the ones in tables, are only unique
+// within a store, so engines shared by stores use this to resolve them from the calling module instance.
+func (m *ModuleInstance) FunctionByAddress(addr FunctionAddress) *FunctionInstance {
+	if m.store == nil || int(addr) >= len(m.store.Functions) {
+		return nil
+	}
+	return m.store.Functions[addr]
 }
 
-func (s *Store) resolveImports(module *Module, target *ModuleInstance) error {
-	for _, is := range module.ImportSection {
-		if err := s.resolveImport(target, is); err != nil {
-			return fmt.Errorf("%s: %w", is.Name, err)
+func (m *ModuleInstance) addDependency(d *ModuleInstance) {
+	for _, existing := range m.dependencies {
+		if existing == d {
+			return
 		}
 	}
-	return nil
+	m.dependencies = append(m.dependencies, d)
 }
 
-func (s *Store) resolveImport(target *ModuleInstance, is *Import) error {
-	em, ok := s.ModuleInstances[is.Module]
+// AliasModule makes the module instance instantiated as moduleName visible as alias as well, so that it can be
+// imported and called with either name. This corresponds to the "register" command of the spec tests.
+//
+// Closing the module instance with CloseModule removes all of its names.
+func (s *Store) AliasModule(moduleName, alias string) error {
+	m, ok := s.ModuleInstances[moduleName]
 	if !ok {
-		return fmt.Errorf("failed to resolve import of module name %s", is.Module)
+		return fmt.Errorf("module '%s' not instantiated", moduleName)
+	}
+	if _, ok := s.ModuleInstances[alias]; ok {
+		return fmt.Errorf("module '%s' already exists", alias)
 	}
+	s.ModuleInstances[alias] = m
+	return nil
+}
 
-	e, ok := em.Exports[is.Name]
+// CloseModule closes the module instance instantiated as moduleName, and releases the instances
+// defined in it as well as the compiled code of its functions.
+//
+// This returns an error if other module instances in this store still import the module instance.
+// Note that this must not be invoked while functions of the module instance are being executed.
+func (s *Store) CloseModule(moduleName string) error {
+	m, ok := s.ModuleInstances[moduleName]
 	if !ok {
-		return fmt.Errorf("not exported in module %s", is.Module)
+		return fmt.Errorf("module '%s' not instantiated", moduleName)
+	}
+	for name, other := range s.ModuleInstances {
+		if other == m {
+			continue
+		}
+		for _, d := range other.dependencies {
+			if d == m {
+				return fmt.Errorf("module '%s' is imported by '%s'", moduleName, name)
+			}
+		}
+	}
+
+	for name, other := range s.ModuleInstances {
+		if other == m {
+			delete(s.ModuleInstances, name)
+		}
+	}
+	return s.releaseModuleInstance(m)
+}
+
+// Close closes all the module instances in this store regardless of their imports, and releases
+// the compiled code of their functions. The store is empty after this returns.
+func (s *Store) Close() (err error) {
+	closed := map[*ModuleInstance]struct{}{}
+	for name, m := range s.ModuleInstances {
+		delete(s.ModuleInstances, name)
+		if _, ok := closed[m]; ok {
+			continue
+		}
+		closed[m] = struct{}{}
+		if e := s.releaseModuleInstance(m); e != nil && err == nil {
+			err = fmt.Errorf("close module '%s': %w", name, e)
+		}
+	}
+	s.Functions, s.Globals, s.Memories, s.Tables = nil, nil, nil, nil
+	return
+}
+
+// releaseModuleInstance releases the instances defined in m from the store.
+func (s *Store) releaseModuleInstance(m *ModuleInstance) (err error) {
+	// The instances imported by m are exported by its dependencies, and must not be released.
+	imported := map[interface{}]struct{}{}
+	for _, d := range m.dependencies {
+		for _, e := range d.Exports {
+			switch e.Kind {
+			case ExportKindFunc:
+				imported[e.Function] = struct{}{}
+			case ExportKindGlobal:
+				imported[e.Global] = struct{}{}
+			case ExportKindMemory:
+				imported[e.Memory] = struct{}{}
+			case ExportKindTable:
+				imported[e.Table] = struct{}{}
+			}
+		}
+	}
+
+	// Host modules hold their instances only in Exports.
+	owned := map[interface{}]struct{}{}
+	functions := append([]*FunctionInstance{}, m.Functions...)
+	globals := append([]*GlobalInstance{}, m.Globals...)
+	memories := []*MemoryInstance{m.Memory}
+	tables := append([]*TableInstance{}, m.Tables...)
+	for _, e := range m.Exports {
+		functions = append(functions, e.Function)
+		globals = append(globals, e.Global)
+		memories = append(memories, e.Memory)
+		tables = append(tables, e.Table)
+	}
+
+	releasedAddresses := map[FunctionAddress]struct{}{}
+	for _, f := range functions {
+		if _, ok := owned[f]; ok || f == nil || f.ModuleInstance != m {
+			continue
+		}
+		owned[f] = struct{}{}
+		// f is not in the store if the instantiation of m failed and was rolled back.
+		if int(f.Address) >= len(s.Functions) || s.Functions[f.Address] != f {
+			continue
+		}
+		if e := s.engine.Release(f); e != nil && err == nil {
+			err = fmt.Errorf("release function %s: %w", f.Name, e)
+		}
+		s.Functions[f.Address] = nil
+		releasedAddresses[f.Address] = struct{}{}
+	}
+	// Function addresses are indexes of Store.Functions, so only the trailing released ones can be removed.
+	for len(s.Functions) > 0 && s.Functions[len(s.Functions)-1] == nil {
+		s.Functions = s.Functions[:len(s.Functions)-1]
+	}
+
+	for _, g := range globals {
+		if _, ok := imported[g]; !ok && g != nil {
+			owned[g] = struct{}{}
+		}
+	}
+	for _, mem := range memories {
+		if _, ok := imported[mem]; !ok && mem != nil {
+			owned[mem] = struct{}{}
+		}
+	}
+	for _, t := range tables {
+		if _, ok := imported[t]; !ok && t != nil {
+			owned[t] = struct{}{}
+		} else if t != nil {
+			// The element segments of m might have put its functions into the imported table.
+			for i, elm := range t.Table {
+				if _, ok := releasedAddresses[elm.FunctionAddress]; ok && elm.FunctionTypeID != UninitializedTableElelemtTypeID {
+					t.Table[i] = TableElement{FunctionTypeID: UninitializedTableElelemtTypeID}
+				}
+			}
+		}
+	}
+
+	globalsLeft := s.Globals[:0]
+	for _, g := range s.Globals {
+		if _, ok := owned[g]; !ok {
+			globalsLeft = append(globalsLeft, g)
+		}
+	}
+	s.Globals = globalsLeft
+	memoriesLeft := s.Memories[:0]
+	for _, mem := range s.Memories {
+		if _, ok := owned[mem]; !ok {
+			memoriesLeft = append(memoriesLeft, mem)
+		}
+	}
+	s.Memories = memoriesLeft
+	tablesLeft := s.Tables[:0]
+	for _, t := range s.Tables {
+		if _, ok := owned[t]; !ok {
+			tablesLeft = append(tablesLeft, t)
+		}
+	}
+	s.Tables = tablesLeft
+	return
+}
+
+func (s *Store) addFunctionInstance(f *FunctionInstance) {
+	f.Address = FunctionAddress(len(s.Functions))
+	s.Functions = append(s.Functions, f)
+}
+
+// resolveImports resolves the imports of module with resolver, and applies them to target.
+// All the unresolved imports are reported at once as UnresolvedImportsError.
+func (s *Store) resolveImports(resolver ImportResolver, module *Module, target *ModuleInstance) (rollbackFuncs []func(), err error) {
+	var unresolved []*Import
+	for _, is := range module.ImportSection {
+		e, err := resolver.ResolveImport(s, module, is)
+		if err != nil {
+			return rollbackFuncs, fmt.Errorf("%s: %w", is.Name, err)
+		} else if e == nil {
+			unresolved = append(unresolved, is)
+			continue
+		} else if len(unresolved) > 0 {
+			// We only look for the other unresolved imports.
+			continue
+		}
+		rs, err := s.resolveImport(target, is, e)
+		rollbackFuncs = append(rollbackFuncs, rs...)
+		if err != nil {
+			return rollbackFuncs, fmt.Errorf("%s: %w", is.Name, err)
+		}
 	}
+	if len(unresolved) > 0 {
+		return rollbackFuncs, &UnresolvedImportsError{Imports: unresolved}
+	}
+	return
+}
 
+// resolveImport applies the instance e resolved for the import is to target. The module instance exporting e
+// becomes a dependency of target, and e is added to the store if it is a new instance.
+func (s *Store) resolveImport(target *ModuleInstance, is *Import, e *ExportInstance) (rollbackFuncs []func(), err error) {
 	if is.Kind != e.Kind {
-		return fmt.Errorf("type mismatch on export: got %#x but want %#x", e.Kind, is.Kind)
+		return nil, fmt.Errorf("type mismatch on export: got %#x but want %#x", e.Kind, is.Kind)
 	}
 	switch is.Kind {
 	case ImportKindFunc:
-		if err := s.applyFunctionImport(target, is.DescFunc, e); err != nil {
-			return fmt.Errorf("applyFunctionImport: %w", err)
+		if err = s.applyFunctionImport(target, is.DescFunc, e); err != nil {
+			return nil, fmt.Errorf("applyFunctionImport: %w", err)
 		}
 	case ImportKindTable:
-		if err := s.applyTableImport(target, is.DescTable, e); err != nil {
-			return fmt.Errorf("applyTableImport: %w", err)
+		if err = s.applyTableImport(target, is.DescTable, e); err != nil {
+			return nil, fmt.Errorf("applyTableImport: %w", err)
 		}
 	case ImportKindMemory:
-		if err := s.applyMemoryImport(target, is.DescMem, e); err != nil {
-			return fmt.Errorf("applyMemoryImport: %w", err)
+		if err = s.applyMemoryImport(target, is.DescMem, e); err != nil {
+			return nil, fmt.Errorf("applyMemoryImport: %w", err)
 		}
 	case ImportKindGlobal:
-		if err := s.applyGlobalImport(target, is.DescGlobal, e); err != nil {
-			return fmt.Errorf("applyGlobalImport: %w", err)
+		if err = s.applyGlobalImport(target, is.DescGlobal, e); err != nil {
+			return nil, fmt.Errorf("applyGlobalImport: %w", err)
 		}
 	default:
-		return fmt.Errorf("invalid kind of import: %#x", is.Kind)
+		return nil, fmt.Errorf("invalid kind of import: %#x", is.Kind)
 	}
 
+	if exporter := s.exportingModuleInstance(e); exporter != nil {
+		target.addDependency(exporter)
+		return nil, nil
+	}
+	return s.addResolvedInstance(target, e)
+}
+
+// exportingModuleInstance returns the module instance in this store which exports e, or nil if e is a new instance.
+func (s *Store) exportingModuleInstance(e *ExportInstance) *ModuleInstance {
+	if f := e.Function; f != nil {
+		if int(f.Address) < len(s.Functions) && s.Functions[f.Address] == f {
+			return f.ModuleInstance
+		}
+		return nil
+	}
+	for _, m := range s.ModuleInstances {
+		for _, exp := range m.Exports {
+			if exp.Kind == e.Kind && exp.Global == e.Global && exp.Memory == e.Memory && exp.Table == e.Table {
+				return m
+			}
+		}
+	}
 	return nil
 }
 
+// addResolvedInstance adds the new instance e resolved for an import of target to the store. The instance is owned by
+// target, so it is released when target is closed.
+func (s *Store) addResolvedInstance(target *ModuleInstance, e *ExportInstance) (rollbackFuncs []func(), err error) {
+	switch e.Kind {
+	case ExportKindFunc:
+		f := e.Function
+		if f.ModuleInstance == nil {
+			// The function is just imported at the end of the function index space of target.
+			f.ModuleInstance, f.Index = target, Index(len(target.Functions)-1)
+		}
+		compiled, err := s.engine.Compile(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile %s: %v", f.Name, err)
+		}
+		// Bind requires the address of f, so the instance is added to the store first.
+		s.addFunctionInstance(f)
+		if err = s.engine.Bind(f, compiled); err != nil {
+			s.Functions = s.Functions[:f.Address]
+			_ = s.engine.ReleaseCompiled(compiled)
+			return nil, fmt.Errorf("failed to bind %s: %v", f.Name, err)
+		}
+		rollbackFuncs = append(rollbackFuncs, func() {
+			_ = s.engine.Release(f)
+			s.Functions[f.Address] = nil
+			for len(s.Functions) > 0 && s.Functions[len(s.Functions)-1] == nil {
+				s.Functions = s.Functions[:len(s.Functions)-1]
+			}
+		})
+	case ExportKindGlobal:
+		prevLen := len(s.Globals)
+		s.Globals = append(s.Globals, e.Global)
+		rollbackFuncs = append(rollbackFuncs, func() { s.Globals = s.Globals[:prevLen] })
+	case ExportKindMemory:
+		prevLen := len(s.Memories)
+		s.Memories = append(s.Memories, e.Memory)
+		rollbackFuncs = append(rollbackFuncs, func() { s.Memories = s.Memories[:prevLen] })
+	case ExportKindTable:
+		prevLen := len(s.Tables)
+		s.Tables = append(s.Tables, e.Table)
+		rollbackFuncs = append(rollbackFuncs, func() { s.Tables = s.Tables[:prevLen] })
+	}
+	return
+}
+
 func (s *Store) applyFunctionImport(target *ModuleInstance, typeIndex Index, externModuleExportInstance *ExportInstance) error {
 	f := externModuleExportInstance.Function
 	if int(typeIndex) >= len(target.Types) {
@@ -505,29 +990,13 @@ func (s *Store) buildFunctionInstances(module *Module, target *ModuleInstance) (
 	rollbackFuncs = append(rollbackFuncs, func() {
 		s.Functions = s.Functions[:prevLen]
 	})
-	var functionDeclarations []Index
-	var globalDeclarations []*GlobalType
-	var memoryDeclarations []*MemoryType
-	var tableDeclarations []*TableType
+
+	var importedFunctionCount int
 	for _, imp := range module.ImportSection {
-		switch imp.Kind {
-		case ImportKindFunc:
-			functionDeclarations = append(functionDeclarations, imp.DescFunc)
-		case ImportKindGlobal:
-			globalDeclarations = append(globalDeclarations, imp.DescGlobal)
-		case ImportKindMemory:
-			memoryDeclarations = append(memoryDeclarations, imp.DescMem)
-		case ImportKindTable:
-			tableDeclarations = append(tableDeclarations, imp.DescTable)
+		if imp.Kind == ImportKindFunc {
+			importedFunctionCount++
 		}
 	}
-	importedFunctionCount := len(functionDeclarations)
-	functionDeclarations = append(functionDeclarations, module.FunctionSection...)
-	for _, g := range module.GlobalSection {
-		globalDeclarations = append(globalDeclarations, g.Type)
-	}
-	memoryDeclarations = append(memoryDeclarations, module.MemorySection...)
-	tableDeclarations = append(tableDeclarations, module.TableSection...)
 
 	var functionNames NameMap
 	if module.NameSection != nil {
@@ -536,8 +1005,6 @@ func (s *Store) buildFunctionInstances(module *Module, target *ModuleInstance) (
 
 	n, nLen := 0, len(functionNames)
 
-	analysisCache := map[int]map[uint64]struct{}{}
-
 	for codeIndex, typeIndex := range module.FunctionSection {
 		if typeIndex >= uint32(len(module.TypeSection)) {
 			return rollbackFuncs, fmt.Errorf("function type index out of range")
@@ -564,18 +1031,10 @@ func (s *Store) buildFunctionInstances(module *Module, target *ModuleInstance) (
 			Name:           name,
 			FunctionType:   s.getTypeInstance(module.TypeSection[typeIndex]),
 			Body:           module.CodeSection[codeIndex].Body,
+			BodyOffset:     module.CodeSection[codeIndex].BodyOffset,
 			LocalTypes:     module.CodeSection[codeIndex].LocalTypes,
 			ModuleInstance: target,
-		}
-
-		if _, ok := analysisCache[codeIndex]; !ok {
-			err := validateFunction(
-				module, f, functionDeclarations, globalDeclarations,
-				memoryDeclarations, tableDeclarations,
-			)
-			if err != nil {
-				return rollbackFuncs, fmt.Errorf("invalid function at index %d/%d: %v", codeIndex, len(module.FunctionSection)-1, err)
-			}
+			Index:          funcIdx,
 		}
 
 		target.Functions = append(target.Functions, f)
@@ -584,6 +1043,73 @@ func (s *Store) buildFunctionInstances(module *Module, target *ModuleInstance) (
 	return rollbackFuncs, nil
 }
 
+// newCompilationTemplate validates the functions defined in module, and returns a ModuleInstance
+// which doesn't belong to any Store, and is only used to compile the functions.
+//
+// The template holds the function, global and type instances both imported and defined in module
+// so that the functions can be compiled without resolving the imports. Note that the store specific
+// values such as FunctionInstance.Address and TypeInstance.TypeID are not set.
+func newCompilationTemplate(module *Module) (*ModuleInstance, error) {
+	template := &ModuleInstance{}
+	for _, t := range module.TypeSection {
+		template.Types = append(template.Types, &TypeInstance{Type: t})
+	}
+
+	var functionDeclarations []Index
+	var globalDeclarations []*GlobalType
+	var memoryDeclarations []*MemoryType
+	var tableDeclarations []*TableType
+	for _, imp := range module.ImportSection {
+		switch imp.Kind {
+		case ImportKindFunc:
+			functionDeclarations = append(functionDeclarations, imp.DescFunc)
+		case ImportKindGlobal:
+			globalDeclarations = append(globalDeclarations, imp.DescGlobal)
+		case ImportKindMemory:
+			memoryDeclarations = append(memoryDeclarations, imp.DescMem)
+		case ImportKindTable:
+			tableDeclarations = append(tableDeclarations, imp.DescTable)
+		}
+	}
+	importedFunctionCount := len(functionDeclarations)
+	functionDeclarations = append(functionDeclarations, module.FunctionSection...)
+	for _, g := range module.GlobalSection {
+		globalDeclarations = append(globalDeclarations, g.Type)
+	}
+	memoryDeclarations = append(memoryDeclarations, module.MemorySection...)
+	tableDeclarations = append(tableDeclarations, module.TableSection...)
+
+	for i, typeIndex := range functionDeclarations {
+		if typeIndex >= uint32(len(module.TypeSection)) {
+			return nil, fmt.Errorf("function type index out of range")
+		}
+		f := &FunctionInstance{FunctionType: template.Types[typeIndex], ModuleInstance: template, Index: Index(i)}
+		if codeIndex := i - importedFunctionCount; codeIndex >= 0 {
+			if codeIndex >= len(module.CodeSection) {
+				return nil, fmt.Errorf("code index out of range")
+			}
+			f.Body = module.CodeSection[codeIndex].Body
+			f.BodyOffset = module.CodeSection[codeIndex].BodyOffset
+			f.LocalTypes = module.CodeSection[codeIndex].LocalTypes
+		}
+		template.Functions = append(template.Functions, f)
+	}
+	for _, g := range globalDeclarations {
+		template.Globals = append(template.Globals, &GlobalInstance{Type: g})
+	}
+
+	for codeIndex, f := range template.Functions[importedFunctionCount:] {
+		err := validateFunction(
+			module, f, functionDeclarations, globalDeclarations,
+			memoryDeclarations, tableDeclarations,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("invalid function at index %d/%d: %v", codeIndex, len(module.FunctionSection)-1, err)
+		}
+	}
+	return template, nil
+}
+
 func (s *Store) buildMemoryInstances(module *Module, target *ModuleInstance) (rollbackFuncs []func(), err error) {
 	// Allocate memory instances.
 	for _, memSec := range module.MemorySection {
@@ -592,10 +1118,15 @@ func (s *Store) buildMemoryInstances(module *Module, target *ModuleInstance) (ro
 			// and the current Wasm spec doesn't allow multiple memories.
 			return rollbackFuncs, fmt.Errorf("multiple memories not supported")
 		}
+		if memSec.Min > s.config.MaxMemoryPages {
+			return rollbackFuncs, fmt.Errorf("memory min %d pages exceeds the limit %d pages", memSec.Min, s.config.MaxMemoryPages)
+		}
 		target.Memory = &MemoryInstance{
-			Buffer: make([]byte, uint64(memSec.Min)*PageSize),
-			Min:    memSec.Min,
-			Max:    memSec.Max,
+			Buffer:   make([]byte, uint64(memSec.Min)*PageSize),
+			Min:      memSec.Min,
+			Max:      memSec.Max,
+			maxPages: &s.config.MaxMemoryPages,
+			growHook: s.config.MemoryGrowHook,
 		}
 		s.Memories = append(s.Memories, target.Memory)
 	}
@@ -649,6 +1180,9 @@ func (s *Store) buildMemoryInstances(module *Module, target *ModuleInstance) (ro
 func (s *Store) buildTableInstances(module *Module, target *ModuleInstance) (rollbackFuncs []func(), err error) {
 	// Allocate table instances.
 	for _, tableSeg := range module.TableSection {
+		if tableSeg.Limit.Min > s.config.MaxTableElements {
+			return rollbackFuncs, fmt.Errorf("table min %d elements exceeds the limit %d elements", tableSeg.Limit.Min, s.config.MaxTableElements)
+		}
 		instance := newTableInstance(tableSeg.Limit.Min, tableSeg.Limit.Max)
 		target.Tables = append(target.Tables, instance)
 		s.Tables = append(s.Tables, instance)
@@ -822,13 +1356,26 @@ func (s *valueTypeStack) pushStackLimit() {
 	s.stackLimits = append(s.stackLimits, len(s.stack))
 }
 
+// enterBlock pops the params of a block, and pushes them back above the new stack limit of the block.
+func (s *valueTypeStack) enterBlock(params []ValueType) error {
+	if err := s.popResults(params, false); err != nil {
+		return err
+	}
+	s.pushStackLimit()
+	for _, t := range params {
+		s.push(t)
+	}
+	return nil
+}
+
 func (s *valueTypeStack) popResults(expResults []ValueType, checkAboveLimit bool) error {
 	limit := 0
 	if len(s.stackLimits) > 0 {
 		limit = s.stackLimits[len(s.stackLimits)-1]
 	}
-	for _, exp := range expResults {
-		if err := s.popAndVerifyType(exp); err != nil {
+	// The last result is on the top of the stack.
+	for i := len(expResults) - 1; i >= 0; i-- {
+		if err := s.popAndVerifyType(expResults[i]); err != nil {
 			return err
 		}
 	}
@@ -1200,8 +1747,8 @@ func validateFunction(
 			targetResultType := target.BlockType.Results
 			if target.IsLoop {
 				// Loop operation doesn't require results since the continuation is
-				// the beginning of the loop.
-				targetResultType = []ValueType{}
+				// the beginning of the loop, which takes the params instead.
+				targetResultType = target.BlockType.Params
 			}
 			if err := valueTypeStack.popResults(targetResultType, false); err != nil {
 				return fmt.Errorf("type mismatch on the br operation: %v", err)
@@ -1227,8 +1774,8 @@ func validateFunction(
 			targetResultType := target.BlockType.Results
 			if target.IsLoop {
 				// Loop operation doesn't require results since the continuation is
-				// the beginning of the loop.
-				targetResultType = []ValueType{}
+				// the beginning of the loop, which takes the params instead.
+				targetResultType = target.BlockType.Params
 			}
 			if err := valueTypeStack.popResults(targetResultType, false); err != nil {
 				return fmt.Errorf("type mismatch on the br_if operation: %v", err)
@@ -1271,8 +1818,8 @@ func validateFunction(
 			expType := lnLabel.BlockType.Results
 			if lnLabel.IsLoop {
 				// Loop operation doesn't require results since the continuation is
-				// the beginning of the loop.
-				expType = []ValueType{}
+				// the beginning of the loop, which takes the params instead.
+				expType = lnLabel.BlockType.Params
 			}
 			for _, l := range list {
 				if int(l) >= len(labelStack) {
@@ -1282,8 +1829,8 @@ func validateFunction(
 				expType2 := label.BlockType.Results
 				if label.IsLoop {
 					// Loop operation doesn't require results since the continuation is
-					// the beginning of the loop.
-					expType2 = []ValueType{}
+					// the beginning of the loop, which takes the params instead.
+					expType2 = label.BlockType.Params
 				}
 				if len(expType) != len(expType2) {
 					return fmt.Errorf("incosistent block type length for br_table at %d; %v (ln=%d) != %v (l=%d)", l, expType, ln, expType2, l)
@@ -1554,7 +2101,9 @@ func validateFunction(
 				BlockType:      bt,
 				BlockTypeBytes: num,
 			})
-			valueTypeStack.pushStackLimit()
+			if err := valueTypeStack.enterBlock(bt.Params); err != nil {
+				return fmt.Errorf("cannot pop the params for 'block': %v", err)
+			}
 			pc += num
 		} else if op == OpcodeLoop {
 			bt, num, err := DecodeBlockType(f.ModuleInstance.Types, bytes.NewBuffer(f.Body[pc+1:]))
@@ -1567,7 +2116,9 @@ func validateFunction(
 				BlockTypeBytes: num,
 				IsLoop:         true,
 			})
-			valueTypeStack.pushStackLimit()
+			if err := valueTypeStack.enterBlock(bt.Params); err != nil {
+				return fmt.Errorf("cannot pop the params for 'loop': %v", err)
+			}
 			pc += num
 		} else if op == OpcodeIf {
 			bt, num, err := DecodeBlockType(f.ModuleInstance.Types, bytes.NewBuffer(f.Body[pc+1:]))
@@ -1583,7 +2134,9 @@ func validateFunction(
 			if err := valueTypeStack.popAndVerifyType(ValueTypeI32); err != nil {
 				return fmt.Errorf("cannot pop the operand for 'if': %v", err)
 			}
-			valueTypeStack.pushStackLimit()
+			if err := valueTypeStack.enterBlock(bt.Params); err != nil {
+				return fmt.Errorf("cannot pop the params for 'if': %v", err)
+			}
 			pc += num
 		} else if op == OpcodeElse {
 			bl := labelStack[len(labelStack)-1]
@@ -1593,14 +2146,18 @@ func validateFunction(
 				return fmt.Errorf("invalid instruction results in then instructions")
 			}
 			// Before entring instructions inside else, we pop all the values pushed by
-			// then block.
+			// then block, and the else block starts with the params as well.
 			valueTypeStack.resetAtStackLimit()
+			for _, t := range bl.BlockType.Params {
+				valueTypeStack.push(t)
+			}
 		} else if op == OpcodeEnd {
 			bl := labelStack[len(labelStack)-1]
 			bl.EndAt = pc
 			labelStack = labelStack[:len(labelStack)-1]
 			if bl.IsIf && bl.ElseAt <= bl.StartAt {
-				if len(bl.BlockType.Results) > 0 {
+				// The missing else block passes the params through as the results.
+				if !bytes.Equal(bl.BlockType.Params, bl.BlockType.Results) {
 					return fmt.Errorf("type mismatch between then and else blocks")
 				}
 				// To handle if block without else properly,
@@ -1698,51 +2255,128 @@ func DecodeBlockType(types []*TypeInstance, r io.Reader) (*FunctionType, uint64,
 	return ret, num, nil
 }
 
+// errorType is the reflect.Type of error which can be the last result of host functions.
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
 // HostFunctionCallContext is the first argument of all host functions.
 type HostFunctionCallContext struct {
 	// Memory is the currently used memory instance at the time when the host function call is made.
+	// This equals Module.Memory.
 	Memory *MemoryInstance
-	// TODO: Add others if necessary.
+	// Module is the module instance of the caller of the host function. When the host function is called
+	// directly by the embedder (e.g. Store.CallFunction), this is the module instance of the host function.
+	Module *ModuleInstance
+	// Context is the context.Context given to the call into Wasm, e.g. Store.CallFunctionContext.
+	Context context.Context
+	// UserValue is ModuleInstance.UserValue of the module instance to which the host function belongs.
+	UserValue interface{}
+	// NestedCaller is set by the engine executing the host function, and used by Call to call functions
+	// on the same call stack as the host function.
+	NestedCaller NestedCaller
 }
 
-func (s *Store) AddHostFunction(moduleName, funcName string, fn reflect.Value) error {
-	getTypeOf := func(kind reflect.Kind) (ValueType, error) {
-		switch kind {
-		case reflect.Float64:
-			return ValueTypeF64, nil
-		case reflect.Float32:
-			return ValueTypeF32, nil
-		case reflect.Int32, reflect.Uint32:
-			return ValueTypeI32, nil
-		case reflect.Int64, reflect.Uint64:
-			return ValueTypeI64, nil
-		default:
-			return 0x00, fmt.Errorf("invalid type: %s", kind.String())
-		}
-	}
-	getType := func(p reflect.Type) (*FunctionType, error) {
-		var err error
-		if p.NumIn() == 0 {
-			return nil, fmt.Errorf("host function must accept *wasm.HostFunctionCallContext as the first param")
-		}
-		paramTypes := make([]ValueType, p.NumIn()-1)
-		for i := range paramTypes {
-			paramTypes[i], err = getTypeOf(p.In(i + 1).Kind())
-			if err != nil {
-				return nil, err
-			}
+// NestedCaller is implemented by the engines to call functions from inside host functions. See HostFunctionCallContext.Call.
+type NestedCaller interface {
+	// CallNested calls f with params on top of the current call stack, so the call shares the limits, the fuel and
+	// the context of the current call. This returns the error of the trap if the call traps, and the call stack
+	// is unwound to the host function which made the call.
+	CallNested(f *FunctionInstance, params []uint64) (results []uint64, err error)
+}
+
+// ForeignCaller is optionally implemented by NestedCaller to call functions with another Engine. See StateCaller.
+type ForeignCaller interface {
+	// CallForeign calls f with engine in place of the host function being executed, i.e. the call continues with the
+	// fuel and the call stack depth of the current call, and the current call continues with the remaining fuel when
+	// it returns. The results are written to results, which may overlap with params.
+	CallForeign(engine StateCaller, f *FunctionInstance, results, params []uint64) error
+}
+
+// Call calls f on the same call stack as this host function, i.e. the calls re-entering Wasm from host functions
+// are counted towards RuntimeConfig.MaxCallStackDepth, and consume the same Fuel as the outermost call.
+//
+// If f traps, this returns the error including the backtrace of the whole call stack. Returning the error (possibly
+// wrapped) from the host function makes the outer call fail with the same error and backtrace.
+func (c *HostFunctionCallContext) Call(f *FunctionInstance, params ...uint64) ([]uint64, error) {
+	if len(params) != len(f.FunctionType.Type.Params) {
+		return nil, fmt.Errorf("invalid number of parameters: expected %d but got %d", len(f.FunctionType.Type.Params), len(params))
+	}
+	if c.NestedCaller == nil { // Not given by an engine.
+		if f.ModuleInstance.engine == nil {
+			return nil, fmt.Errorf("module instance doesn't belong to any store")
+		}
+		ctx := c.Context
+		if ctx == nil {
+			ctx = context.Background()
 		}
+		return f.ModuleInstance.engine.Call(ctx, f, params...)
+	}
+	return c.NestedCaller.CallNested(f, params)
+}
 
-		resultTypes := make([]ValueType, p.NumOut())
-		for i := range resultTypes {
-			resultTypes[i], err = getTypeOf(p.Out(i).Kind())
-			if err != nil {
-				return nil, err
-			}
+// CallFunction calls the function exported as name by Module with Call.
+// This can be used to call back to the caller, for example, to allocate memory with a "malloc" function
+// exported by the caller.
+func (c *HostFunctionCallContext) CallFunction(name string, params ...uint64) ([]uint64, error) {
+	exp, ok := c.Module.Exports[name]
+	if !ok {
+		return nil, fmt.Errorf("exported function '%s' not found", name)
+	} else if exp.Kind != ExportKindFunc {
+		return nil, fmt.Errorf("'%s' is not functype", name)
+	}
+	return c.Call(exp.Function, params...)
+}
+
+// getHostFunctionType returns the Wasm signature of the host function of the type p. See Store.AddHostFunction.
+func getHostFunctionType(p reflect.Type) (*FunctionType, error) {
+	var err error
+	if p.NumIn() == 0 {
+		return nil, fmt.Errorf("host function must accept *wasm.HostFunctionCallContext as the first param")
+	}
+	paramTypes := make([]ValueType, p.NumIn()-1)
+	for i := range paramTypes {
+		paramTypes[i], err = getHostFunctionValueType(p.In(i + 1).Kind())
+		if err != nil {
+			return nil, err
 		}
-		return &FunctionType{Params: paramTypes, Results: resultTypes}, nil
 	}
 
+	numOut := p.NumOut()
+	// The trailing error result is not a part of the Wasm signature.
+	if numOut > 0 && p.Out(numOut-1) == errorType {
+		numOut--
+	}
+	resultTypes := make([]ValueType, numOut)
+	for i := range resultTypes {
+		resultTypes[i], err = getHostFunctionValueType(p.Out(i).Kind())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &FunctionType{Params: paramTypes, Results: resultTypes}, nil
+}
+
+func getHostFunctionValueType(kind reflect.Kind) (ValueType, error) {
+	switch kind {
+	case reflect.Float64:
+		return ValueTypeF64, nil
+	case reflect.Float32:
+		return ValueTypeF32, nil
+	case reflect.Int32, reflect.Uint32:
+		return ValueTypeI32, nil
+	case reflect.Int64, reflect.Uint64:
+		return ValueTypeI64, nil
+	default:
+		return 0x00, fmt.Errorf("invalid type: %s", kind.String())
+	}
+}
+
+// AddHostFunction adds the Go function fn as funcName in the module moduleName.
+//
+// fn must accept *HostFunctionCallContext as the first param followed by the Wasm params, and the params and
+// results must be one of int32, uint32, int64, uint64, float32 or float64. Additionally, fn can have error as
+// the last result which is not a part of the Wasm signature. A non-nil error aborts the execution as a trap,
+// and is returned from Store.CallFunction wrapped so that errors.Is and errors.As can be used on it.
+func (s *Store) AddHostFunction(moduleName, funcName string, fn reflect.Value) error {
 	m := s.getModuleInstance(moduleName)
 
 	_, ok := m.Exports[funcName]
@@ -1750,23 +2384,84 @@ func (s *Store) AddHostFunction(moduleName, funcName string, fn reflect.Value) e
 		return fmt.Errorf("name %s already exists in module %s", funcName, moduleName)
 	}
 
-	sig, err := getType(fn.Type())
+	sig, err := getHostFunctionType(fn.Type())
 	if err != nil {
 		return fmt.Errorf("invalid signature: %w", err)
 	}
 
-	f := &FunctionInstance{
+	return s.addHostFunction(m, funcName, &FunctionInstance{
 		Name:           fmt.Sprintf("%s.%s", moduleName, funcName),
 		HostFunction:   &fn,
 		FunctionType:   s.getTypeInstance(sig),
 		ModuleInstance: m,
+	})
+}
+
+// RawHostFunction is the low-level form of host functions which operates directly on the operand stack
+// without reflection. See Store.AddRawHostFunction.
+//
+// stack holds the parameters in order at the time of the call, and the function must write the results in order
+// to the head of stack before returning. The length of stack is the larger of the number of parameters and
+// results, and the values are encoded in the same way as Store.CallFunction. See EncodeI32 and DecodeI32 for example.
+//
+// Note: ctx and stack are only valid during the call, so they must not be retained after the function returns.
+type RawHostFunction func(ctx *HostFunctionCallContext, stack []uint64)
+
+// AddRawHostFunction is the same as AddHostFunction except that fn is a RawHostFunction with the signature sig.
+// Calls to fn are made without reflection nor allocations, so this is preferable for the functions frequently
+// called by Wasm, such as WASI.
+func (s *Store) AddRawHostFunction(moduleName, funcName string, sig *FunctionType, fn RawHostFunction) error {
+	if fn == nil {
+		return fmt.Errorf("host function %s.%s is nil", moduleName, funcName)
+	}
+	if err := validateRawHostFunctionType(sig); err != nil {
+		return err
+	}
+
+	m := s.getModuleInstance(moduleName)
+
+	_, ok := m.Exports[funcName]
+	if ok {
+		return fmt.Errorf("name %s already exists in module %s", funcName, moduleName)
+	}
+
+	return s.addHostFunction(m, funcName, &FunctionInstance{
+		Name:            fmt.Sprintf("%s.%s", moduleName, funcName),
+		RawHostFunction: fn,
+		FunctionType:    s.getTypeInstance(sig),
+		ModuleInstance:  m,
+	})
+}
+
+// validateRawHostFunctionType returns an error if sig contains types unsupported by host functions.
+func validateRawHostFunctionType(sig *FunctionType) error {
+	for _, types := range [][]ValueType{sig.Params, sig.Results} {
+		for _, t := range types {
+			switch t {
+			case ValueTypeI32, ValueTypeI64, ValueTypeF32, ValueTypeF64:
+			default:
+				return fmt.Errorf("invalid signature: invalid type: 0x%x", t)
+			}
+		}
 	}
+	return nil
+}
 
-	if err := s.engine.Compile(f); err != nil {
+// addHostFunction compiles and binds the host function f, and exports it as funcName in m.
+func (s *Store) addHostFunction(m *ModuleInstance, funcName string, f *FunctionInstance) error {
+	compiled, err := s.engine.Compile(f)
+	if err != nil {
 		return fmt.Errorf("failed to compile %s: %v", f.Name, err)
 	}
-	m.Exports[funcName] = &ExportInstance{Kind: ExportKindFunc, Function: f}
+	// Bind requires the address of f, so the instance is added to the store first.
 	s.addFunctionInstance(f)
+	if err = s.engine.Bind(f, compiled); err != nil {
+		s.Functions = s.Functions[:f.Address]
+		return fmt.Errorf("failed to bind %s: %v", f.Name, err)
+	}
+	f.Index = Index(len(m.Functions))
+	m.Functions = append(m.Functions, f)
+	m.Exports[funcName] = &ExportInstance{Kind: ExportKindFunc, Function: f}
 	return nil
 }
 
@@ -1794,6 +2489,9 @@ func (s *Store) AddTableInstance(moduleName, name string, min uint32, max *uint3
 		return fmt.Errorf("name %s already exists in module %s", name, moduleName)
 	}
 
+	if min > s.config.MaxTableElements {
+		return fmt.Errorf("table min %d elements exceeds the limit %d elements", min, s.config.MaxTableElements)
+	}
 	instance := newTableInstance(min, max)
 	m.Exports[name] = &ExportInstance{Kind: ExportKindTable, Table: instance}
 	s.Tables = append(s.Tables, instance)
@@ -1808,16 +2506,26 @@ func (s *Store) AddMemoryInstance(moduleName, name string, min uint32, max *uint
 		return fmt.Errorf("name %s already exists in module %s", name, moduleName)
 	}
 
-	memory := &MemoryInstance{
-		Buffer: make([]byte, uint64(min)*PageSize),
-		Min:    min,
-		Max:    max,
+	if min > s.config.MaxMemoryPages {
+		return fmt.Errorf("memory min %d pages exceeds the limit %d pages", min, s.config.MaxMemoryPages)
 	}
+	memory := s.newHostMemoryInstance(min, max)
 	m.Exports[name] = &ExportInstance{Kind: ExportKindMemory, Memory: memory}
 	s.Memories = append(s.Memories, memory)
 	return nil
 }
 
+// newHostMemoryInstance returns the memory instance of a host module with the limits of this store.
+func (s *Store) newHostMemoryInstance(min uint32, max *uint32) *MemoryInstance {
+	return &MemoryInstance{
+		Buffer:   make([]byte, uint64(min)*PageSize),
+		Min:      min,
+		Max:      max,
+		maxPages: &s.config.MaxMemoryPages,
+		growHook: s.config.MemoryGrowHook,
+	}
+}
+
 func (s *Store) getTypeInstance(t *FunctionType) *TypeInstance {
 	key := t.String()
 	id, ok := s.TypeIDs[key]
@@ -1832,7 +2540,7 @@ func (s *Store) getTypeInstance(t *FunctionType) *TypeInstance {
 func (s *Store) getModuleInstance(name string) *ModuleInstance {
 	m, ok := s.ModuleInstances[name]
 	if !ok {
-		m = &ModuleInstance{Exports: map[string]*ExportInstance{}}
+		m = &ModuleInstance{Name: name, Exports: map[string]*ExportInstance{}, engine: s.engine, store: s}
 		s.ModuleInstances[name] = m
 	}
 	return m
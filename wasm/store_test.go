@@ -1,6 +1,9 @@
 package wasm
 
 import (
+	"errors"
+	"fmt"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -27,7 +30,7 @@ func TestBuildFunctionInstances_FunctionNames(t *testing.T) {
 	mi := s.getModuleInstance(name)
 
 	zero := Index(0)
-	nopCode := &Code{0, nil, []byte{OpcodeNop, OpcodeEnd}}
+	nopCode := &Code{Body: []byte{OpcodeNop, OpcodeEnd}}
 	m := &Module{
 		TypeSection:     []*FunctionType{{}},
 		FunctionSection: []Index{zero, zero, zero, zero, zero},
@@ -52,3 +55,127 @@ func TestBuildFunctionInstances_FunctionNames(t *testing.T) {
 	// We expect unknown for any functions missing data in the NameSection
 	require.Equal(t, []string{"unknown", "two", "unknown", "four", "five"}, names)
 }
+
+func TestStore_RuntimeConfigLimits(t *testing.T) {
+	s := NewStoreWithConfig(nil, &RuntimeConfig{MaxMemoryPages: 2, MaxTableElements: 10})
+
+	require.EqualError(t, s.AddMemoryInstance("env", "memory", 3, nil), "memory min 3 pages exceeds the limit 2 pages")
+	require.NoError(t, s.AddMemoryInstance("env", "memory", 1, nil))
+	memory := s.ModuleInstances["env"].Exports["memory"].Memory
+	_, ok := memory.Grow(2)
+	require.False(t, ok)
+	_, ok = memory.Grow(1)
+	require.True(t, ok)
+
+	require.EqualError(t, s.AddTableInstance("env", "table", 11, nil), "table min 11 elements exceeds the limit 10 elements")
+	require.NoError(t, s.AddTableInstance("env", "table", 10, nil))
+
+	mi := &ModuleInstance{}
+	_, err := s.buildMemoryInstances(&Module{MemorySection: []*MemoryType{{Min: 3}}}, mi)
+	require.EqualError(t, err, "memory min 3 pages exceeds the limit 2 pages")
+	_, err = s.buildTableInstances(&Module{TableSection: []*TableType{{ElemType: 0x70, Limit: &LimitsType{Min: 11}}}}, mi)
+	require.EqualError(t, err, "table min 11 elements exceeds the limit 10 elements")
+}
+
+func TestStore_AddRawHostFunction_Errors(t *testing.T) {
+	s := NewStore(nil)
+	require.EqualError(t, s.AddRawHostFunction("env", "nil", &FunctionType{}, nil), "host function env.nil is nil")
+
+	nop := func(*HostFunctionCallContext, []uint64) {}
+	err := s.AddRawHostFunction("env", "invalid", &FunctionType{Params: []ValueType{ValueTypeI32, 0x10}}, nop)
+	require.EqualError(t, err, "invalid signature: invalid type: 0x10")
+	err = s.AddRawHostFunction("env", "invalid", &FunctionType{Results: []ValueType{0x10}}, nop)
+	require.EqualError(t, err, "invalid signature: invalid type: 0x10")
+}
+
+// compileTestEngine is the Engine which only compiles and releases functions. The compiled function is "f" followed by
+// the constant in the body of the function, and the compilation fails if the body starts with unreachable.
+type compileTestEngine struct {
+	Engine
+	mux      sync.Mutex
+	released []CompiledFunction
+	// releaseErrors are the errors returned by ReleaseCompiled for the compiled functions.
+	releaseErrors map[CompiledFunction]error
+}
+
+func (e *compileTestEngine) Compile(f *FunctionInstance) (CompiledFunction, error) {
+	name := fmt.Sprintf("f%d", f.Body[len(f.Body)-3])
+	if f.Body[0] == OpcodeUnreachable {
+		return nil, fmt.Errorf("failed to compile %s", name)
+	}
+	return name, nil
+}
+
+func (e *compileTestEngine) ReleaseCompiled(compiled CompiledFunction) error {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	e.released = append(e.released, compiled)
+	if err, ok := e.releaseErrors[compiled]; ok {
+		return err
+	}
+	return nil
+}
+
+func TestStore_CompileModule_Concurrent(t *testing.T) {
+	newModule := func(failures ...int) *Module {
+		m := &Module{TypeSection: []*FunctionType{{}}}
+		for i := 0; i < 16; i++ {
+			// (i32.const i) (drop)
+			body := []byte{OpcodeI32Const, byte(i), OpcodeDrop, OpcodeEnd}
+			for _, f := range failures {
+				if i == f {
+					body = append([]byte{OpcodeUnreachable}, body...)
+				}
+			}
+			m.FunctionSection = append(m.FunctionSection, 0)
+			m.CodeSection = append(m.CodeSection, &Code{Body: body})
+		}
+		return m
+	}
+
+	for _, workers := range []uint32{1, 4, 32} {
+		workers := workers
+		t.Run(fmt.Sprintf("workers=%d", workers), func(t *testing.T) {
+			e := &compileTestEngine{}
+			s := NewStoreWithConfig(e, &RuntimeConfig{CompilationWorkers: workers})
+
+			compiled, err := s.CompileModule(newModule())
+			require.NoError(t, err)
+			// The results are in the order of the functions.
+			for i, f := range compiled.functions {
+				require.Equal(t, fmt.Sprintf("f%d", i), f)
+			}
+			require.NoError(t, compiled.Close())
+			require.Len(t, e.released, 16)
+
+			// The first failure is reported, and the others are released.
+			e.released = nil
+			_, err = s.CompileModule(newModule(11, 5))
+			require.EqualError(t, err, "compilation failed at index 5/15: failed to compile f5")
+			require.Len(t, e.released, 14)
+			require.NotContains(t, e.released, "f5")
+			require.NotContains(t, e.released, "f11")
+		})
+	}
+}
+
+func TestCompiledModule_Close(t *testing.T) {
+	m := &Module{TypeSection: []*FunctionType{{}}}
+	for i := 0; i < 4; i++ {
+		// (i32.const i) (drop)
+		m.FunctionSection = append(m.FunctionSection, 0)
+		m.CodeSection = append(m.CodeSection, &Code{Body: []byte{OpcodeI32Const, byte(i), OpcodeDrop, OpcodeEnd}})
+	}
+	e := &compileTestEngine{releaseErrors: map[CompiledFunction]error{
+		"f1": errors.New("busy"),
+		"f2": errors.New("unmapped"),
+	}}
+	compiled, err := NewStore(e).CompileModule(m)
+	require.NoError(t, err)
+
+	// The failures don't stop releasing the rest of the functions.
+	err = compiled.Close()
+	require.EqualError(t, err, "releasing compiled functions failed at index 1/3: busy, index 2/3: unmapped")
+	require.Equal(t, []CompiledFunction{"f0", "f1", "f2", "f3"}, e.released)
+	require.Nil(t, compiled.functions)
+}
@@ -0,0 +1,134 @@
+package wasm
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+)
+
+// ExportedTable is a handle to a table exported by a ModuleInstance, returned by ModuleInstance.ExportedTable.
+//
+// The elements of the table are function references which are called by call_indirect instructions.
+// The changes made via the handle are visible to the guest, so host functions can use this to manage callback
+// tables of guests. Note that they are not synchronized with the concurrent calls accessing the same table.
+type ExportedTable struct {
+	table *TableInstance
+	store *Store
+}
+
+// ExportedTable returns the handle to the table exported as name.
+func (m *ModuleInstance) ExportedTable(name string) (*ExportedTable, error) {
+	exp, ok := m.Exports[name]
+	if !ok {
+		return nil, fmt.Errorf("exported table '%s' not found", name)
+	}
+	if exp.Kind != ExportKindTable {
+		return nil, fmt.Errorf("'%s' is not table", name)
+	}
+	if m.store == nil {
+		return nil, fmt.Errorf("module instance doesn't belong to any store")
+	}
+	return &ExportedTable{table: exp.Table, store: m.store}, nil
+}
+
+// Size returns the current number of the elements in this table.
+func (t *ExportedTable) Size() uint32 {
+	return uint32(len(t.table.Table))
+}
+
+// Get returns the function at index, or nil if the element is uninitialized or the function is already released.
+// This returns an error if index is out of range.
+func (t *ExportedTable) Get(index uint32) (*FunctionInstance, error) {
+	if index >= t.Size() {
+		return nil, fmt.Errorf("index %d out of range of table size %d", index, t.Size())
+	}
+	return t.function(index), nil
+}
+
+// Set sets the function f at index, or uninitializes the element if f is nil. f is either a host function or a Wasm
+// function in the same store as this table. This returns an error if index is out of range.
+func (t *ExportedTable) Set(index uint32, f *FunctionInstance) error {
+	if index >= t.Size() {
+		return fmt.Errorf("index %d out of range of table size %d", index, t.Size())
+	}
+	elm, err := t.newElement(f)
+	if err != nil {
+		return err
+	}
+	t.table.Table[index] = elm
+	return nil
+}
+
+// Grow increases the size of this table by delta elements, and sets init to the new elements in the same manner as Set.
+// This returns the previous size, or an error if the new size exceeds the maximum size of the table or the limit
+// given by RuntimeConfig.MaxTableElements.
+func (t *ExportedTable) Grow(delta uint32, init *FunctionInstance) (uint32, error) {
+	elm, err := t.newElement(init)
+	if err != nil {
+		return 0, err
+	}
+	size := t.Size()
+	newSize := uint64(size) + uint64(delta)
+	if max := t.table.Max; max != nil && newSize > uint64(*max) {
+		return 0, fmt.Errorf("table size %d exceeds the maximum %d elements", newSize, *max)
+	} else if limit := t.store.config.MaxTableElements; newSize > uint64(limit) {
+		return 0, fmt.Errorf("table size %d exceeds the limit %d elements", newSize, limit)
+	}
+	for i := uint32(0); i < delta; i++ {
+		t.table.Table = append(t.table.Table, elm)
+	}
+	return size, nil
+}
+
+// Lookup returns the function at index after the same checks as call_indirect instruction: this returns
+// ErrRuntimeInvalidTableAcces if index is out of range or the element is uninitialized, and
+// ErrRuntimeIndirectCallTypeMismatch if the function's type doesn't equal ft.
+//
+// The function can be called by HostFunctionCallContext.Call from host functions.
+func (t *ExportedTable) Lookup(index uint32, ft *FunctionType) (*FunctionInstance, error) {
+	var f *FunctionInstance
+	if index < t.Size() {
+		f = t.function(index)
+	}
+	if f == nil {
+		return nil, ErrRuntimeInvalidTableAcces
+	}
+	actual := f.FunctionType.Type
+	if !bytes.Equal(actual.Params, ft.Params) || !bytes.Equal(actual.Results, ft.Results) {
+		return nil, ErrRuntimeIndirectCallTypeMismatch
+	}
+	return f, nil
+}
+
+// Call invokes the function at index with the parameters encoded as uint64 (See EncodeI32 etc.), and returns the
+// results in the same encoding. The function is looked up with its expected type ft in the same way as Lookup.
+func (t *ExportedTable) Call(ctx context.Context, index uint32, ft *FunctionType, params ...uint64) ([]uint64, error) {
+	f, err := t.Lookup(index, ft)
+	if err != nil {
+		return nil, err
+	}
+	if len(params) != len(ft.Params) {
+		return nil, fmt.Errorf("invalid number of parameters: expected %d but got %d", len(ft.Params), len(params))
+	}
+	return t.store.engine.Call(ctx, f, params...)
+}
+
+// function returns the function at index, or nil if the element is uninitialized or the function is already released.
+func (t *ExportedTable) function(index uint32) *FunctionInstance {
+	elm := t.table.Table[index]
+	if elm.FunctionTypeID == UninitializedTableElelemtTypeID || int(elm.FunctionAddress) >= len(t.store.Functions) {
+		return nil
+	}
+	return t.store.Functions[elm.FunctionAddress]
+}
+
+// newElement returns the TableElement referring to f, or the uninitialized one if f is nil.
+func (t *ExportedTable) newElement(f *FunctionInstance) (TableElement, error) {
+	if f == nil {
+		return TableElement{FunctionTypeID: UninitializedTableElelemtTypeID}, nil
+	}
+	if int(f.Address) >= len(t.store.Functions) || t.store.Functions[f.Address] != f {
+		return TableElement{}, fmt.Errorf("function %s doesn't belong to the store of the table", f.Name)
+	}
+	return TableElement{FunctionAddress: f.Address, FunctionTypeID: f.FunctionType.TypeID}, nil
+}
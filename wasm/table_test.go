@@ -0,0 +1,89 @@
+package wasm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportedTable(t *testing.T) {
+	s := NewStoreWithConfig(nil, &RuntimeConfig{MaxTableElements: 4})
+	max := uint32(3)
+	require.NoError(t, s.AddTableInstance("env", "table", 1, &max))
+	require.NoError(t, s.AddGlobal("env", "global", 0, ValueTypeI32, false))
+
+	i32 := &FunctionType{Results: []ValueType{ValueTypeI32}}
+	m := s.ModuleInstances["env"]
+	f := &FunctionInstance{Name: "env.f", FunctionType: s.getTypeInstance(i32), ModuleInstance: m}
+	s.addFunctionInstance(f)
+	g := &FunctionInstance{Name: "env.g", FunctionType: s.getTypeInstance(&FunctionType{}), ModuleInstance: m}
+	s.addFunctionInstance(g)
+
+	_, err := m.ExportedTable("global")
+	require.EqualError(t, err, "'global' is not table")
+	_, err = m.ExportedTable("unknown")
+	require.EqualError(t, err, "exported table 'unknown' not found")
+
+	table, err := m.ExportedTable("table")
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), table.Size())
+
+	// Elements are uninitialized at first.
+	actual, err := table.Get(0)
+	require.NoError(t, err)
+	require.Nil(t, actual)
+	_, err = table.Lookup(0, i32)
+	require.Equal(t, ErrRuntimeInvalidTableAcces, err)
+
+	require.NoError(t, table.Set(0, f))
+	actual, err = table.Get(0)
+	require.NoError(t, err)
+	require.Equal(t, f, actual)
+	require.Equal(t, TableElement{FunctionAddress: f.Address, FunctionTypeID: f.FunctionType.TypeID}, m.Exports["table"].Table.Table[0])
+	actual, err = table.Lookup(0, i32)
+	require.NoError(t, err)
+	require.Equal(t, f, actual)
+	_, err = table.Lookup(0, &FunctionType{})
+	require.Equal(t, ErrRuntimeIndirectCallTypeMismatch, err)
+
+	// Grow initializes the new elements with the given function.
+	previous, err := table.Grow(2, g)
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), previous)
+	require.Equal(t, uint32(3), table.Size())
+	for _, i := range []uint32{1, 2} {
+		actual, err = table.Get(i)
+		require.NoError(t, err)
+		require.Equal(t, g, actual)
+	}
+	_, err = table.Grow(1, nil)
+	require.EqualError(t, err, "table size 4 exceeds the maximum 3 elements")
+
+	// nil uninitializes the element.
+	require.NoError(t, table.Set(1, nil))
+	actual, err = table.Get(1)
+	require.NoError(t, err)
+	require.Nil(t, actual)
+
+	require.EqualError(t, table.Set(3, f), "index 3 out of range of table size 3")
+	_, err = table.Get(3)
+	require.EqualError(t, err, "index 3 out of range of table size 3")
+	_, err = table.Lookup(3, i32)
+	require.Equal(t, ErrRuntimeInvalidTableAcces, err)
+	err = table.Set(0, &FunctionInstance{Name: "other"})
+	require.EqualError(t, err, "function other doesn't belong to the store of the table")
+}
+
+func TestExportedTable_Grow_Limit(t *testing.T) {
+	s := NewStoreWithConfig(nil, &RuntimeConfig{MaxTableElements: 4})
+	require.NoError(t, s.AddTableInstance("env", "table", 1, nil))
+	table, err := s.ModuleInstances["env"].ExportedTable("table")
+	require.NoError(t, err)
+
+	_, err = table.Grow(4, nil)
+	require.EqualError(t, err, "table size 5 exceeds the limit 4 elements")
+	previous, err := table.Grow(3, nil)
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), previous)
+	require.Equal(t, uint32(4), table.Size())
+}
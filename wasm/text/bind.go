@@ -68,7 +68,7 @@ func bindFunctionTypes(m *module, typeToIndex map[*typeFunc]uint32, typeNameToIn
 		if f.typeInlined != nil {
 			realType := m.types[idx.numeric]
 			ti := f.typeInlined
-			if !funcTypeEquals(realType, ti.typeFunc.params, ti.typeFunc.result) {
+			if !funcTypeEquals(realType, ti.typeFunc.params, ti.typeFunc.results) {
 				return nil, &FormatError{ti.line, ti.col, fmt.Sprintf("module.import[%d].func.type", i),
 					fmt.Errorf("inlined type doesn't match type index %d", idx.numeric),
 				}
@@ -10,8 +10,8 @@ import (
 
 func TestBindIndices(t *testing.T) {
 	i32 := wasm.ValueTypeI32
-	paramI32I32ResultI32 := &typeFunc{params: []wasm.ValueType{i32, i32}, result: i32}
-	paramI32I32I32I32ResultI32 := &typeFunc{params: []wasm.ValueType{i32, i32, i32, i32}, result: i32}
+	paramI32I32ResultI32 := &typeFunc{params: []wasm.ValueType{i32, i32}, results: []wasm.ValueType{i32}}
+	paramI32I32I32I32ResultI32 := &typeFunc{params: []wasm.ValueType{i32, i32, i32, i32}, results: []wasm.ValueType{i32}}
 	indexZero, indexOne := &index{numeric: 0}, &index{numeric: 1}
 
 	tests := []struct {
@@ -95,8 +95,8 @@ func TestBindIndices(t *testing.T) {
 			input: &module{
 				types: []*typeFunc{
 					typeFuncEmpty,
-					{name: "i32i32_i32", params: []wasm.ValueType{i32, i32}, result: i32},
-					{name: "i32i32i32i32_i32", params: []wasm.ValueType{i32, i32, i32, i32}, result: i32},
+					{name: "i32i32_i32", params: []wasm.ValueType{i32, i32}, results: []wasm.ValueType{i32}},
+					{name: "i32i32i32i32_i32", params: []wasm.ValueType{i32, i32, i32, i32}, results: []wasm.ValueType{i32}},
 				},
 				importFuncs: []*importFunc{
 					{importIndex: wasm.Index(0), module: "wasi_snapshot_preview1", name: "args_sizes_get",
@@ -112,8 +112,8 @@ func TestBindIndices(t *testing.T) {
 			expected: &module{
 				types: []*typeFunc{
 					typeFuncEmpty,
-					{name: "i32i32_i32", params: []wasm.ValueType{i32, i32}, result: i32},
-					{name: "i32i32i32i32_i32", params: []wasm.ValueType{i32, i32, i32, i32}, result: i32},
+					{name: "i32i32_i32", params: []wasm.ValueType{i32, i32}, results: []wasm.ValueType{i32}},
+					{name: "i32i32i32i32_i32", params: []wasm.ValueType{i32, i32, i32, i32}, results: []wasm.ValueType{i32}},
 				},
 				importFuncs: []*importFunc{
 					{importIndex: wasm.Index(0), module: "wasi_snapshot_preview1", name: "args_sizes_get",
@@ -22,11 +22,7 @@ func DecodeModule(source []byte) (result *wasm.Module, err error) {
 	if typeCount > 0 {
 		result.TypeSection = make([]*wasm.FunctionType, typeCount)
 		for i, t := range m.types {
-			var results []wasm.ValueType
-			if t.result != 0 {
-				results = []wasm.ValueType{t.result}
-			}
-			result.TypeSection[i] = &wasm.FunctionType{Params: t.params, Results: results}
+			result.TypeSection[i] = &wasm.FunctionType{Params: t.params, Results: t.results}
 		}
 	}
 
@@ -211,7 +211,7 @@ func TestDecodeModule(t *testing.T) {
 
 func TestMergeLocalNames(t *testing.T) {
 	i32 := wasm.ValueTypeI32
-	paramI32I32ResultI32 := &typeFunc{params: []wasm.ValueType{i32, i32}, result: i32}
+	paramI32I32ResultI32 := &typeFunc{params: []wasm.ValueType{i32, i32}, results: []wasm.ValueType{i32}}
 	indexZero, indexOne := &index{numeric: 0}, &index{numeric: 1}
 
 	tests := []struct {
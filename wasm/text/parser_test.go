@@ -12,13 +12,13 @@ import (
 func TestParseModule(t *testing.T) {
 	f32, i32, i64 := wasm.ValueTypeF32, wasm.ValueTypeI32, wasm.ValueTypeI64
 	paramI32 := &typeFunc{params: []wasm.ValueType{i32}}
-	paramI32I32ResultI32 := &typeFunc{params: []wasm.ValueType{i32, i32}, result: i32}
-	paramI32I32I32I32ResultI32 := &typeFunc{params: []wasm.ValueType{i32, i32, i32, i32}, result: i32}
+	paramI32I32ResultI32 := &typeFunc{params: []wasm.ValueType{i32, i32}, results: []wasm.ValueType{i32}}
+	paramI32I32I32I32ResultI32 := &typeFunc{params: []wasm.ValueType{i32, i32, i32, i32}, results: []wasm.ValueType{i32}}
 	paramI32I32I32I32I32I64I32I32ResultI32 := &typeFunc{
-		params: []wasm.ValueType{i32, i32, i32, i32, i32, i64, i64, i32, i32},
-		result: i32,
+		params:  []wasm.ValueType{i32, i32, i32, i32, i32, i64, i64, i32, i32},
+		results: []wasm.ValueType{i32},
 	}
-	resultI32 := &typeFunc{result: i32}
+	resultI32 := &typeFunc{results: []wasm.ValueType{i32}}
 	indexZero, indexOne := &index{numeric: wasm.Index(0)}, &index{numeric: wasm.Index(1)}
 
 	tests := []struct {
@@ -41,17 +41,27 @@ func TestParseModule(t *testing.T) {
 			input: "(module (type $i32i32_i32 (func (param i32 i32) (result i32))) (type (func)))",
 			expected: &module{
 				types: []*typeFunc{
-					{name: "i32i32_i32", params: []wasm.ValueType{i32, i32}, result: i32},
+					{name: "i32i32_i32", params: []wasm.ValueType{i32, i32}, results: []wasm.ValueType{i32}},
 					typeFuncEmpty,
 				},
 			},
 		},
+		{
+			name:  "type func multiple results",
+			input: "(module (type (func (result i32 i64))) (type (func (param f32) (result i32) (result i64 f32))))",
+			expected: &module{
+				types: []*typeFunc{
+					{results: []wasm.ValueType{i32, i64}},
+					{params: []wasm.ValueType{f32}, results: []wasm.ValueType{i32, i64, f32}},
+				},
+			},
+		},
 		{
 			name:  "type func param names",
 			input: "(module (type $mul (func (param $x f32) (param $y f32) (result f32))))",
 			expected: &module{
 				types: []*typeFunc{
-					{name: "mul", params: []wasm.ValueType{f32, f32}, result: f32},
+					{name: "mul", params: []wasm.ValueType{f32, f32}, results: []wasm.ValueType{f32}},
 				},
 				typeParamNames: map[wasm.Index]wasm.NameMap{wasm.Index(0): {
 					&wasm.NameAssoc{Index: wasm.Index(0), Name: "x"},
@@ -81,9 +91,9 @@ func TestParseModule(t *testing.T) {
 )`,
 			expected: &module{
 				types: []*typeFunc{
-					{name: "mul", params: []wasm.ValueType{f32, f32}, result: f32},
+					{name: "mul", params: []wasm.ValueType{f32, f32}, results: []wasm.ValueType{f32}},
 					typeFuncEmpty,
-					{name: "add", params: []wasm.ValueType{f32, f32}, result: f32},
+					{name: "add", params: []wasm.ValueType{f32, f32}, results: []wasm.ValueType{f32}},
 				},
 				typeParamNames: map[wasm.Index]wasm.NameMap{
 					wasm.Index(0): {
@@ -299,8 +309,8 @@ func TestParseModule(t *testing.T) {
 			expected: &module{
 				types: []*typeFunc{
 					typeFuncEmpty,
-					{name: "i32i32_i32", params: []wasm.ValueType{i32, i32}, result: i32},
-					{name: "i32i32i32i32_i32", params: []wasm.ValueType{i32, i32, i32, i32}, result: i32},
+					{name: "i32i32_i32", params: []wasm.ValueType{i32, i32}, results: []wasm.ValueType{i32}},
+					{name: "i32i32i32i32_i32", params: []wasm.ValueType{i32, i32, i32, i32}, results: []wasm.ValueType{i32}},
 				},
 				importFuncs: []*importFunc{
 					{importIndex: wasm.Index(0), module: "wasi_snapshot_preview1", name: "args_sizes_get",
@@ -405,7 +415,7 @@ func TestParseModule(t *testing.T) {
 			input: "(module (import \"Math\" \"Mul\" (func $mul (param $x f32) (param $y f32) (result f32))))",
 			expected: &module{
 				types: []*typeFunc{
-					{params: []wasm.ValueType{f32, f32}, result: f32},
+					{params: []wasm.ValueType{f32, f32}, results: []wasm.ValueType{f32}},
 				},
 				importFuncs: []*importFunc{
 					{importIndex: wasm.Index(0), module: "Math", name: "Mul", typeIndex: indexZero},
@@ -424,7 +434,7 @@ func TestParseModule(t *testing.T) {
 )`,
 			expected: &module{
 				types: []*typeFunc{
-					{params: []wasm.ValueType{f32, f32}, result: f32},
+					{params: []wasm.ValueType{f32, f32}, results: []wasm.ValueType{f32}},
 				},
 				importFuncs: []*importFunc{
 					{importIndex: wasm.Index(0), module: "Math", name: "Mul", typeIndex: indexZero},
@@ -754,14 +764,9 @@ func TestParseModule_Errors(t *testing.T) {
 			expectedErr: "1:48: unknown type: f65 in module.import[0].func.param[1]",
 		},
 		{
-			name:        "import func double result",
-			input:       "(module (import \"\" \"\" (func (param i32) (result i32) (result i32))))",
-			expectedErr: "1:54: unexpected '(' in module.import[0].func",
-		},
-		{
-			name:        "import func double result type",
-			input:       "(module (import \"\" \"\" (func (param i32) (result i32 i32))))",
-			expectedErr: "1:53: redundant type in module.import[0].func.result",
+			name:        "import func wrong second result type",
+			input:       "(module (import \"\" \"\" (func (param i32) (result i32) (result f65))))",
+			expectedErr: "1:62: unknown type: f65 in module.import[0].func.result",
 		},
 		{
 			name:        "import func wrong result type",
@@ -816,7 +821,7 @@ func TestParseModule_Errors(t *testing.T) {
 		{
 			name:        "import func param after result",
 			input:       "(module (import \"\" \"\" (func (result i32) (param i32))))",
-			expectedErr: "1:42: unexpected '(' in module.import[0].func",
+			expectedErr: "1:43: unexpected keyword: param in module.import[0].func",
 		},
 		{
 			name:        "import func double desc",
@@ -39,7 +39,7 @@ type typeParser struct {
 	// m is used as a function pointer to moduleParser.tokenParser. This updates based on state changes.
 	m *moduleParser
 
-	// onTypeEnd is invoked when the grammar "(param)* (result)?" completes.
+	// onTypeEnd is invoked when the grammar "(param)* (result)*" completes.
 	//
 	// Note: this is called when neither a "param" nor a "result" field are found, or on any field following a "param"
 	// that is not a "result".
@@ -85,8 +85,12 @@ type typeParser struct {
 	// parameters are abbreviated, ex. (param i32 i32), the currentParamField will be less than the type count.
 	foundParam bool
 
-	// currentResult is zero until set, and only set once as WebAssembly 1.0 only supports up to one result.
-	currentResult wasm.ValueType
+	// currentResults allow us to accumulate typeFunc.results across multiple fields, as well support abbreviated
+	// results. ex. both (result i32) (result i32) and (result i32 i32) formats.
+	currentResults []wasm.ValueType
+
+	// foundResult allows us to check if we found a type in the current "result" field.
+	foundResult bool
 
 	// currentTypeUseStartLine tracks the start column of a type use in case there's an error later
 	currentTypeUseStartLine uint32
@@ -148,7 +152,7 @@ func (p *typeParser) reset() {
 	p.currentParams = nil
 	p.currentParamNames = nil
 	p.currentParamField = 0
-	p.currentResult = 0
+	p.currentResults = nil
 }
 
 func (p *typeParser) parseTypeIndexEnd(index *index) {
@@ -169,6 +173,7 @@ func (p *typeParser) beginParamOrResult(tok tokenType, tokenBytes []byte, line,
 			p.m.tokenParser = p.parseParamName
 		case "result":
 			p.state = parsingResult
+			p.foundResult = false
 			p.m.tokenParser = p.parseResult
 		case "type": // cannot repeat
 			return errors.New("redundant type")
@@ -258,24 +263,23 @@ func (p *typeParser) parseParam(tok tokenType, tokenBytes []byte, _, _ uint32) e
 	return nil
 }
 
-// parseResult is a tokenParser inside a "result" field (tokenKeyword). When this field completes (tokenRParen), control
-// transitions to parseComplete.
+// parseResult is a tokenParser inside a "result" field (tokenKeyword). This records value type and continues if it is
+// an abbreviated form with multiple value types. When this field completes (tokenRParen), this sets the next parser to
+// parseMoreResults.
 func (p *typeParser) parseResult(tok tokenType, tokenBytes []byte, _, _ uint32) error {
 	switch tok {
 	case tokenKeyword: // Ex. i32
-		if p.currentResult != 0 {
-			return errors.New("redundant type")
-		}
 		vt, err := parseValueType(tokenBytes)
 		if err != nil {
 			return err
 		}
-		p.currentResult = vt
+		p.currentResults = append(p.currentResults, vt)
+		p.foundResult = true
 	case tokenRParen: // end of this field
-		if p.currentResult == 0 {
+		if !p.foundResult {
 			return errors.New("expected a type")
 		}
-		p.m.tokenParser = p.onTypeEnd
+		p.m.tokenParser = p.parseMoreResults
 		p.state = parsingComplete
 	default:
 		return unexpectedToken(tok, tokenBytes)
@@ -283,6 +287,31 @@ func (p *typeParser) parseResult(tok tokenType, tokenBytes []byte, _, _ uint32)
 	return nil
 }
 
+// parseMoreResults is a tokenParser after a "result" field. As only "result" fields can follow one, this dispatches to
+// onTypeEnd on anything except a tokenLParen.
+//
+// Ex. `(func (result i32) (result i64))`
+//    parseMoreResults starts here --^
+func (p *typeParser) parseMoreResults(tok tokenType, tokenBytes []byte, line, col uint32) error {
+	if tok == tokenLParen {
+		p.m.tokenParser = p.beginResult
+		return nil
+	}
+	return p.onTypeEnd(tok, tokenBytes, line, col)
+}
+
+// beginResult is a tokenParser called after a tokenLParen following a "result" field, and only accepts another
+// "result" field (tokenKeyword).
+func (p *typeParser) beginResult(tok tokenType, tokenBytes []byte, _, _ uint32) error {
+	if tok == tokenKeyword && string(tokenBytes) == "result" {
+		p.state = parsingResult
+		p.foundResult = false
+		p.m.tokenParser = p.parseResult
+		return nil
+	}
+	return unexpectedToken(tok, tokenBytes)
+}
+
 func (p *typeParser) errorContext() string {
 	switch p.state {
 	case parsingParam:
@@ -304,13 +333,13 @@ func (p *typeParser) getTypeUse() (typeIndex *index, inlined *inlinedTypeFunc, l
 	localNames = p.currentParamNames
 
 	// Don't conflate lack of verification type with nullary
-	if typeIndex != nil && funcTypeEquals(typeFuncEmpty, p.currentParams, p.currentResult) {
+	if typeIndex != nil && funcTypeEquals(typeFuncEmpty, p.currentParams, p.currentResults) {
 		return
 	}
 
 	// Search for an existing signature that matches the current type in the module types.
 	for _, t := range p.m.module.types {
-		if funcTypeEquals(t, p.currentParams, p.currentResult) {
+		if funcTypeEquals(t, p.currentParams, p.currentResults) {
 			inlined = &inlinedTypeFunc{t, p.currentTypeUseStartLine, p.currentTypeUseStartCol}
 			return
 		}
@@ -318,14 +347,14 @@ func (p *typeParser) getTypeUse() (typeIndex *index, inlined *inlinedTypeFunc, l
 
 	// Search for an existing signature that matches the current type in the pending inlined types
 	for _, t := range p.inlinedTypes {
-		if funcTypeEquals(t, p.currentParams, p.currentResult) {
+		if funcTypeEquals(t, p.currentParams, p.currentResults) {
 			inlined = &inlinedTypeFunc{t, p.currentTypeUseStartLine, p.currentTypeUseStartCol}
 			return
 		}
 	}
 
 	inlined = &inlinedTypeFunc{
-		typeFunc: &typeFunc{"", p.currentParams, p.currentResult},
+		typeFunc: &typeFunc{"", p.currentParams, p.currentResults},
 		line:     p.currentTypeUseStartLine,
 		col:      p.currentTypeUseStartCol,
 	}
@@ -346,7 +375,7 @@ func (p *typeParser) getType(typeName string) (sig *typeFunc, paramNames wasm.Na
 
 	// Search inlined types in case a matching type was found after its type use.
 	for i, t := range p.inlinedTypes {
-		if funcTypeEquals(t, p.currentParams, p.currentResult) {
+		if funcTypeEquals(t, p.currentParams, p.currentResults) {
 			// If we got here, we found a type field after a type use. This means it wasn't an inlined type, rather an
 			// out-of-order type. Hence, remove it from the inlined types and add it to the module types.
 			p.inlinedTypes = append(p.inlinedTypes[:i], p.inlinedTypes[i+1:]...)
@@ -358,7 +387,7 @@ func (p *typeParser) getType(typeName string) (sig *typeFunc, paramNames wasm.Na
 	// While inlined types are supposed to re-use an existing type index, there's no no unique constraint on explicitly
 	// defined module types. This means a duplicate type is not a bug: we don't check module.types first.
 	if sig == nil {
-		sig = &typeFunc{typeName, p.currentParams, p.currentResult}
+		sig = &typeFunc{typeName, p.currentParams, p.currentResults}
 	}
 	return
 }
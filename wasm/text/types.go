@@ -108,21 +108,18 @@ type typeFunc struct {
 	name string // TODO: presumably, this must be unique as it is a symbolic identifier?
 
 	// params are the possibly empty sequence of value types accepted by a function with this signature.
-	//
-	// Note: In WebAssembly 1.0 (MVP), there can be at most one result.
-	// See https://www.w3.org/TR/wasm-core-1/#result-types%E2%91%A0
 	params []wasm.ValueType
 
-	// result is the value type of the signature or zero if there is none.
+	// results are the possibly empty sequence of value types returned by a function with this signature.
 	//
-	// Note: We use this shortcut instead of a slice because in WebAssembly 1.0 (MVP), there can be at most one result.
-	// See https://www.w3.org/TR/wasm-core-1/#result-types%E2%91%A0
-	result wasm.ValueType
+	// Note: In WebAssembly 1.0 (MVP), there can be at most one result, but the multi-value proposal lifts this limit.
+	// See https://github.com/WebAssembly/multi-value/blob/master/proposals/multi-value/Overview.md
+	results []wasm.ValueType
 }
 
 // funcTypeEquals allows you to compare signatures ignoring names
-func funcTypeEquals(t *typeFunc, params []wasm.ValueType, result wasm.ValueType) bool {
-	return bytes.Equal(t.params, params) && t.result == result
+func funcTypeEquals(t *typeFunc, params []wasm.ValueType, results []wasm.ValueType) bool {
+	return bytes.Equal(t.params, params) && bytes.Equal(t.results, results)
 }
 
 // importFunc corresponds to the text format of a WebAssembly function import.
@@ -0,0 +1,91 @@
+package wasm
+
+import "math"
+
+// The following functions convert Go values to and from the uint64 representation of Wasm values,
+// which is used for the parameters and results of Engine.Call and ExportedFunction.Call.
+
+// EncodeI32 encodes the i32 value v.
+func EncodeI32(v int32) uint64 {
+	return uint64(uint32(v))
+}
+
+// DecodeI32 decodes the i32 value encoded as v.
+func DecodeI32(v uint64) int32 {
+	return int32(uint32(v))
+}
+
+// EncodeI64 encodes the i64 value v.
+func EncodeI64(v int64) uint64 {
+	return uint64(v)
+}
+
+// DecodeI64 decodes the i64 value encoded as v.
+func DecodeI64(v uint64) int64 {
+	return int64(v)
+}
+
+// EncodeF32 encodes the f32 value v.
+func EncodeF32(v float32) uint64 {
+	return uint64(math.Float32bits(v))
+}
+
+// DecodeF32 decodes the f32 value encoded as v.
+func DecodeF32(v uint64) float32 {
+	return math.Float32frombits(uint32(v))
+}
+
+// EncodeF64 encodes the f64 value v.
+func EncodeF64(v float64) uint64 {
+	return math.Float64bits(v)
+}
+
+// DecodeF64 decodes the f64 value encoded as v.
+func DecodeF64(v uint64) float64 {
+	return math.Float64frombits(v)
+}
+
+// encodeValue encodes the Go value v as the Wasm value of type t. The Go type of v must
+// be int32 or uint32 for i32, int64 or uint64 for i64, float32 for f32 and float64 for f64.
+func encodeValue(t ValueType, v interface{}) (uint64, bool) {
+	switch t {
+	case ValueTypeI32:
+		switch v := v.(type) {
+		case int32:
+			return EncodeI32(v), true
+		case uint32:
+			return uint64(v), true
+		}
+	case ValueTypeI64:
+		switch v := v.(type) {
+		case int64:
+			return EncodeI64(v), true
+		case uint64:
+			return v, true
+		}
+	case ValueTypeF32:
+		if v, ok := v.(float32); ok {
+			return EncodeF32(v), true
+		}
+	case ValueTypeF64:
+		if v, ok := v.(float64); ok {
+			return EncodeF64(v), true
+		}
+	}
+	return 0, false
+}
+
+// decodeValue decodes v as the Wasm value of type t into int32, int64, float32 or float64.
+func decodeValue(t ValueType, v uint64) interface{} {
+	switch t {
+	case ValueTypeI32:
+		return DecodeI32(v)
+	case ValueTypeI64:
+		return DecodeI64(v)
+	case ValueTypeF32:
+		return DecodeF32(v)
+	case ValueTypeF64:
+		return DecodeF64(v)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package wasm
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	for _, v := range []int32{0, 1, -1, math.MinInt32, math.MaxInt32} {
+		require.Equal(t, v, DecodeI32(EncodeI32(v)))
+		// The upper 32 bits must be zero.
+		require.Equal(t, uint64(uint32(v)), EncodeI32(v))
+	}
+	for _, v := range []int64{0, 1, -1, math.MinInt64, math.MaxInt64} {
+		require.Equal(t, v, DecodeI64(EncodeI64(v)))
+	}
+	for _, v := range []float32{0, 1.5, -1.5, math.MaxFloat32, float32(math.Inf(-1))} {
+		require.Equal(t, v, DecodeF32(EncodeF32(v)))
+		require.Equal(t, uint64(math.Float32bits(v)), EncodeF32(v))
+	}
+	require.True(t, math.IsNaN(float64(DecodeF32(EncodeF32(float32(math.NaN()))))))
+	for _, v := range []float64{0, 1.5, -1.5, math.MaxFloat64, math.Inf(1)} {
+		require.Equal(t, v, DecodeF64(EncodeF64(v)))
+		require.Equal(t, math.Float64bits(v), EncodeF64(v))
+	}
+	require.True(t, math.IsNaN(DecodeF64(EncodeF64(math.NaN()))))
+}
+
+func TestEncodeValue(t *testing.T) {
+	for _, c := range []struct {
+		valueType ValueType
+		value     interface{}
+		expected  uint64
+		ok        bool
+	}{
+		{valueType: ValueTypeI32, value: int32(-1), expected: math.MaxUint32, ok: true},
+		{valueType: ValueTypeI32, value: uint32(1), expected: 1, ok: true},
+		{valueType: ValueTypeI32, value: int64(1)},
+		{valueType: ValueTypeI32, value: 1},
+		{valueType: ValueTypeI64, value: int64(-1), expected: math.MaxUint64, ok: true},
+		{valueType: ValueTypeI64, value: uint64(1), expected: 1, ok: true},
+		{valueType: ValueTypeI64, value: int32(1)},
+		{valueType: ValueTypeF32, value: float32(1.5), expected: uint64(math.Float32bits(1.5)), ok: true},
+		{valueType: ValueTypeF32, value: float64(1.5)},
+		{valueType: ValueTypeF64, value: float64(1.5), expected: math.Float64bits(1.5), ok: true},
+		{valueType: ValueTypeF64, value: float32(1.5)},
+	} {
+		actual, ok := encodeValue(c.valueType, c.value)
+		require.Equal(t, c.ok, ok, "%s %T", valueTypeName(c.valueType), c.value)
+		require.Equal(t, c.expected, actual)
+	}
+}
+
+func TestDecodeValue(t *testing.T) {
+	require.Equal(t, int32(-1), decodeValue(ValueTypeI32, math.MaxUint32))
+	require.Equal(t, int64(-1), decodeValue(ValueTypeI64, math.MaxUint64))
+	require.Equal(t, float32(1.5), decodeValue(ValueTypeF32, uint64(math.Float32bits(1.5))))
+	require.Equal(t, float64(1.5), decodeValue(ValueTypeF64, math.Float64bits(1.5)))
+}
@@ -4,9 +4,11 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"math"
 	"os"
 	"strings"
+	"sync"
 
 	"github.com/tetratelabs/wazero/wasm"
 	"github.com/tetratelabs/wazero/wasm/buildoptions"
@@ -26,9 +28,10 @@ const (
 
 type (
 	controlFrame struct {
-		frameID          uint32
+		frameID uint32
+		// originalStackLen is the length of the stack on entering this frame excluding the params of the block.
 		originalStackLen int
-		returns          []UnsignedType
+		params, returns  []UnsignedType
 		kind             controlFrameKind
 	}
 	controlFrames struct{ frames []*controlFrame }
@@ -110,9 +113,11 @@ type compiler struct {
 		on    bool
 		depth int
 	}
-	pc     uint64
-	f      *wasm.FunctionInstance
-	result CompilationResult
+	pc uint64
+	// sourceOffset is the offset of the currently handled instruction in the function body.
+	sourceOffset uint64
+	f            *wasm.FunctionInstance
+	result       CompilationResult
 }
 
 // For debugging only.
@@ -135,16 +140,37 @@ func (c *compiler) resetUnreachable() {
 type CompilationResult struct {
 	// Operations holds wazerois operations compiled from Wasm instructions in a Wasm function.
 	Operations []Operation
+	// SourceOffsets holds the offsets of the Wasm instructions in the function body from which
+	// the operations are compiled. SourceOffsets[i] corresponds to Operations[i], and this is zero
+	// for the operations initializing the locals.
+	SourceOffsets []uint64
 	// LabelCallers maps Label.String() to the number of callers to that label.
 	// Here "callers" means that the callsites which jumps to the label with br, br_if or br_table
 	// instructions.
 	LabelCallers map[string]int
+	// EntryFuelCost is the fuel consumed on entering the function, which equals
+	// the number of operations before the first label.
+	EntryFuelCost uint64
+	// LabelFuelCosts maps Label.String() to the fuel consumed on jumping to that label,
+	// which equals the number of operations between the label and the next one.
+	LabelFuelCosts map[string]uint64
+	// MaxStackHeight is the maximum number of the values on the stack during the function including
+	// the parameters, so that engines can reserve the stack before executing the function.
+	MaxStackHeight uint64
 }
 
 // Compile lowers given function instance into wazeroir operations
 // so that the resulting operations can be consumed by the interpreter
 // or the JIT compilation engine.
+//
+// This only reads f and its module instance, so functions can be compiled concurrently.
 func Compile(f *wasm.FunctionInstance) (*CompilationResult, error) {
+	return CompileWithConfig(f, nil)
+}
+
+// CompileWithConfig is the same as Compile except that the operations are optimized if config.Optimize is set.
+// The operations before and after each optimization pass are written to config.DebugOutput if config.Debug is set.
+func CompileWithConfig(f *wasm.FunctionInstance, config *wasm.RuntimeConfig) (*CompilationResult, error) {
 	c := compiler{controlFrames: &controlFrames{}, f: f, result: CompilationResult{LabelCallers: map[string]int{}}}
 
 	// Push function arguments.
@@ -159,15 +185,11 @@ func Compile(f *wasm.FunctionInstance) (*CompilationResult, error) {
 		c.emitDefaultValue(t)
 	}
 
-	// Insert the function control frame.
-	returns := make([]UnsignedType, 0, len(f.FunctionType.Type.Results))
-	for _, t := range f.FunctionType.Type.Results {
-		returns = append(returns, wasmValueTypeToUnsignedType(t))
-	}
+	// Insert the function control frame. Note that the function params are locals rather than the params of the frame.
 	c.controlFrames.push(&controlFrame{
 		frameID:          c.nextID(),
 		originalStackLen: len(f.FunctionType.Type.Params),
-		returns:          returns,
+		returns:          wasmValueTypesToUnsignedTypes(f.FunctionType.Type.Results),
 		kind:             controlFrameKindFunction,
 	})
 
@@ -177,13 +199,63 @@ func Compile(f *wasm.FunctionInstance) (*CompilationResult, error) {
 			return nil, fmt.Errorf("handling instruction: %w\ndisassemble: %v", err, Format(c.result.Operations))
 		}
 	}
+	if config != nil && config.Optimize {
+		if buildoptions.IsDebugMode || config.Debug {
+			var dump strings.Builder
+			_, _ = dump.WriteString(fmt.Sprintf("wazeroir passes of function[%d]:\n", f.Index))
+			c.result.optimize(passes, &dump)
+			writeDebugOutput(config, dump.String())
+		} else {
+			c.result.optimize(passes, nil)
+		}
+	}
+	c.result.computeFuelCosts()
 	return &c.result, nil
 }
 
+// debugOutputMux serializes the debug output of the functions compiled concurrently.
+var debugOutputMux sync.Mutex
+
+// writeDebugOutput writes s to config.DebugOutput, or os.Stdout if not set.
+func writeDebugOutput(config *wasm.RuntimeConfig, s string) {
+	w := config.DebugOutput
+	if w == nil {
+		w = os.Stdout
+	}
+	debugOutputMux.Lock()
+	defer debugOutputMux.Unlock()
+	_, _ = io.WriteString(w, s)
+}
+
+// computeFuelCosts calculates EntryFuelCost and LabelFuelCosts.
+//
+// Labels are only reachable by explicit branches, so the costs of all the operations
+// in a basic block can be charged at once on entering the block. This way both engines
+// consume exactly the same amount of fuel for the same execution.
+func (r *CompilationResult) computeFuelCosts() {
+	r.LabelFuelCosts = map[string]uint64{}
+	cost, label := &r.EntryFuelCost, ""
+	for _, op := range r.Operations {
+		if o, ok := op.(*OperationLabel); ok {
+			if label != "" {
+				r.LabelFuelCosts[label] = *cost
+			}
+			label = o.Label.String()
+			cost = new(uint64)
+			continue
+		}
+		*cost++
+	}
+	if label != "" {
+		r.LabelFuelCosts[label] = *cost
+	}
+}
+
 // Translate the current Wasm instruction to wazeroir's operations,
 // and emit the results into c.results.
 func (c *compiler) handleInstruction() error {
 	op := c.f.Body[c.pc]
+	c.sourceOffset = c.pc
 	if buildoptions.IsDebugMode {
 		fmt.Printf("handling %s, unreachable_state(on=%v,depth=%d)\n",
 			wasm.InstructionName(op),
@@ -228,12 +300,11 @@ operatorSwitch:
 		// Create a new frame -- entering this block.
 		frame := &controlFrame{
 			frameID:          c.nextID(),
-			originalStackLen: len(c.stack),
+			originalStackLen: len(c.stack) - len(bt.Params),
+			params:           wasmValueTypesToUnsignedTypes(bt.Params),
+			returns:          wasmValueTypesToUnsignedTypes(bt.Results),
 			kind:             controlFrameKindBlockWithoutContinuationLabel,
 		}
-		for _, t := range bt.Results {
-			frame.returns = append(frame.returns, wasmValueTypeToUnsignedType(t))
-		}
 		c.controlFrames.push(frame)
 
 	case wasm.OpcodeLoop:
@@ -254,12 +325,11 @@ operatorSwitch:
 		// Create a new frame -- entering loop.
 		frame := &controlFrame{
 			frameID:          c.nextID(),
-			originalStackLen: len(c.stack),
+			originalStackLen: len(c.stack) - len(bt.Params),
+			params:           wasmValueTypesToUnsignedTypes(bt.Params),
+			returns:          wasmValueTypesToUnsignedTypes(bt.Results),
 			kind:             controlFrameKindLoop,
 		}
-		for _, t := range bt.Results {
-			frame.returns = append(frame.returns, wasmValueTypeToUnsignedType(t))
-		}
 		c.controlFrames.push(frame)
 
 		// Prep labels for inside and the continuation of this loop.
@@ -292,14 +362,13 @@ operatorSwitch:
 		// Create a new frame -- entering if.
 		frame := &controlFrame{
 			frameID:          c.nextID(),
-			originalStackLen: len(c.stack),
+			originalStackLen: len(c.stack) - len(bt.Params),
+			params:           wasmValueTypesToUnsignedTypes(bt.Params),
+			returns:          wasmValueTypesToUnsignedTypes(bt.Results),
 			// Note this will be set to controlFrameKindIfWithElse
 			// when else opcode found later.
 			kind: controlFrameKindIfWithoutElse,
 		}
-		for _, t := range bt.Results {
-			frame.returns = append(frame.returns, wasmValueTypeToUnsignedType(t))
-		}
 		c.controlFrames.push(frame)
 
 		// Prep labels for if and else of this if.
@@ -329,6 +398,9 @@ operatorSwitch:
 			// reset the stack so we can correctly handle the else block.
 			top := c.controlFrames.top()
 			c.stack = c.stack[:top.originalStackLen]
+			for _, t := range top.params {
+				c.stackPush(t)
+			}
 			top.kind = controlFrameKindIfWithElse
 
 			// We are no longer unreachable in else frame,
@@ -347,9 +419,12 @@ operatorSwitch:
 
 		// We need to reset the stack so that
 		// the values pushed inside the then block
-		// do not affect the else block.
-		dropOp := &OperationDrop{Range: c.getFrameDropRange(frame)}
+		// do not affect the else block, which starts with the params.
+		dropOp := &OperationDrop{Range: c.getFrameDropRange(frame, true)}
 		c.stack = c.stack[:frame.originalStackLen]
+		for _, t := range frame.params {
+			c.stackPush(t)
+		}
 
 		// Prep labels for else and the continueation of this if block.
 		elseLabel := &Label{FrameID: frame.frameID, Kind: LabelKindElse, OriginalStackLen: frame.originalStackLen}
@@ -405,7 +480,7 @@ operatorSwitch:
 
 		// We need to reset the stack so that
 		// the values pushed inside the block.
-		dropOp := &OperationDrop{Range: c.getFrameDropRange(frame)}
+		dropOp := &OperationDrop{Range: c.getFrameDropRange(frame, true)}
 		c.stack = c.stack[:frame.originalStackLen]
 
 		// Push the result types onto the stack.
@@ -467,7 +542,7 @@ operatorSwitch:
 
 		targetFrame := c.controlFrames.get(int(targetIndex))
 		targetFrame.ensureContinuation()
-		dropOp := &OperationDrop{Range: c.getFrameDropRange(targetFrame)}
+		dropOp := &OperationDrop{Range: c.getFrameDropRange(targetFrame, false)}
 		target := targetFrame.asBranchTarget()
 		c.result.LabelCallers[target.Label.String()]++
 		c.emit(
@@ -487,7 +562,7 @@ operatorSwitch:
 
 		targetFrame := c.controlFrames.get(int(targetIndex))
 		targetFrame.ensureContinuation()
-		drop := c.getFrameDropRange(targetFrame)
+		drop := c.getFrameDropRange(targetFrame, false)
 		target := targetFrame.asBranchTarget()
 		c.result.LabelCallers[target.Label.String()]++
 
@@ -521,7 +596,7 @@ operatorSwitch:
 			c.pc += n
 			targetFrame := c.controlFrames.get(int(l))
 			targetFrame.ensureContinuation()
-			drop := c.getFrameDropRange(targetFrame)
+			drop := c.getFrameDropRange(targetFrame, false)
 			target := &BranchTargetDrop{ToDrop: drop, Target: targetFrame.asBranchTarget()}
 			targets[i] = target
 			c.result.LabelCallers[target.Target.Label.String()]++
@@ -535,7 +610,7 @@ operatorSwitch:
 		c.pc += n
 		defaultTargetFrame := c.controlFrames.get(int(l))
 		defaultTargetFrame.ensureContinuation()
-		defaultTargetDrop := c.getFrameDropRange(defaultTargetFrame)
+		defaultTargetDrop := c.getFrameDropRange(defaultTargetFrame, false)
 		defaultTarget := defaultTargetFrame.asBranchTarget()
 		c.result.LabelCallers[defaultTarget.Label.String()]++
 
@@ -553,7 +628,7 @@ operatorSwitch:
 		c.markUnreachable()
 	case wasm.OpcodeReturn:
 		functionFrame := c.controlFrames.functionFrame()
-		dropOp := &OperationDrop{Range: c.getFrameDropRange(functionFrame)}
+		dropOp := &OperationDrop{Range: c.getFrameDropRange(functionFrame, false)}
 
 		// Cleanup the stack and then jmp to function frame's continuation (meaning return).
 		c.emit(
@@ -1452,6 +1527,9 @@ func (c *compiler) stackPop() (ret UnsignedType) {
 
 func (c *compiler) stackPush(t UnsignedType) {
 	c.stack = append(c.stack, t)
+	if h := uint64(len(c.stack)); h > c.result.MaxStackHeight {
+		c.result.MaxStackHeight = h
+	}
 }
 
 // Emit the operatiosn into the result.
@@ -1469,6 +1547,7 @@ func (c *compiler) emit(ops ...Operation) {
 				}
 			}
 			c.result.Operations = append(c.result.Operations, op)
+			c.result.SourceOffsets = append(c.result.SourceOffsets, c.sourceOffset)
 			if buildoptions.IsDebugMode {
 				fmt.Printf("emitting ")
 				formatOperation(os.Stdout, op)
@@ -1503,9 +1582,14 @@ func (c *compiler) localDepth(n uint32) int {
 
 // Returns the range (starting from top of the stack) that spans across
 // the stack. The range is supposed to be dropped from the stack when
-// the given frame exists.
-func (c *compiler) getFrameDropRange(frame *controlFrame) *InclusiveRange {
+// the given frame exits, keeping the values passed to the destination.
+// isEnd is true if this exits the frame by the end of it, and false if by a branch.
+func (c *compiler) getFrameDropRange(frame *controlFrame, isEnd bool) *InclusiveRange {
 	start := len(frame.returns)
+	if !isEnd && frame.kind == controlFrameKindLoop {
+		// Branching into a loop jumps to the header with the params of the loop.
+		start = len(frame.params)
+	}
 	var end int
 	if frame.kind == controlFrameKindFunction {
 		// On the function return, we eliminate all the contents on the stack
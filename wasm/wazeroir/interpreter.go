@@ -1,91 +1,184 @@
 package wazeroir
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"math"
 	"math/bits"
 	"reflect"
 	"runtime/debug"
 	"strings"
+	"sync"
 
 	"github.com/tetratelabs/wazero/wasm"
 	"github.com/tetratelabs/wazero/wasm/buildoptions"
 )
 
-var callStackCeiling = buildoptions.CallStackCeiling
-
 // interpreter implements wasm.Engine interface.
 // This is the direct interpreter of wazeroir operations.
 type interpreter struct {
-	// Stores compiled functions.
-	functions map[wasm.FunctionAddress]*interpreterFunction
-	// stack contains the operands.
+	// mux protects functions so that calls can be made while other functions are bound.
+	mux sync.RWMutex
+	// Stores the functions bound to the function instances. These are keyed by the function instances rather than
+	// their addresses, since the addresses are only unique within a store while an engine can be shared by stores.
+	functions map[*wasm.FunctionInstance]*interpreterFunction
+	// config holds the limits of the calls. See wasm.RuntimeConfig.
+	config *wasm.RuntimeConfig
+	// callEngines pools the callEngines so that their stacks are reused across the calls.
+	callEngines sync.Pool
+}
+
+func NewEngine() wasm.Engine {
+	return NewEngineWithConfig(nil)
+}
+
+// NewEngineWithConfig is the same as NewEngine except that the calls are executed with the limits in config.
+func NewEngineWithConfig(config *wasm.RuntimeConfig) wasm.Engine {
+	it := &interpreter{
+		functions: map[*wasm.FunctionInstance]*interpreterFunction{},
+		config:    config.WithDefaults(),
+	}
+	it.callEngines.New = func() interface{} { return it.newCallEngine() }
+	return it
+}
+
+// callEngine holds the execution context of a Call, so that functions can be called concurrently.
+type callEngine struct {
+	// stack contains the operands, and the values above sp are unused.
 	// Note that all the values are represented as uint64.
+	//
+	// The length of stack is the preallocated capacity of the operand stack, which is only grown at function
+	// entries by the maximum height of the function. See ensureStack.
 	stack []uint64
-	// Function call stack.
-	frames []*interpreterFrame
-	// onCompilationDoneCallbacks call back when a function instance is compiled.
-	// See the comment where this is used below for detail.
-	// Not used at runtime, and only in the compilation phase.
-	onCompilationDoneCallbacks map[wasm.FunctionAddress][]func(*interpreterFunction)
+	// sp is the stack pointer, i.e. the number of the operands on stack.
+	sp int
+	// Function call stack. The frames are held by value in the preallocated slice, so pointers to them
+	// are only valid until the next call.
+	frames []interpreterFrame
+	// callCanceledCheckCountdown is decremented at function entries and backward branches,
+	// and we check whether ctx is done when this reaches zero.
+	callCanceledCheckCountdown uint64
+	// ctx is the context.Context given to this call.
+	ctx context.Context
+	// fuel is the remaining fuel of this call.
+	// See wasm.Fuel for detail.
+	fuel uint64
+	// interpreter is the engine from which this is created, and used to look up the callee functions.
+	interpreter *interpreter
+	// maxCallStackDepth is the maximum of baseCallStackDepth plus the length of frames.
+	// See wasm.RuntimeConfig.MaxCallStackDepth.
+	maxCallStackDepth int
+	// baseCallStackDepth is the number of the frames below frames, which are the ones of another engine when this call
+	// continues the call made by it. See wasm.StateCaller.
+	baseCallStackDepth int
+	// maxOperandStackSize is the maximum height of stack checked on function calls.
+	// See wasm.RuntimeConfig.MaxOperandStackSize.
+	maxOperandStackSize int
+	// hostCallContext is passed to raw host functions, and reused across the calls to avoid allocations.
+	hostCallContext wasm.HostFunctionCallContext
 }
 
-func NewEngine() wasm.Engine {
-	return &interpreter{
-		functions:                  map[wasm.FunctionAddress]*interpreterFunction{},
-		onCompilationDoneCallbacks: map[wasm.FunctionAddress][]func(*interpreterFunction){},
+func (it *interpreter) newCallEngine() *callEngine {
+	maxCallStackDepth := clampToInt(it.config.MaxCallStackDepth)
+	frameCap := maxCallStackDepth
+	if frameCap > buildoptions.CallStackCeiling {
+		// The frames beyond the ceiling are rare, so they are allocated on demand.
+		frameCap = buildoptions.CallStackCeiling
+	}
+	return &callEngine{
+		stack:                      make([]uint64, it.config.InitialOperandStackSize),
+		frames:                     make([]interpreterFrame, 0, frameCap),
+		callCanceledCheckCountdown: callCanceledCheckInterval,
+		interpreter:                it,
+		maxCallStackDepth:          maxCallStackDepth,
+		maxOperandStackSize:        clampToInt(it.config.MaxOperandStackSize),
+	}
+}
+
+// clampToInt converts v to int, clamping it to the max int on 32-bit platforms.
+func clampToInt(v uint32) int {
+	if maxInt := uint64(^uint(0) >> 1); uint64(v) > maxInt {
+		return int(maxInt)
 	}
+	return int(v)
 }
 
-func (it *interpreter) push(v uint64) {
-	it.stack = append(it.stack, v)
+// getCallEngine returns a callEngine from the pool, which is ready for a new Call.
+func (it *interpreter) getCallEngine() *callEngine {
+	ce := it.callEngines.Get().(*callEngine)
+	ce.sp, ce.frames = 0, ce.frames[:0]
+	ce.callCanceledCheckCountdown = callCanceledCheckInterval
+	return ce
 }
 
-func (it *interpreter) pop() (v uint64) {
+// putCallEngine returns ce to the pool after clearing the references to the finished call.
+func (it *interpreter) putCallEngine(ce *callEngine) {
+	ce.ctx, ce.hostCallContext = nil, wasm.HostFunctionCallContext{}
+	it.callEngines.Put(ce)
+}
+
+func (ce *callEngine) push(v uint64) {
+	// No need to check stack bound as ensureStack has reserved the maximum height of the current function.
+	ce.stack[ce.sp] = v
+	ce.sp++
+}
+
+func (ce *callEngine) pop() (v uint64) {
 	// No need to check stack bound
 	// as we can assume that all the operations
 	// are valid thanks to validateFunction
 	// at module validation phase
 	// and wazeroir translation
 	// before compilation.
-	v = it.stack[len(it.stack)-1]
-	it.stack = it.stack[:len(it.stack)-1]
+	ce.sp--
+	v = ce.stack[ce.sp]
 	return
 }
 
-func (it *interpreter) drop(r *InclusiveRange) {
+// drop removes the values in the range from the top of the stack, where 0 is the top, by moving down the
+// values above them in place.
+func (ce *callEngine) drop(start, end int) {
 	// No need to check stack bound
 	// as we can assume that all the operations
 	// are valid thanks to validateFunction
 	// at module validation phase
 	// and wazeroir translation
 	// before compilation.
-	if r == nil {
-		return
-	} else if r.Start == 0 {
-		it.stack = it.stack[:len(it.stack)-1-r.End]
-	} else {
-		newStack := it.stack[:len(it.stack)-1-r.End]
-		newStack = append(newStack, it.stack[len(it.stack)-r.Start:]...)
-		it.stack = newStack
+	if start > 0 {
+		copy(ce.stack[ce.sp-1-end:], ce.stack[ce.sp-start:ce.sp])
+	}
+	ce.sp -= end - start + 1
+}
+
+// ensureStack grows stack if less than n slots are available above sp. The values are copied to the new stack,
+// so slices of the old stack must not be written after this.
+func (ce *callEngine) ensureStack(n int) {
+	if required := ce.sp + n; required > len(ce.stack) {
+		size := 2 * len(ce.stack)
+		if size < required {
+			size = required
+		}
+		stack := make([]uint64, size)
+		copy(stack, ce.stack[:ce.sp])
+		ce.stack = stack
 	}
 }
 
-func (it *interpreter) pushFrame(frame *interpreterFrame) {
-	if callStackCeiling <= len(it.frames) {
+// pushFrame pushes the frame of f and returns it. The returned pointer is invalidated by the next pushFrame.
+func (ce *callEngine) pushFrame(f *interpreterFunction) (frame *interpreterFrame) {
+	if ce.maxCallStackDepth <= ce.baseCallStackDepth+len(ce.frames) || ce.maxOperandStackSize < ce.sp {
 		panic(wasm.ErrRuntimeCallStackOverflow)
 	}
-	it.frames = append(it.frames, frame)
+	ce.frames = append(ce.frames, interpreterFrame{f: f})
+	return &ce.frames[len(ce.frames)-1]
 }
 
-func (it *interpreter) popFrame() (frame *interpreterFrame) {
+func (ce *callEngine) popFrame() {
 	// No need to check stack bound as we can assume that all the operations are valid thanks to validateFunction at
 	// module validation phase and wazeroir translation before compilation.
-	oneLess := len(it.frames) - 1
-	frame = it.frames[oneLess]
-	it.frames = it.frames[:oneLess]
-	return
+	ce.frames = ce.frames[:len(ce.frames)-1]
 }
 
 type interpreterFrame struct {
@@ -98,56 +191,215 @@ type interpreterFrame struct {
 
 type interpreterFunction struct {
 	funcInstance *wasm.FunctionInstance
-	body         []*interpreterOp
-	hostFn       *reflect.Value
+	body         []interpreterOp
+	// branchTargets holds the targets of the br_if and br_table operations in body. See interpreterOp.
+	branchTargets []branchTarget
+	hostFn        *reflect.Value
+	rawHostFn     wasm.RawHostFunction
+	// entryFuelCost is the fuel consumed on entering this function.
+	entryFuelCost uint64
+	// stackGrowth is the maximum number of the values pushed above the parameters during this function.
+	stackGrowth int
+	// lazy is non-nil if the compilation is deferred until the first call, in which case body is nil.
+	// See wasm.RuntimeConfig.LazyCompilation.
+	lazy *lazyCompilation
 }
 
-// Non-interface union of all the wazeroir operations.
+// lazyCompilation is the state of the compilation deferred until the first call of the function,
+// which is shared by all the instances of the function.
+type lazyCompilation struct {
+	once sync.Once
+	// compiled is the template compiled on the first call, or nil if the compilation failed with err.
+	compiled *interpreterFunction
+	err      error
+}
+
+// Non-interface union of all the wazeroir operations, which are packed into the flat array of the
+// function body. The immediates are held in u1 and u2 as follows:
+//
+//   - br: u1 is the address of the target, and u2 is the fuel cost of it.
+//   - br_if: u1 is the index of the "then" target in interpreterFunction.branchTargets, followed by the "else" one.
+//   - br_table: u1 is the index of the default target in interpreterFunction.branchTargets followed by the others,
+//     and u2 is the number of the targets including the default.
+//   - drop: u1 and u2 are the start and the end of the range.
+//   - load and store: u1 is the alignment, and u2 is the offset.
+//   - the others: u1 is the index or the constant value if any.
 type interpreterOp struct {
 	kind   OperationKind
 	b1, b2 byte
-	us     []uint64
-	rs     []*InclusiveRange
-	f      *interpreterFunction
+	u1, u2 uint64
+	// sourceOffset is the offset of the Wasm instruction in the function body from which this is compiled.
+	sourceOffset uint64
 }
 
-// Compile Implements wasm.Engine for interpreter.
-func (it *interpreter) Compile(f *wasm.FunctionInstance) error {
-	funcaddr := f.Address
+// The kinds of the superinstructions which are fused from the common sequences of wazeroir operations.
+// These follow the kinds of the operations so that they are dispatched by the same switch.
+const (
+	// interpreterOpKindSet is the fusion of OperationSwap with the depth u1 and OperationDrop of the top value,
+	// which is the lowering of local.set: this pops the top value and sets it at the depth u1 - 1.
+	interpreterOpKindSet = OperationKindExtend + 1 + iota
+	// interpreterOpKindAddConst is the fusion of OperationConstI32 or OperationConstI64 with the value u1 and
+	// OperationAdd of the same type b1.
+	interpreterOpKindAddConst
+	// interpreterOpKindSubConst is the same as interpreterOpKindAddConst except that this is fused with OperationSub.
+	interpreterOpKindSubConst
+)
 
+// branchTarget is the target of br_if and br_table operations.
+type branchTarget struct {
+	// pc is the address of the target, or math.MaxUint64 for the return.
+	pc uint64
+	// fuelCost is the fuel consumed on jumping to the target.
+	fuelCost uint64
+	// toDrop is the range of the stack dropped before the jump, or nil if nothing is dropped.
+	toDrop *InclusiveRange
+}
+
+// Compile implements wasm.Engine Compile for interpreter.
+//
+// The returned *interpreterFunction is a template which doesn't depend on any store,
+// and its copy is bound to each function instance by Bind.
+func (it *interpreter) Compile(f *wasm.FunctionInstance) (wasm.CompiledFunction, error) {
 	if f.IsHostFunction() {
-		ret := &interpreterFunction{
-			hostFn: f.HostFunction, funcInstance: f,
-		}
-		it.functions[funcaddr] = ret
-		return nil
-	} else {
-		ir, err := Compile(f)
-		if err != nil {
-			return fmt.Errorf("failed to compile Wasm to wazeroir: %w", err)
+		fn := &interpreterFunction{hostFn: f.HostFunction, rawHostFn: f.RawHostFunction}
+		// The results of host functions replace the parameters on the stack.
+		tp := f.FunctionType.Type
+		if fn.stackGrowth = len(tp.Results) - len(tp.Params); fn.stackGrowth < 0 {
+			fn.stackGrowth = 0
 		}
+		return fn, nil
+	}
+	if it.config.LazyCompilation {
+		// The function is compiled on the first call. See compileLazily.
+		return &interpreterFunction{lazy: &lazyCompilation{}}, nil
+	}
+	return it.compile(f)
+}
 
-		fn, err := it.lowerIROps(f, ir.Operations)
-		if err != nil {
-			return fmt.Errorf("failed to convert wazeroir operations to interpreter ones: %w", err)
-		}
-		it.functions[funcaddr] = fn
-		for _, cb := range it.onCompilationDoneCallbacks[funcaddr] {
-			cb(fn)
-		}
-		delete(it.onCompilationDoneCallbacks, funcaddr)
+func (it *interpreter) compile(f *wasm.FunctionInstance) (*interpreterFunction, error) {
+	ir, err := CompileWithConfig(f, it.config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile Wasm to wazeroir: %w", err)
 	}
+
+	fn, err := it.lowerIROps(ir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert wazeroir operations to interpreter ones: %w", err)
+	}
+	fn.stackGrowth = int(ir.MaxStackHeight) - len(f.FunctionType.Type.Params)
+	return fn, nil
+}
+
+// compileLazily returns the function compiled from f whose compilation is deferred, and binds it to the function
+// instance of f for the later calls. This panics if the compilation fails.
+func (it *interpreter) compileLazily(f *interpreterFunction) *interpreterFunction {
+	lazy := f.lazy
+	lazy.once.Do(func() {
+		// The compiled function doesn't depend on the instance, so the template compiled from any of the
+		// instances sharing lazy can be used by all of them.
+		lazy.compiled, lazy.err = it.compile(f.funcInstance)
+	})
+	if lazy.err != nil {
+		panic(lazy.err)
+	}
+
+	fn := *lazy.compiled
+	fn.funcInstance = f.funcInstance
+	it.mux.Lock()
+	defer it.mux.Unlock()
+	// f might have been released or rebound meanwhile.
+	if it.functions[f.funcInstance] == f {
+		it.functions[f.funcInstance] = &fn
+	}
+	return &fn
+}
+
+// Bind implements wasm.Engine Bind for interpreter.
+//
+// The host functions of the template are replaced with the ones of f only when f is a host function, so a template
+// compiled from a host function can also be bound to a Wasm function to run it by other means, as the JIT engine does.
+func (it *interpreter) Bind(f *wasm.FunctionInstance, compiled wasm.CompiledFunction) error {
+	template, ok := compiled.(*interpreterFunction)
+	if !ok {
+		return fmt.Errorf("%T is not compiled by interpreter", compiled)
+	}
+
+	fn := *template
+	fn.funcInstance = f
+	if f.IsHostFunction() {
+		fn.hostFn = f.HostFunction
+		fn.rawHostFn = f.RawHostFunction
+	}
+
+	it.mux.Lock()
+	defer it.mux.Unlock()
+	it.functions[f] = &fn
+	return nil
+}
+
+// Release implements wasm.Engine Release for interpreter.
+func (it *interpreter) Release(f *wasm.FunctionInstance) error {
+	it.mux.Lock()
+	defer it.mux.Unlock()
+	if _, ok := it.functions[f]; !ok {
+		return fmt.Errorf("function at address %d is not bound", f.Address)
+	}
+	delete(it.functions, f)
+	return nil
+}
+
+// ReleaseCompiled implements wasm.Engine ReleaseCompiled for interpreter.
+// This is no-op as the interpreter's compiled functions are garbage collected.
+func (it *interpreter) ReleaseCompiled(compiled wasm.CompiledFunction) error {
 	return nil
 }
 
 // Lowers the wazeroir operations to interpreter friendly struct.
-func (it *interpreter) lowerIROps(f *wasm.FunctionInstance,
-	ops []Operation) (*interpreterFunction, error) {
-	ret := &interpreterFunction{funcInstance: f}
+func (it *interpreter) lowerIROps(ir *CompilationResult) (*interpreterFunction, error) {
+	ret := &interpreterFunction{entryFuelCost: ir.EntryFuelCost}
 	labelAddress := map[string]uint64{}
 	onLabelAddressResolved := map[string][]func(addr uint64){}
-	for _, original := range ops {
-		op := &interpreterOp{kind: original.Kind()}
+	// resolveLabel calls setAddress with the address of target once it is emitted.
+	resolveLabel := func(target *BranchTarget, setAddress func(addr uint64)) {
+		if target.IsReturnTarget() {
+			// Jmp to the end of the possible binary.
+			setAddress(math.MaxUint64)
+			return
+		}
+		labelKey := target.String()
+		if addr, ok := labelAddress[labelKey]; ok {
+			setAddress(addr)
+		} else {
+			// If this is the forward jump (e.g. to the continuation of if, etc.),
+			// the target is not emitted yet, so resolve the address later.
+			onLabelAddressResolved[labelKey] = append(onLabelAddressResolved[labelKey], setAddress)
+		}
+	}
+	// addBranchTargets appends targets to ret.branchTargets, and returns the index of the first one.
+	// Note that the addresses are set by index as ret.branchTargets might be reallocated before they are resolved.
+	addBranchTargets := func(targets ...*BranchTargetDrop) uint64 {
+		first := len(ret.branchTargets)
+		for i, target := range targets {
+			index := first + i
+			ret.branchTargets = append(ret.branchTargets, branchTarget{
+				fuelCost: ir.LabelFuelCosts[target.Target.String()],
+				toDrop:   target.ToDrop,
+			})
+			resolveLabel(target.Target, func(addr uint64) { ret.branchTargets[index].pc = addr })
+		}
+		return uint64(first)
+	}
+
+	for i := 0; i < len(ir.Operations); i++ {
+		original := ir.Operations[i]
+		op := interpreterOp{kind: original.Kind(), sourceOffset: ir.SourceOffsets[i]}
+		if fused, ok := fuseIROps(original, ir.Operations[i+1:]); ok {
+			// The fused operations never trap, so the source offset of the first one is enough.
+			fused.sourceOffset = op.sourceOffset
+			ret.body = append(ret.body, fused)
+			i++
+			continue
+		}
 		switch o := original.(type) {
 		case *OperationUnreachable:
 		case *OperationLabel:
@@ -162,164 +414,83 @@ func (it *interpreter) lowerIROps(f *wasm.FunctionInstance,
 			// as we translate branch operations to the direct address jmp.
 			continue
 		case *OperationBr:
-			op.us = make([]uint64, 1)
-			if o.Target.IsReturnTarget() {
-				// Jmp to the end of the possible binary.
-				op.us[0] = math.MaxUint64
-			} else {
-				labelKey := o.Target.String()
-				addr, ok := labelAddress[labelKey]
-				if !ok {
-					// If this is the forward jump (e.g. to the continuation of if, etc.),
-					// the target is not emitted yet, so resolve the address later.
-					onLabelAddressResolved[labelKey] = append(onLabelAddressResolved[labelKey],
-						func(addr uint64) {
-							op.us[0] = addr
-						},
-					)
-				} else {
-					op.us[0] = addr
-				}
-			}
+			// The fuel cost of the target follows the address.
+			op.u2 = ir.LabelFuelCosts[o.Target.String()]
+			index := len(ret.body)
+			ret.body = append(ret.body, op)
+			resolveLabel(o.Target, func(addr uint64) { ret.body[index].u1 = addr })
+			continue
 		case *OperationBrIf:
-			op.rs = make([]*InclusiveRange, 2)
-			op.us = make([]uint64, 2)
-			for i, target := range []*BranchTargetDrop{o.Then, o.Else} {
-				op.rs[i] = target.ToDrop
-				if target.Target.IsReturnTarget() {
-					// Jmp to the end of the possible binary.
-					op.us[i] = math.MaxUint64
-				} else {
-					labelKey := target.Target.String()
-					addr, ok := labelAddress[labelKey]
-					if !ok {
-						i := i
-						// If this is the forward jump (e.g. to the continuation of if, etc.),
-						// the target is not emitted yet, so resolve the address later.
-						onLabelAddressResolved[labelKey] = append(onLabelAddressResolved[labelKey],
-							func(addr uint64) {
-								op.us[i] = addr
-							},
-						)
-					} else {
-						op.us[i] = addr
-					}
-				}
-			}
+			op.u1 = addBranchTargets(o.Then, o.Else)
 		case *OperationBrTable:
-			targets := append([]*BranchTargetDrop{o.Default}, o.Targets...)
-			op.rs = make([]*InclusiveRange, len(targets))
-			op.us = make([]uint64, len(targets))
-			for i, target := range targets {
-				op.rs[i] = target.ToDrop
-				if target.Target.IsReturnTarget() {
-					// Jmp to the end of the possible binary.
-					op.us[i] = math.MaxUint64
-				} else {
-					labelKey := target.Target.String()
-					addr, ok := labelAddress[labelKey]
-					if !ok {
-						i := i // pin index for later resolution
-						// If this is the forward jump (e.g. to the continuation of if, etc.),
-						// the target is not emitted yet, so resolve the address later.
-						onLabelAddressResolved[labelKey] = append(onLabelAddressResolved[labelKey],
-							func(addr uint64) {
-								op.us[i] = addr
-							},
-						)
-					} else {
-						op.us[i] = addr
-					}
-				}
-			}
+			op.u1 = addBranchTargets(append([]*BranchTargetDrop{o.Default}, o.Targets...)...)
+			op.u2 = uint64(len(o.Targets) + 1)
 		case *OperationCall:
-			target := f.ModuleInstance.Functions[o.FunctionIndex]
-			compiledTarget, ok := it.functions[target.Address]
-			if !ok {
-				// If the target function instance is not compiled,
-				// we set the callback so we can set the pointer to the target when the compilation done.
-				it.onCompilationDoneCallbacks[target.Address] = append(it.onCompilationDoneCallbacks[target.Address],
-					func(compiled *interpreterFunction) {
-						op.f = compiled
-					})
-			} else {
-				op.f = compiledTarget
-			}
+			// The target is resolved at runtime as the function instances are specific to module instances.
+			op.u1 = uint64(o.FunctionIndex)
 		case *OperationCallIndirect:
-			op.us = make([]uint64, 2)
-			op.us[0] = uint64(o.TableIndex)
-			op.us[1] = uint64(f.ModuleInstance.Types[o.TypeIndex].TypeID)
+			// The type ID is resolved at runtime as it is specific to a store.
+			op.u1 = uint64(o.TableIndex)
+			op.u2 = uint64(o.TypeIndex)
 		case *OperationDrop:
-			op.rs = make([]*InclusiveRange, 1)
-			op.rs[0] = o.Range
+			if o.Range == nil {
+				// Nothing to drop.
+				continue
+			}
+			op.u1 = uint64(o.Range.Start)
+			op.u2 = uint64(o.Range.End)
 		case *OperationSelect:
 		case *OperationPick:
-			op.us = make([]uint64, 1)
-			op.us[0] = uint64(o.Depth)
+			op.u1 = uint64(o.Depth)
 		case *OperationSwap:
-			op.us = make([]uint64, 1)
-			op.us[0] = uint64(o.Depth)
+			op.u1 = uint64(o.Depth)
 		case *OperationGlobalGet:
-			op.us = make([]uint64, 1)
-			op.us[0] = uint64(o.Index)
+			op.u1 = uint64(o.Index)
 		case *OperationGlobalSet:
-			op.us = make([]uint64, 1)
-			op.us[0] = uint64(o.Index)
+			op.u1 = uint64(o.Index)
 		case *OperationLoad:
 			op.b1 = byte(o.Type)
-			op.us = make([]uint64, 2)
-			op.us[0] = uint64(o.Arg.Alignment)
-			op.us[1] = uint64(o.Arg.Offest)
+			op.u1 = uint64(o.Arg.Alignment)
+			op.u2 = uint64(o.Arg.Offest)
 		case *OperationLoad8:
 			op.b1 = byte(o.Type)
-			op.us = make([]uint64, 2)
-			op.us[0] = uint64(o.Arg.Alignment)
-			op.us[1] = uint64(o.Arg.Offest)
+			op.u1 = uint64(o.Arg.Alignment)
+			op.u2 = uint64(o.Arg.Offest)
 		case *OperationLoad16:
 			op.b1 = byte(o.Type)
-			op.us = make([]uint64, 2)
-			op.us[0] = uint64(o.Arg.Alignment)
-			op.us[1] = uint64(o.Arg.Offest)
+			op.u1 = uint64(o.Arg.Alignment)
+			op.u2 = uint64(o.Arg.Offest)
 		case *OperationLoad32:
 			if o.Signed {
 				op.b1 = 1
 			}
-			op.us = make([]uint64, 2)
-			op.us[0] = uint64(o.Arg.Alignment)
-			op.us[1] = uint64(o.Arg.Offest)
+			op.u1 = uint64(o.Arg.Alignment)
+			op.u2 = uint64(o.Arg.Offest)
 		case *OperationStore:
 			op.b1 = byte(o.Type)
-			op.us = make([]uint64, 2)
-			op.us[0] = uint64(o.Arg.Alignment)
-			op.us[1] = uint64(o.Arg.Offest)
+			op.u1 = uint64(o.Arg.Alignment)
+			op.u2 = uint64(o.Arg.Offest)
 		case *OperationStore8:
 			op.b1 = byte(o.Type)
-			op.us = make([]uint64, 2)
-			op.us[0] = uint64(o.Arg.Alignment)
-			op.us[1] = uint64(o.Arg.Offest)
+			op.u1 = uint64(o.Arg.Alignment)
+			op.u2 = uint64(o.Arg.Offest)
 		case *OperationStore16:
 			op.b1 = byte(o.Type)
-			op.us = make([]uint64, 2)
-			op.us[0] = uint64(o.Arg.Alignment)
-			op.us[1] = uint64(o.Arg.Offest)
+			op.u1 = uint64(o.Arg.Alignment)
+			op.u2 = uint64(o.Arg.Offest)
 		case *OperationStore32:
-			op.us = make([]uint64, 2)
-			op.us[0] = uint64(o.Arg.Alignment)
-			op.us[1] = uint64(o.Arg.Offest)
+			op.u1 = uint64(o.Arg.Alignment)
+			op.u2 = uint64(o.Arg.Offest)
 		case *OperationMemorySize:
 		case *OperationMemoryGrow:
 		case *OperationConstI32:
-			op.us = make([]uint64, 1)
-			op.us[0] = uint64(o.Value)
+			op.u1 = uint64(o.Value)
 		case *OperationConstI64:
-			op.us = make([]uint64, 1)
-			op.us[0] = o.Value
+			op.u1 = o.Value
 		case *OperationConstF32:
-			op.us = make([]uint64, 1)
-			op.us[0] = uint64(math.Float32bits(o.Value))
+			op.u1 = uint64(math.Float32bits(o.Value))
 		case *OperationConstF64:
-			op.us = make([]uint64, 1)
-			op.us[0] = math.Float64bits(o.Value)
+			op.u1 = math.Float64bits(o.Value)
 		case *OperationEq:
 			op.b1 = byte(o.Type)
 		case *OperationNe:
@@ -422,68 +593,323 @@ func (it *interpreter) lowerIROps(f *wasm.FunctionInstance,
 	return ret, nil
 }
 
+// fuseIROps returns the superinstruction fused from op and the first of the following operations if possible.
+// Note that labels are operations, so the fusion never crosses branch targets.
+func fuseIROps(op Operation, following []Operation) (fused interpreterOp, ok bool) {
+	if len(following) == 0 {
+		return
+	}
+	switch o := op.(type) {
+	case *OperationSwap:
+		if d, isDrop := following[0].(*OperationDrop); isDrop && d.Range != nil && d.Range.Start == 0 && d.Range.End == 0 {
+			return interpreterOp{kind: interpreterOpKindSet, u1: uint64(o.Depth)}, true
+		}
+	case *OperationConstI32:
+		return fuseConstArithmetic(UnsignedTypeI32, uint64(o.Value), following[0])
+	case *OperationConstI64:
+		return fuseConstArithmetic(UnsignedTypeI64, o.Value, following[0])
+	}
+	return
+}
+
+// fuseConstArithmetic returns the superinstruction of the constant value v of type t followed by next if possible.
+func fuseConstArithmetic(t UnsignedType, v uint64, next Operation) (fused interpreterOp, ok bool) {
+	switch o := next.(type) {
+	case *OperationAdd:
+		if o.Type == t {
+			return interpreterOp{kind: interpreterOpKindAddConst, b1: byte(t), u1: v}, true
+		}
+	case *OperationSub:
+		if o.Type == t {
+			return interpreterOp{kind: interpreterOpKindSubConst, b1: byte(t), u1: v}, true
+		}
+	}
+	return
+}
+
 // Call implements an interpreted wasm.Engine.
-func (it *interpreter) Call(f *wasm.FunctionInstance, params ...uint64) (results []uint64, err error) {
-	prevFrameLen := len(it.frames)
-	defer func() {
-		if v := recover(); v != nil {
-			if buildoptions.IsDebugMode {
-				debug.PrintStack()
-			}
-			traceNum := len(it.frames) - prevFrameLen
-			traces := make([]string, 0, traceNum)
-			for i := 0; i < traceNum; i++ {
-				frame := it.popFrame()
-				name := frame.f.funcInstance.Name
-				// TODO: include the original instruction which corresponds
-				// to frame.f.body[frame.pc].
-				traces = append(traces, fmt.Sprintf("\t%d: %s", i, name))
-			}
+//
+// Each call is made with its own callEngine, so calls can be made concurrently from multiple goroutines.
+// The callEngines are pooled, so that the calls don't allocate their stacks.
+func (it *interpreter) Call(ctx context.Context, f *wasm.FunctionInstance, params ...uint64) (results []uint64, err error) {
+	g, ok := it.getFunction(f)
+	if !ok {
+		err = fmt.Errorf("function not compiled")
+		return
+	}
+	results = make([]uint64, len(f.FunctionType.Type.Results))
+	ce := it.getCallEngine()
+	err = ce.call(ctx, g, results, params)
+	it.putCallEngine(ce)
+	if err != nil {
+		results = nil
+	}
+	return
+}
 
-			it.frames = it.frames[:prevFrameLen]
-			err2, ok := v.(error)
-			if ok {
-				if err2.Error() == "runtime error: integer divide by zero" {
-					err2 = wasm.ErrRuntimeIntegerDivideByZero
-				}
-				err = fmt.Errorf("wasm runtime error: %w", err2)
-			} else {
-				err = fmt.Errorf("wasm runtime error: %v", v)
-			}
+// CallWithResults implements wasm.ResultsCaller.
+func (it *interpreter) CallWithResults(ctx context.Context, f *wasm.FunctionInstance, results []uint64, params ...uint64) error {
+	if len(results) != len(f.FunctionType.Type.Results) {
+		return fmt.Errorf("invalid number of results: expected %d but got %d", len(f.FunctionType.Type.Results), len(results))
+	}
+	g, ok := it.getFunction(f)
+	if !ok {
+		return fmt.Errorf("function not compiled")
+	}
+	ce := it.getCallEngine()
+	err := ce.call(ctx, g, results, params)
+	it.putCallEngine(ce)
+	return err
+}
 
-			if len(traces) > 0 {
-				err = fmt.Errorf("%w\nwasm backtrace:\n%s", err, strings.Join(traces, "\n"))
-			}
+// CallWithState implements wasm.StateCaller.
+func (it *interpreter) CallWithState(ctx context.Context, state *wasm.CallState, f *wasm.FunctionInstance, results []uint64, params ...uint64) error {
+	if len(results) != len(f.FunctionType.Type.Results) {
+		return fmt.Errorf("invalid number of results: expected %d but got %d", len(f.FunctionType.Type.Results), len(results))
+	}
+	g, ok := it.getFunction(f)
+	if !ok {
+		return fmt.Errorf("function not compiled")
+	}
+	ce := it.getCallEngine()
+	err := ce.callWithState(ctx, state, g, results, params)
+	it.putCallEngine(ce)
+	return err
+}
+
+func (it *interpreter) getFunction(fi *wasm.FunctionInstance) (f *interpreterFunction, ok bool) {
+	it.mux.RLock()
+	defer it.mux.RUnlock()
+	f, ok = it.functions[fi]
+	return
+}
+
+// call calls g with params, and writes the results to results.
+func (ce *callEngine) call(ctx context.Context, g *interpreterFunction, results, params []uint64) error {
+	state := wasm.CallState{Fuel: math.MaxUint64}
+	if fuel := wasm.FuelFromContext(ctx); fuel != nil {
+		state.Fuel = fuel.Remaining
+		defer func() { fuel.Remaining = state.Fuel }()
+	}
+	return ce.callWithState(ctx, &state, g, results, params)
+}
+
+// callWithState is the same as call except that the call starts with state, which is updated with the remaining fuel
+// when this returns. See wasm.StateCaller.
+func (ce *callEngine) callWithState(ctx context.Context, state *wasm.CallState, g *interpreterFunction, results, params []uint64) (err error) {
+	if ctx.Err() != nil {
+		err = &wasm.RuntimeError{Cause: callCanceledError(ctx)}
+		return
+	}
+	ce.ctx, ce.fuel = ctx, state.Fuel
+	defer func() { state.Fuel = ce.fuel }()
+
+	ce.baseCallStackDepth = ce.maxCallStackDepth
+	if state.CallStackDepth < uint64(ce.maxCallStackDepth) {
+		ce.baseCallStackDepth = int(state.CallStackDepth)
+	}
+
+	defer func() {
+		if v := recover(); v != nil {
+			err = ce.runtimeError(v)
+			ce.frames = ce.frames[:0]
 		}
 	}()
 
-	g, ok := it.functions[f.Address]
+	ce.ensureStack(len(params))
+	for _, param := range params {
+		ce.push(param)
+	}
+	ce.callFunction(g)
+	for i := range results {
+		results[len(results)-1-i] = ce.pop()
+	}
+	return
+}
+
+// CallNested implements wasm.NestedCaller by calling f on top of the frames of the host function being executed.
+func (ce *callEngine) CallNested(f *wasm.FunctionInstance, params []uint64) (results []uint64, err error) {
+	g, ok := ce.interpreter.getFunction(f)
 	if !ok {
 		err = fmt.Errorf("function not compiled")
 		return
 	}
 
-	if g.hostFn != nil {
-		it.callHostFunc(g, params...)
-	} else {
-		for _, param := range params {
-			it.push(param)
+	// On a trap, the frames and the stack are restored so that the host function can continue.
+	frameLen, sp, hostCallContext := len(ce.frames), ce.sp, ce.hostCallContext
+	defer func() {
+		if v := recover(); v != nil {
+			err = &nestedCallError{ce: ce, err: ce.runtimeError(v)}
+			ce.frames, ce.sp, ce.hostCallContext = ce.frames[:frameLen], sp, hostCallContext
 		}
-		it.callNativeFunc(g)
+	}()
+
+	ce.ensureStack(len(params))
+	for _, param := range params {
+		ce.push(param)
 	}
+	ce.callFunction(g)
 	results = make([]uint64, len(f.FunctionType.Type.Results))
 	for i := range results {
-		results[len(results)-1-i] = it.pop()
+		results[len(results)-1-i] = ce.pop()
 	}
 	return
 }
 
-func (it *interpreter) callHostFunc(f *interpreterFunction, _ ...uint64) {
+// CallForeign implements wasm.ForeignCaller.
+func (ce *callEngine) CallForeign(engine wasm.StateCaller, f *wasm.FunctionInstance, results, params []uint64) error {
+	// The top frame is the one of the host function calling f, which is replaced with the frame of f in engine.
+	state := wasm.CallState{Fuel: ce.fuel, CallStackDepth: uint64(ce.baseCallStackDepth + len(ce.frames) - 1)}
+	err := engine.CallWithState(ce.ctx, &state, f, results, params...)
+	ce.fuel = state.Fuel
+	return err
+}
+
+// nestedCallError is the error of a trap in CallNested. This includes the backtrace of all the frames of the call engine,
+// so the outer calls propagate this as is when the host function traps with this error.
+type nestedCallError struct {
+	ce  *callEngine
+	err error
+}
+
+func (e *nestedCallError) Error() string {
+	return e.err.Error()
+}
+
+func (e *nestedCallError) Unwrap() error {
+	return e.err
+}
+
+// runtimeError returns the *wasm.RuntimeError of the trap v with the backtrace of the current frames.
+func (ce *callEngine) runtimeError(v interface{}) error {
+	if buildoptions.IsDebugMode || ce.interpreter.config.Debug {
+		debug.PrintStack()
+	}
+
+	cause, ok := v.(error)
+	if ok {
+		var nested *nestedCallError
+		if errors.As(cause, &nested) && nested.ce == ce {
+			// The error already includes the backtrace from the frame of the trap.
+			return cause
+		}
+		if cause.Error() == "runtime error: integer divide by zero" {
+			cause = wasm.ErrRuntimeIntegerDivideByZero
+		}
+	} else {
+		cause = fmt.Errorf("%v", v)
+	}
+
+	frames := make([]wasm.Frame, 0, len(ce.frames))
+	for i := len(ce.frames) - 1; i >= 0; i-- {
+		frame := &ce.frames[i]
+		var offset uint64
+		// frame.pc points to the trapping operation or the call for the callers.
+		if frame.pc < uint64(len(frame.f.body)) {
+			offset = frame.f.body[frame.pc].sourceOffset
+		}
+		frames = append(frames, wasm.NewFrame(frame.f.funcInstance, offset))
+	}
+	return &wasm.RuntimeError{Cause: cause, Frames: frames}
+}
+
+func callCanceledError(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("%w: %v", wasm.ErrRuntimeCallCanceled, err)
+	}
+	return wasm.ErrRuntimeCallCanceled
+}
+
+// callCanceledCheckInterval is the number of function entries and loop iterations
+// between checks of whether the context.Context given to Call is done.
+const callCanceledCheckInterval = 1 << 16
+
+// checkCallCanceled panics with wasm.ErrRuntimeCallCanceled if the context of the current call is done.
+// The check is actually made once per callCanceledCheckInterval invocations.
+func (ce *callEngine) checkCallCanceled() {
+	if ce.callCanceledCheckCountdown > 0 {
+		ce.callCanceledCheckCountdown--
+		return
+	}
+	ce.callCanceledCheckCountdown = callCanceledCheckInterval
+	if ce.ctx != nil && ce.ctx.Err() != nil {
+		panic(callCanceledError(ce.ctx))
+	}
+}
+
+// consumeFuel panics with wasm.ErrRuntimeOutOfFuel if the remaining fuel is less than cost,
+// otherwise subtracts cost from it.
+func (ce *callEngine) consumeFuel(cost uint64) {
+	if ce.fuel < cost {
+		ce.fuel = 0
+		panic(wasm.ErrRuntimeOutOfFuel)
+	}
+	ce.fuel -= cost
+}
+
+// callFunction calls f with the parameters on the top of the stack.
+func (ce *callEngine) callFunction(f *interpreterFunction) {
+	if f.lazy != nil {
+		f = ce.interpreter.compileLazily(f)
+	}
+	ce.ensureStack(f.stackGrowth)
+	if f.rawHostFn != nil {
+		ce.callRawHostFunc(f)
+	} else if f.hostFn != nil {
+		ce.callHostFunc(f)
+	} else {
+		ce.callNativeFunc(f)
+	}
+}
+
+// callRawHostFunc calls the raw host function f directly on the stack where the parameters are
+// replaced with the results.
+func (ce *callEngine) callRawHostFunc(f *interpreterFunction) {
+	tp := f.funcInstance.FunctionType.Type
+	paramLen, resultLen := len(tp.Params), len(tp.Results)
+	base := ce.sp - paramLen
+	for i := paramLen; i < resultLen; i++ {
+		ce.push(0)
+	}
+
+	// The context is restored after the call in case that this is a nested host function call.
+	saved := ce.hostCallContext
+	ce.hostCallContext = ce.newHostCallContext(f)
+
+	ce.pushFrame(f)
+	stack := ce.stack[base:ce.sp]
+	f.rawHostFn(&ce.hostCallContext, stack)
+	// The calls made by the host function via HostFunctionCallContext.Call might have grown the stack,
+	// so the values are copied back in case stack is the old one.
+	copy(ce.stack[base:], stack)
+	ce.popFrame()
+
+	ce.hostCallContext = saved
+	ce.sp = base + resultLen
+}
+
+// newHostCallContext returns the wasm.HostFunctionCallContext for the call to the host function f
+// where the caller is the function of the top frame, or f itself if there's no frame.
+func (ce *callEngine) newHostCallContext(f *interpreterFunction) wasm.HostFunctionCallContext {
+	caller := f.funcInstance.ModuleInstance
+	if len(ce.frames) > 0 {
+		caller = ce.frames[len(ce.frames)-1].f.funcInstance.ModuleInstance
+	}
+	return wasm.HostFunctionCallContext{
+		Memory:       caller.Memory,
+		Module:       caller,
+		Context:      ce.ctx,
+		UserValue:    f.funcInstance.ModuleInstance.UserValue,
+		NestedCaller: ce,
+	}
+}
+
+func (ce *callEngine) callHostFunc(f *interpreterFunction) {
 	tp := f.hostFn.Type()
 	in := make([]reflect.Value, tp.NumIn())
 	for i := len(in) - 1; i >= 1; i-- {
 		val := reflect.New(tp.In(i)).Elem()
-		raw := it.pop()
+		raw := ce.pop()
 		kind := tp.In(i).Kind()
 		switch kind {
 		case reflect.Float64, reflect.Float32:
@@ -497,32 +923,32 @@ func (it *interpreter) callHostFunc(f *interpreterFunction, _ ...uint64) {
 	}
 
 	val := reflect.New(tp.In(0)).Elem()
-	var memory *wasm.MemoryInstance
-	if len(it.frames) > 0 {
-		memory = it.frames[len(it.frames)-1].f.funcInstance.ModuleInstance.Memory
-	}
-	val.Set(reflect.ValueOf(&wasm.HostFunctionCallContext{Memory: memory}))
+	hostCallContext := ce.newHostCallContext(f)
+	val.Set(reflect.ValueOf(&hostCallContext))
 	in[0] = val
 
-	frame := &interpreterFrame{f: f}
-	it.pushFrame(frame)
+	ce.pushFrame(f)
 	for _, ret := range f.hostFn.Call(in) {
 		switch ret.Kind() {
 		case reflect.Float64, reflect.Float32:
-			it.push(math.Float64bits(ret.Float()))
+			ce.push(math.Float64bits(ret.Float()))
 		case reflect.Uint32, reflect.Uint64:
-			it.push(ret.Uint())
+			ce.push(ret.Uint())
 		case reflect.Int32, reflect.Int64:
-			it.push(uint64(ret.Int()))
+			ce.push(uint64(ret.Int()))
+		case reflect.Interface:
+			// This is the trailing error result, and a non-nil error traps.
+			if !ret.IsNil() {
+				panic(ret.Interface().(error))
+			}
 		default:
 			panic("invalid return type")
 		}
 	}
-	it.popFrame()
+	ce.popFrame()
 }
 
-func (it *interpreter) callNativeFunc(f *interpreterFunction) {
-	frame := &interpreterFrame{f: f}
+func (ce *callEngine) callNativeFunc(f *interpreterFunction) {
 	moduleInst := f.funcInstance.ModuleInstance
 	memoryInst := moduleInst.Memory
 	globals := moduleInst.Globals
@@ -530,10 +956,14 @@ func (it *interpreter) callNativeFunc(f *interpreterFunction) {
 	if len(moduleInst.Tables) > 0 {
 		table = moduleInst.Tables[0] // WebAssembly 1.0 (MVP) defines at most one table
 	}
-	it.pushFrame(frame)
-	bodyLen := uint64(len(frame.f.body))
+	frame := ce.pushFrame(f)
+	frameIndex := len(ce.frames) - 1
+	ce.checkCallCanceled()
+	ce.consumeFuel(f.entryFuelCost)
+	body, branchTargets := f.body, f.branchTargets
+	bodyLen := uint64(len(body))
 	for frame.pc < bodyLen {
-		op := frame.f.body[frame.pc]
+		op := &body[frame.pc]
 		// TODO: add description of each operation/case
 		// on, for example, how many args are used,
 		// how the stack is modified, etc.
@@ -542,161 +972,206 @@ func (it *interpreter) callNativeFunc(f *interpreterFunction) {
 			panic(wasm.ErrRuntimeUnreachable)
 		case OperationKindBr:
 			{
-				frame.pc = op.us[0]
+				pc := frame.pc
+				frame.pc = op.u1
+				ce.consumeFuel(op.u2)
+				if frame.pc <= pc {
+					// Backward branch, meaning a loop iteration.
+					ce.checkCallCanceled()
+				}
 			}
 		case OperationKindBrIf:
 			{
-				if it.pop() > 0 {
-					it.drop(op.rs[0])
-					frame.pc = op.us[0]
-				} else {
-					it.drop(op.rs[1])
-					frame.pc = op.us[1]
+				pc := frame.pc
+				target := &branchTargets[op.u1]
+				if ce.pop() == 0 {
+					// Else target follows the then target.
+					target = &branchTargets[op.u1+1]
+				}
+				if r := target.toDrop; r != nil {
+					ce.drop(r.Start, r.End)
+				}
+				frame.pc = target.pc
+				ce.consumeFuel(target.fuelCost)
+				if frame.pc <= pc {
+					ce.checkCallCanceled()
 				}
 			}
 		case OperationKindBrTable:
 			{
-				if v := int(it.pop()); v < len(op.us)-1 {
-					it.drop(op.rs[v+1])
-					frame.pc = op.us[v+1]
-				} else {
-					// Default branch.
-					it.drop(op.rs[0])
-					frame.pc = op.us[0]
+				pc := frame.pc
+				// Default branch comes first.
+				index := op.u1
+				if v := ce.pop(); v < op.u2-1 {
+					index += v + 1
+				}
+				target := &branchTargets[index]
+				if r := target.toDrop; r != nil {
+					ce.drop(r.Start, r.End)
+				}
+				frame.pc = target.pc
+				ce.consumeFuel(target.fuelCost)
+				if frame.pc <= pc {
+					ce.checkCallCanceled()
 				}
 			}
 		case OperationKindCall:
 			{
-				if op.f.hostFn != nil {
-					it.callHostFunc(op.f, it.stack[len(it.stack)-len(op.f.funcInstance.FunctionType.Type.Params):]...)
-				} else {
-					it.callNativeFunc(op.f)
-				}
+				target, _ := ce.interpreter.getFunction(moduleInst.Functions[op.u1])
+				ce.callFunction(target)
+				// The frames might have been reallocated by the callee.
+				frame = &ce.frames[frameIndex]
 				frame.pc++
 			}
 		case OperationKindCallIndirect:
 			{
-				offset := it.pop()
+				offset := ce.pop()
 				if offset >= uint64(len(table.Table)) {
 					panic(wasm.ErrRuntimeInvalidTableAcces)
 				}
 				tableElement := table.Table[offset]
 				// Type check.
-				if uint64(tableElement.FunctionTypeID) != op.us[1] {
+				if tableElement.FunctionTypeID != moduleInst.Types[op.u2].TypeID {
 					if tableElement.FunctionTypeID == wasm.UninitializedTableElelemtTypeID {
 						panic(wasm.ErrRuntimeInvalidTableAcces)
 					}
 					panic(wasm.ErrRuntimeIndirectCallTypeMismatch)
 				}
-				target := it.functions[table.Table[offset].FunctionAddress]
+				// The address is resolved in the store of the caller, since the engine might be shared by stores.
+				target, _ := ce.interpreter.getFunction(moduleInst.FunctionByAddress(table.Table[offset].FunctionAddress))
 				// Call in.
-				if target.hostFn != nil {
-					it.callHostFunc(target, it.stack[len(it.stack)-len(target.funcInstance.FunctionType.Type.Params):]...)
-				} else {
-					it.callNativeFunc(target)
-				}
+				ce.callFunction(target)
+				// The frames might have been reallocated by the callee.
+				frame = &ce.frames[frameIndex]
 				frame.pc++
 			}
 		case OperationKindDrop:
 			{
-				it.drop(op.rs[0])
+				ce.drop(int(op.u1), int(op.u2))
 				frame.pc++
 			}
 		case OperationKindSelect:
 			{
-				c := it.pop()
-				v2 := it.pop()
+				c := ce.pop()
+				v2 := ce.pop()
 				if c == 0 {
-					_ = it.pop()
-					it.push(v2)
+					_ = ce.pop()
+					ce.push(v2)
 				}
 				frame.pc++
 			}
 		case OperationKindPick:
 			{
-				it.push(it.stack[len(it.stack)-1-int(op.us[0])])
+				ce.push(ce.stack[ce.sp-1-int(op.u1)])
 				frame.pc++
 			}
 		case OperationKindSwap:
 			{
-				index := len(it.stack) - 1 - int(op.us[0])
-				it.stack[len(it.stack)-1], it.stack[index] = it.stack[index], it.stack[len(it.stack)-1]
+				top := ce.sp - 1
+				index := top - int(op.u1)
+				ce.stack[top], ce.stack[index] = ce.stack[index], ce.stack[top]
+				frame.pc++
+			}
+		case interpreterOpKindSet:
+			{
+				v := ce.pop()
+				ce.stack[ce.sp-int(op.u1)] = v
+				frame.pc++
+			}
+		case interpreterOpKindAddConst:
+			{
+				top := &ce.stack[ce.sp-1]
+				if UnsignedType(op.b1) == UnsignedTypeI32 {
+					*top = uint64(uint32(*top) + uint32(op.u1))
+				} else {
+					*top += op.u1
+				}
+				frame.pc++
+			}
+		case interpreterOpKindSubConst:
+			{
+				top := &ce.stack[ce.sp-1]
+				if UnsignedType(op.b1) == UnsignedTypeI32 {
+					*top = uint64(uint32(*top) - uint32(op.u1))
+				} else {
+					*top -= op.u1
+				}
 				frame.pc++
 			}
 		case OperationKindGlobalGet:
 			{
-				g := globals[op.us[0]]
-				it.push(g.Val)
+				g := globals[op.u1]
+				ce.push(g.Val)
 				frame.pc++
 			}
 		case OperationKindGlobalSet:
 			{
-				g := globals[op.us[0]]
-				g.Val = it.pop()
+				g := globals[op.u1]
+				g.Val = ce.pop()
 				frame.pc++
 			}
 		case OperationKindLoad:
 			{
-				base := op.us[1] + it.pop()
+				base := op.u2 + ce.pop()
 				switch UnsignedType(op.b1) {
 				case UnsignedTypeI32, UnsignedTypeF32:
 					if uint64(len(memoryInst.Buffer)) < base+4 {
 						panic(wasm.ErrRuntimeOutOfBoundsMemoryAccess)
 					}
-					it.push(uint64(binary.LittleEndian.Uint32(memoryInst.Buffer[base:])))
+					ce.push(uint64(binary.LittleEndian.Uint32(memoryInst.Buffer[base:])))
 				case UnsignedTypeI64, UnsignedTypeF64:
 					if uint64(len(memoryInst.Buffer)) < base+8 {
 						panic(wasm.ErrRuntimeOutOfBoundsMemoryAccess)
 					}
-					it.push(binary.LittleEndian.Uint64(memoryInst.Buffer[base:]))
+					ce.push(binary.LittleEndian.Uint64(memoryInst.Buffer[base:]))
 				}
 				frame.pc++
 			}
 		case OperationKindLoad8:
 			{
-				base := op.us[1] + it.pop()
+				base := op.u2 + ce.pop()
 				if uint64(len(memoryInst.Buffer)) < base+1 {
 					panic(wasm.ErrRuntimeOutOfBoundsMemoryAccess)
 				}
 				switch SignedInt(op.b1) {
 				case SignedInt32, SignedInt64:
-					it.push(uint64(int8(memoryInst.Buffer[base])))
+					ce.push(uint64(int8(memoryInst.Buffer[base])))
 				case SignedUint32, SignedUint64:
-					it.push(uint64(uint8(memoryInst.Buffer[base])))
+					ce.push(uint64(uint8(memoryInst.Buffer[base])))
 				}
 				frame.pc++
 			}
 		case OperationKindLoad16:
 			{
-				base := op.us[1] + it.pop()
+				base := op.u2 + ce.pop()
 				if uint64(len(memoryInst.Buffer)) < base+2 {
 					panic(wasm.ErrRuntimeOutOfBoundsMemoryAccess)
 				}
 				switch SignedInt(op.b1) {
 				case SignedInt32, SignedInt64:
-					it.push(uint64(int16(binary.LittleEndian.Uint16(memoryInst.Buffer[base:]))))
+					ce.push(uint64(int16(binary.LittleEndian.Uint16(memoryInst.Buffer[base:]))))
 				case SignedUint32, SignedUint64:
-					it.push(uint64(binary.LittleEndian.Uint16(memoryInst.Buffer[base:])))
+					ce.push(uint64(binary.LittleEndian.Uint16(memoryInst.Buffer[base:])))
 				}
 				frame.pc++
 			}
 		case OperationKindLoad32:
 			{
-				base := op.us[1] + it.pop()
+				base := op.u2 + ce.pop()
 				if uint64(len(memoryInst.Buffer)) < base+4 {
 					panic(wasm.ErrRuntimeOutOfBoundsMemoryAccess)
 				}
 				if op.b1 == 1 {
-					it.push(uint64(int32(binary.LittleEndian.Uint32(memoryInst.Buffer[base:]))))
+					ce.push(uint64(int32(binary.LittleEndian.Uint32(memoryInst.Buffer[base:]))))
 				} else {
-					it.push(uint64(binary.LittleEndian.Uint32(memoryInst.Buffer[base:])))
+					ce.push(uint64(binary.LittleEndian.Uint32(memoryInst.Buffer[base:])))
 				}
 				frame.pc++
 			}
 		case OperationKindStore:
 			{
-				val := it.pop()
-				base := op.us[1] + it.pop()
+				val := ce.pop()
+				base := op.u2 + ce.pop()
 				switch UnsignedType(op.b1) {
 				case UnsignedTypeI32, UnsignedTypeF32:
 					if uint64(len(memoryInst.Buffer)) < base+4 {
@@ -713,8 +1188,8 @@ func (it *interpreter) callNativeFunc(f *interpreterFunction) {
 			}
 		case OperationKindStore8:
 			{
-				val := byte(it.pop())
-				base := op.us[1] + it.pop()
+				val := byte(ce.pop())
+				base := op.u2 + ce.pop()
 				if uint64(len(memoryInst.Buffer)) < base+1 {
 					panic(wasm.ErrRuntimeOutOfBoundsMemoryAccess)
 				}
@@ -723,8 +1198,8 @@ func (it *interpreter) callNativeFunc(f *interpreterFunction) {
 			}
 		case OperationKindStore16:
 			{
-				val := uint16(it.pop())
-				base := op.us[1] + it.pop()
+				val := uint16(ce.pop())
+				base := op.u2 + ce.pop()
 				if uint64(len(memoryInst.Buffer)) < base+2 {
 					panic(wasm.ErrRuntimeOutOfBoundsMemoryAccess)
 				}
@@ -733,8 +1208,8 @@ func (it *interpreter) callNativeFunc(f *interpreterFunction) {
 			}
 		case OperationKindStore32:
 			{
-				val := uint32(it.pop())
-				base := op.us[1] + it.pop()
+				val := uint32(ce.pop())
+				base := op.u2 + ce.pop()
 				if uint64(len(memoryInst.Buffer)) < base+4 {
 					panic(wasm.ErrRuntimeOutOfBoundsMemoryAccess)
 				}
@@ -744,29 +1219,24 @@ func (it *interpreter) callNativeFunc(f *interpreterFunction) {
 		case OperationKindMemorySize:
 			{
 				v := uint64(len(memoryInst.Buffer)) / wasm.PageSize
-				it.push(v)
+				ce.push(v)
 				frame.pc++
 			}
 		case OperationKindMemoryGrow:
 			{
-				n := it.pop()
-				max := uint64(math.MaxUint32)
-				if memoryInst.Max != nil {
-					max = uint64(*memoryInst.Max) * wasm.PageSize
-				}
-				if uint64(n*wasm.PageSize+uint64(len(memoryInst.Buffer))) > max {
+				n := ce.pop()
+				if previousPages, ok := memoryInst.Grow(uint32(n)); !ok {
 					v := int32(-1)
-					it.push(uint64(v))
+					ce.push(uint64(v))
 				} else {
-					it.push(uint64(len(memoryInst.Buffer)) / wasm.PageSize)
-					memoryInst.Buffer = append(memoryInst.Buffer, make([]byte, n*wasm.PageSize)...)
+					ce.push(uint64(previousPages))
 				}
 				frame.pc++
 			}
 		case OperationKindConstI32, OperationKindConstI64,
 			OperationKindConstF32, OperationKindConstF64:
 			{
-				it.push(op.us[0])
+				ce.push(op.u1)
 				frame.pc++
 			}
 		case OperationKindEq:
@@ -774,19 +1244,19 @@ func (it *interpreter) callNativeFunc(f *interpreterFunction) {
 				var b bool
 				switch UnsignedType(op.b1) {
 				case UnsignedTypeI32, UnsignedTypeI64:
-					v2, v1 := it.pop(), it.pop()
+					v2, v1 := ce.pop(), ce.pop()
 					b = v1 == v2
 				case UnsignedTypeF32:
-					v2, v1 := it.pop(), it.pop()
+					v2, v1 := ce.pop(), ce.pop()
 					b = math.Float32frombits(uint32(v2)) == math.Float32frombits(uint32(v1))
 				case UnsignedTypeF64:
-					v2, v1 := it.pop(), it.pop()
+					v2, v1 := ce.pop(), ce.pop()
 					b = math.Float64frombits(v2) == math.Float64frombits(v1)
 				}
 				if b {
-					it.push(1)
+					ce.push(1)
 				} else {
-					it.push(0)
+					ce.push(0)
 				}
 				frame.pc++
 			}
@@ -795,35 +1265,35 @@ func (it *interpreter) callNativeFunc(f *interpreterFunction) {
 				var b bool
 				switch UnsignedType(op.b1) {
 				case UnsignedTypeI32, UnsignedTypeI64:
-					v2, v1 := it.pop(), it.pop()
+					v2, v1 := ce.pop(), ce.pop()
 					b = v1 != v2
 				case UnsignedTypeF32:
-					v2, v1 := it.pop(), it.pop()
+					v2, v1 := ce.pop(), ce.pop()
 					b = math.Float32frombits(uint32(v2)) != math.Float32frombits(uint32(v1))
 				case UnsignedTypeF64:
-					v2, v1 := it.pop(), it.pop()
+					v2, v1 := ce.pop(), ce.pop()
 					b = math.Float64frombits(v2) != math.Float64frombits(v1)
 				}
 				if b {
-					it.push(1)
+					ce.push(1)
 				} else {
-					it.push(0)
+					ce.push(0)
 				}
 				frame.pc++
 			}
 		case OperationKindEqz:
 			{
-				if it.pop() == 0 {
-					it.push(1)
+				if ce.pop() == 0 {
+					ce.push(1)
 				} else {
-					it.push(0)
+					ce.push(0)
 				}
 				frame.pc++
 			}
 		case OperationKindLt:
 			{
-				v2 := it.pop()
-				v1 := it.pop()
+				v2 := ce.pop()
+				v1 := ce.pop()
 				var b bool
 				switch SignedType(op.b1) {
 				case SignedTypeInt32:
@@ -838,16 +1308,16 @@ func (it *interpreter) callNativeFunc(f *interpreterFunction) {
 					b = math.Float64frombits(v1) < math.Float64frombits(v2)
 				}
 				if b {
-					it.push(1)
+					ce.push(1)
 				} else {
-					it.push(0)
+					ce.push(0)
 				}
 				frame.pc++
 			}
 		case OperationKindGt:
 			{
-				v2 := it.pop()
-				v1 := it.pop()
+				v2 := ce.pop()
+				v1 := ce.pop()
 				var b bool
 				switch SignedType(op.b1) {
 				case SignedTypeInt32:
@@ -862,16 +1332,16 @@ func (it *interpreter) callNativeFunc(f *interpreterFunction) {
 					b = math.Float64frombits(v1) > math.Float64frombits(v2)
 				}
 				if b {
-					it.push(1)
+					ce.push(1)
 				} else {
-					it.push(0)
+					ce.push(0)
 				}
 				frame.pc++
 			}
 		case OperationKindLe:
 			{
-				v2 := it.pop()
-				v1 := it.pop()
+				v2 := ce.pop()
+				v1 := ce.pop()
 				var b bool
 				switch SignedType(op.b1) {
 				case SignedTypeInt32:
@@ -886,16 +1356,16 @@ func (it *interpreter) callNativeFunc(f *interpreterFunction) {
 					b = math.Float64frombits(v1) <= math.Float64frombits(v2)
 				}
 				if b {
-					it.push(1)
+					ce.push(1)
 				} else {
-					it.push(0)
+					ce.push(0)
 				}
 				frame.pc++
 			}
 		case OperationKindGe:
 			{
-				v2 := it.pop()
-				v1 := it.pop()
+				v2 := ce.pop()
+				v1 := ce.pop()
 				var b bool
 				switch SignedType(op.b1) {
 				case SignedTypeInt32:
@@ -910,100 +1380,100 @@ func (it *interpreter) callNativeFunc(f *interpreterFunction) {
 					b = math.Float64frombits(v1) >= math.Float64frombits(v2)
 				}
 				if b {
-					it.push(1)
+					ce.push(1)
 				} else {
-					it.push(0)
+					ce.push(0)
 				}
 				frame.pc++
 			}
 		case OperationKindAdd:
 			{
-				v2 := it.pop()
-				v1 := it.pop()
+				v2 := ce.pop()
+				v1 := ce.pop()
 				switch UnsignedType(op.b1) {
 				case UnsignedTypeI32:
 					v := uint32(v1) + uint32(v2)
-					it.push(uint64(v))
+					ce.push(uint64(v))
 				case UnsignedTypeI64:
-					it.push(v1 + v2)
+					ce.push(v1 + v2)
 				case UnsignedTypeF32:
 					v := math.Float32frombits(uint32(v1)) + math.Float32frombits(uint32(v2))
-					it.push(uint64(math.Float32bits(v)))
+					ce.push(uint64(math.Float32bits(v)))
 				case UnsignedTypeF64:
 					v := math.Float64frombits(v1) + math.Float64frombits(v2)
-					it.push(math.Float64bits(v))
+					ce.push(math.Float64bits(v))
 				}
 				frame.pc++
 			}
 		case OperationKindSub:
 			{
-				v2 := it.pop()
-				v1 := it.pop()
+				v2 := ce.pop()
+				v1 := ce.pop()
 				switch UnsignedType(op.b1) {
 				case UnsignedTypeI32:
-					it.push(uint64(uint32(v1) - uint32(v2)))
+					ce.push(uint64(uint32(v1) - uint32(v2)))
 				case UnsignedTypeI64:
-					it.push(v1 - v2)
+					ce.push(v1 - v2)
 				case UnsignedTypeF32:
 					v := math.Float32frombits(uint32(v1)) - math.Float32frombits(uint32(v2))
-					it.push(uint64(math.Float32bits(v)))
+					ce.push(uint64(math.Float32bits(v)))
 				case UnsignedTypeF64:
 					v := math.Float64frombits(v1) - math.Float64frombits(v2)
-					it.push(math.Float64bits(v))
+					ce.push(math.Float64bits(v))
 				}
 				frame.pc++
 			}
 		case OperationKindMul:
 			{
-				v2 := it.pop()
-				v1 := it.pop()
+				v2 := ce.pop()
+				v1 := ce.pop()
 				switch UnsignedType(op.b1) {
 				case UnsignedTypeI32:
-					it.push(uint64(uint32(v1) * uint32(v2)))
+					ce.push(uint64(uint32(v1) * uint32(v2)))
 				case UnsignedTypeI64:
-					it.push(v1 * v2)
+					ce.push(v1 * v2)
 				case UnsignedTypeF32:
 					v := math.Float32frombits(uint32(v2)) * math.Float32frombits(uint32(v1))
-					it.push(uint64(math.Float32bits(v)))
+					ce.push(uint64(math.Float32bits(v)))
 				case UnsignedTypeF64:
 					v := math.Float64frombits(v2) * math.Float64frombits(v1)
-					it.push(math.Float64bits(v))
+					ce.push(math.Float64bits(v))
 				}
 				frame.pc++
 			}
 		case OperationKindClz:
 			{
-				v := it.pop()
+				v := ce.pop()
 				if op.b1 == 0 {
 					// UnsignedInt32
-					it.push(uint64(bits.LeadingZeros32(uint32(v))))
+					ce.push(uint64(bits.LeadingZeros32(uint32(v))))
 				} else {
 					// UnsignedInt64
-					it.push(uint64(bits.LeadingZeros64(v)))
+					ce.push(uint64(bits.LeadingZeros64(v)))
 				}
 				frame.pc++
 			}
 		case OperationKindCtz:
 			{
-				v := it.pop()
+				v := ce.pop()
 				if op.b1 == 0 {
 					// UnsignedInt32
-					it.push(uint64(bits.TrailingZeros32(uint32(v))))
+					ce.push(uint64(bits.TrailingZeros32(uint32(v))))
 				} else {
 					// UnsignedInt64
-					it.push(uint64(bits.TrailingZeros64(v)))
+					ce.push(uint64(bits.TrailingZeros64(v)))
 				}
 				frame.pc++
 			}
 		case OperationKindPopcnt:
 			{
-				v := it.pop()
+				v := ce.pop()
 				if op.b1 == 0 {
 					// UnsignedInt32
-					it.push(uint64(bits.OnesCount32(uint32(v))))
+					ce.push(uint64(bits.OnesCount32(uint32(v))))
 				} else {
 					// UnsignedInt64
-					it.push(uint64(bits.OnesCount64(v)))
+					ce.push(uint64(bits.OnesCount64(v)))
 				}
 				frame.pc++
 			}
@@ -1011,37 +1481,37 @@ func (it *interpreter) callNativeFunc(f *interpreterFunction) {
 			{
 				switch SignedType(op.b1) {
 				case SignedTypeInt32:
-					v2 := int32(it.pop())
-					v1 := int32(it.pop())
+					v2 := int32(ce.pop())
+					v1 := int32(ce.pop())
 					if v1 == math.MinInt32 && v2 == -1 {
 						panic(wasm.ErrRuntimeIntegerOverflow)
 					}
-					it.push(uint64(uint32(v1 / v2)))
+					ce.push(uint64(uint32(v1 / v2)))
 				case SignedTypeInt64:
-					v2 := int64(it.pop())
-					v1 := int64(it.pop())
+					v2 := int64(ce.pop())
+					v1 := int64(ce.pop())
 					if v1 == math.MinInt64 && v2 == -1 {
 						panic(wasm.ErrRuntimeIntegerOverflow)
 					}
-					it.push(uint64(v1 / v2))
+					ce.push(uint64(v1 / v2))
 				case SignedTypeUint32:
-					v2 := uint32(it.pop())
-					v1 := uint32(it.pop())
-					it.push(uint64(v1 / v2))
+					v2 := uint32(ce.pop())
+					v1 := uint32(ce.pop())
+					ce.push(uint64(v1 / v2))
 				case SignedTypeUint64:
-					v2 := it.pop()
-					v1 := it.pop()
-					it.push(v1 / v2)
+					v2 := ce.pop()
+					v1 := ce.pop()
+					ce.push(v1 / v2)
 				case SignedTypeFloat32:
-					v2 := it.pop()
-					v1 := it.pop()
+					v2 := ce.pop()
+					v1 := ce.pop()
 					v := math.Float32frombits(uint32(v1)) / math.Float32frombits(uint32(v2))
-					it.push(uint64(math.Float32bits(v)))
+					ce.push(uint64(math.Float32bits(v)))
 				case SignedTypeFloat64:
-					v2 := it.pop()
-					v1 := it.pop()
+					v2 := ce.pop()
+					v1 := ce.pop()
 					v := math.Float64frombits(v1) / math.Float64frombits(v2)
-					it.push(uint64(math.Float64bits(v)))
+					ce.push(uint64(math.Float64bits(v)))
 				}
 				frame.pc++
 			}
@@ -1049,115 +1519,115 @@ func (it *interpreter) callNativeFunc(f *interpreterFunction) {
 			{
 				switch SignedInt(op.b1) {
 				case SignedInt32:
-					v2 := int32(it.pop())
-					v1 := int32(it.pop())
-					it.push(uint64(uint32(v1 % v2)))
+					v2 := int32(ce.pop())
+					v1 := int32(ce.pop())
+					ce.push(uint64(uint32(v1 % v2)))
 				case SignedInt64:
-					v2 := int64(it.pop())
-					v1 := int64(it.pop())
-					it.push(uint64(v1 % v2))
+					v2 := int64(ce.pop())
+					v1 := int64(ce.pop())
+					ce.push(uint64(v1 % v2))
 				case SignedUint32:
-					v2 := uint32(it.pop())
-					v1 := uint32(it.pop())
-					it.push(uint64(v1 % v2))
+					v2 := uint32(ce.pop())
+					v1 := uint32(ce.pop())
+					ce.push(uint64(v1 % v2))
 				case SignedUint64:
-					v2 := it.pop()
-					v1 := it.pop()
-					it.push(v1 % v2)
+					v2 := ce.pop()
+					v1 := ce.pop()
+					ce.push(v1 % v2)
 				}
 				frame.pc++
 			}
 		case OperationKindAnd:
 			{
-				v2 := it.pop()
-				v1 := it.pop()
+				v2 := ce.pop()
+				v1 := ce.pop()
 				if op.b1 == 0 {
 					// UnsignedInt32
-					it.push(uint64(uint32(v2) & uint32(v1)))
+					ce.push(uint64(uint32(v2) & uint32(v1)))
 				} else {
 					// UnsignedInt64
-					it.push(uint64(v2 & v1))
+					ce.push(uint64(v2 & v1))
 				}
 				frame.pc++
 			}
 		case OperationKindOr:
 			{
-				v2 := it.pop()
-				v1 := it.pop()
+				v2 := ce.pop()
+				v1 := ce.pop()
 				if op.b1 == 0 {
 					// UnsignedInt32
-					it.push(uint64(uint32(v2) | uint32(v1)))
+					ce.push(uint64(uint32(v2) | uint32(v1)))
 				} else {
 					// UnsignedInt64
-					it.push(uint64(v2 | v1))
+					ce.push(uint64(v2 | v1))
 				}
 				frame.pc++
 			}
 		case OperationKindXor:
 			{
-				v2 := it.pop()
-				v1 := it.pop()
+				v2 := ce.pop()
+				v1 := ce.pop()
 				if op.b1 == 0 {
 					// UnsignedInt32
-					it.push(uint64(uint32(v2) ^ uint32(v1)))
+					ce.push(uint64(uint32(v2) ^ uint32(v1)))
 				} else {
 					// UnsignedInt64
-					it.push(uint64(v2 ^ v1))
+					ce.push(uint64(v2 ^ v1))
 				}
 				frame.pc++
 			}
 		case OperationKindShl:
 			{
-				v2 := it.pop()
-				v1 := it.pop()
+				v2 := ce.pop()
+				v1 := ce.pop()
 				if op.b1 == 0 {
 					// UnsignedInt32
-					it.push(uint64(uint32(v1) << (uint32(v2) % 32)))
+					ce.push(uint64(uint32(v1) << (uint32(v2) % 32)))
 				} else {
 					// UnsignedInt64
-					it.push(v1 << (v2 % 64))
+					ce.push(v1 << (v2 % 64))
 				}
 				frame.pc++
 			}
 		case OperationKindShr:
 			{
-				v2 := it.pop()
-				v1 := it.pop()
+				v2 := ce.pop()
+				v1 := ce.pop()
 				switch SignedInt(op.b1) {
 				case SignedInt32:
-					it.push(uint64(int32(v1) >> (uint32(v2) % 32)))
+					ce.push(uint64(int32(v1) >> (uint32(v2) % 32)))
 				case SignedInt64:
-					it.push(uint64(int64(v1) >> (v2 % 64)))
+					ce.push(uint64(int64(v1) >> (v2 % 64)))
 				case SignedUint32:
-					it.push(uint64(uint32(v1) >> (uint32(v2) % 32)))
+					ce.push(uint64(uint32(v1) >> (uint32(v2) % 32)))
 				case SignedUint64:
-					it.push(v1 >> (v2 % 64))
+					ce.push(v1 >> (v2 % 64))
 				}
 				frame.pc++
 			}
 		case OperationKindRotl:
 			{
-				v2 := it.pop()
-				v1 := it.pop()
+				v2 := ce.pop()
+				v1 := ce.pop()
 				if op.b1 == 0 {
 					// UnsignedInt32
-					it.push(uint64(bits.RotateLeft32(uint32(v1), int(v2))))
+					ce.push(uint64(bits.RotateLeft32(uint32(v1), int(v2))))
 				} else {
 					// UnsignedInt64
-					it.push(uint64(bits.RotateLeft64(v1, int(v2))))
+					ce.push(uint64(bits.RotateLeft64(v1, int(v2))))
 				}
 				frame.pc++
 			}
 		case OperationKindRotr:
 			{
-				v2 := it.pop()
-				v1 := it.pop()
+				v2 := ce.pop()
+				v1 := ce.pop()
 				if op.b1 == 0 {
 					// UnsignedInt32
-					it.push(uint64(bits.RotateLeft32(uint32(v1), -int(v2))))
+					ce.push(uint64(bits.RotateLeft32(uint32(v1), -int(v2))))
 				} else {
 					// UnsignedInt64
-					it.push(uint64(bits.RotateLeft64(v1, -int(v2))))
+					ce.push(uint64(bits.RotateLeft64(v1, -int(v2))))
 				}
 				frame.pc++
 			}
@@ -1166,11 +1636,11 @@ func (it *interpreter) callNativeFunc(f *interpreterFunction) {
 				if op.b1 == 0 {
 					// Float32
 					const mask uint32 = 1 << 31
-					it.push(uint64(uint32(it.pop()) &^ mask))
+					ce.push(uint64(uint32(ce.pop()) &^ mask))
 				} else {
 					// Float64
 					const mask uint64 = 1 << 63
-					it.push(uint64(it.pop() &^ mask))
+					ce.push(uint64(ce.pop() &^ mask))
 				}
 				frame.pc++
 			}
@@ -1178,12 +1648,12 @@ func (it *interpreter) callNativeFunc(f *interpreterFunction) {
 			{
 				if op.b1 == 0 {
 					// Float32
-					v := -math.Float32frombits(uint32(it.pop()))
-					it.push(uint64(math.Float32bits(v)))
+					v := -math.Float32frombits(uint32(ce.pop()))
+					ce.push(uint64(math.Float32bits(v)))
 				} else {
 					// Float64
-					v := -math.Float64frombits(it.pop())
-					it.push(math.Float64bits(v))
+					v := -math.Float64frombits(ce.pop())
+					ce.push(math.Float64bits(v))
 				}
 				frame.pc++
 			}
@@ -1191,12 +1661,12 @@ func (it *interpreter) callNativeFunc(f *interpreterFunction) {
 			{
 				if op.b1 == 0 {
 					// Float32
-					v := math.Ceil(float64(math.Float32frombits(uint32(it.pop()))))
-					it.push(uint64(math.Float32bits(float32(v))))
+					v := math.Ceil(float64(math.Float32frombits(uint32(ce.pop()))))
+					ce.push(uint64(math.Float32bits(float32(v))))
 				} else {
 					// Float64
-					v := math.Ceil(float64(math.Float64frombits(it.pop())))
-					it.push(math.Float64bits(v))
+					v := math.Ceil(float64(math.Float64frombits(ce.pop())))
+					ce.push(math.Float64bits(v))
 				}
 				frame.pc++
 			}
@@ -1204,12 +1674,12 @@ func (it *interpreter) callNativeFunc(f *interpreterFunction) {
 			{
 				if op.b1 == 0 {
 					// Float32
-					v := math.Floor(float64(math.Float32frombits(uint32(it.pop()))))
-					it.push(uint64(math.Float32bits(float32(v))))
+					v := math.Floor(float64(math.Float32frombits(uint32(ce.pop()))))
+					ce.push(uint64(math.Float32bits(float32(v))))
 				} else {
 					// Float64
-					v := math.Floor(float64(math.Float64frombits(it.pop())))
-					it.push(math.Float64bits(v))
+					v := math.Floor(float64(math.Float64frombits(ce.pop())))
+					ce.push(math.Float64bits(v))
 				}
 				frame.pc++
 			}
@@ -1217,12 +1687,12 @@ func (it *interpreter) callNativeFunc(f *interpreterFunction) {
 			{
 				if op.b1 == 0 {
 					// Float32
-					v := math.Trunc(float64(math.Float32frombits(uint32(it.pop()))))
-					it.push(uint64(math.Float32bits(float32(v))))
+					v := math.Trunc(float64(math.Float32frombits(uint32(ce.pop()))))
+					ce.push(uint64(math.Float32bits(float32(v))))
 				} else {
 					// Float64
-					v := math.Trunc(float64(math.Float64frombits(it.pop())))
-					it.push(math.Float64bits(v))
+					v := math.Trunc(float64(math.Float64frombits(ce.pop())))
+					ce.push(math.Float64bits(v))
 				}
 				frame.pc++
 			}
@@ -1231,7 +1701,7 @@ func (it *interpreter) callNativeFunc(f *interpreterFunction) {
 				// TODO: look at https://github.com/bytecodealliance/wasmtime/pull/2171 and reconsider this algorithm
 				if op.b1 == 0 {
 					// Float32
-					f := math.Float32frombits(uint32(it.pop()))
+					f := math.Float32frombits(uint32(ce.pop()))
 					if f != -0 && f != 0 {
 						ceil := float32(math.Ceil(float64(f)))
 						floor := float32(math.Floor(float64(f)))
@@ -1246,10 +1716,10 @@ func (it *interpreter) callNativeFunc(f *interpreterFunction) {
 							f = floor
 						}
 					}
-					it.push(uint64(math.Float32bits(f)))
+					ce.push(uint64(math.Float32bits(f)))
 				} else {
 					// Float64
-					f := math.Float64frombits(it.pop())
+					f := math.Float64frombits(ce.pop())
 					if f != -0 && f != 0 {
 						ceil := math.Ceil(f)
 						floor := math.Floor(f)
@@ -1264,7 +1734,7 @@ func (it *interpreter) callNativeFunc(f *interpreterFunction) {
 							f = floor
 						}
 					}
-					it.push(math.Float64bits(f))
+					ce.push(math.Float64bits(f))
 				}
 				frame.pc++
 			}
@@ -1272,12 +1742,12 @@ func (it *interpreter) callNativeFunc(f *interpreterFunction) {
 			{
 				if op.b1 == 0 {
 					// Float32
-					v := math.Sqrt(float64(math.Float32frombits(uint32(it.pop()))))
-					it.push(uint64(math.Float32bits(float32(v))))
+					v := math.Sqrt(float64(math.Float32frombits(uint32(ce.pop()))))
+					ce.push(uint64(math.Float32bits(float32(v))))
 				} else {
 					// Float64
-					v := math.Sqrt(float64(math.Float64frombits(it.pop())))
-					it.push(math.Float64bits(v))
+					v := math.Sqrt(float64(math.Float64frombits(ce.pop())))
+					ce.push(math.Float64bits(v))
 				}
 				frame.pc++
 			}
@@ -1285,13 +1755,13 @@ func (it *interpreter) callNativeFunc(f *interpreterFunction) {
 			{
 				if op.b1 == 0 {
 					// Float32
-					v2 := math.Float32frombits(uint32(it.pop()))
-					v1 := math.Float32frombits(uint32(it.pop()))
-					it.push(uint64(math.Float32bits(float32(Min(float64(v1), float64(v2))))))
+					v2 := math.Float32frombits(uint32(ce.pop()))
+					v1 := math.Float32frombits(uint32(ce.pop()))
+					ce.push(uint64(math.Float32bits(float32(Min(float64(v1), float64(v2))))))
 				} else {
-					v2 := math.Float64frombits(it.pop())
-					v1 := math.Float64frombits(it.pop())
-					it.push(math.Float64bits(Min(v1, v2)))
+					v2 := math.Float64frombits(ce.pop())
+					v1 := math.Float64frombits(ce.pop())
+					ce.push(math.Float64bits(Min(v1, v2)))
 				}
 				frame.pc++
 			}
@@ -1300,14 +1770,14 @@ func (it *interpreter) callNativeFunc(f *interpreterFunction) {
 
 				if op.b1 == 0 {
 					// Float32
-					v2 := math.Float32frombits(uint32(it.pop()))
-					v1 := math.Float32frombits(uint32(it.pop()))
-					it.push(uint64(math.Float32bits(float32(Max(float64(v1), float64(v2))))))
+					v2 := math.Float32frombits(uint32(ce.pop()))
+					v1 := math.Float32frombits(uint32(ce.pop()))
+					ce.push(uint64(math.Float32bits(float32(Max(float64(v1), float64(v2))))))
 				} else {
 					// Float64
-					v2 := math.Float64frombits(it.pop())
-					v1 := math.Float64frombits(it.pop())
-					it.push(math.Float64bits(Max(v1, v2)))
+					v2 := math.Float64frombits(ce.pop())
+					v1 := math.Float64frombits(ce.pop())
+					ce.push(math.Float64bits(Max(v1, v2)))
 				}
 				frame.pc++
 			}
@@ -1315,20 +1785,20 @@ func (it *interpreter) callNativeFunc(f *interpreterFunction) {
 			{
 				if op.b1 == 0 {
 					// Float32
-					v2 := math.Float32frombits(uint32(it.pop()))
-					v1 := math.Float32frombits(uint32(it.pop()))
-					it.push(uint64(math.Float32bits(float32(math.Copysign(float64(v1), float64(v2))))))
+					v2 := math.Float32frombits(uint32(ce.pop()))
+					v1 := math.Float32frombits(uint32(ce.pop()))
+					ce.push(uint64(math.Float32bits(float32(math.Copysign(float64(v1), float64(v2))))))
 				} else {
 					// Float64
-					v2 := math.Float64frombits(it.pop())
-					v1 := math.Float64frombits(it.pop())
-					it.push(uint64(math.Float64bits(math.Copysign(v1, v2))))
+					v2 := math.Float64frombits(ce.pop())
+					v1 := math.Float64frombits(ce.pop())
+					ce.push(uint64(math.Float64bits(math.Copysign(v1, v2))))
 				}
 				frame.pc++
 			}
 		case OperationKindI32WrapFromI64:
 			{
-				it.push(uint64(uint32(it.pop())))
+				ce.push(uint64(uint32(ce.pop())))
 				frame.pc++
 			}
 		case OperationKindITruncFromF:
@@ -1337,77 +1807,77 @@ func (it *interpreter) callNativeFunc(f *interpreterFunction) {
 					// Float32
 					switch SignedInt(op.b2) {
 					case SignedInt32:
-						v := math.Trunc(float64(math.Float32frombits(uint32(it.pop()))))
+						v := math.Trunc(float64(math.Float32frombits(uint32(ce.pop()))))
 						if math.IsNaN(v) {
 							panic(wasm.ErrRuntimeInvalidConversionToInteger)
 						} else if v < math.MinInt32 || v > math.MaxInt32 {
 							panic(wasm.ErrRuntimeIntegerOverflow)
 						}
-						it.push(uint64(int32(v)))
+						ce.push(uint64(int32(v)))
 					case SignedInt64:
-						v := math.Trunc(float64(math.Float32frombits(uint32(it.pop()))))
+						v := math.Trunc(float64(math.Float32frombits(uint32(ce.pop()))))
 						res := int64(v)
 						if math.IsNaN(v) {
 							panic(wasm.ErrRuntimeInvalidConversionToInteger)
 						} else if v < math.MinInt64 || v > 0 && res < 0 {
 							panic(wasm.ErrRuntimeIntegerOverflow)
 						}
-						it.push(uint64(res))
+						ce.push(uint64(res))
 					case SignedUint32:
-						v := math.Trunc(float64(math.Float32frombits(uint32(it.pop()))))
+						v := math.Trunc(float64(math.Float32frombits(uint32(ce.pop()))))
 						if math.IsNaN(v) {
 							panic(wasm.ErrRuntimeInvalidConversionToInteger)
 						} else if v < 0 || v > math.MaxUint32 {
 							panic(wasm.ErrRuntimeIntegerOverflow)
 						}
-						it.push(uint64(uint32(v)))
+						ce.push(uint64(uint32(v)))
 					case SignedUint64:
-						v := math.Trunc(float64(math.Float32frombits(uint32(it.pop()))))
+						v := math.Trunc(float64(math.Float32frombits(uint32(ce.pop()))))
 						res := uint64(v)
 						if math.IsNaN(v) {
 							panic(wasm.ErrRuntimeInvalidConversionToInteger)
 						} else if v < 0 || v > float64(res) {
 							panic(wasm.ErrRuntimeIntegerOverflow)
 						}
-						it.push(res)
+						ce.push(res)
 					}
 				} else {
 					// Float64
 					switch SignedInt(op.b2) {
 					case SignedInt32:
-						v := math.Trunc(math.Float64frombits(it.pop()))
+						v := math.Trunc(math.Float64frombits(ce.pop()))
 						if math.IsNaN(v) {
 							panic(wasm.ErrRuntimeInvalidConversionToInteger)
 						} else if v < math.MinInt32 || v > math.MaxInt32 {
 							panic(wasm.ErrRuntimeIntegerOverflow)
 						}
-						it.push(uint64(int32(v)))
+						ce.push(uint64(int32(v)))
 					case SignedInt64:
-						v := math.Trunc(math.Float64frombits(it.pop()))
+						v := math.Trunc(math.Float64frombits(ce.pop()))
 						res := int64(v)
 						if math.IsNaN(v) {
 							panic(wasm.ErrRuntimeInvalidConversionToInteger)
 						} else if v < math.MinInt64 || v > 0 && res < 0 {
 							panic(wasm.ErrRuntimeIntegerOverflow)
 						}
-						it.push(uint64(res))
+						ce.push(uint64(res))
 					case SignedUint32:
-						v := math.Trunc(math.Float64frombits(it.pop()))
+						v := math.Trunc(math.Float64frombits(ce.pop()))
 						if math.IsNaN(v) {
 							panic(wasm.ErrRuntimeInvalidConversionToInteger)
 						} else if v < 0 || v > math.MaxUint32 {
 							panic(wasm.ErrRuntimeIntegerOverflow)
 						}
-						it.push(uint64(uint32(v)))
+						ce.push(uint64(uint32(v)))
 					case SignedUint64:
-						v := math.Trunc(math.Float64frombits(it.pop()))
+						v := math.Trunc(math.Float64frombits(ce.pop()))
 						res := uint64(v)
 						if math.IsNaN(v) {
 							panic(wasm.ErrRuntimeInvalidConversionToInteger)
 						} else if v < 0 || v > float64(res) {
 							panic(wasm.ErrRuntimeIntegerOverflow)
 						}
-						it.push(res)
+						ce.push(res)
 					}
 				}
 				frame.pc++
@@ -1418,73 +1888,73 @@ func (it *interpreter) callNativeFunc(f *interpreterFunction) {
 				case SignedInt32:
 					if op.b2 == 0 {
 						// Float32
-						v := float32(int32(it.pop()))
-						it.push(uint64(math.Float32bits(v)))
+						v := float32(int32(ce.pop()))
+						ce.push(uint64(math.Float32bits(v)))
 					} else {
 						// Float64
-						v := float64(int32(it.pop()))
-						it.push(math.Float64bits(v))
+						v := float64(int32(ce.pop()))
+						ce.push(math.Float64bits(v))
 					}
 				case SignedInt64:
 					if op.b2 == 0 {
 						// Float32
-						v := float32(int64(it.pop()))
-						it.push(uint64(math.Float32bits(v)))
+						v := float32(int64(ce.pop()))
+						ce.push(uint64(math.Float32bits(v)))
 					} else {
 						// Float64
-						v := float64(int64(it.pop()))
-						it.push(math.Float64bits(v))
+						v := float64(int64(ce.pop()))
+						ce.push(math.Float64bits(v))
 					}
 				case SignedUint32:
 					if op.b2 == 0 {
 						// Float32
-						v := float32(uint32(it.pop()))
-						it.push(uint64(math.Float32bits(v)))
+						v := float32(uint32(ce.pop()))
+						ce.push(uint64(math.Float32bits(v)))
 					} else {
 						// Float64
-						v := float64(uint32(it.pop()))
-						it.push(math.Float64bits(v))
+						v := float64(uint32(ce.pop()))
+						ce.push(math.Float64bits(v))
 					}
 				case SignedUint64:
 					if op.b2 == 0 {
 						// Float32
-						v := float32(it.pop())
-						it.push(uint64(math.Float32bits(v)))
+						v := float32(ce.pop())
+						ce.push(uint64(math.Float32bits(v)))
 					} else {
 						// Float64
-						v := float64(it.pop())
-						it.push(math.Float64bits(v))
+						v := float64(ce.pop())
+						ce.push(math.Float64bits(v))
 					}
 				}
 				frame.pc++
 			}
 		case OperationKindF32DemoteFromF64:
 			{
-				v := float32(math.Float64frombits(it.pop()))
-				it.push(uint64(math.Float32bits(v)))
+				v := float32(math.Float64frombits(ce.pop()))
+				ce.push(uint64(math.Float32bits(v)))
 				frame.pc++
 			}
 		case OperationKindF64PromoteFromF32:
 			{
-				v := float64(math.Float32frombits(uint32(it.pop())))
-				it.push(math.Float64bits(v))
+				v := float64(math.Float32frombits(uint32(ce.pop())))
+				ce.push(math.Float64bits(v))
 				frame.pc++
 			}
 		case OperationKindExtend:
 			{
 				if op.b1 == 1 {
 					// Signed.
-					v := int64(int32(it.pop()))
-					it.push(uint64(v))
+					v := int64(int32(ce.pop()))
+					ce.push(uint64(v))
 				} else {
-					v := uint64(uint32(it.pop()))
-					it.push(v)
+					v := uint64(uint32(ce.pop()))
+					ce.push(v)
 				}
 				frame.pc++
 			}
 		}
 	}
-	it.popFrame()
+	ce.popFrame()
 }
 
 // math.Min doen't comply with the Wasm spec, so we borrow from the original
@@ -1,40 +1,217 @@
 package wazeroir
 
 import (
+	"context"
+	"math"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 
-	"github.com/tetratelabs/wazero/wasm/buildoptions"
+	"github.com/tetratelabs/wazero/wasm"
 )
 
 func TestInterpreter_PushFrame(t *testing.T) {
-	f1 := &interpreterFrame{}
-	f2 := &interpreterFrame{}
+	f1 := &interpreterFunction{}
+	f2 := &interpreterFunction{}
 
-	it := interpreter{}
-	require.Empty(t, it.frames)
+	ce := callEngine{maxCallStackDepth: 2, maxOperandStackSize: 1}
+	require.Empty(t, ce.frames)
 
-	it.pushFrame(f1)
-	require.Equal(t, []*interpreterFrame{f1}, it.frames)
+	ce.pushFrame(f1)
+	require.Equal(t, []interpreterFrame{{f: f1}}, ce.frames)
 
-	it.pushFrame(f2)
-	require.Equal(t, []*interpreterFrame{f1, f2}, it.frames)
+	frame := ce.pushFrame(f2)
+	require.Equal(t, []interpreterFrame{{f: f1}, {f: f2}}, ce.frames)
+	require.Equal(t, &ce.frames[1], frame)
 }
 
 func TestInterpreter_PushFrame_StackOverflow(t *testing.T) {
-	defer func() { callStackCeiling = buildoptions.CallStackCeiling }()
+	f := &interpreterFunction{}
 
-	callStackCeiling = 3
+	ce := callEngine{maxCallStackDepth: 3, maxOperandStackSize: 1}
+	ce.pushFrame(f)
+	ce.pushFrame(f)
+	ce.pushFrame(f)
+	require.Panics(t, func() { ce.pushFrame(f) })
 
-	f1 := &interpreterFrame{}
-	f2 := &interpreterFrame{}
-	f3 := &interpreterFrame{}
-	f4 := &interpreterFrame{}
+	// The operand stack is also limited.
+	ce = callEngine{maxCallStackDepth: 3, maxOperandStackSize: 1, stack: []uint64{1, 2}, sp: 2}
+	require.Panics(t, func() { ce.pushFrame(f) })
+}
+
+func TestInterpreter_Drop(t *testing.T) {
+	for _, c := range []struct {
+		name       string
+		start, end int
+		exp        []uint64
+	}{
+		{name: "top", start: 0, end: 0, exp: []uint64{1, 2, 3}},
+		{name: "top two", start: 0, end: 1, exp: []uint64{1, 2}},
+		{name: "below top", start: 1, end: 1, exp: []uint64{1, 2, 4}},
+		{name: "below top two", start: 2, end: 3, exp: []uint64{3, 4}},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			ce := callEngine{stack: []uint64{1, 2, 3, 4, 0, 0}, sp: 4}
+			ce.drop(c.start, c.end)
+			require.Equal(t, c.exp, ce.stack[:ce.sp])
+		})
+	}
+}
+
+func TestInterpreter_EnsureStack(t *testing.T) {
+	ce := callEngine{stack: []uint64{1, 2, 0}, sp: 2}
+	ce.ensureStack(1)
+	require.Len(t, ce.stack, 3)
+
+	ce.ensureStack(2)
+	require.Len(t, ce.stack, 6)
+	require.Equal(t, []uint64{1, 2}, ce.stack[:ce.sp])
+
+	ce.ensureStack(10)
+	require.Len(t, ce.stack, 12)
+	require.Equal(t, []uint64{1, 2}, ce.stack[:ce.sp])
+}
+
+func TestInterpreter_CloseModule(t *testing.T) {
+	i32 := wasm.ValueTypeI32
+	sig := &wasm.FunctionType{Params: []wasm.ValueType{i32}, Results: []wasm.ValueType{i32}}
+	// (func (export "inc") (param i32) (result i32) (i32.add (local.get 0) (i32.const 1)))
+	mod := &wasm.Module{
+		TypeSection:     []*wasm.FunctionType{sig},
+		FunctionSection: []wasm.Index{0},
+		CodeSection: []*wasm.Code{
+			{Body: []byte{wasm.OpcodeLocalGet, 0x00, wasm.OpcodeI32Const, 0x01, wasm.OpcodeI32Add, wasm.OpcodeEnd}},
+		},
+		ExportSection: map[string]*wasm.Export{"inc": {Name: "inc", Kind: wasm.ExportKindFunc, Index: 0}},
+	}
+	// (func (export "inc") (import "a" "inc") (param i32) (result i32))
+	importing := &wasm.Module{
+		TypeSection:   []*wasm.FunctionType{sig},
+		ImportSection: []*wasm.Import{{Kind: wasm.ImportKindFunc, Module: "a", Name: "inc", DescFunc: 0}},
+		ExportSection: map[string]*wasm.Export{"inc": {Name: "inc", Kind: wasm.ExportKindFunc, Index: 0}},
+	}
+
+	it := NewEngine().(*interpreter)
+	store := wasm.NewStore(it)
+	require.NoError(t, store.Instantiate(mod, "a"))
+	require.NoError(t, store.Instantiate(importing, "b"))
+	require.Len(t, it.functions, 1)
+
+	// The function is released only when "a" is closed.
+	require.NoError(t, store.CloseModule("b"))
+	require.Len(t, it.functions, 1)
+	require.NoError(t, store.CloseModule("a"))
+	require.Empty(t, it.functions)
+}
+
+func TestInterpreter_Call_Allocs(t *testing.T) {
+	i32 := wasm.ValueTypeI32
+	mod := &wasm.Module{
+		TypeSection:     []*wasm.FunctionType{{Params: []wasm.ValueType{i32}, Results: []wasm.ValueType{i32}}},
+		FunctionSection: []wasm.Index{0, 0},
+		CodeSection: []*wasm.Code{
+			// (local.get 0) (call 1)
+			{Body: []byte{wasm.OpcodeLocalGet, 0x00, wasm.OpcodeCall, 0x01, wasm.OpcodeEnd}},
+			// (local.get 0) (i32.const 1) (i32.sub)
+			{Body: []byte{wasm.OpcodeLocalGet, 0x00, wasm.OpcodeI32Const, 0x01, wasm.OpcodeI32Sub, wasm.OpcodeEnd}},
+		},
+		ExportSection: map[string]*wasm.Export{
+			"dec": {Name: "dec", Kind: wasm.ExportKindFunc, Index: 0},
+		},
+	}
+
+	store := wasm.NewStore(NewEngine())
+	require.NoError(t, store.Instantiate(mod, "test"))
+	f, err := store.ModuleInstances["test"].ExportedFunction("dec")
+	require.NoError(t, err)
+
+	ctx, params, results := context.Background(), []uint64{10}, make([]uint64, 1)
+	require.NoError(t, f.CallWithResults(ctx, results, params...))
+	require.Equal(t, []uint64{9}, results)
+
+	// The stacks are reused across the calls, and the results are written to the given buffer.
+	allocs := testing.AllocsPerRun(100, func() {
+		if err := f.CallWithResults(ctx, results, params...); err != nil {
+			t.Fatal(err)
+		}
+	})
+	require.Equal(t, float64(0), allocs)
+
+	// The fuel is also metered without allocations.
+	fuel := &wasm.Fuel{Remaining: math.MaxUint64}
+	ctx = wasm.WithFuel(ctx, fuel)
+	allocs = testing.AllocsPerRun(100, func() {
+		if err := f.CallWithResults(ctx, results, params...); err != nil {
+			t.Fatal(err)
+		}
+	})
+	require.Equal(t, float64(0), allocs)
+}
+
+func TestInterpreter_LowerIROps_Superinstructions(t *testing.T) {
+	label := &Label{Kind: LabelKindHeader}
+	ir := &CompilationResult{
+		Operations: []Operation{
+			// local.set
+			&OperationSwap{Depth: 2},
+			&OperationDrop{Range: &InclusiveRange{Start: 0, End: 0}},
+			&OperationConstI64{Value: 1},
+			&OperationAdd{Type: UnsignedTypeI64},
+			&OperationConstI32{Value: 2},
+			&OperationSub{Type: UnsignedTypeI32},
+			// Not fused as the types differ.
+			&OperationConstI32{Value: 3},
+			&OperationAdd{Type: UnsignedTypeI64},
+			// Not fused across the label.
+			&OperationConstI32{Value: 4},
+			&OperationLabel{Label: label},
+			&OperationAdd{Type: UnsignedTypeI32},
+		},
+		SourceOffsets:  []uint64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+		LabelFuelCosts: map[string]uint64{},
+	}
+	fn, err := (&interpreter{}).lowerIROps(ir)
+	require.NoError(t, err)
+	require.Equal(t, []interpreterOp{
+		{kind: interpreterOpKindSet, u1: 2, sourceOffset: 1},
+		{kind: interpreterOpKindAddConst, b1: byte(UnsignedTypeI64), u1: 1, sourceOffset: 3},
+		{kind: interpreterOpKindSubConst, b1: byte(UnsignedTypeI32), u1: 2, sourceOffset: 5},
+		{kind: OperationKindConstI32, u1: 3, sourceOffset: 7},
+		{kind: OperationKindAdd, b1: byte(UnsignedTypeI64), sourceOffset: 8},
+		{kind: OperationKindConstI32, u1: 4, sourceOffset: 9},
+		{kind: OperationKindAdd, b1: byte(UnsignedTypeI32), sourceOffset: 11},
+	}, fn.body)
+}
+
+func TestInterpreter_CompileLazily(t *testing.T) {
+	i32 := wasm.ValueTypeI32
+	mod := &wasm.Module{
+		TypeSection:     []*wasm.FunctionType{{Results: []wasm.ValueType{i32}}},
+		FunctionSection: []wasm.Index{0},
+		CodeSection:     []*wasm.Code{{Body: []byte{wasm.OpcodeI32Const, 0x01, wasm.OpcodeEnd}}},
+		ExportSection:   map[string]*wasm.Export{"one": {Name: "one", Kind: wasm.ExportKindFunc, Index: 0}},
+	}
+
+	it := NewEngineWithConfig(&wasm.RuntimeConfig{LazyCompilation: true}).(*interpreter)
+	store := wasm.NewStore(it)
+	require.NoError(t, store.Instantiate(mod, "test"))
+	f := store.ModuleInstances["test"].Exports["one"].Function
+
+	// Not compiled until the first call.
+	lazy, ok := it.getFunction(f)
+	require.True(t, ok)
+	require.NotNil(t, lazy.lazy)
+	require.Nil(t, lazy.body)
+
+	results, _, err := store.CallFunction("test", "one")
+	require.NoError(t, err)
+	require.Equal(t, []uint64{1}, results)
 
-	it := interpreter{}
-	it.pushFrame(f1)
-	it.pushFrame(f2)
-	it.pushFrame(f3)
-	require.Panics(t, func() { it.pushFrame(f4) })
+	// The compiled function replaces the lazy one.
+	compiled, ok := it.getFunction(f)
+	require.True(t, ok)
+	require.Nil(t, compiled.lazy)
+	require.NotEmpty(t, compiled.body)
+	require.Equal(t, lazy.funcInstance, compiled.funcInstance)
 }
@@ -0,0 +1,680 @@
+package wazeroir
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+)
+
+// pass is an optimization pass which rewrites the operations of CompilationResult.
+//
+// Passes must keep SourceOffsets parallel to Operations, and must keep labels as operations since
+// engines lower the operations one by one. LabelCallers is recalculated after all the passes, so passes
+// don't need to maintain it.
+type pass struct {
+	name string
+	run  func(r *CompilationResult)
+}
+
+// passes is the pipeline of the optimization passes applied in order when wasm.RuntimeConfig.Optimize is set.
+var passes = []pass{
+	{name: "constant folding", run: foldConstants},
+	{name: "strength reduction", run: reduceStrength},
+	{name: "redundant stack operation elimination", run: eliminateRedundantStackOperations},
+	{name: "dead code elimination", run: eliminateDeadCode},
+}
+
+// optimize applies passes to r in order. If dump is non-nil, the operations are formatted into it
+// before and after each pass.
+func (r *CompilationResult) optimize(passes []pass, dump io.StringWriter) {
+	for _, p := range passes {
+		if dump != nil {
+			_, _ = dump.WriteString(fmt.Sprintf("wazeroir before %s:\n%s\n", p.name, Format(r.Operations)))
+		}
+		p.run(r)
+		if dump != nil {
+			_, _ = dump.WriteString(fmt.Sprintf("wazeroir after %s:\n%s\n", p.name, Format(r.Operations)))
+		}
+	}
+	r.countLabelCallers()
+}
+
+// countLabelCallers recalculates LabelCallers from the branch operations.
+func (r *CompilationResult) countLabelCallers() {
+	r.LabelCallers = map[string]int{}
+	for _, op := range r.Operations {
+		for _, target := range branchTargets(op) {
+			if !target.IsReturnTarget() {
+				r.LabelCallers[target.Label.String()]++
+			}
+		}
+	}
+}
+
+// branchTargets returns the targets of op if op is a branch operation.
+func branchTargets(op Operation) []*BranchTarget {
+	switch o := op.(type) {
+	case *OperationBr:
+		return []*BranchTarget{o.Target}
+	case *OperationBrIf:
+		return []*BranchTarget{o.Then.Target, o.Else.Target}
+	case *OperationBrTable:
+		targets := make([]*BranchTarget, 0, len(o.Targets)+1)
+		for _, t := range o.Targets {
+			targets = append(targets, t.Target)
+		}
+		return append(targets, o.Default.Target)
+	}
+	return nil
+}
+
+// rewriter accumulates the operations rewritten by a pass, keeping the source offsets parallel to them.
+type rewriter struct {
+	ops     []Operation
+	offsets []uint64
+}
+
+func newRewriter(r *CompilationResult) *rewriter {
+	return &rewriter{
+		ops:     make([]Operation, 0, len(r.Operations)),
+		offsets: make([]uint64, 0, len(r.Operations)),
+	}
+}
+
+func (w *rewriter) emit(op Operation, offset uint64) {
+	w.ops = append(w.ops, op)
+	w.offsets = append(w.offsets, offset)
+}
+
+// peek returns the n-th last emitted operation where 0 is the last one, or nil if there's no such operation.
+func (w *rewriter) peek(n int) Operation {
+	if i := len(w.ops) - 1 - n; i >= 0 {
+		return w.ops[i]
+	}
+	return nil
+}
+
+// truncate removes the last n emitted operations.
+func (w *rewriter) truncate(n int) {
+	w.ops, w.offsets = w.ops[:len(w.ops)-n], w.offsets[:len(w.offsets)-n]
+}
+
+func (w *rewriter) apply(r *CompilationResult) {
+	r.Operations, r.SourceOffsets = w.ops, w.offsets
+}
+
+// foldConstants evaluates the integer operations whose operands are the constants pushed right before them,
+// and resolves the branches and selects whose conditions are such constants.
+//
+// Floating point operations are left as is so that the NaN bit patterns are produced by engines as usual.
+func foldConstants(r *CompilationResult) {
+	w := newRewriter(r)
+	for i, op := range r.Operations {
+		offset := r.SourceOffsets[i]
+		if folded, ok := foldIntOperation(w, op); ok {
+			w.emit(folded, offset)
+			continue
+		}
+
+		switch o := op.(type) {
+		case *OperationPick:
+			if o.Depth == 0 {
+				if t, v, ok := intConst(w.peek(0)); ok {
+					w.emit(newIntConst(t, v), offset)
+					continue
+				}
+			}
+		case *OperationBrIf:
+			if t, v, ok := intConst(w.peek(0)); ok && t == UnsignedInt32 {
+				w.truncate(1)
+				target := o.Then
+				if v == 0 {
+					target = o.Else
+				}
+				emitBranch(w, target, offset)
+				continue
+			}
+		case *OperationBrTable:
+			if t, v, ok := intConst(w.peek(0)); ok && t == UnsignedInt32 {
+				w.truncate(1)
+				target := o.Default
+				if v < uint64(len(o.Targets)) {
+					target = o.Targets[v]
+				}
+				emitBranch(w, target, offset)
+				continue
+			}
+		case *OperationSelect:
+			if t, v, ok := intConst(w.peek(0)); ok && t == UnsignedInt32 {
+				w.truncate(1)
+				// The first operand is selected if the condition is non-zero, otherwise the second one.
+				depth := 0
+				if v == 0 {
+					depth = 1
+				}
+				w.emit(&OperationDrop{Range: &InclusiveRange{Start: depth, End: depth}}, offset)
+				continue
+			}
+		}
+		w.emit(op, offset)
+	}
+	w.apply(r)
+}
+
+// emitBranch emits the unconditional branch to target, dropping the values in target.ToDrop beforehand.
+func emitBranch(w *rewriter, target *BranchTargetDrop, offset uint64) {
+	if target.ToDrop != nil {
+		w.emit(&OperationDrop{Range: target.ToDrop}, offset)
+	}
+	w.emit(&OperationBr{Target: target.Target}, offset)
+}
+
+// foldIntOperation returns the constant which is the result of op if op is an integer operation whose operands
+// are the constants at the end of w, in which case they are removed from w. This returns false if op traps.
+func foldIntOperation(w *rewriter, op Operation) (folded Operation, ok bool) {
+	if t, ok := intUnaryOperandType(op); ok {
+		if xt, x, ok := intConst(w.peek(0)); ok && xt == t {
+			w.truncate(1)
+			return evalIntUnary(op, t, x), true
+		}
+		return nil, false
+	}
+	if t, isBinary := intBinaryOperandType(op); isBinary {
+		xt, x, xok := intConst(w.peek(1))
+		yt, y, yok := intConst(w.peek(0))
+		if xok && yok && xt == t && yt == t {
+			if folded, ok = evalIntBinary(op, t, x, y); ok {
+				w.truncate(2)
+			}
+		}
+	}
+	return
+}
+
+// intConst returns the type and the value of op if op is an integer constant.
+func intConst(op Operation) (t UnsignedInt, v uint64, ok bool) {
+	switch o := op.(type) {
+	case *OperationConstI32:
+		return UnsignedInt32, uint64(o.Value), true
+	case *OperationConstI64:
+		return UnsignedInt64, o.Value, true
+	}
+	return
+}
+
+func newIntConst(t UnsignedInt, v uint64) Operation {
+	if t == UnsignedInt32 {
+		return &OperationConstI32{Value: uint32(v)}
+	}
+	return &OperationConstI64{Value: v}
+}
+
+// intUnaryOperandType returns the type of the operand of op if op is an integer unary operation.
+func intUnaryOperandType(op Operation) (t UnsignedInt, ok bool) {
+	switch o := op.(type) {
+	case *OperationEqz:
+		return o.Type, true
+	case *OperationClz:
+		return o.Type, true
+	case *OperationCtz:
+		return o.Type, true
+	case *OperationPopcnt:
+		return o.Type, true
+	case *OperationI32WrapFromI64:
+		return UnsignedInt64, true
+	case *OperationExtend:
+		return UnsignedInt32, true
+	}
+	return
+}
+
+func evalIntUnary(op Operation, t UnsignedInt, x uint64) Operation {
+	switch o := op.(type) {
+	case *OperationEqz:
+		return &OperationConstI32{Value: boolToUint32(x == 0)}
+	case *OperationClz:
+		if t == UnsignedInt32 {
+			return &OperationConstI32{Value: uint32(bits.LeadingZeros32(uint32(x)))}
+		}
+		return &OperationConstI64{Value: uint64(bits.LeadingZeros64(x))}
+	case *OperationCtz:
+		if t == UnsignedInt32 {
+			return &OperationConstI32{Value: uint32(bits.TrailingZeros32(uint32(x)))}
+		}
+		return &OperationConstI64{Value: uint64(bits.TrailingZeros64(x))}
+	case *OperationPopcnt:
+		if t == UnsignedInt32 {
+			return &OperationConstI32{Value: uint32(bits.OnesCount32(uint32(x)))}
+		}
+		return &OperationConstI64{Value: uint64(bits.OnesCount64(x))}
+	case *OperationI32WrapFromI64:
+		return &OperationConstI32{Value: uint32(x)}
+	case *OperationExtend:
+		if o.Signed {
+			return &OperationConstI64{Value: uint64(int64(int32(x)))}
+		}
+		return &OperationConstI64{Value: uint64(uint32(x))}
+	}
+	panic(fmt.Sprintf("BUG: %s is not an integer unary operation", op.Kind()))
+}
+
+// intBinaryOperandType returns the type of the operands of op if op is an integer binary operation.
+func intBinaryOperandType(op Operation) (t UnsignedInt, ok bool) {
+	switch o := op.(type) {
+	case *OperationAdd:
+		return unsignedTypeToInt(o.Type)
+	case *OperationSub:
+		return unsignedTypeToInt(o.Type)
+	case *OperationMul:
+		return unsignedTypeToInt(o.Type)
+	case *OperationEq:
+		return unsignedTypeToInt(o.Type)
+	case *OperationNe:
+		return unsignedTypeToInt(o.Type)
+	case *OperationLt:
+		t, _, ok = signedTypeToInt(o.Type)
+	case *OperationGt:
+		t, _, ok = signedTypeToInt(o.Type)
+	case *OperationLe:
+		t, _, ok = signedTypeToInt(o.Type)
+	case *OperationGe:
+		t, _, ok = signedTypeToInt(o.Type)
+	case *OperationDiv:
+		t, _, ok = signedTypeToInt(o.Type)
+	case *OperationRem:
+		t, _ = signedIntToInt(o.Type)
+		ok = true
+	case *OperationShr:
+		t, _ = signedIntToInt(o.Type)
+		ok = true
+	case *OperationAnd:
+		return o.Type, true
+	case *OperationOr:
+		return o.Type, true
+	case *OperationXor:
+		return o.Type, true
+	case *OperationShl:
+		return o.Type, true
+	case *OperationRotl:
+		return o.Type, true
+	case *OperationRotr:
+		return o.Type, true
+	}
+	return
+}
+
+// evalIntBinary returns the constant which is the result of the integer binary operation op with the operands
+// x and y of the type t, or false if op traps with them.
+func evalIntBinary(op Operation, t UnsignedInt, x, y uint64) (Operation, bool) {
+	size := uint64(64)
+	if t == UnsignedInt32 {
+		size = 32
+	}
+	// signed returns v as the signed integer of the type t.
+	signed := func(v uint64) int64 {
+		if t == UnsignedInt32 {
+			return int64(int32(v))
+		}
+		return int64(v)
+	}
+	rotateLeft := func(v uint64, k int) uint64 {
+		if t == UnsignedInt32 {
+			return uint64(bits.RotateLeft32(uint32(v), k))
+		}
+		return bits.RotateLeft64(v, k)
+	}
+
+	var v uint64
+	switch o := op.(type) {
+	case *OperationAdd:
+		v = x + y
+	case *OperationSub:
+		v = x - y
+	case *OperationMul:
+		v = x * y
+	case *OperationAnd:
+		v = x & y
+	case *OperationOr:
+		v = x | y
+	case *OperationXor:
+		v = x ^ y
+	case *OperationShl:
+		v = x << (y % size)
+	case *OperationShr:
+		if _, isSigned := signedIntToInt(o.Type); isSigned {
+			v = uint64(signed(x) >> (y % size))
+		} else {
+			v = x >> (y % size)
+		}
+	case *OperationRotl:
+		v = rotateLeft(x, int(y%size))
+	case *OperationRotr:
+		v = rotateLeft(x, -int(y%size))
+	case *OperationEq:
+		return &OperationConstI32{Value: boolToUint32(x == y)}, true
+	case *OperationNe:
+		return &OperationConstI32{Value: boolToUint32(x != y)}, true
+	case *OperationLt:
+		_, isSigned, _ := signedTypeToInt(o.Type)
+		return &OperationConstI32{Value: boolToUint32(compareInts(isSigned, signed, x, y) < 0)}, true
+	case *OperationGt:
+		_, isSigned, _ := signedTypeToInt(o.Type)
+		return &OperationConstI32{Value: boolToUint32(compareInts(isSigned, signed, x, y) > 0)}, true
+	case *OperationLe:
+		_, isSigned, _ := signedTypeToInt(o.Type)
+		return &OperationConstI32{Value: boolToUint32(compareInts(isSigned, signed, x, y) <= 0)}, true
+	case *OperationGe:
+		_, isSigned, _ := signedTypeToInt(o.Type)
+		return &OperationConstI32{Value: boolToUint32(compareInts(isSigned, signed, x, y) >= 0)}, true
+	case *OperationDiv:
+		if y == 0 {
+			return nil, false
+		}
+		if _, isSigned, _ := signedTypeToInt(o.Type); isSigned {
+			min := int64(math.MinInt64)
+			if t == UnsignedInt32 {
+				min = math.MinInt32
+			}
+			if signed(x) == min && signed(y) == -1 {
+				// Integer overflow.
+				return nil, false
+			}
+			v = uint64(signed(x) / signed(y))
+		} else {
+			v = x / y
+		}
+	case *OperationRem:
+		if y == 0 {
+			return nil, false
+		}
+		if _, isSigned := signedIntToInt(o.Type); isSigned {
+			// Note that this is zero for the min value and -1 which is not a trap unlike the division.
+			v = uint64(signed(x) % signed(y))
+		} else {
+			v = x % y
+		}
+	default:
+		panic(fmt.Sprintf("BUG: %s is not an integer binary operation", op.Kind()))
+	}
+	return newIntConst(t, v), true
+}
+
+// compareInts returns the sign of x - y where x and y are compared as signed integers if isSigned is true.
+func compareInts(isSigned bool, signed func(uint64) int64, x, y uint64) int {
+	if isSigned {
+		sx, sy := signed(x), signed(y)
+		if sx < sy {
+			return -1
+		} else if sx > sy {
+			return 1
+		}
+		return 0
+	}
+	if x < y {
+		return -1
+	} else if x > y {
+		return 1
+	}
+	return 0
+}
+
+func boolToUint32(b bool) uint32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func unsignedTypeToInt(t UnsignedType) (UnsignedInt, bool) {
+	switch t {
+	case UnsignedTypeI32:
+		return UnsignedInt32, true
+	case UnsignedTypeI64:
+		return UnsignedInt64, true
+	}
+	return 0, false
+}
+
+func signedTypeToInt(t SignedType) (ret UnsignedInt, isSigned, ok bool) {
+	switch t {
+	case SignedTypeInt32:
+		return UnsignedInt32, true, true
+	case SignedTypeUint32:
+		return UnsignedInt32, false, true
+	case SignedTypeInt64:
+		return UnsignedInt64, true, true
+	case SignedTypeUint64:
+		return UnsignedInt64, false, true
+	}
+	return
+}
+
+func signedIntToInt(t SignedInt) (ret UnsignedInt, isSigned bool) {
+	switch t {
+	case SignedInt32:
+		return UnsignedInt32, true
+	case SignedUint32:
+		return UnsignedInt32, false
+	case SignedInt64:
+		return UnsignedInt64, true
+	default:
+		return UnsignedInt64, false
+	}
+}
+
+// reduceStrength replaces the integer operations with a constant operand pushed right before them by
+// cheaper ones: the operations which don't change the other operand such as the addition of zero are removed,
+// and the multiplications and the unsigned divisions by powers of two are replaced with shifts.
+func reduceStrength(r *CompilationResult) {
+	w := newRewriter(r)
+	for i, op := range r.Operations {
+		offset := r.SourceOffsets[i]
+		t, c, ok := intConst(w.peek(0))
+		if !ok {
+			w.emit(op, offset)
+			continue
+		}
+		if ot, ok := intBinaryOperandType(op); !ok || ot != t {
+			w.emit(op, offset)
+			continue
+		}
+
+		size := uint64(64)
+		allOnes := uint64(math.MaxUint64)
+		if t == UnsignedInt32 {
+			size, allOnes = 32, math.MaxUint32
+		}
+		isPowerOfTwo := c != 0 && c&(c-1) == 0
+		log2 := uint64(bits.TrailingZeros64(c))
+
+		switch o := op.(type) {
+		case *OperationAdd, *OperationSub, *OperationOr, *OperationXor:
+			if c == 0 {
+				w.truncate(1)
+				continue
+			}
+		case *OperationShl, *OperationShr, *OperationRotl, *OperationRotr:
+			if c%size == 0 {
+				w.truncate(1)
+				continue
+			}
+		case *OperationAnd:
+			if c == allOnes {
+				w.truncate(1)
+				continue
+			}
+		case *OperationMul:
+			if c == 1 {
+				w.truncate(1)
+				continue
+			} else if isPowerOfTwo {
+				w.truncate(1)
+				w.emit(newIntConst(t, log2), offset)
+				w.emit(&OperationShl{Type: t}, offset)
+				continue
+			}
+		case *OperationDiv:
+			if c == 1 {
+				w.truncate(1)
+				continue
+			} else if _, isSigned, _ := signedTypeToInt(o.Type); !isSigned && isPowerOfTwo {
+				w.truncate(1)
+				w.emit(newIntConst(t, log2), offset)
+				w.emit(&OperationShr{Type: unsignedIntToSignedUint(t)}, offset)
+				continue
+			}
+		case *OperationRem:
+			if _, isSigned := signedIntToInt(o.Type); !isSigned && isPowerOfTwo {
+				w.truncate(1)
+				w.emit(newIntConst(t, c-1), offset)
+				w.emit(&OperationAnd{Type: t}, offset)
+				continue
+			}
+		}
+		w.emit(op, offset)
+	}
+	w.apply(r)
+}
+
+func unsignedIntToSignedUint(t UnsignedInt) SignedInt {
+	if t == UnsignedInt32 {
+		return SignedUint32
+	}
+	return SignedUint64
+}
+
+// eliminateRedundantStackOperations removes the values pushed by OperationPick and constants which are
+// dropped right after, the pairs of OperationSwap cancelling each other, and merges the adjacent drops.
+func eliminateRedundantStackOperations(r *CompilationResult) {
+	w := newRewriter(r)
+	for i, op := range r.Operations {
+		offset := r.SourceOffsets[i]
+		switch o := op.(type) {
+		case *OperationDrop:
+			start, end := o.Range.Start, o.Range.End
+			// Values dropped right after being pushed don't need to be pushed.
+			for start == 0 && end >= 0 && isPush(w.peek(0)) {
+				w.truncate(1)
+				end--
+			}
+			if end < start {
+				continue
+			}
+			if prev, ok := w.peek(0).(*OperationDrop); ok {
+				// The range of this drop is shifted by the values dropped by the previous one, and they
+				// are merged if they are contiguous.
+				if s1, e1 := prev.Range.Start, prev.Range.End; start <= s1 && s1 <= end+1 {
+					end += e1 - s1 + 1
+					w.truncate(1)
+				}
+			}
+			if start != o.Range.Start || end != o.Range.End {
+				op = &OperationDrop{Range: &InclusiveRange{Start: start, End: end}}
+			}
+		case *OperationSwap:
+			if prev, ok := w.peek(0).(*OperationSwap); ok && prev.Depth == o.Depth {
+				w.truncate(1)
+				continue
+			}
+		}
+		w.emit(op, offset)
+	}
+	w.apply(r)
+}
+
+// isPush returns true if op only pushes a value without any side effect.
+func isPush(op Operation) bool {
+	switch op.(type) {
+	case *OperationPick, *OperationConstI32, *OperationConstI64, *OperationConstF32, *OperationConstF64:
+		return true
+	}
+	return false
+}
+
+// eliminateDeadCode removes the operations which are never executed: the ones after the unconditional branches
+// and the blocks whose labels are not reachable from the entry of the function. Then the branches to the labels
+// right after them are removed together with the labels if they have no other callers.
+func eliminateDeadCode(r *CompilationResult) {
+	// Split the operations into the blocks beginning with labels except the entry block.
+	var blockStarts []int
+	blockIndex := map[string]int{}
+	blockStarts = append(blockStarts, 0)
+	for i, op := range r.Operations {
+		if o, ok := op.(*OperationLabel); ok {
+			if i > 0 {
+				blockStarts = append(blockStarts, i)
+			}
+			blockIndex[o.Label.String()] = len(blockStarts) - 1
+		}
+	}
+	blockEnd := func(b int) int {
+		if b+1 < len(blockStarts) {
+			return blockStarts[b+1]
+		}
+		return len(r.Operations)
+	}
+
+	// liveEnds[b] is the end of the live operations in the block b if reachable[b] is true.
+	reachable, liveEnds := make([]bool, len(blockStarts)), make([]int, len(blockStarts))
+	worklist := []int{0}
+	for len(worklist) > 0 {
+		b := worklist[len(worklist)-1]
+		worklist = worklist[:len(worklist)-1]
+		if reachable[b] {
+			continue
+		}
+		reachable[b], liveEnds[b] = true, blockEnd(b)
+		fallsThrough := true
+		for i := blockStarts[b]; i < blockEnd(b); i++ {
+			op := r.Operations[i]
+			for _, target := range branchTargets(op) {
+				if !target.IsReturnTarget() {
+					worklist = append(worklist, blockIndex[target.Label.String()])
+				}
+			}
+			if isUnconditionalBranch(op) {
+				liveEnds[b], fallsThrough = i+1, false
+				break
+			}
+		}
+		if fallsThrough && b+1 < len(blockStarts) {
+			worklist = append(worklist, b+1)
+		}
+	}
+
+	w := newRewriter(r)
+	for b, start := range blockStarts {
+		if !reachable[b] {
+			continue
+		}
+		for i := start; i < liveEnds[b]; i++ {
+			w.emit(r.Operations[i], r.SourceOffsets[i])
+		}
+	}
+	w.apply(r)
+
+	// Remove the branches to the next operation.
+	r.countLabelCallers()
+	w = newRewriter(r)
+	for i, op := range r.Operations {
+		if o, ok := op.(*OperationLabel); ok {
+			if br, ok := w.peek(0).(*OperationBr); ok && !br.Target.IsReturnTarget() &&
+				br.Target.Label.String() == o.Label.String() && r.LabelCallers[o.Label.String()] == 1 {
+				w.truncate(1)
+				continue
+			}
+		}
+		w.emit(op, r.SourceOffsets[i])
+	}
+	w.apply(r)
+}
+
+// isUnconditionalBranch returns true if the operations after op are not executed unless branched to.
+func isUnconditionalBranch(op Operation) bool {
+	switch op.(type) {
+	case *OperationBr, *OperationBrTable, *OperationUnreachable:
+		return true
+	}
+	return false
+}
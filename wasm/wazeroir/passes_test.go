@@ -0,0 +1,513 @@
+package wazeroir
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/tetratelabs/wazero/wasm"
+)
+
+// passTestCase is the operations before and after a pass where the source offsets are the indexes of
+// the original operations.
+type passTestCase struct {
+	name            string
+	ops             []Operation
+	expected        []Operation
+	expectedOffsets []uint64
+}
+
+func runPassTestCases(t *testing.T, run func(r *CompilationResult), tests []passTestCase) {
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			offsets := make([]uint64, len(tc.ops))
+			for i := range offsets {
+				offsets[i] = uint64(i)
+			}
+			r := &CompilationResult{Operations: tc.ops, SourceOffsets: offsets}
+			run(r)
+			require.Equal(t, tc.expected, r.Operations)
+			require.Equal(t, tc.expectedOffsets, r.SourceOffsets)
+		})
+	}
+}
+
+func TestFoldConstants(t *testing.T) {
+	thenTarget := &BranchTargetDrop{Target: &BranchTarget{Label: &Label{FrameID: 1}}, ToDrop: &InclusiveRange{Start: 1, End: 2}}
+	elseTarget := &BranchTargetDrop{Target: &BranchTarget{Label: &Label{FrameID: 2}}}
+	runPassTestCases(t, foldConstants, []passTestCase{
+		{
+			name: "nested",
+			ops: []Operation{
+				&OperationConstI32{Value: 2}, &OperationConstI32{Value: 3}, &OperationAdd{Type: UnsignedTypeI32},
+				&OperationConstI32{Value: 4}, &OperationMul{Type: UnsignedTypeI32},
+			},
+			expected:        []Operation{&OperationConstI32{Value: 20}},
+			expectedOffsets: []uint64{4},
+		},
+		{
+			name: "wrap around",
+			ops: []Operation{
+				&OperationConstI32{Value: 0xffffffff}, &OperationConstI32{Value: 1}, &OperationAdd{Type: UnsignedTypeI32},
+			},
+			expected:        []Operation{&OperationConstI32{Value: 0}},
+			expectedOffsets: []uint64{2},
+		},
+		{
+			name: "signed comparison",
+			ops: []Operation{
+				&OperationConstI64{Value: 0xffffffffffffffff}, &OperationConstI64{Value: 1}, &OperationLt{Type: SignedTypeInt64},
+			},
+			expected:        []Operation{&OperationConstI32{Value: 1}},
+			expectedOffsets: []uint64{2},
+		},
+		{
+			name: "unsigned comparison",
+			ops: []Operation{
+				&OperationConstI32{Value: 0xffffffff}, &OperationConstI32{Value: 1}, &OperationLt{Type: SignedTypeUint32},
+			},
+			expected:        []Operation{&OperationConstI32{Value: 0}},
+			expectedOffsets: []uint64{2},
+		},
+		{
+			name: "signed shift",
+			ops: []Operation{
+				&OperationConstI32{Value: 0x80000000}, &OperationConstI32{Value: 33}, &OperationShr{Type: SignedInt32},
+			},
+			expected:        []Operation{&OperationConstI32{Value: 0xc0000000}},
+			expectedOffsets: []uint64{2},
+		},
+		{
+			name: "rotation",
+			ops: []Operation{
+				&OperationConstI32{Value: 0x80000001}, &OperationConstI32{Value: 1}, &OperationRotr{Type: UnsignedInt32},
+			},
+			expected:        []Operation{&OperationConstI32{Value: 0xc0000000}},
+			expectedOffsets: []uint64{2},
+		},
+		{
+			name: "unary",
+			ops: []Operation{
+				&OperationConstI32{Value: 0xffffffff}, &OperationExtend{Signed: true}, &OperationPopcnt{Type: UnsignedInt64},
+			},
+			expected:        []Operation{&OperationConstI64{Value: 64}},
+			expectedOffsets: []uint64{2},
+		},
+		{
+			name: "signed remainder of min value by -1",
+			ops: []Operation{
+				&OperationConstI32{Value: 0x80000000}, &OperationConstI32{Value: 0xffffffff}, &OperationRem{Type: SignedInt32},
+			},
+			expected:        []Operation{&OperationConstI32{Value: 0}},
+			expectedOffsets: []uint64{2},
+		},
+		{
+			name: "division by zero traps",
+			ops: []Operation{
+				&OperationConstI32{Value: 1}, &OperationConstI32{Value: 0}, &OperationDiv{Type: SignedTypeUint32},
+			},
+			expected: []Operation{
+				&OperationConstI32{Value: 1}, &OperationConstI32{Value: 0}, &OperationDiv{Type: SignedTypeUint32},
+			},
+			expectedOffsets: []uint64{0, 1, 2},
+		},
+		{
+			name: "signed division overflow traps",
+			ops: []Operation{
+				&OperationConstI32{Value: 0x80000000}, &OperationConstI32{Value: 0xffffffff}, &OperationDiv{Type: SignedTypeInt32},
+			},
+			expected: []Operation{
+				&OperationConstI32{Value: 0x80000000}, &OperationConstI32{Value: 0xffffffff}, &OperationDiv{Type: SignedTypeInt32},
+			},
+			expectedOffsets: []uint64{0, 1, 2},
+		},
+		{
+			name: "floats are not folded",
+			ops: []Operation{
+				&OperationConstF32{Value: 1}, &OperationConstF32{Value: 2}, &OperationAdd{Type: UnsignedTypeF32},
+			},
+			expected: []Operation{
+				&OperationConstF32{Value: 1}, &OperationConstF32{Value: 2}, &OperationAdd{Type: UnsignedTypeF32},
+			},
+			expectedOffsets: []uint64{0, 1, 2},
+		},
+		{
+			name: "not folded across label",
+			ops: []Operation{
+				&OperationConstI32{Value: 1}, &OperationLabel{Label: &Label{}}, &OperationConstI32{Value: 2}, &OperationAdd{Type: UnsignedTypeI32},
+			},
+			expected: []Operation{
+				&OperationConstI32{Value: 1}, &OperationLabel{Label: &Label{}}, &OperationConstI32{Value: 2}, &OperationAdd{Type: UnsignedTypeI32},
+			},
+			expectedOffsets: []uint64{0, 1, 2, 3},
+		},
+		{
+			name:            "pick",
+			ops:             []Operation{&OperationConstI64{Value: 5}, &OperationPick{Depth: 0}},
+			expected:        []Operation{&OperationConstI64{Value: 5}, &OperationConstI64{Value: 5}},
+			expectedOffsets: []uint64{0, 1},
+		},
+		{
+			name:            "br_if taken",
+			ops:             []Operation{&OperationConstI32{Value: 1}, &OperationBrIf{Then: thenTarget, Else: elseTarget}},
+			expected:        []Operation{&OperationDrop{Range: thenTarget.ToDrop}, &OperationBr{Target: thenTarget.Target}},
+			expectedOffsets: []uint64{1, 1},
+		},
+		{
+			name:            "br_if not taken",
+			ops:             []Operation{&OperationConstI32{Value: 0}, &OperationBrIf{Then: thenTarget, Else: elseTarget}},
+			expected:        []Operation{&OperationBr{Target: elseTarget.Target}},
+			expectedOffsets: []uint64{1},
+		},
+		{
+			name: "br_table",
+			ops: []Operation{
+				&OperationConstI32{Value: 1}, &OperationBrTable{Targets: []*BranchTargetDrop{elseTarget, thenTarget}, Default: elseTarget},
+				&OperationConstI32{Value: 2}, &OperationBrTable{Targets: []*BranchTargetDrop{elseTarget, thenTarget}, Default: elseTarget},
+			},
+			expected: []Operation{
+				&OperationDrop{Range: thenTarget.ToDrop}, &OperationBr{Target: thenTarget.Target},
+				&OperationBr{Target: elseTarget.Target},
+			},
+			expectedOffsets: []uint64{1, 1, 3},
+		},
+		{
+			name: "select",
+			ops: []Operation{
+				&OperationConstI32{Value: 1}, &OperationSelect{},
+				&OperationConstI32{Value: 0}, &OperationSelect{},
+			},
+			expected: []Operation{
+				&OperationDrop{Range: &InclusiveRange{Start: 0, End: 0}},
+				&OperationDrop{Range: &InclusiveRange{Start: 1, End: 1}},
+			},
+			expectedOffsets: []uint64{1, 3},
+		},
+	})
+}
+
+func TestReduceStrength(t *testing.T) {
+	runPassTestCases(t, reduceStrength, []passTestCase{
+		{
+			name: "identities",
+			ops: []Operation{
+				&OperationConstI32{Value: 0}, &OperationAdd{Type: UnsignedTypeI32},
+				&OperationConstI64{Value: 64}, &OperationShl{Type: UnsignedInt64},
+				&OperationConstI32{Value: 0xffffffff}, &OperationAnd{Type: UnsignedInt32},
+				&OperationConstI64{Value: 1}, &OperationDiv{Type: SignedTypeInt64},
+				&OperationConstI32{Value: 1}, &OperationMul{Type: UnsignedTypeI32},
+			},
+			expected:        []Operation{},
+			expectedOffsets: []uint64{},
+		},
+		{
+			name: "powers of two",
+			ops: []Operation{
+				&OperationConstI32{Value: 8}, &OperationMul{Type: UnsignedTypeI32},
+				&OperationConstI64{Value: 16}, &OperationDiv{Type: SignedTypeUint64},
+				&OperationConstI32{Value: 32}, &OperationRem{Type: SignedUint32},
+			},
+			expected: []Operation{
+				&OperationConstI32{Value: 3}, &OperationShl{Type: UnsignedInt32},
+				&OperationConstI64{Value: 4}, &OperationShr{Type: SignedUint64},
+				&OperationConstI32{Value: 31}, &OperationAnd{Type: UnsignedInt32},
+			},
+			expectedOffsets: []uint64{1, 1, 3, 3, 5, 5},
+		},
+		{
+			name: "signed division is not reduced",
+			ops: []Operation{
+				&OperationConstI32{Value: 8}, &OperationDiv{Type: SignedTypeInt32},
+				&OperationConstI32{Value: 8}, &OperationRem{Type: SignedInt32},
+			},
+			expected: []Operation{
+				&OperationConstI32{Value: 8}, &OperationDiv{Type: SignedTypeInt32},
+				&OperationConstI32{Value: 8}, &OperationRem{Type: SignedInt32},
+			},
+			expectedOffsets: []uint64{0, 1, 2, 3},
+		},
+		{
+			name:            "types differ",
+			ops:             []Operation{&OperationConstI32{Value: 0}, &OperationAdd{Type: UnsignedTypeI64}},
+			expected:        []Operation{&OperationConstI32{Value: 0}, &OperationAdd{Type: UnsignedTypeI64}},
+			expectedOffsets: []uint64{0, 1},
+		},
+	})
+}
+
+func TestEliminateRedundantStackOperations(t *testing.T) {
+	runPassTestCases(t, eliminateRedundantStackOperations, []passTestCase{
+		{
+			name: "pushes dropped",
+			ops: []Operation{
+				&OperationPick{Depth: 1}, &OperationConstI32{Value: 1}, &OperationDrop{Range: &InclusiveRange{Start: 0, End: 1}},
+			},
+			expected:        []Operation{},
+			expectedOffsets: []uint64{},
+		},
+		{
+			name: "push dropped with others",
+			ops: []Operation{
+				&OperationConstF64{Value: 1}, &OperationDrop{Range: &InclusiveRange{Start: 0, End: 2}},
+			},
+			expected:        []Operation{&OperationDrop{Range: &InclusiveRange{Start: 0, End: 1}}},
+			expectedOffsets: []uint64{1},
+		},
+		{
+			name: "adjacent drops",
+			ops: []Operation{
+				&OperationDrop{Range: &InclusiveRange{Start: 1, End: 2}}, &OperationDrop{Range: &InclusiveRange{Start: 0, End: 1}},
+			},
+			expected:        []Operation{&OperationDrop{Range: &InclusiveRange{Start: 0, End: 3}}},
+			expectedOffsets: []uint64{1},
+		},
+		{
+			name: "separate drops",
+			ops: []Operation{
+				&OperationDrop{Range: &InclusiveRange{Start: 2, End: 2}}, &OperationDrop{Range: &InclusiveRange{Start: 0, End: 0}},
+			},
+			expected: []Operation{
+				&OperationDrop{Range: &InclusiveRange{Start: 2, End: 2}}, &OperationDrop{Range: &InclusiveRange{Start: 0, End: 0}},
+			},
+			expectedOffsets: []uint64{0, 1},
+		},
+		{
+			name:            "swaps",
+			ops:             []Operation{&OperationSwap{Depth: 3}, &OperationSwap{Depth: 3}, &OperationSwap{Depth: 2}},
+			expected:        []Operation{&OperationSwap{Depth: 2}},
+			expectedOffsets: []uint64{2},
+		},
+		{
+			name: "side effects kept",
+			ops: []Operation{
+				&OperationMemoryGrow{}, &OperationDrop{Range: &InclusiveRange{Start: 0, End: 0}},
+			},
+			expected: []Operation{
+				&OperationMemoryGrow{}, &OperationDrop{Range: &InclusiveRange{Start: 0, End: 0}},
+			},
+			expectedOffsets: []uint64{0, 1},
+		},
+	})
+}
+
+func TestEliminateDeadCode(t *testing.T) {
+	l1, l2, l3 := &Label{FrameID: 1}, &Label{FrameID: 2}, &Label{FrameID: 3}
+	runPassTestCases(t, eliminateDeadCode, []passTestCase{
+		{
+			name: "after unconditional branches",
+			ops: []Operation{
+				&OperationBr{Target: l1.asBranchTarget()}, &OperationConstI32{},
+				&OperationLabel{Label: l1}, &OperationUnreachable{}, &OperationConstI32{},
+				&OperationLabel{Label: l2}, &OperationBr{Target: l1.asBranchTarget()},
+			},
+			expected: []Operation{
+				&OperationUnreachable{},
+			},
+			expectedOffsets: []uint64{3},
+		},
+		{
+			name: "unreachable loop",
+			ops: []Operation{
+				&OperationBr{Target: &BranchTarget{}},
+				&OperationLabel{Label: l1}, &OperationBr{Target: l2.asBranchTarget()},
+				// The header is only branched to from inside the loop.
+				&OperationLabel{Label: l2}, &OperationBrIf{Then: l2.asBranchTargetDrop(), Else: l3.asBranchTargetDrop()},
+				&OperationLabel{Label: l3}, &OperationBr{Target: &BranchTarget{}},
+			},
+			expected:        []Operation{&OperationBr{Target: &BranchTarget{}}},
+			expectedOffsets: []uint64{0},
+		},
+		{
+			name: "loop",
+			ops: []Operation{
+				&OperationBr{Target: l2.asBranchTarget()},
+				&OperationLabel{Label: l2}, &OperationBrIf{Then: l2.asBranchTargetDrop(), Else: l3.asBranchTargetDrop()},
+				&OperationLabel{Label: l3}, &OperationBr{Target: &BranchTarget{}},
+			},
+			expected: []Operation{
+				&OperationBr{Target: l2.asBranchTarget()},
+				&OperationLabel{Label: l2}, &OperationBrIf{Then: l2.asBranchTargetDrop(), Else: l3.asBranchTargetDrop()},
+				&OperationLabel{Label: l3}, &OperationBr{Target: &BranchTarget{}},
+			},
+			expectedOffsets: []uint64{0, 1, 2, 3, 4},
+		},
+		{
+			name: "branches to next",
+			ops: []Operation{
+				&OperationBrIf{Then: l1.asBranchTargetDrop(), Else: l2.asBranchTargetDrop()},
+				&OperationLabel{Label: l1}, &OperationBr{Target: l3.asBranchTarget()},
+				&OperationLabel{Label: l2}, &OperationBr{Target: l3.asBranchTarget()},
+				&OperationLabel{Label: l3}, &OperationConstI32{}, &OperationBr{Target: &BranchTarget{}},
+			},
+			expected: []Operation{
+				&OperationBrIf{Then: l1.asBranchTargetDrop(), Else: l2.asBranchTargetDrop()},
+				&OperationLabel{Label: l1}, &OperationBr{Target: l3.asBranchTarget()},
+				&OperationLabel{Label: l2}, &OperationBr{Target: l3.asBranchTarget()},
+				&OperationLabel{Label: l3}, &OperationConstI32{}, &OperationBr{Target: &BranchTarget{}},
+			},
+			expectedOffsets: []uint64{0, 1, 2, 3, 4, 5, 6, 7},
+		},
+		{
+			name: "branch to next with single caller",
+			ops: []Operation{
+				&OperationBr{Target: l1.asBranchTarget()},
+				&OperationLabel{Label: l1}, &OperationConstI32{}, &OperationBr{Target: &BranchTarget{}},
+			},
+			expected:        []Operation{&OperationConstI32{}, &OperationBr{Target: &BranchTarget{}}},
+			expectedOffsets: []uint64{2, 3},
+		},
+	})
+}
+
+func TestCompileWithConfig(t *testing.T) {
+	// (if (i32.const 1) (then (return (i32.mul (i32.const 3) (i32.const 4))))) (i32.const 0)
+	f := &wasm.FunctionInstance{
+		FunctionType: &wasm.TypeInstance{Type: &wasm.FunctionType{Results: []wasm.ValueType{wasm.ValueTypeI32}}},
+		Body: []byte{
+			wasm.OpcodeI32Const, 0x01, wasm.OpcodeIf, 0x40,
+			wasm.OpcodeI32Const, 0x03, wasm.OpcodeI32Const, 0x04, wasm.OpcodeI32Mul, wasm.OpcodeReturn,
+			wasm.OpcodeEnd, wasm.OpcodeI32Const, 0x00, wasm.OpcodeEnd,
+		},
+		ModuleInstance: &wasm.ModuleInstance{},
+	}
+
+	r, err := Compile(f)
+	require.NoError(t, err)
+	require.Len(t, r.Operations, 12)
+	require.Equal(t, uint64(2), r.EntryFuelCost)
+
+	r, err = CompileWithConfig(f, &wasm.RuntimeConfig{Optimize: true})
+	require.NoError(t, err)
+	require.Equal(t, []Operation{&OperationConstI32{Value: 12}, &OperationBr{Target: &BranchTarget{}}}, r.Operations)
+	require.Equal(t, []uint64{8, 9}, r.SourceOffsets)
+	require.Equal(t, map[string]int{}, r.LabelCallers)
+	require.Equal(t, uint64(2), r.EntryFuelCost)
+	require.Equal(t, map[string]uint64{}, r.LabelFuelCosts)
+}
+
+func TestCompilationResult_Optimize_Dump(t *testing.T) {
+	r := &CompilationResult{
+		Operations:    []Operation{&OperationConstI32{Value: 1}, &OperationEqz{Type: UnsignedInt32}},
+		SourceOffsets: []uint64{0, 1},
+	}
+	var dump bytes.Buffer
+	r.optimize(passes, &dump)
+
+	for _, p := range passes {
+		require.Contains(t, dump.String(), "wazeroir before "+p.name+":\n")
+		require.Contains(t, dump.String(), "wazeroir after "+p.name+":\n")
+	}
+	before := "wazeroir before constant folding:\n" + Format([]Operation{&OperationConstI32{Value: 1}, &OperationEqz{Type: UnsignedInt32}})
+	after := "wazeroir after constant folding:\n" + Format([]Operation{&OperationConstI32{Value: 0}})
+	require.True(t, strings.HasPrefix(dump.String(), before+"\n"+after+"\n"))
+}
+
+func TestPasses_SourceOffsets(t *testing.T) {
+	i32 := wasm.ValueTypeI32
+	for _, tc := range []struct {
+		name string
+		body []byte
+	}{
+		{
+			name: "constants and dead code",
+			// (if (i32.const 1) (then (return (i32.mul (i32.const 3) (i32.const 4))))) (i32.const 0)
+			body: []byte{
+				wasm.OpcodeI32Const, 0x01, wasm.OpcodeIf, 0x40,
+				wasm.OpcodeI32Const, 0x03, wasm.OpcodeI32Const, 0x04, wasm.OpcodeI32Mul, wasm.OpcodeReturn,
+				wasm.OpcodeEnd, wasm.OpcodeI32Const, 0x00, wasm.OpcodeEnd,
+			},
+		},
+		{
+			name: "loop",
+			// (loop (br_if 0 (local.tee 0 (i32.sub (local.get 0) (i32.const 1))))) (local.get 0)
+			body: []byte{
+				wasm.OpcodeLoop, 0x40,
+				wasm.OpcodeLocalGet, 0x00, wasm.OpcodeI32Const, 0x01, wasm.OpcodeI32Sub, wasm.OpcodeLocalTee, 0x00,
+				wasm.OpcodeBrIf, 0x00,
+				wasm.OpcodeEnd, wasm.OpcodeLocalGet, 0x00, wasm.OpcodeEnd,
+			},
+		},
+		{
+			name: "stack operations",
+			// (local.set 0 (local.get 0)) (drop (i32.mul (local.get 0) (i32.const 8))) (block (br 0) (drop (i32.const 1)))
+			// (i32.add (local.get 0) (i32.const 0))
+			body: []byte{
+				wasm.OpcodeLocalGet, 0x00, wasm.OpcodeLocalSet, 0x00,
+				wasm.OpcodeLocalGet, 0x00, wasm.OpcodeI32Const, 0x08, wasm.OpcodeI32Mul, wasm.OpcodeDrop,
+				wasm.OpcodeBlock, 0x40, wasm.OpcodeBr, 0x00, wasm.OpcodeI32Const, 0x01, wasm.OpcodeDrop, wasm.OpcodeEnd,
+				wasm.OpcodeLocalGet, 0x00, wasm.OpcodeI32Const, 0x00, wasm.OpcodeI32Add, wasm.OpcodeEnd,
+			},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			f := &wasm.FunctionInstance{
+				FunctionType:   &wasm.TypeInstance{Type: &wasm.FunctionType{Params: []wasm.ValueType{i32}, Results: []wasm.ValueType{i32}}},
+				Body:           tc.body,
+				ModuleInstance: &wasm.ModuleInstance{},
+			}
+			r, err := Compile(f)
+			require.NoError(t, err)
+			original := map[uint64]bool{}
+			for _, offset := range r.SourceOffsets {
+				original[offset] = true
+			}
+
+			// RuntimeError reports the offsets of the optimized operations, so they must stay parallel to the
+			// operations and point to the original instructions after each pass.
+			for _, p := range passes {
+				r.optimize([]pass{p}, nil)
+				require.Len(t, r.SourceOffsets, len(r.Operations), p.name)
+				for _, offset := range r.SourceOffsets {
+					require.True(t, original[offset], "%s: unknown offset %d", p.name, offset)
+				}
+			}
+		})
+	}
+}
+
+func TestCompileWithConfig_DebugOutput(t *testing.T) {
+	var out bytes.Buffer
+	config := &wasm.RuntimeConfig{Optimize: true, Debug: true, DebugOutput: &out}
+
+	const functions = 10
+	var wg sync.WaitGroup
+	wg.Add(functions)
+	errs := make(chan error, functions)
+	for i := 0; i < functions; i++ {
+		f := &wasm.FunctionInstance{
+			FunctionType:   &wasm.TypeInstance{Type: &wasm.FunctionType{}},
+			Body:           []byte{wasm.OpcodeI32Const, 0x01, wasm.OpcodeI32Eqz, wasm.OpcodeDrop, wasm.OpcodeEnd},
+			ModuleInstance: &wasm.ModuleInstance{},
+			Index:          wasm.Index(i),
+		}
+		go func() {
+			defer wg.Done()
+			if _, err := CompileWithConfig(f, config); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	// The output of each function is written at once, and starts with the function index.
+	var seen []string
+	for _, block := range strings.Split(out.String(), "wazeroir passes of ")[1:] {
+		seen = append(seen, block[:strings.Index(block, ":")])
+		require.Equal(t, len(passes), strings.Count(block, "wazeroir before "))
+		require.Equal(t, len(passes), strings.Count(block, "wazeroir after "))
+	}
+	require.Len(t, seen, functions)
+	for i := 0; i < functions; i++ {
+		require.Contains(t, seen, fmt.Sprintf("function[%d]", i))
+	}
+}
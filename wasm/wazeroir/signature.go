@@ -375,3 +375,11 @@ func wasmValueTypeToUnsignedType(vt wasm.ValueType) UnsignedType {
 	}
 	panic("unreachable")
 }
+
+func wasmValueTypesToUnsignedTypes(vts []wasm.ValueType) []UnsignedType {
+	ret := make([]UnsignedType, 0, len(vts))
+	for _, vt := range vts {
+		ret = append(ret, wasmValueTypeToUnsignedType(vt))
+	}
+	return ret
+}